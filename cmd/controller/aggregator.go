@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/aggregator"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// Leader election timings, as used by the Kubernetes controller manager
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// aggregatorOptions are the flags of the aggregator command
+type aggregatorOptions struct {
+	address        string
+	metricsAddress string
+	agentNamespace string
+	agentSelector  string
+	agentPort      string
+	probeInterval  time.Duration
+	leaderElect    bool
+	leaseName      string
+	leaseNamespace string
+}
+
+// runAggregator implements "controller aggregator [flags]", which runs the
+// cluster aggregator in front of the node agents, usually as a Deployment.
+// Replicas elect a leader through a Lease; only the leader probes the node
+// agents and serves the cluster API.
+func runAggregator(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("aggregator", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	klog.InitFlags(fs)
+
+	// The node agents and the lease default to the aggregator's own namespace
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		namespace = agent.DefaultNamespace
+	}
+	o := aggregatorOptions{}
+	fs.StringVar(&o.address, "address", ":8083", "Address the cluster API listens on")
+	fs.StringVar(&o.metricsAddress, "metrics-address", ":8080", "Address the metrics endpoint listens on")
+	fs.StringVar(&o.agentNamespace, "agent-namespace", namespace, "Namespace the node agent DaemonSet runs in")
+	fs.StringVar(&o.agentSelector, "agent-selector", agent.DefaultSelector, "Label selector of the node agent pods")
+	fs.StringVar(&o.agentPort, "agent-port", agent.DefaultPort, "Port of the node agent session API")
+	fs.DurationVar(&o.probeInterval, "probe-interval", aggregator.DefaultProbeInterval, "How often the node agents are probed")
+	fs.BoolVar(&o.leaderElect, "leader-elect", true, "Elect a leader among the replicas; without it this replica serves right away")
+	fs.StringVar(&o.leaseName, "lease-name", "packet-capture-aggregator", "Name of the Lease used for leader election")
+	fs.StringVar(&o.leaseNamespace, "lease-namespace", namespace, "Namespace of the Lease used for leader election")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: controller aggregator [flags]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 0 || o.probeInterval <= 0 {
+		fs.Usage()
+		return 2
+	}
+
+	kubeConfig, err := getKubeConfig()
+	if err != nil {
+		klog.Errorf("Failed to get Kubernetes config: %v", err)
+		return 1
+	}
+	// Requests to the node agents carry the token of the user the aggregator
+	// serves, set on their context
+	kubeConfig.Wrap(agent.ForwardToken)
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		klog.Errorf("Failed to create Kubernetes client: %v", err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	agents := agent.NewClient(clientset)
+	agents.Namespace = o.agentNamespace
+	agents.Selector = o.agentSelector
+	agents.Port = o.agentPort
+	agg := aggregator.New(clientset, agents)
+
+	go serveMetrics(o.metricsAddress)
+	go serveAggregator(o.address, agg.Handler())
+
+	if !o.leaderElect {
+		klog.Infof("Starting cluster aggregator for node agents %s in namespace %s without leader election", o.agentSelector, o.agentNamespace)
+		agg.SetLeader(true)
+		agg.Run(ctx, o.probeInterval)
+		return 0
+	}
+
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		if identity, err = os.Hostname(); err != nil {
+			klog.Errorf("Failed to get an identity for leader election: %v", err)
+			return 1
+		}
+	}
+	klog.Infof("Starting cluster aggregator %s for node agents %s in namespace %s", identity, o.agentSelector, o.agentNamespace)
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: o.leaseName, Namespace: o.leaseNamespace},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		ReleaseOnCancel: true,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Info("Became the leader, serving the cluster API")
+				agg.SetLeader(true)
+				agg.Run(ctx, o.probeInterval)
+			},
+			OnStoppedLeading: func() {
+				agg.SetLeader(false)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					klog.Infof("Cluster aggregator %s is the leader", leader)
+				}
+			},
+		},
+	})
+
+	if ctx.Err() == nil {
+		// Restart to rejoin the election with fresh state
+		klog.Error("Lost the leader lease, exiting")
+		return 1
+	}
+	klog.Info("Cluster aggregator stopped")
+	return 0
+}
+
+// serveAggregator serves the cluster API of the aggregator
+func serveAggregator(addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("Serving cluster API on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		klog.Errorf("Cluster API server stopped: %v", err)
+	}
+}
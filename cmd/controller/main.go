@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
 	"github.com/packet-capture-controller/pkg/controller"
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/rpcap"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/client-go/informers"
@@ -20,21 +27,41 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:], os.Stdout, os.Stderr))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "aggregator" {
+		os.Exit(runAggregator(os.Args[2:], os.Stderr))
+	}
+
 	klog.InitFlags(nil)
+	configFile := flag.String("config", "", "Path to an optional YAML config file; flags override its values")
+	config.Default().AddFlags(flag.CommandLine)
 	flag.Parse()
 
+	cfg, err := config.Load(*configFile, flag.CommandLine)
+	if err != nil {
+		klog.Fatalf("Invalid configuration: %v", err)
+	}
+	klog.Infof("Loaded configuration: %+v", *cfg)
+	if cfg.SigningKeyFile != "" {
+		if _, err := capture.LoadSigningKey(cfg.SigningKeyFile); err != nil {
+			klog.Fatalf("Invalid manifest signing key: %v", err)
+		}
+	}
+
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
 		klog.Fatal("NODE_NAME environment variable must be set")
 	}
 	klog.Infof("Starting packet capture controller on node: %s", nodeName)
 
-	config, err := getKubeConfig()
+	kubeConfig, err := getKubeConfig()
 	if err != nil {
 		klog.Fatalf("Failed to get Kubernetes config: %v", err)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
 	if err != nil {
 		klog.Fatalf("Failed to create Kubernetes client: %v", err)
 	}
@@ -42,30 +69,66 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	reloader := config.NewReloader(*configFile, flag.CommandLine, cfg)
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		sig := <-sigCh
-		klog.Infof("Received signal %v, initiating graceful shutdown...", sig)
-		cancel()
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				klog.Info("Received SIGHUP, reloading configuration")
+				_ = reloader.Reload()
+				continue
+			}
+			klog.Infof("Received signal %v, initiating graceful shutdown...", sig)
+			cancel()
+			return
+		}
 	}()
 
+	go serveMetrics(cfg.MetricsAddress)
+
 	fieldSelector := fields.OneTermEqualSelector("spec.nodeName", nodeName).String()
 	klog.Infof("Creating informer with field selector: %s", fieldSelector)
 
 	informerFactory := informers.NewSharedInformerFactoryWithOptions(
 		clientset,
-		30*time.Second,
+		cfg.ResyncPeriod.Duration,
 		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
 			options.FieldSelector = fieldSelector
 		}),
 	)
 
-	ctrl := controller.NewController(clientset, informerFactory, nodeName)
+	clusterInformerFactory := informers.NewSharedInformerFactory(clientset, cfg.ResyncPeriod.Duration)
 
-	klog.Info("Starting informer factory")
+	ctrl := controller.NewController(clientset, informerFactory, clusterInformerFactory, nodeName, cfg)
+	reloader.OnReload(ctrl.ApplyConfig)
+	go reloader.Run(config.DefaultReloadInterval, ctx.Done())
+
+	if cfg.APIAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/", agent.NewHandler(cfg.CaptureDir, clientset))
+		mux.Handle(agent.TriggersPath+"/", agent.NewTriggerHandler(ctrl.Trigger, clientset))
+		go serveAPI(cfg.APIAddress, mux)
+	}
+	var tlsConfig *tls.Config
+	if cfg.ServingCertFile != "" {
+		if tlsConfig, err = servingTLSConfig(cfg); err != nil {
+			klog.Fatalf("Failed to load the serving certificate: %v", err)
+		}
+	}
+	if cfg.AlertReceiver.Address != "" {
+		alertSettings := func() config.AlertReceiver { return reloader.Current().AlertReceiver }
+		go serveAlerts(cfg.AlertReceiver.Address, agent.NewAlertHandler(alertSettings, clientset, cfg.AnnotationKey), tlsConfig)
+	}
+	if cfg.RPCAPAddress != "" {
+		go serveRPCAP(cfg.RPCAPAddress, rpcap.NewServer(rpcapSource{ctrl}, clientset, tlsConfig))
+	}
+
+	klog.Info("Starting informer factories")
 	informerFactory.Start(ctx.Done())
+	clusterInformerFactory.Start(ctx.Done())
 
 	klog.Info("Packet capture controller started successfully")
 
@@ -80,6 +143,80 @@ func main() {
 	klog.Info("Packet capture controller stopped")
 }
 
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("Serving metrics on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		klog.Errorf("Metrics server stopped: %v", err)
+	}
+}
+
+// serveAPI serves the session API kubectl-pcap downloads captures from
+// through the API server's pod proxy, and the trigger API of armed captures
+func serveAPI(addr string, handler http.Handler) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("Serving session API on %s", addr)
+	if err := server.ListenAndServe(); err != nil {
+		klog.Errorf("Session API server stopped: %v", err)
+	}
+}
+
+// serveAlerts serves the Alertmanager webhook receiver over TLS, apart from
+// the session API since it is reached through a Service rather than the pod
+// proxy and Alertmanager's token must not cross the network in clear text
+func serveAlerts(addr string, handler http.Handler, tlsConfig *tls.Config) {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	klog.Infof("Serving Alertmanager webhook receiver on %s", addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		klog.Errorf("Alertmanager webhook receiver stopped: %v", err)
+	}
+}
+
+// rpcapSource offers the capturable pods of the controller to rpcap clients
+type rpcapSource struct {
+	*controller.Controller
+}
+
+func (s rpcapSource) OpenStream(namespace, name string) (rpcap.Stream, error) {
+	stream, err := s.Controller.OpenStream(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// servingTLSConfig serves the certificate and key of cfg
+func servingTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.ServingCertFile, cfg.ServingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+func serveRPCAP(addr string, server *rpcap.Server) {
+	klog.Infof("Serving rpcap on %s", addr)
+	if err := server.ListenAndServe(addr); err != nil {
+		klog.Errorf("rpcap server stopped: %v", err)
+	}
+}
+
 func getKubeConfig() (*rest.Config, error) {
 	config, err := rest.InClusterConfig()
 	if err == nil {
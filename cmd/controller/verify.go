@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/packet-capture-controller/pkg/capture"
+)
+
+// runVerify implements "controller verify [--public-key file] <session dir>",
+// which checks the integrity of a downloaded capture session bundle
+func runVerify(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	publicKeyFile := fs.String("public-key", "", "PEM-encoded Ed25519 public key the manifest must be signed with")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: controller verify [--public-key file] <session directory>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	var key ed25519.PublicKey
+	if *publicKeyFile != "" {
+		var err error
+		key, err = capture.LoadVerificationKey(*publicKeyFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "FAILED: %v\n", err)
+			return 1
+		}
+	}
+
+	result, err := capture.VerifyBundle(fs.Arg(0), key)
+	if err != nil {
+		fmt.Fprintf(stderr, "FAILED: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "OK: session %s, %d segments match the custody log\n", result.SessionID, result.Segments)
+	if !result.Complete {
+		fmt.Fprintln(stdout, "Note: the session was still running when the bundle was taken")
+	}
+	if result.Signed {
+		fmt.Fprintln(stdout, "Manifest signature is valid")
+	} else {
+		fmt.Fprintln(stdout, "Manifest signature not checked; pass --public-key to verify it")
+	}
+	return 0
+}
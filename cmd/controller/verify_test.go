@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunVerifyExitCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStderr string
+	}{
+		{name: "missing bundle", args: nil, wantCode: 2, wantStderr: "Usage"},
+		{name: "unknown flag", args: []string{"--key", "k", "dir"}, wantCode: 2},
+		{name: "bundle without manifest", args: []string{t.TempDir()}, wantCode: 1, wantStderr: "FAILED"},
+		{name: "unreadable public key", args: []string{"--public-key", "/nonexistent.pub", t.TempDir()}, wantCode: 1, wantStderr: "FAILED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runVerify(tt.args, &stdout, &stderr); code != tt.wantCode {
+				t.Errorf("runVerify() = %d, want %d (stderr: %s)", code, tt.wantCode, stderr.String())
+			}
+			if !strings.Contains(stderr.String(), tt.wantStderr) {
+				t.Errorf("stderr %q should contain %q", stderr.String(), tt.wantStderr)
+			}
+		})
+	}
+}
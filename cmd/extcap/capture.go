@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// captureIDPrefix starts the IDs of the captures this program adds to
+	// the capture list of a pod
+	captureIDPrefix = "wireshark-"
+	// sessionStartTimeout bounds the wait for the node agent to start the
+	// requested session
+	sessionStartTimeout = time.Minute
+	// stopTimeout bounds the removal of the capture once Wireshark stops
+	stopTimeout = 10 * time.Second
+)
+
+// sessionPollInterval is how often the pod and the node agent are checked
+// while waiting for the session; a variable so tests can shorten it
+var sessionPollInterval = time.Second
+
+// runCapture adds a capture to the pod of the selected interface, streams
+// its packets into the FIFO until Wireshark stops or the capture ends, and
+// removes the capture again
+func runCapture(ctx context.Context, o *options, stderr io.Writer, newClient clientFactory) error {
+	namespace, name, err := podInterface(o.iface)
+	if err != nil {
+		return err
+	}
+	if o.fifo == "" {
+		return fmt.Errorf("--capture requires --fifo")
+	}
+	entry, err := o.captureEntry()
+	if err != nil {
+		return err
+	}
+	client, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	agents := agent.NewClient(client)
+	agents.Namespace = o.agentNamespace
+
+	id := captureIDPrefix + randomSuffix()
+	entry["id"] = id
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if err := addCapture(ctx, client, pod.Namespace, pod.Name, o.annotationKey, pod.Annotations, entry); err != nil {
+		return err
+	}
+	fmt.Fprintf(stderr, "Requested capture %s of pod %s/%s\n", id, namespace, name)
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+		if err := removeCapture(stopCtx, client, namespace, name, o.annotationKey, id); err != nil {
+			fmt.Fprintf(stderr, "Failed to remove capture %s of pod %s/%s: %v\n", id, namespace, name, err)
+		}
+	}()
+
+	agentPod, err := agents.AgentFor(ctx, pod.Spec.NodeName)
+	if err != nil {
+		return err
+	}
+	session, err := waitForSession(ctx, client, agents, agentPod, namespace, name, o.annotationKey, id)
+	if err != nil {
+		return err
+	}
+
+	fifo, err := os.OpenFile(o.fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fifo.Close()
+	stream, err := agents.Live(ctx, agentPod, session)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = io.Copy(fifo, stream)
+	// Wireshark stops a capture by terminating this program, and closing
+	// the FIFO ends it too
+	if ctx.Err() != nil || errors.Is(err, syscall.EPIPE) {
+		return nil
+	}
+	return err
+}
+
+// captureEntry returns the capture list entry for the dialog options. Like
+// kubectl pcap start, it only sets options that were given, so the node
+// agent's defaults apply to the rest. The session is always live, since
+// Wireshark streams it.
+func (o *options) captureEntry() (map[string]any, error) {
+	entry := map[string]any{"live": true}
+	var filters []string
+	for _, f := range []string{o.filter, o.captureFilter} {
+		if f = strings.TrimSpace(f); f != "" {
+			filters = append(filters, "("+f+")")
+		}
+	}
+	if len(filters) > 0 {
+		entry["filter"] = strings.Join(filters, " and ")
+	}
+	if o.duration != "" {
+		d, err := time.ParseDuration(o.duration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration %q: %w", o.duration, err)
+		}
+		if d != 0 {
+			entry["duration"] = d.String()
+		}
+	}
+	if o.snaplen != 0 {
+		entry["snaplen"] = o.snaplen
+	}
+	if o.podIface != "" {
+		entry["interface"] = o.podIface
+	}
+	if o.container != "" {
+		entry["container"] = o.container
+	}
+	return entry, nil
+}
+
+// addCapture adds entry to the capture list of a pod
+func addCapture(ctx context.Context, client kubernetes.Interface, namespace, name, annotationKey string, annotations map[string]string, entry map[string]any) error {
+	current, requested := annotations[annotationKey]
+	if requested && !capture.IsCaptureList(current) {
+		return fmt.Errorf("pod %s/%s already has a capture without an ID; stop it before capturing from Wireshark", namespace, name)
+	}
+	value, err := capture.UpdateCaptureList(current, entry["id"].(string), entry)
+	if err != nil {
+		return err
+	}
+	// Reject values the node agent would refuse to parse before touching the pod
+	if _, err := capture.ParseSessionSpecs(value, capture.CaptureSpec{}); err != nil {
+		return err
+	}
+	return patchAnnotation(ctx, client, namespace, name, annotationKey, &value)
+}
+
+// removeCapture removes the capture with id from the capture list of a pod,
+// and the annotation with it when no other capture is left
+func removeCapture(ctx context.Context, client kubernetes.Interface, namespace, name, annotationKey, id string) error {
+	pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	current, requested := pod.Annotations[annotationKey]
+	if !requested || !capture.IsCaptureList(current) {
+		return nil
+	}
+	remaining, err := capture.UpdateCaptureList(current, id, nil)
+	if err != nil {
+		return err
+	}
+	var value *string
+	if remaining != "[]" {
+		value = &remaining
+	}
+	return patchAnnotation(ctx, client, namespace, name, annotationKey, value)
+}
+
+// patchAnnotation sets the capture annotation of a pod, or removes it when
+// value is nil
+func patchAnnotation(ctx context.Context, client kubernetes.Interface, namespace, name, annotationKey string, value *string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]*string{annotationKey: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// waitForSession waits until the node agent runs a session for the capture
+// with id and returns it. A refusal reported in the pod status ends the wait
+// with the node agent's reason.
+func waitForSession(ctx context.Context, client kubernetes.Interface, agents *agent.Client, agentPod, namespace, name, annotationKey, id string) (*agent.SessionInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, sessionStartTimeout)
+	defer cancel()
+	captureID := fmt.Sprintf("%s/%s/%s", namespace, name, id)
+	ticker := time.NewTicker(sessionPollInterval)
+	defer ticker.Stop()
+	for {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if value, ok := pod.Annotations[annotationKey+capture.StatusAnnotationSuffix]; ok {
+			if status, err := capture.ParseStatus(value); err == nil {
+				for _, s := range status.Sessions {
+					if s.CaptureID == captureID && s.State == capture.StateRefused {
+						return nil, fmt.Errorf("node agent refused the capture: %s", s.Message)
+					}
+				}
+			}
+		}
+
+		sessions, err := agents.Sessions(ctx, agentPod, namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sessions {
+			s := &sessions[i]
+			if strings.HasPrefix(s.Session, id+"_") && s.Manifest != nil && s.Manifest.StopTime == nil {
+				return s, nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("node agent %s did not start capture %s: %w", agentPod, id, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func randomSuffix() string {
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+	return hex.EncodeToString(suffix)
+}
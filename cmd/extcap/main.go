@@ -0,0 +1,203 @@
+// packet-capture-extcap is a Wireshark extcap program: installed in
+// Wireshark's extcap folder it lists the pods of the cluster as capture
+// interfaces and captures them through the node agents, streaming the
+// packets into the FIFO Wireshark reads from.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// version is reported to Wireshark in the extcap line
+	version = "1.0"
+	// interfacePrefix starts the names of the interfaces this program
+	// offers, followed by <namespace>/<pod>
+	interfacePrefix = "k8s:"
+	// dltUser0 is announced as link type; the real one is taken from the
+	// pcap header of the stream, as it depends on the captured interface
+	dltUser0 = 147
+)
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr, newKubeClient))
+}
+
+// clientFactory returns a clientset for the kubeconfig and context options
+type clientFactory func(o *options) (kubernetes.Interface, error)
+
+// options are the extcap arguments Wireshark passes and the capture options
+// offered in its interface dialog
+type options struct {
+	// Extcap protocol
+	listInterfaces bool
+	listDLTs       bool
+	listConfig     bool
+	capture        bool
+	iface          string
+	fifo           string
+	captureFilter  string
+
+	// Capture options
+	filter    string
+	duration  string
+	snaplen   int
+	podIface  string
+	container string
+
+	// Cluster options
+	kubeconfig     string
+	context        string
+	annotationKey  string
+	agentNamespace string
+}
+
+func (o *options) addFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&o.listInterfaces, "extcap-interfaces", false, "List the pods as capture interfaces")
+	fs.BoolVar(&o.listDLTs, "extcap-dlts", false, "List the link types of --extcap-interface")
+	fs.BoolVar(&o.listConfig, "extcap-config", false, "List the options of --extcap-interface")
+	fs.BoolVar(&o.capture, "capture", false, "Capture --extcap-interface into --fifo")
+	fs.StringVar(&o.iface, "extcap-interface", "", "Interface to work on, k8s:<namespace>/<pod>")
+	fs.StringVar(&o.fifo, "fifo", "", "FIFO the capture is written to")
+	fs.StringVar(&o.captureFilter, "extcap-capture-filter", "", "Capture filter entered in Wireshark")
+	// Passed by Wireshark but not used
+	fs.String("extcap-version", "", "Wireshark version")
+	fs.String("extcap-control-in", "", "Control pipe from Wireshark")
+	fs.String("extcap-control-out", "", "Control pipe to Wireshark")
+	fs.Bool("debug", false, "Ignored")
+	fs.String("debug-file", "", "Ignored")
+
+	fs.StringVar(&o.filter, "filter", "", "BPF filter expression")
+	fs.StringVar(&o.duration, "duration", "", "Stop capturing after this time")
+	fs.IntVar(&o.snaplen, "snaplen", 0, "Bytes captured per packet")
+	fs.StringVar(&o.podIface, "interface", "", "Interface inside the pod network namespace")
+	fs.StringVar(&o.container, "container", "", "Container used to locate the pod network namespace")
+
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file")
+	fs.StringVar(&o.context, "context", "", "Kubeconfig context to use")
+	fs.StringVar(&o.annotationKey, "annotation-key", config.DefaultAnnotationKey, "Capture annotation key configured in the node agents")
+	fs.StringVar(&o.agentNamespace, "agent-namespace", agent.DefaultNamespace, "Namespace the node agent DaemonSet runs in")
+}
+
+// configArgs describes the options of the interface dialog in the extcap
+// "arg" syntax; the calls match the flags above
+var configArgs = []string{
+	"{call=--filter}{display=Capture filter}{type=string}{tooltip=BPF expression applied by tcpdump on the node, in addition to the capture filter field}{group=Capture}",
+	"{call=--duration}{display=Duration}{type=string}{default=10m}{validation=^(0|([0-9]+(\\.[0-9]+)?(ms|s|m|h))+)$}{tooltip=Stop capturing after this time, e.g. 30s or 1h; 0 captures until Wireshark stops}{group=Capture}",
+	"{call=--snaplen}{display=Snapshot length}{type=unsigned}{range=0,262144}{default=0}{tooltip=Bytes captured per packet; 0 keeps the node agent's default}{group=Capture}",
+	"{call=--interface}{display=Pod interface}{type=string}{tooltip=Interface inside the pod network namespace; empty uses the node agent's default}{group=Capture}",
+	"{call=--container}{display=Container}{type=string}{tooltip=Container used to locate the pod network namespace; empty uses the first one}{group=Capture}",
+	"{call=--kubeconfig}{display=Kubeconfig}{type=fileselect}{mustexist=true}{tooltip=Defaults to $KUBECONFIG or ~/.kube/config}{group=Cluster}",
+	"{call=--context}{display=Context}{type=string}{tooltip=Kubeconfig context; empty uses the current one}{group=Cluster}",
+	"{call=--annotation-key}{display=Annotation key}{type=string}{default=" + config.DefaultAnnotationKey + "}{tooltip=Capture annotation key configured in the node agents}{group=Cluster}",
+	"{call=--agent-namespace}{display=Agent namespace}{type=string}{default=" + agent.DefaultNamespace + "}{tooltip=Namespace the node agent DaemonSet runs in}{group=Cluster}",
+}
+
+// run executes the extcap step selected by args and returns the exit code
+func run(ctx context.Context, args []string, stdout, stderr io.Writer, newClient clientFactory) int {
+	fs := flag.NewFlagSet("packet-capture-extcap", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	o := &options{}
+	o.addFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	var err error
+	switch {
+	case o.listInterfaces:
+		fmt.Fprintf(stdout, "extcap {version=%s}{display=Kubernetes pod capture}\n", version)
+		err = listInterfaces(ctx, o, stdout, newClient)
+	case o.listDLTs:
+		fmt.Fprintf(stdout, "dlt {number=%d}{name=%s}{display=Link type of the pod interface}\n", dltUser0, strings.TrimSuffix(interfacePrefix, ":"))
+	case o.listConfig:
+		for i, arg := range configArgs {
+			fmt.Fprintf(stdout, "arg {number=%d}%s\n", i, arg)
+		}
+	case o.capture:
+		err = runCapture(ctx, o, stderr, newClient)
+	default:
+		fmt.Fprintln(stderr, "Expected one of --extcap-interfaces, --extcap-dlts, --extcap-config or --capture")
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// listInterfaces prints an interface for every running pod of the cluster
+func listInterfaces(ctx context.Context, o *options, stdout io.Writer, newClient clientFactory) error {
+	client, err := newClient(o)
+	if err != nil {
+		return err
+	}
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	sort.Slice(pods.Items, func(i, j int) bool {
+		a, b := &pods.Items[i], &pods.Items[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		fmt.Fprintf(stdout, "interface {value=%s%s/%s}{display=Pod %s/%s on %s}\n", interfacePrefix, pod.Namespace, pod.Name, pod.Namespace, pod.Name, pod.Spec.NodeName)
+	}
+	return nil
+}
+
+// podInterface splits an interface name into the namespace and name of the pod
+func podInterface(iface string) (string, string, error) {
+	namespace, name, ok := strings.Cut(strings.TrimPrefix(iface, interfacePrefix), "/")
+	if !strings.HasPrefix(iface, interfacePrefix) || !ok || namespace == "" || name == "" {
+		return "", "", fmt.Errorf("invalid interface %q, expected %s<namespace>/<pod>", iface, interfacePrefix)
+	}
+	return namespace, name, nil
+}
+
+func newKubeClient(o *options) (kubernetes.Interface, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: o.context})
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	restConfig.Wrap(agent.ForwardToken)
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	return client, nil
+}
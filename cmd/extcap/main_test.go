@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/pcap"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// serverResponse answers a pod proxy request of the fake clientset from a
+// test server, so live streams arrive as they are written
+type serverResponse struct {
+	url string
+}
+
+func (r serverResponse) DoRaw(ctx context.Context) ([]byte, error) {
+	stream, err := r.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func (r serverResponse) Stream(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(agent.TokenHeader, "user-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// acceptAgentToken lets the node agent accept user-token, the token
+// ForwardToken would add to pod proxy requests, as a user allowed to capture
+// every pod
+func acceptAgentToken(clientset *fake.Clientset) {
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "user-token" {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "user"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "user"
+		return true, review, nil
+	})
+}
+
+// newTestCluster returns a fake cluster with the running pod shop/web-0 on
+// node-1, whose node agent serves the sessions stored in the returned
+// capture directory
+func newTestCluster(t *testing.T, annotations map[string]string) (*fake.Clientset, string) {
+	t.Helper()
+	captureDir := t.TempDir()
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "shop", Annotations: annotations},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "batch-0", Namespace: "shop"},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodSucceeded},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: agent.DefaultNamespace, Labels: map[string]string{"app": "packet-capture-controller"}},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+	)
+	acceptAgentToken(clientset)
+	server := httptest.NewServer(agent.NewHandler(captureDir, clientset))
+	t.Cleanup(server.Close)
+	clientset.AddProxyReactor("pods", func(action k8stesting.Action) (bool, restclient.ResponseWrapper, error) {
+		proxy := action.(k8stesting.ProxyGetAction)
+		if proxy.GetName() != "agent-1" || proxy.GetPort() != agent.DefaultPort {
+			return true, nil, fmt.Errorf("unexpected proxy target %s:%s", proxy.GetName(), proxy.GetPort())
+		}
+		query := url.Values{}
+		for k, v := range proxy.GetParams() {
+			query.Set(k, v)
+		}
+		return true, serverResponse{url: server.URL + proxy.GetPath() + "?" + query.Encode()}, nil
+	})
+	return clientset, captureDir
+}
+
+func runExtcap(ctx context.Context, clientset kubernetes.Interface, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	newClient := func(*options) (kubernetes.Interface, error) { return clientset, nil }
+	code := run(ctx, args, &stdout, &stderr, newClient)
+	return code, stdout.String(), stderr.String()
+}
+
+func podAnnotations(t *testing.T, clientset kubernetes.Interface) map[string]string {
+	t.Helper()
+	pod, err := clientset.CoreV1().Pods("shop").Get(context.Background(), "web-0", metav1.GetOptions{})
+	if err != nil {
+		t.Errorf("Failed to get pod: %v", err)
+		return nil
+	}
+	return pod.Annotations
+}
+
+// waitForCaptureID waits until the extcap program added a capture to the
+// capture list of shop/web-0 and returns its ID
+func waitForCaptureID(t *testing.T, clientset kubernetes.Interface) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var list []capture.SessionSpec
+		if value, ok := podAnnotations(t, clientset)[config.DefaultAnnotationKey]; ok {
+			if err := json.Unmarshal([]byte(value), &list); err != nil {
+				t.Errorf("Invalid capture annotation %q: %v", value, err)
+				return ""
+			}
+		}
+		for _, s := range list {
+			if strings.HasPrefix(s.ID, captureIDPrefix) {
+				return s.ID
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("no capture was added to the pod")
+	return ""
+}
+
+func waitForSize(t *testing.T, path string, size int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if info, err := os.Stat(path); err == nil && info.Size() >= size {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%s did not grow to %d bytes", path, size)
+}
+
+// writeSession writes the manifest and pcap file of a session of shop/web-0,
+// appending packets stamped at the given seconds after start
+func writeSession(t *testing.T, dir string, start time.Time, stop *time.Time, seconds ...int) {
+	t.Helper()
+	manifest, err := json.Marshal(capture.Manifest{StartTime: start, StopTime: stop})
+	if err != nil {
+		t.Errorf("Failed to encode manifest: %v", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, capture.ManifestFileName), manifest, 0644); err != nil {
+		t.Errorf("Failed to write manifest: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf, pcap.Header{SnapLen: 262144, LinkType: 1})
+	if err != nil {
+		t.Errorf("NewWriter() returned error: %v", err)
+		return
+	}
+	for _, s := range seconds {
+		if err := w.WritePacket(&pcap.Packet{Timestamp: start.Add(time.Duration(s) * time.Second), Data: []byte{byte(s)}}); err != nil {
+			t.Errorf("WritePacket() returned error: %v", err)
+		}
+	}
+	data := buf.Bytes()
+	path := filepath.Join(dir, "capture.pcap0")
+	if _, err := os.Stat(path); err == nil {
+		data = data[pcap.HeaderLen:]
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Errorf("Failed to open pcap file: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Errorf("Failed to write pcap file: %v", err)
+	}
+}
+
+func TestExtcapListsPodsAndOptions(t *testing.T) {
+	clientset, _ := newTestCluster(t, nil)
+
+	code, stdout, stderr := runExtcap(context.Background(), clientset, "--extcap-interfaces", "--extcap-version=4.2")
+	if code != 0 {
+		t.Fatalf("--extcap-interfaces exited with %d: %s", code, stderr)
+	}
+	want := "extcap {version=1.0}{display=Kubernetes pod capture}\n" +
+		"interface {value=k8s:default/agent-1}{display=Pod default/agent-1 on node-1}\n" +
+		"interface {value=k8s:shop/web-0}{display=Pod shop/web-0 on node-1}\n"
+	if stdout != want {
+		t.Errorf("--extcap-interfaces printed:\n%s\nwant:\n%s", stdout, want)
+	}
+
+	code, stdout, _ = runExtcap(context.Background(), clientset, "--extcap-config", "--extcap-interface", "k8s:shop/web-0")
+	if code != 0 || !strings.HasPrefix(stdout, "arg {number=0}{call=--filter}") || !strings.Contains(stdout, "{call=--duration}") {
+		t.Errorf("--extcap-config exited with %d and printed:\n%s", code, stdout)
+	}
+
+	code, stdout, _ = runExtcap(context.Background(), clientset, "--extcap-dlts", "--extcap-interface", "k8s:shop/web-0")
+	if code != 0 || !strings.HasPrefix(stdout, "dlt {number=147}") {
+		t.Errorf("--extcap-dlts exited with %d and printed:\n%s", code, stdout)
+	}
+}
+
+func TestExtcapStreamsCaptureIntoFIFO(t *testing.T) {
+	sessionPollInterval = 10 * time.Millisecond
+	other := `[{"filter":"udp port 53","id":"dns"}]`
+	clientset, captureDir := newTestCluster(t, map[string]string{config.DefaultAnnotationKey: other})
+	fifo := filepath.Join(t.TempDir(), "fifo")
+	if err := os.WriteFile(fifo, nil, 0644); err != nil {
+		t.Fatalf("Failed to create FIFO stand-in: %v", err)
+	}
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+	// Act as the node agent: start the requested session, write packets once
+	// the stream follows it and stop it again
+	go func() {
+		id := waitForCaptureID(t, clientset)
+		if id == "" {
+			return
+		}
+		var list []map[string]any
+		_ = json.Unmarshal([]byte(podAnnotations(t, clientset)[config.DefaultAnnotationKey]), &list)
+		if filter := list[1]["filter"]; filter != "(tcp) and (port 80)" || list[1]["duration"] != "30s" || list[1]["live"] != true {
+			t.Errorf("capture entry = %v, want a live capture with filter (tcp) and (port 80) for 30s", list[1])
+		}
+		dir := filepath.Join(captureDir, "shop", "web-0", id+"_20261018T100000Z-0a1b2c3d")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Errorf("Failed to create session dir: %v", err)
+			return
+		}
+		writeSession(t, dir, start, nil)
+		waitForSize(t, fifo, pcap.HeaderLen)
+		writeSession(t, dir, start, nil, 1, 2)
+		waitForSize(t, fifo, pcap.HeaderLen+2*(pcap.RecordHeaderLen+1))
+		stop := start.Add(time.Minute)
+		writeSession(t, dir, start, &stop)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	code, _, stderr := runExtcap(ctx, clientset, "--capture", "--extcap-interface", "k8s:shop/web-0", "--fifo", fifo,
+		"--filter", "tcp", "--extcap-capture-filter", "port 80", "--duration", "30s")
+	if code != 0 {
+		t.Fatalf("--capture exited with %d: %s", code, stderr)
+	}
+
+	f, err := os.Open(fifo)
+	if err != nil {
+		t.Fatalf("Failed to open FIFO stand-in: %v", err)
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader() returned error: %v", err)
+	}
+	for _, want := range []int{1, 2} {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() returned error: %v", err)
+		}
+		if !p.Timestamp.Equal(start.Add(time.Duration(want) * time.Second)) {
+			t.Errorf("packet at %v, want %ds after start", p.Timestamp, want)
+		}
+	}
+	if value := podAnnotations(t, clientset)[config.DefaultAnnotationKey]; value != other {
+		t.Errorf("capture annotation after the capture = %q, want %q", value, other)
+	}
+}
+
+func TestExtcapReportsRefusedCapture(t *testing.T) {
+	sessionPollInterval = 10 * time.Millisecond
+	clientset, _ := newTestCluster(t, nil)
+
+	go func() {
+		id := waitForCaptureID(t, clientset)
+		if id == "" {
+			return
+		}
+		status := &capture.Status{Node: "node-1", State: capture.StateRefused, Sessions: []capture.SessionStatus{
+			{CaptureID: "shop/web-0/" + id, State: capture.StateRefused, Message: "namespace shop has not opted in"},
+		}}
+		patch, _ := json.Marshal(map[string]any{"metadata": map[string]any{"annotations": map[string]string{
+			config.DefaultAnnotationKey + capture.StatusAnnotationSuffix: status.String(),
+		}}})
+		if _, err := clientset.CoreV1().Pods("shop").Patch(context.Background(), "web-0", "application/merge-patch+json", patch, metav1.PatchOptions{}); err != nil {
+			t.Errorf("Failed to set status: %v", err)
+		}
+	}()
+
+	code, _, stderr := runExtcap(context.Background(), clientset, "--capture", "--extcap-interface", "k8s:shop/web-0", "--fifo", filepath.Join(t.TempDir(), "fifo"))
+	if code != 1 || !strings.Contains(stderr, "has not opted in") {
+		t.Errorf("--capture exited with %d, want 1 with the refusal reason: %s", code, stderr)
+	}
+	if value, ok := podAnnotations(t, clientset)[config.DefaultAnnotationKey]; ok {
+		t.Errorf("capture annotation %q should have been removed", value)
+	}
+}
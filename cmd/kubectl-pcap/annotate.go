@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func startFlags(fs *flag.FlagSet) commandFunc {
+	var (
+		id         string
+		fileCount  int
+		fileSizeMB int
+		duration   time.Duration
+		filter     string
+		snaplen    int
+		iface      string
+		container  string
+		retention  time.Duration
+		armed      bool
+		bufferMB   int
+		bufferFor  time.Duration
+		postFor    time.Duration
+		schedule   string
+		keepRuns   int
+		live       bool
+	)
+	fs.StringVar(&id, "id", "", "Add or replace the capture with this ID, keeping the pod's other captures")
+	fs.IntVar(&fileCount, "file-count", 0, "Number of rotated pcap files kept")
+	fs.IntVar(&fileSizeMB, "file-size-mb", 0, "File size in MB before rotating")
+	fs.DurationVar(&duration, "duration", 0, "Stop capturing after this time")
+	fs.StringVar(&filter, "filter", "", "BPF filter expression")
+	fs.IntVar(&snaplen, "snaplen", 0, "Bytes captured per packet")
+	fs.StringVar(&iface, "interface", "", "Interface inside the pod network namespace")
+	fs.StringVar(&container, "container", "", "Container used to locate the pod network namespace")
+	fs.DurationVar(&retention, "retention", 0, "How long files are kept after the capture stops")
+	fs.BoolVar(&armed, "armed", false, "Only keep the latest packets in memory until the capture is triggered")
+	fs.IntVar(&bufferMB, "buffer-size-mb", 0, "Size in MB of the in-memory buffer of an armed capture")
+	fs.DurationVar(&bufferFor, "buffer-duration", 0, "Age of the oldest packet an armed capture keeps")
+	fs.DurationVar(&postFor, "post-trigger", 0, "How long an armed capture keeps writing after a trigger")
+	fs.StringVar(&schedule, "schedule", "", "Cron expression in UTC at which the capture runs for --duration, e.g. \"0 2 * * *\"")
+	fs.IntVar(&keepRuns, "keep-runs", 0, "Number of runs of a scheduled capture whose files are kept")
+	fs.BoolVar(&live, "live", false, "Write every packet as it arrives, so \"kubectl pcap live\" follows the capture closely")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		namespace, name, err := p.podArg(args)
+		if err != nil {
+			return err
+		}
+
+		// Only options given on the command line are written, so the node
+		// agent's defaults apply to the rest
+		entry := map[string]any{}
+		if fileCount != 0 {
+			entry["fileCount"] = fileCount
+		}
+		if fileSizeMB != 0 {
+			entry["fileSizeMB"] = fileSizeMB
+		}
+		if duration != 0 {
+			entry["duration"] = duration.String()
+		}
+		if filter != "" {
+			entry["filter"] = filter
+		}
+		if snaplen != 0 {
+			entry["snaplen"] = snaplen
+		}
+		if iface != "" {
+			entry["interface"] = iface
+		}
+		if container != "" {
+			entry["container"] = container
+		}
+		if retention != 0 {
+			entry["retention"] = retention.String()
+		}
+		if armed {
+			entry["mode"] = capture.ModeArmed
+		}
+		if bufferMB != 0 {
+			entry["bufferSizeMB"] = bufferMB
+		}
+		if bufferFor != 0 {
+			entry["bufferDuration"] = bufferFor.String()
+		}
+		if postFor != 0 {
+			entry["postTrigger"] = postFor.String()
+		}
+		if schedule != "" {
+			entry["schedule"] = schedule
+		}
+		if keepRuns != 0 {
+			entry["keepRuns"] = keepRuns
+		}
+		if live {
+			entry["live"] = true
+		}
+
+		pod, err := p.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current, requested := pod.Annotations[p.annotationKey]
+
+		var value string
+		if id == "" {
+			if requested && capture.IsCaptureList(current) {
+				return fmt.Errorf("pod %s/%s has a list of captures; pass --id to add or replace one of them", namespace, name)
+			}
+			value, err = encodeJSON(entry)
+		} else {
+			if requested && !capture.IsCaptureList(current) {
+				return fmt.Errorf("pod %s/%s already has a capture without an ID; stop it before adding captures with --id", namespace, name)
+			}
+			entry["id"] = id
+			value, err = capture.UpdateCaptureList(current, id, entry)
+		}
+		if err != nil {
+			return err
+		}
+		// Reject values the node agent would refuse to parse before touching the pod
+		if _, err := capture.ParseSessionSpecs(value, capture.CaptureSpec{}); err != nil {
+			return err
+		}
+
+		if err := p.patchAnnotation(ctx, namespace, name, &value); err != nil {
+			return err
+		}
+		if armed {
+			fmt.Fprintf(p.stdout, "Requested armed capture of pod %s/%s%s\n", namespace, name, idSuffix(id))
+			return nil
+		}
+		fmt.Fprintf(p.stdout, "Requested capture of pod %s/%s%s\n", namespace, name, idSuffix(id))
+		return nil
+	}
+}
+
+func stopFlags(fs *flag.FlagSet) commandFunc {
+	var id string
+	fs.StringVar(&id, "id", "", "Stop only the capture with this ID")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		namespace, name, err := p.podArg(args)
+		if err != nil {
+			return err
+		}
+		pod, err := p.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current, requested := pod.Annotations[p.annotationKey]
+		if !requested {
+			return fmt.Errorf("pod %s/%s has no capture annotation", namespace, name)
+		}
+
+		var value *string
+		if id != "" {
+			if !capture.IsCaptureList(current) {
+				return fmt.Errorf("pod %s/%s has a single capture without an ID; stop it without --id", namespace, name)
+			}
+			remaining, err := capture.UpdateCaptureList(current, id, nil)
+			if err != nil {
+				return err
+			}
+			if remaining != "[]" {
+				value = &remaining
+			}
+		}
+
+		if err := p.patchAnnotation(ctx, namespace, name, value); err != nil {
+			return err
+		}
+		fmt.Fprintf(p.stdout, "Stopped capture of pod %s/%s%s\n", namespace, name, idSuffix(id))
+		return nil
+	}
+}
+
+func triggerFlags(fs *flag.FlagSet) commandFunc {
+	var reason string
+	fs.StringVar(&reason, "reason", "", "Reason recorded in the manifest of the sessions written")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		namespace, name, err := p.podArg(args)
+		if err != nil {
+			return err
+		}
+		pod, err := p.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var armed []string
+		if status := p.podStatus(pod); status != nil {
+			for _, s := range status.Sessions {
+				if s.State == capture.StateArmed {
+					armed = append(armed, s.CaptureID)
+				}
+			}
+		}
+		if len(armed) == 0 {
+			return fmt.Errorf("pod %s/%s has no armed capture", namespace, name)
+		}
+
+		// Every change of the value triggers, so it starts with the time
+		value := time.Now().UTC().Format(time.RFC3339Nano)
+		if reason != "" {
+			value += " " + reason
+		}
+		if err := p.patchAnnotations(ctx, namespace, name, map[string]*string{p.triggerKey(): &value}); err != nil {
+			return err
+		}
+		fmt.Fprintf(p.stdout, "Triggered armed captures %s of pod %s/%s\n", strings.Join(armed, ", "), namespace, name)
+		return nil
+	}
+}
+
+func listFlags(fs *flag.FlagSet) commandFunc {
+	var allNamespaces bool
+	fs.BoolVar(&allNamespaces, "all-namespaces", false, "List pods in every namespace")
+	fs.BoolVar(&allNamespaces, "A", false, "Shorthand for --all-namespaces")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if len(args) != 0 {
+			return fmt.Errorf("list takes no arguments: %w", errUsage)
+		}
+		namespace := p.namespace
+		if allNamespaces {
+			namespace = metav1.NamespaceAll
+		}
+		pods, err := p.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(p.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAMESPACE\tPOD\tNODE\tSTATE\tCAPTURES")
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			_, requested := pod.Annotations[p.annotationKey]
+			status := p.podStatus(pod)
+			if !requested && status == nil {
+				continue
+			}
+			state, captures := "Pending", "-"
+			if status != nil {
+				state = status.State
+				ids := make([]string, 0, len(status.Sessions))
+				for _, s := range status.Sessions {
+					ids = append(ids, s.CaptureID)
+				}
+				if len(ids) > 0 {
+					captures = strings.Join(ids, ",")
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", pod.Namespace, pod.Name, pod.Spec.NodeName, state, captures)
+		}
+		return w.Flush()
+	}
+}
+
+func statusFlags(fs *flag.FlagSet) commandFunc {
+	return func(ctx context.Context, p *plugin, args []string) error {
+		namespace, name, err := p.podArg(args)
+		if err != nil {
+			return err
+		}
+		pod, err := p.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(p.stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(w, "Pod:\t%s/%s\n", namespace, name)
+		fmt.Fprintf(w, "Node:\t%s\n", pod.Spec.NodeName)
+		if value, ok := pod.Annotations[p.annotationKey]; ok {
+			fmt.Fprintf(w, "Requested:\t%s\n", value)
+		}
+		status := p.podStatus(pod)
+		if status == nil {
+			fmt.Fprintf(w, "State:\t%s\n", "Unknown (no status reported by the node agent)")
+		} else {
+			fmt.Fprintf(w, "State:\t%s\n", status.State)
+			if status.Message != "" {
+				fmt.Fprintf(w, "Message:\t%s\n", status.Message)
+			}
+			if status.HostNetwork != "" {
+				fmt.Fprintf(w, "HostNetwork:\t%s\n", status.HostNetwork)
+			}
+			if len(status.Sessions) > 0 {
+				fmt.Fprintln(w, "\nCAPTURE ID\tSTATE\tFILTER\tMESSAGE")
+				for _, s := range status.Sessions {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.CaptureID, s.State, s.Filter, s.Message)
+				}
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		agentPod, err := p.agents.AgentFor(ctx, pod.Spec.NodeName)
+		if err == nil {
+			var sessions []agent.SessionInfo
+			if sessions, err = p.agents.Sessions(ctx, agentPod, namespace, name); err == nil {
+				return printSessions(p, sessions)
+			}
+		}
+		fmt.Fprintf(p.stdout, "\nStored sessions unavailable: %v\n", err)
+		return nil
+	}
+}
+
+// podStatus returns the status reported by the node agent, or nil
+func (p *plugin) podStatus(pod *corev1.Pod) *capture.Status {
+	value, ok := pod.Annotations[p.statusKey()]
+	if !ok {
+		return nil
+	}
+	status, err := capture.ParseStatus(value)
+	if err != nil {
+		fmt.Fprintf(p.stderr, "Warning: ignoring invalid status annotation of pod %s/%s: %v\n", pod.Namespace, pod.Name, err)
+		return nil
+	}
+	return status
+}
+
+// patchAnnotation sets the capture annotation of a pod, or removes it when
+// value is nil
+func (p *plugin) patchAnnotation(ctx context.Context, namespace, name string, value *string) error {
+	return p.patchAnnotations(ctx, namespace, name, map[string]*string{p.annotationKey: value})
+}
+
+// patchAnnotations sets annotations of a pod, removing those set to nil
+func (p *plugin) patchAnnotations(ctx context.Context, namespace, name string, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = p.client.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func encodeJSON(v any) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func idSuffix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return fmt.Sprintf(" with ID %s", id)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/pcap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sessionOptions select the session get and open work on
+type sessionOptions struct {
+	id      string
+	session string
+	// running only selects sessions that are still capturing
+	running bool
+}
+
+func (o *sessionOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.id, "id", "", "Use the latest session of the capture with this ID")
+	fs.StringVar(&o.session, "session", "", "Use the session directory with this name, as shown by status")
+}
+
+func getFlags(fs *flag.FlagSet) commandFunc {
+	var selection sessionOptions
+	var output, bundle string
+	selection.addFlags(fs)
+	fs.StringVar(&output, "o", "", "File the merged capture is written to, - for stdout; defaults to <pod>.pcap")
+	fs.StringVar(&bundle, "bundle", "", "Download every file of the session unmerged into this directory, e.g. for controller verify")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		agentPod, session, err := p.selectSession(ctx, args, selection)
+		if err != nil {
+			return err
+		}
+
+		if bundle != "" {
+			dir := filepath.Join(bundle, session.Session)
+			if err := p.downloadBundle(ctx, agentPod, session, dir); err != nil {
+				return err
+			}
+			fmt.Fprintf(p.stdout, "Downloaded session %s to %s\n", session.Session, dir)
+			return nil
+		}
+
+		if output == "-" {
+			return p.mergeSession(ctx, agentPod, session, p.stdout)
+		}
+		if output == "" {
+			output = session.Pod + ".pcap"
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		if err := p.mergeSession(ctx, agentPod, session, f); err != nil {
+			f.Close()
+			os.Remove(output)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(p.stdout, "Wrote session %s to %s\n", session.Session, output)
+		return nil
+	}
+}
+
+func openFlags(fs *flag.FlagSet) commandFunc {
+	var selection sessionOptions
+	var viewer string
+	selection.addFlags(fs)
+	fs.StringVar(&viewer, "viewer", "wireshark -k -i -", "Command reading the capture from stdin")
+	fs.BoolVar(&selection.running, "live", false, "Stream the packets of a running session as they are captured")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		command := strings.Fields(viewer)
+		if len(command) == 0 {
+			return fmt.Errorf("--viewer must not be empty: %w", errUsage)
+		}
+		agentPod, session, err := p.selectSession(ctx, args, selection)
+		if err != nil {
+			return err
+		}
+
+		stdin, wait, err := p.startViewer(ctx, command)
+		if err != nil {
+			return fmt.Errorf("failed to start %s: %w", command[0], err)
+		}
+		var copyErr error
+		if selection.running {
+			copyErr = p.streamSession(ctx, agentPod, session, stdin)
+		} else {
+			copyErr = p.mergeSession(ctx, agentPod, session, stdin)
+		}
+		stdin.Close()
+		waitErr := wait()
+		// A viewer closed before the whole capture was written is not an error
+		if copyErr != nil && !errors.Is(copyErr, os.ErrClosed) && !errors.Is(copyErr, syscall.EPIPE) {
+			return copyErr
+		}
+		return waitErr
+	}
+}
+
+func liveFlags(fs *flag.FlagSet) commandFunc {
+	selection := sessionOptions{running: true}
+	var output string
+	selection.addFlags(fs)
+	fs.StringVar(&output, "o", "-", "File the stream is written to, - for stdout")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		agentPod, session, err := p.selectSession(ctx, args, selection)
+		if err != nil {
+			return err
+		}
+		w := p.stdout
+		if output != "-" {
+			f, err := os.Create(output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		err = p.streamSession(ctx, agentPod, session, w)
+		// Interrupting the stream and closing the reading end are how it is
+		// meant to end
+		if errors.Is(err, context.Canceled) || errors.Is(err, syscall.EPIPE) {
+			return nil
+		}
+		return err
+	}
+}
+
+// streamSession copies the live stream of a running session to w
+func (p *plugin) streamSession(ctx context.Context, agentPod string, session *agent.SessionInfo, w io.Writer) error {
+	stream, err := p.agents.Live(ctx, agentPod, session)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	_, err = io.Copy(w, stream)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// selectSession finds the node agent of the pod in args and the session
+// chosen by o, by default the one started last
+func (p *plugin) selectSession(ctx context.Context, args []string, o sessionOptions) (string, *agent.SessionInfo, error) {
+	namespace, name, err := p.podArg(args)
+	if err != nil {
+		return "", nil, err
+	}
+	pod, err := p.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+	agentPod, err := p.agents.AgentFor(ctx, pod.Spec.NodeName)
+	if err != nil {
+		return "", nil, err
+	}
+	sessions, err := p.agents.Sessions(ctx, agentPod, namespace, name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var selected *agent.SessionInfo
+	for i := range sessions {
+		s := &sessions[i]
+		if o.session != "" && s.Session != o.session {
+			continue
+		}
+		if o.id != "" && !strings.HasPrefix(s.Session, o.id+"_") {
+			continue
+		}
+		if o.running && (s.Manifest == nil || s.Manifest.StopTime != nil) {
+			continue
+		}
+		if !o.running && len(s.PcapFiles()) == 0 {
+			continue
+		}
+		if selected == nil || startTime(s).After(startTime(selected)) {
+			selected = s
+		}
+	}
+	if selected == nil && o.running {
+		return "", nil, fmt.Errorf("no running capture session matches pod %s/%s on node %s", namespace, name, pod.Spec.NodeName)
+	}
+	if selected == nil {
+		return "", nil, fmt.Errorf("no stored capture session with pcap files matches pod %s/%s on node %s", namespace, name, pod.Spec.NodeName)
+	}
+	if o.session == "" {
+		fmt.Fprintf(p.stderr, "Using session %s\n", selected.Session)
+	}
+	return agentPod, selected, nil
+}
+
+func startTime(s *agent.SessionInfo) time.Time {
+	if s.Manifest != nil {
+		return s.Manifest.StartTime
+	}
+	return time.Time{}
+}
+
+// mergeSession writes the pcap files of a session to w as one capture
+// ordered by packet time
+func (p *plugin) mergeSession(ctx context.Context, agentPod string, session *agent.SessionInfo, w io.Writer) error {
+	var inputs []io.Reader
+	for _, file := range session.PcapFiles() {
+		stream, err := p.agents.OpenFile(ctx, agentPod, session, file)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		inputs = append(inputs, stream)
+	}
+	return pcap.Merge(w, inputs...)
+}
+
+// downloadBundle copies every file of a session into dir unchanged
+func (p *plugin) downloadBundle(ctx context.Context, agentPod string, session *agent.SessionInfo, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, file := range session.Files {
+		if err := p.downloadFile(ctx, agentPod, session, file.Name, filepath.Join(dir, file.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *plugin) downloadFile(ctx context.Context, agentPod string, session *agent.SessionInfo, file, path string) error {
+	stream, err := p.agents.OpenFile(ctx, agentPod, session, file)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, stream); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to download %s: %w", file, err)
+	}
+	return f.Close()
+}
+
+func printSessions(p *plugin, sessions []agent.SessionInfo) error {
+	if len(sessions) == 0 {
+		fmt.Fprintln(p.stdout, "\nNo stored sessions")
+		return nil
+	}
+	w := tabwriter.NewWriter(p.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\nSESSION\tCAPTURE ID\tSTARTED\tSTOPPED\tFILES\tSIZE")
+	for _, s := range sessions {
+		captureID, started, stopped := "-", "-", "running"
+		if s.Manifest != nil {
+			captureID = s.Manifest.CaptureID
+			started = s.Manifest.StartTime.Format(time.RFC3339)
+			if s.Manifest.StopTime != nil {
+				stopped = fmt.Sprintf("%s (%s)", s.Manifest.StopTime.Format(time.RFC3339), s.Manifest.StopReason)
+			}
+		}
+		var size int64
+		for _, f := range s.Files {
+			size += f.SizeBytes
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\n", s.Session, captureID, started, stopped, len(s.PcapFiles()), size)
+	}
+	return w.Flush()
+}
+
+// startViewer runs command with a pipe as its stdin
+func startViewer(ctx context.Context, command []string) (io.WriteCloser, func() error, error) {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	return stdin, cmd.Wait, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// groupStartFlags adds a capture with the group's ID to every member pod.
+// The captures share a window starting a little after the command runs, so
+// every node agent has seen its request before the window opens.
+func groupStartFlags(fs *flag.FlagSet) commandFunc {
+	var (
+		duration   time.Duration
+		delay      time.Duration
+		fileCount  int
+		fileSizeMB int
+		filter     string
+		snaplen    int
+		iface      string
+		retention  time.Duration
+	)
+	fs.DurationVar(&duration, "duration", 0, "Length of the capture window (required)")
+	fs.DurationVar(&delay, "delay", 10*time.Second, "Time until the capture window opens")
+	fs.IntVar(&fileCount, "file-count", 0, "Number of rotated pcap files kept per pod")
+	fs.IntVar(&fileSizeMB, "file-size-mb", 0, "File size in MB before rotating")
+	fs.StringVar(&filter, "filter", "", "BPF filter expression applied on every pod")
+	fs.IntVar(&snaplen, "snaplen", 0, "Bytes captured per packet")
+	fs.StringVar(&iface, "interface", "", "Interface inside the pod network namespaces")
+	fs.DurationVar(&retention, "retention", 0, "How long files are kept after the window closes")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("expected a group and at least one pod, got %d arguments: %w", len(args), errUsage)
+		}
+		if duration <= 0 {
+			return fmt.Errorf("--duration is required: %w", errUsage)
+		}
+		if delay < 0 {
+			return fmt.Errorf("--delay must not be negative: %w", errUsage)
+		}
+		group := args[0]
+		start := time.Now().Add(delay).UTC().Truncate(time.Second)
+		// The same window is requested from every node agent, so their
+		// captures start and stop together however late each one syncs
+		entry := map[string]any{
+			"id":       group,
+			"group":    group,
+			"startAt":  start.Format(time.RFC3339),
+			"duration": duration.String(),
+		}
+		if fileCount != 0 {
+			entry["fileCount"] = fileCount
+		}
+		if fileSizeMB != 0 {
+			entry["fileSizeMB"] = fileSizeMB
+		}
+		if filter != "" {
+			entry["filter"] = filter
+		}
+		if snaplen != 0 {
+			entry["snaplen"] = snaplen
+		}
+		if iface != "" {
+			entry["interface"] = iface
+		}
+		if retention != 0 {
+			entry["retention"] = retention.String()
+		}
+
+		// Every member is checked before any pod is changed
+		type member struct{ namespace, name, value string }
+		var members []member
+		for _, arg := range args[1:] {
+			namespace, name, err := p.podArg([]string{arg})
+			if err != nil {
+				return err
+			}
+			pod, err := p.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			current, requested := pod.Annotations[p.annotationKey]
+			if requested && !capture.IsCaptureList(current) {
+				return fmt.Errorf("pod %s/%s already has a capture without an ID; stop it before adding the pod to a group", namespace, name)
+			}
+			value, err := capture.UpdateCaptureList(current, group, entry)
+			if err != nil {
+				return err
+			}
+			if _, err := capture.ParseSessionSpecs(value, capture.CaptureSpec{}); err != nil {
+				return err
+			}
+			members = append(members, member{namespace: namespace, name: name, value: value})
+		}
+
+		names := make([]string, 0, len(members))
+		for _, m := range members {
+			if err := p.patchAnnotation(ctx, m.namespace, m.name, &m.value); err != nil {
+				return fmt.Errorf("failed to add pod %s/%s to group %s, remove the pods added so far with group-stop: %w", m.namespace, m.name, group, err)
+			}
+			names = append(names, m.namespace+"/"+m.name)
+		}
+		fmt.Fprintf(p.stdout, "Requested capture group %s of pods %s from %s to %s\n", group, strings.Join(names, ", "), start.Format(time.RFC3339), start.Add(duration).Format(time.RFC3339))
+		return nil
+	}
+}
+
+// groupStopFlags removes the capture of a group from every pod that has it
+func groupStopFlags(fs *flag.FlagSet) commandFunc {
+	var allNamespaces bool
+	fs.BoolVar(&allNamespaces, "all-namespaces", false, "Stop the group's captures in every namespace")
+	fs.BoolVar(&allNamespaces, "A", false, "Shorthand for --all-namespaces")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected exactly one group, got %d arguments: %w", len(args), errUsage)
+		}
+		group := args[0]
+		namespace := p.namespace
+		if allNamespaces {
+			namespace = metav1.NamespaceAll
+		}
+		pods, err := p.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return err
+		}
+
+		stopped := 0
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if !p.inGroup(pod, group) {
+				continue
+			}
+			remaining, err := capture.UpdateCaptureList(pod.Annotations[p.annotationKey], group, nil)
+			if err != nil {
+				return err
+			}
+			var value *string
+			if remaining != "[]" {
+				value = &remaining
+			}
+			if err := p.patchAnnotation(ctx, pod.Namespace, pod.Name, value); err != nil {
+				return err
+			}
+			fmt.Fprintf(p.stdout, "Stopped capture group %s of pod %s/%s\n", group, pod.Namespace, pod.Name)
+			stopped++
+		}
+		if stopped == 0 {
+			return fmt.Errorf("no pod has a capture of group %s; pass -A to look in every namespace", group)
+		}
+		return nil
+	}
+}
+
+// inGroup reports whether pod requests the capture of group
+func (p *plugin) inGroup(pod *corev1.Pod, group string) bool {
+	value := pod.Annotations[p.annotationKey]
+	if !capture.IsCaptureList(value) {
+		return false
+	}
+	specs, err := capture.ParseSessionSpecs(value, capture.CaptureSpec{})
+	if err != nil {
+		return false
+	}
+	for _, s := range specs {
+		if s.ID == group && s.Group == group {
+			return true
+		}
+	}
+	return false
+}
+
+// groupGetFlags merges the sessions of every member of a group into one
+// pcapng file with an interface per pod
+func groupGetFlags(fs *flag.FlagSet) commandFunc {
+	var output string
+	fs.StringVar(&output, "o", "", "File the merged capture is written to, - for stdout; defaults to <group>.pcapng")
+
+	return func(ctx context.Context, p *plugin, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("expected exactly one group, got %d arguments: %w", len(args), errUsage)
+		}
+		group := args[0]
+		members, err := p.groupMembers(ctx, group)
+		if err != nil {
+			return err
+		}
+
+		if output == "-" {
+			return p.agents.MergeSessions(ctx, p.stdout, members)
+		}
+		if output == "" {
+			output = group + ".pcapng"
+		}
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		if err := p.agents.MergeSessions(ctx, f, members); err != nil {
+			f.Close()
+			os.Remove(output)
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(p.stdout, "Wrote capture group %s of %d pods to %s\n", group, len(members), output)
+		return nil
+	}
+}
+
+// groupMembers asks every node agent for its sessions and returns those of
+// the latest window of group. Agents that cannot be reached are reported
+// and skipped.
+func (p *plugin) groupMembers(ctx context.Context, group string) ([]agent.NodeSession, error) {
+	agents, err := p.agents.Agents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(agents) == 0 {
+		return nil, fmt.Errorf("no running node agents with labels %s in namespace %s", p.agents.Selector, p.agents.Namespace)
+	}
+
+	var sessions []agent.NodeSession
+	for _, agentPod := range agents {
+		stored, err := p.agents.Sessions(ctx, agentPod.Name, "", "")
+		if err != nil {
+			fmt.Fprintf(p.stderr, "Warning: skipping node %s: %v\n", agentPod.Spec.NodeName, err)
+			continue
+		}
+		for _, s := range stored {
+			sessions = append(sessions, agent.NodeSession{Node: agentPod.Spec.NodeName, Agent: agentPod.Name, SessionInfo: s})
+		}
+	}
+	members := agent.GroupSessions(sessions, group)
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no stored capture session with pcap files belongs to group %s", group)
+	}
+	for _, m := range members {
+		fmt.Fprintf(p.stderr, "Using session %s of pod %s/%s on node %s\n", m.Session, m.Namespace, m.Pod, m.Node)
+	}
+	return members, nil
+}
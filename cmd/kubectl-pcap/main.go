@@ -0,0 +1,229 @@
+// kubectl-pcap manages packet captures of the node agents from kubectl:
+// it sets the capture annotation on pods and downloads their pcap files
+// through the API server's pod proxy.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const usage = `kubectl pcap manages packet captures of pods.
+
+Usage:
+  kubectl pcap start   [flags] POD   request a capture, or add one with --id
+  kubectl pcap stop    [flags] POD   stop the capture, or only the one with --id
+  kubectl pcap list    [flags]       list pods with captures
+  kubectl pcap status  [flags] POD   show the capture state and stored sessions
+  kubectl pcap trigger [flags] POD   write the buffer of the pod's armed captures
+  kubectl pcap get     [flags] POD   download a session as one merged pcap file
+  kubectl pcap open    [flags] POD   open a session in Wireshark
+  kubectl pcap live    [flags] POD   stream a running session as pcap to stdout
+
+  kubectl pcap group-start [flags] GROUP POD...   capture pods over one window
+  kubectl pcap group-stop  [flags] GROUP          stop the captures of a group
+  kubectl pcap group-get   [flags] GROUP          download a group as one pcapng file
+
+POD is a pod name or <namespace>/<name>. Run "kubectl pcap <command> -h" for
+the flags of a command.
+`
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr, newKubeClient))
+}
+
+// errUsage reports a command line error after the usage was printed
+var errUsage = errors.New("invalid usage")
+
+// clientFactory returns a clientset and the default namespace for options
+type clientFactory func(o *globalOptions) (kubernetes.Interface, string, error)
+
+// globalOptions are the flags every command accepts
+type globalOptions struct {
+	kubeconfig     string
+	context        string
+	namespace      string
+	annotationKey  string
+	agentNamespace string
+	agentPort      string
+	agentToken     string
+}
+
+func (o *globalOptions) addFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file")
+	fs.StringVar(&o.context, "context", "", "Kubeconfig context to use")
+	fs.StringVar(&o.namespace, "namespace", "", "Namespace of the pod; defaults to the kubeconfig namespace")
+	fs.StringVar(&o.namespace, "n", "", "Shorthand for --namespace")
+	fs.StringVar(&o.annotationKey, "annotation-key", config.DefaultAnnotationKey, "Capture annotation key configured in the node agents")
+	fs.StringVar(&o.agentNamespace, "agent-namespace", agent.DefaultNamespace, "Namespace the node agent DaemonSet runs in")
+	fs.StringVar(&o.agentPort, "agent-port", agent.DefaultPort, "Port of the node agent session API")
+	fs.StringVar(&o.agentToken, "agent-token", "", "Bearer token for the node agent session API; defaults to the kubeconfig token")
+}
+
+// plugin holds what the commands share once the flags are parsed
+type plugin struct {
+	client        kubernetes.Interface
+	agents        *agent.Client
+	namespace     string
+	annotationKey string
+	stdout        io.Writer
+	stderr        io.Writer
+	// startViewer runs the program "open" streams the capture into
+	startViewer func(ctx context.Context, command []string) (io.WriteCloser, func() error, error)
+}
+
+func (p *plugin) statusKey() string {
+	return p.annotationKey + capture.StatusAnnotationSuffix
+}
+
+func (p *plugin) triggerKey() string {
+	return p.annotationKey + capture.TriggerAnnotationSuffix
+}
+
+// commandFunc runs a command with its positional arguments
+type commandFunc func(ctx context.Context, p *plugin, args []string) error
+
+// commands registers the flags of each command and returns the function
+// running it
+var commands = map[string]func(fs *flag.FlagSet) commandFunc{
+	"start":   startFlags,
+	"stop":    stopFlags,
+	"list":    listFlags,
+	"status":  statusFlags,
+	"trigger": triggerFlags,
+	"get":     getFlags,
+	"open":    openFlags,
+	"live":    liveFlags,
+
+	"group-start": groupStartFlags,
+	"group-stop":  groupStopFlags,
+	"group-get":   groupGetFlags,
+}
+
+// run executes the command in args and returns the exit code: 0 on success,
+// 1 when the command failed and 2 for usage errors
+func run(ctx context.Context, args []string, stdout, stderr io.Writer, newClient clientFactory) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, usage)
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+	addFlags, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("kubectl pcap "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	global := &globalOptions{}
+	global.addFlags(fs)
+	runCommand := addFlags(fs)
+
+	positional, err := parseInterspersed(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+
+	client, namespace, err := newClient(global)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	if global.namespace != "" {
+		namespace = global.namespace
+	}
+	if global.agentToken != "" {
+		ctx = agent.WithToken(ctx, global.agentToken)
+	}
+	agents := agent.NewClient(client)
+	agents.Namespace = global.agentNamespace
+	agents.Port = global.agentPort
+
+	p := &plugin{
+		client:        client,
+		agents:        agents,
+		namespace:     namespace,
+		annotationKey: global.annotationKey,
+		stdout:        stdout,
+		stderr:        stderr,
+		startViewer:   startViewer,
+	}
+	if err := runCommand(ctx, p, positional); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		if errors.Is(err, errUsage) {
+			fs.Usage()
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags that follow positional arguments too, as
+// kubectl does, e.g. "start web-0 --filter 'port 80'"
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// podArg splits a POD argument into namespace and name
+func (p *plugin) podArg(args []string) (string, string, error) {
+	if len(args) != 1 {
+		return "", "", fmt.Errorf("expected exactly one pod, got %d arguments: %w", len(args), errUsage)
+	}
+	if namespace, name, ok := strings.Cut(args[0], "/"); ok {
+		return namespace, name, nil
+	}
+	return p.namespace, args[0], nil
+}
+
+func newKubeClient(o *globalOptions) (kubernetes.Interface, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: o.context})
+
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read the namespace from kubeconfig: %w", err)
+	}
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	restConfig.Wrap(agent.ForwardToken)
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+	return client, namespace, nil
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/pcap"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testSession = "pod_20261018T101530Z-3f9a1c2b"
+
+// handlerResponse answers a pod proxy request of the fake clientset with handler
+type handlerResponse struct {
+	handler http.Handler
+	target  string
+}
+
+func (r handlerResponse) DoRaw(ctx context.Context) ([]byte, error) {
+	stream, err := r.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func (r handlerResponse) Stream(context.Context) (io.ReadCloser, error) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, r.target, nil)
+	req.Header.Set(agent.TokenHeader, "user-token")
+	r.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	return io.NopCloser(rec.Body), nil
+}
+
+// acceptAgentToken lets the node agent accept user-token, the token
+// ForwardToken would add to pod proxy requests, as a user allowed to capture
+// every pod
+func acceptAgentToken(clientset *fake.Clientset) {
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == "user-token" {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "user"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "user"
+		return true, review, nil
+	})
+}
+
+// newTestCluster returns a fake cluster with pod shop/web-0 on node-1, whose
+// node agent serves the sessions stored in the returned capture directory
+func newTestCluster(t *testing.T, annotations map[string]string) (*fake.Clientset, string) {
+	t.Helper()
+	captureDir := t.TempDir()
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "shop", Annotations: annotations},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent-1", Namespace: agent.DefaultNamespace, Labels: map[string]string{"app": "packet-capture-controller"}},
+			Spec:       corev1.PodSpec{NodeName: "node-1"},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		},
+	)
+	acceptAgentToken(clientset)
+	handler := agent.NewHandler(captureDir, clientset)
+	clientset.AddProxyReactor("pods", func(action k8stesting.Action) (bool, restclient.ResponseWrapper, error) {
+		proxy := action.(k8stesting.ProxyGetAction)
+		if proxy.GetName() != "agent-1" || proxy.GetPort() != agent.DefaultPort {
+			return true, nil, fmt.Errorf("unexpected proxy target %s:%s", proxy.GetName(), proxy.GetPort())
+		}
+		query := url.Values{}
+		for k, v := range proxy.GetParams() {
+			query.Set(k, v)
+		}
+		return true, handlerResponse{handler: handler, target: proxy.GetPath() + "?" + query.Encode()}, nil
+	})
+	return clientset, captureDir
+}
+
+func runPlugin(t *testing.T, clientset kubernetes.Interface, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	newClient := func(*globalOptions) (kubernetes.Interface, string, error) { return clientset, "shop", nil }
+	code := run(context.Background(), args, &stdout, &stderr, newClient)
+	return code, stdout.String(), stderr.String()
+}
+
+func captureAnnotation(t *testing.T, clientset kubernetes.Interface) (string, bool) {
+	t.Helper()
+	pod, err := clientset.CoreV1().Pods("shop").Get(context.Background(), "web-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	value, ok := pod.Annotations[config.DefaultAnnotationKey]
+	return value, ok
+}
+
+// writePcapSession stores a session of shop/web-0 whose two files hold
+// interleaved packets
+func writePcapSession(t *testing.T, captureDir string) time.Time {
+	t.Helper()
+	dir := filepath.Join(captureDir, "shop", "web-0", testSession)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session dir: %v", err)
+	}
+	start := time.Date(2026, 10, 18, 10, 15, 30, 0, time.UTC)
+	for i, offsets := range [][]time.Duration{{0, 2 * time.Second}, {time.Second, 3 * time.Second}} {
+		var buf bytes.Buffer
+		w, err := pcap.NewWriter(&buf, pcap.Header{SnapLen: 262144, LinkType: 1})
+		if err != nil {
+			t.Fatalf("NewWriter() returned error: %v", err)
+		}
+		for _, offset := range offsets {
+			if err := w.WritePacket(&pcap.Packet{Timestamp: start.Add(offset), Data: []byte{0xde, 0xad}}); err != nil {
+				t.Fatalf("WritePacket() returned error: %v", err)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("capture.pcap%d", i)), buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Failed to write pcap file: %v", err)
+		}
+	}
+	manifest, err := json.Marshal(capture.Manifest{SessionID: "20261018T101530Z-3f9a1c2b", CaptureID: "shop/web-0", StartTime: start})
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, capture.ManifestFileName), manifest, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	return start
+}
+
+func TestStartAndStopEditTheCaptureAnnotation(t *testing.T) {
+	clientset, _ := newTestCluster(t, nil)
+
+	steps := []struct {
+		args      []string
+		wantCode  int
+		wantValue string
+	}{
+		{args: []string{"start", "web-0", "--id", "dns", "--filter", "udp port 53"}, wantValue: `[{"filter":"udp port 53","id":"dns"}]`},
+		{args: []string{"start", "shop/web-0", "--id", "burst", "--duration", "1m0s"}, wantValue: `[{"filter":"udp port 53","id":"dns"},{"duration":"1m0s","id":"burst"}]`},
+		{args: []string{"start", "web-0", "--file-count", "5"}, wantCode: 1, wantValue: `[{"filter":"udp port 53","id":"dns"},{"duration":"1m0s","id":"burst"}]`},
+		{args: []string{"start", "web-0", "--id", "Bad_ID"}, wantCode: 1, wantValue: `[{"filter":"udp port 53","id":"dns"},{"duration":"1m0s","id":"burst"}]`},
+		{args: []string{"stop", "web-0", "--id", "dns"}, wantValue: `[{"duration":"1m0s","id":"burst"}]`},
+		{args: []string{"stop", "web-0", "--id", "burst"}},
+		{args: []string{"start", "-n", "shop", "web-0", "--file-count", "5"}, wantValue: `{"fileCount":5}`},
+		{args: []string{"stop", "web-0"}},
+		{args: []string{"stop", "web-0", "extra"}, wantCode: 2},
+		{args: []string{"start", "web-0", "--buffer-size-mb", "32"}, wantCode: 1},
+		{args: []string{"start", "web-0", "--armed", "--buffer-duration", "30s", "--post-trigger", "10s"}, wantValue: `{"bufferDuration":"30s","mode":"armed","postTrigger":"10s"}`},
+		{args: []string{"start", "web-0", "--schedule", "0 2 * * *"}, wantCode: 1, wantValue: `{"bufferDuration":"30s","mode":"armed","postTrigger":"10s"}`},
+		{args: []string{"start", "web-0", "--schedule", "0 2 * * *", "--duration", "10m", "--keep-runs", "3"}, wantValue: `{"duration":"10m0s","keepRuns":3,"schedule":"0 2 * * *"}`},
+		{args: []string{"start", "web-0", "--live", "--duration", "5m"}, wantValue: `{"duration":"5m0s","live":true}`},
+	}
+	for _, step := range steps {
+		code, _, stderr := runPlugin(t, clientset, step.args...)
+		if code != step.wantCode {
+			t.Fatalf("%v: exit code %d, want %d (stderr: %s)", step.args, code, step.wantCode, stderr)
+		}
+		value, ok := captureAnnotation(t, clientset)
+		if step.wantValue == "" && ok {
+			t.Errorf("%v: annotation %q should have been removed", step.args, value)
+		}
+		if step.wantValue != "" && value != step.wantValue {
+			t.Errorf("%v: annotation = %q, want %q", step.args, value, step.wantValue)
+		}
+	}
+}
+
+func TestTriggerSetsTheTriggerAnnotation(t *testing.T) {
+	clientset, _ := newTestCluster(t, map[string]string{config.DefaultAnnotationKey: `{"mode":"armed"}`})
+	triggerKey := config.DefaultAnnotationKey + capture.TriggerAnnotationSuffix
+
+	if code, _, stderr := runPlugin(t, clientset, "trigger", "web-0"); code != 1 || !strings.Contains(stderr, "no armed capture") {
+		t.Errorf("trigger before the node agent reported an armed capture: exit code %d, stderr %q", code, stderr)
+	}
+
+	status := &capture.Status{Node: "node-1", State: capture.StateCapturing, Sessions: []capture.SessionStatus{{CaptureID: "shop/web-0", State: capture.StateArmed}}}
+	pod, err := clientset.CoreV1().Pods("shop").Get(context.Background(), "web-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	pod.Annotations[config.DefaultAnnotationKey+capture.StatusAnnotationSuffix] = status.String()
+	if _, err := clientset.CoreV1().Pods("shop").Update(context.Background(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update pod: %v", err)
+	}
+
+	var values []string
+	for i := 0; i < 2; i++ {
+		code, stdout, stderr := runPlugin(t, clientset, "trigger", "web-0", "--reason", "checkout errors")
+		if code != 0 || !strings.Contains(stdout, "Triggered armed captures shop/web-0") {
+			t.Fatalf("trigger: exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+		}
+		pod, err := clientset.CoreV1().Pods("shop").Get(context.Background(), "web-0", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get pod: %v", err)
+		}
+		values = append(values, pod.Annotations[triggerKey])
+		if pod.Annotations[config.DefaultAnnotationKey] != `{"mode":"armed"}` {
+			t.Errorf("trigger changed the capture annotation to %q", pod.Annotations[config.DefaultAnnotationKey])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !strings.HasSuffix(values[0], " checkout errors") || values[0] == values[1] {
+		t.Errorf("trigger annotation values %q should end with the reason and differ on every trigger", values)
+	}
+}
+
+func TestGetMergesSessionFiles(t *testing.T) {
+	clientset, captureDir := newTestCluster(t, nil)
+	start := writePcapSession(t, captureDir)
+	output := filepath.Join(t.TempDir(), "web-0.pcap")
+
+	code, stdout, stderr := runPlugin(t, clientset, "get", "web-0", "-o", output)
+	if code != 0 {
+		t.Fatalf("get exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, testSession) {
+		t.Errorf("stdout %q should name the session", stdout)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatalf("Failed to open merged capture: %v", err)
+	}
+	defer f.Close()
+	r, err := pcap.NewReader(f)
+	if err != nil {
+		t.Fatalf("NewReader() returned error: %v", err)
+	}
+	for i := 0; ; i++ {
+		p, err := r.Next()
+		if err == io.EOF {
+			if i != 4 {
+				t.Errorf("merged capture has %d packets, want 4", i)
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() returned error: %v", err)
+		}
+		if want := start.Add(time.Duration(i) * time.Second); !p.Timestamp.Equal(want) {
+			t.Errorf("packet %d at %v, want %v", i, p.Timestamp, want)
+		}
+	}
+
+	if code, _, _ := runPlugin(t, clientset, "get", "web-0", "--id", "dns"); code != 1 {
+		t.Errorf("get of an unknown capture ID exited with %d, want 1", code)
+	}
+}
+
+func TestGetBundleAndStatus(t *testing.T) {
+	status := &capture.Status{Node: "node-1", State: capture.StateCapturing, Sessions: []capture.SessionStatus{{CaptureID: "shop/web-0", State: capture.StateCapturing}}}
+	clientset, captureDir := newTestCluster(t, map[string]string{
+		"tcpdump.antrea.io":        "5",
+		"tcpdump.antrea.io/status": status.String(),
+	})
+	writePcapSession(t, captureDir)
+
+	bundle := t.TempDir()
+	if code, _, stderr := runPlugin(t, clientset, "get", "web-0", "--bundle", bundle); code != 0 {
+		t.Fatalf("get --bundle exited with %d: %s", code, stderr)
+	}
+	for _, name := range []string{capture.ManifestFileName, "capture.pcap0", "capture.pcap1"} {
+		if _, err := os.Stat(filepath.Join(bundle, testSession, name)); err != nil {
+			t.Errorf("bundle is missing %s: %v", name, err)
+		}
+	}
+
+	code, stdout, stderr := runPlugin(t, clientset, "status", "web-0")
+	if code != 0 {
+		t.Fatalf("status exited with %d: %s", code, stderr)
+	}
+	for _, want := range []string{"Capturing", "shop/web-0", testSession} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("status output should contain %q:\n%s", want, stdout)
+		}
+	}
+
+	code, stdout, _ = runPlugin(t, clientset, "list")
+	if code != 0 || !strings.Contains(stdout, "web-0") || strings.Contains(stdout, "agent-1") {
+		t.Errorf("list exited with %d and printed:\n%s", code, stdout)
+	}
+}
+
+func TestGroupStartAndStop(t *testing.T) {
+	clientset, _ := newTestCluster(t, map[string]string{config.DefaultAnnotationKey: `[{"id":"dns","filter":"udp port 53"}]`})
+	api := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api-0", Namespace: "shop"}, Spec: corev1.PodSpec{NodeName: "node-2"}}
+	if _, err := clientset.CoreV1().Pods("shop").Create(context.Background(), api, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create pod: %v", err)
+	}
+
+	if code, _, _ := runPlugin(t, clientset, "group-start", "checkout", "web-0", "api-0"); code != 2 {
+		t.Errorf("group-start without a duration exited with %d, want 2", code)
+	}
+	code, stdout, stderr := runPlugin(t, clientset, "group-start", "checkout", "web-0", "shop/api-0", "--duration", "5m", "--filter", "tcp port 8080")
+	if code != 0 || !strings.Contains(stdout, "shop/web-0, shop/api-0") {
+		t.Fatalf("group-start: exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+
+	var windows []string
+	for _, name := range []string{"web-0", "api-0"} {
+		pod, err := clientset.CoreV1().Pods("shop").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Failed to get pod: %v", err)
+		}
+		specs, err := capture.ParseSessionSpecs(pod.Annotations[config.DefaultAnnotationKey], capture.CaptureSpec{})
+		if err != nil {
+			t.Fatalf("%s: ParseSessionSpecs() returned error: %v", name, err)
+		}
+		last := specs[len(specs)-1]
+		if last.ID != "checkout" || last.Group != "checkout" || last.Filter != "tcp port 8080" || last.Duration.Duration != 5*time.Minute {
+			t.Errorf("%s: group capture = %+v", name, last)
+		}
+		start, _ := last.Window()
+		if until := time.Until(start); until <= 0 || until > 10*time.Second {
+			t.Errorf("%s: window starts in %s, want within the default delay", name, until)
+		}
+		windows = append(windows, last.StartAt)
+	}
+	if windows[0] != windows[1] {
+		t.Errorf("members have different windows: %v", windows)
+	}
+
+	code, stdout, stderr = runPlugin(t, clientset, "group-stop", "checkout")
+	if code != 0 || strings.Count(stdout, "Stopped capture group checkout") != 2 {
+		t.Fatalf("group-stop: exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if value, _ := captureAnnotation(t, clientset); value != `[{"filter":"udp port 53","id":"dns"}]` {
+		t.Errorf("group-stop left annotation %q, want the pod's other capture", value)
+	}
+	if code, _, _ := runPlugin(t, clientset, "group-stop", "checkout"); code != 1 {
+		t.Errorf("group-stop of a stopped group exited with %d, want 1", code)
+	}
+
+	if code, _, _ := runPlugin(t, clientset, "start", "api-0", "--file-count", "5"); code != 0 {
+		t.Fatal("start failed")
+	}
+	if code, _, stderr := runPlugin(t, clientset, "group-start", "checkout", "web-0", "api-0", "--duration", "5m"); code != 1 || !strings.Contains(stderr, "without an ID") {
+		t.Errorf("group-start of a pod with a single capture: exit code %d, stderr %q", code, stderr)
+	}
+	if value, _ := captureAnnotation(t, clientset); value != `[{"filter":"udp port 53","id":"dns"}]` {
+		t.Errorf("refused group-start changed annotation to %q", value)
+	}
+}
+
+// writeGroupSession stores a session of pod in capture group checkout with
+// the window starting at startAt and one packet at every offset from it
+func writeGroupSession(t *testing.T, captureDir, pod string, startAt time.Time, offsets ...time.Duration) {
+	t.Helper()
+	sessionID := startAt.Format("20060102T150405Z") + "-" + pod[:4]
+	dir := filepath.Join(captureDir, "shop", pod, "checkout_"+sessionID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session dir: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf, pcap.Header{SnapLen: 262144, LinkType: 1})
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %v", err)
+	}
+	for _, offset := range offsets {
+		if err := w.WritePacket(&pcap.Packet{Timestamp: startAt.Add(offset), Data: []byte(pod)}); err != nil {
+			t.Fatalf("WritePacket() returned error: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "capture.pcap0"), buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write pcap file: %v", err)
+	}
+	manifest, err := json.Marshal(capture.Manifest{
+		SessionID: sessionID,
+		CaptureID: "shop/" + pod + "/checkout",
+		StartTime: startAt,
+		Spec:      capture.CaptureSpec{Group: "checkout", StartAt: startAt.Format(time.RFC3339), Duration: metav1.Duration{Duration: time.Minute}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, capture.ManifestFileName), manifest, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+}
+
+func TestGroupGetMergesMembersWithAnInterfaceEach(t *testing.T) {
+	clientset, captureDir := newTestCluster(t, nil)
+	earlier := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	writeGroupSession(t, captureDir, "web-0", earlier, 0)
+	writeGroupSession(t, captureDir, "web-0", start, 0, 2*time.Second)
+	writeGroupSession(t, captureDir, "api-0", start, time.Second)
+	output := filepath.Join(t.TempDir(), "checkout.pcapng")
+
+	code, stdout, stderr := runPlugin(t, clientset, "group-get", "checkout", "-o", output)
+	if code != 0 || !strings.Contains(stdout, "of 2 pods") {
+		t.Fatalf("group-get: exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if strings.Contains(stderr, "T090000Z") {
+		t.Errorf("group-get used a session of an earlier window: %s", stderr)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read merged capture: %v", err)
+	}
+	// Section header, an interface per pod in pod order, then the packets
+	// in time order
+	var blocks []uint32
+	var packetInterfaces []uint32
+	var interfaceNames []string
+	for len(data) >= 12 {
+		blockType, length := binary.LittleEndian.Uint32(data), binary.LittleEndian.Uint32(data[4:])
+		body := data[8 : length-4]
+		switch blockType {
+		case 1:
+			// if_name is the first option
+			nameLen := binary.LittleEndian.Uint16(body[10:])
+			interfaceNames = append(interfaceNames, string(body[12:12+nameLen]))
+		case 6:
+			packetInterfaces = append(packetInterfaces, binary.LittleEndian.Uint32(body))
+		}
+		blocks = append(blocks, blockType)
+		data = data[length:]
+	}
+	if fmt.Sprint(blocks) != fmt.Sprint([]uint32{0x0a0d0d0a, 1, 1, 6, 6, 6}) {
+		t.Fatalf("blocks = %#x", blocks)
+	}
+	if fmt.Sprint(interfaceNames) != "[shop/api-0 shop/web-0]" || fmt.Sprint(packetInterfaces) != "[1 0 1]" {
+		t.Errorf("interfaces %v and packet interfaces %v, want one interface per pod and packets in time order", interfaceNames, packetInterfaces)
+	}
+
+	if code, _, _ := runPlugin(t, clientset, "group-get", "payments"); code != 1 {
+		t.Errorf("group-get of an unknown group exited with %d, want 1", code)
+	}
+}
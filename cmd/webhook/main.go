@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/webhook"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// options are the flags of the webhook besides those of the shared configuration
+type options struct {
+	configFile string
+	address    string
+	certFile   string
+	keyFile    string
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// run starts the webhook with the policy of the node agents, read from the
+// same config file and flags, and serves it until SIGINT or SIGTERM.
+func run(args []string, stderr io.Writer) int {
+	o, fs, err := parseFlags(args, stderr)
+	if err != nil {
+		return 2
+	}
+	cfg, err := config.Load(o.configFile, fs)
+	if err != nil {
+		klog.Errorf("Invalid configuration: %v", err)
+		return 1
+	}
+	klog.Infof("Starting capture annotation webhook with policy: %+v", cfg.Policy)
+
+	kubeConfig, err := getKubeConfig()
+	if err != nil {
+		klog.Errorf("Failed to get Kubernetes config: %v", err)
+		return 1
+	}
+	clientset, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		klog.Errorf("Failed to create Kubernetes client: %v", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	informerFactory := informers.NewSharedInformerFactory(clientset, cfg.ResyncPeriod.Duration)
+	namespaces := informerFactory.Core().V1().Namespaces()
+	validator := webhook.NewValidator(cfg.AnnotationKey, cfg.Policy, capture.ConfigDefaults(cfg), namespaces.Lister())
+
+	reloader := config.NewReloader(o.configFile, fs, cfg)
+	reloader.OnReload(func(c *config.Config) {
+		validator.SetPolicy(c.Policy)
+		validator.SetDefaults(capture.ConfigDefaults(c))
+	})
+	go reloader.Run(config.DefaultReloadInterval, ctx.Done())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				klog.Info("Received SIGHUP, reloading configuration")
+				_ = reloader.Reload()
+				continue
+			}
+			klog.Infof("Received signal %v, initiating graceful shutdown...", sig)
+			cancel()
+			return
+		}
+	}()
+
+	informerFactory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), namespaces.Informer().HasSynced) {
+		klog.Error("Failed to sync the namespace cache")
+		return 1
+	}
+
+	listener, err := net.Listen("tcp", o.address)
+	if err != nil {
+		klog.Errorf("Failed to listen on %s: %v", o.address, err)
+		return 1
+	}
+	klog.Infof("Listening on %s", listener.Addr())
+	if err := serve(ctx, listener, newHandler(validator), o.certFile, o.keyFile); err != nil {
+		klog.Errorf("Error running webhook server: %v", err)
+		return 1
+	}
+	klog.Info("Capture annotation webhook stopped")
+	return 0
+}
+
+// parseFlags parses args into the webhook options and a flag set that
+// overrides the config file when passed to config.Load
+func parseFlags(args []string, stderr io.Writer) (*options, *flag.FlagSet, error) {
+	fs := flag.NewFlagSet("packet-capture-webhook", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	klog.InitFlags(fs)
+
+	o := &options{}
+	fs.StringVar(&o.configFile, "config", "", "Path to the node agent config file whose policy the webhook enforces; flags override its values")
+	fs.StringVar(&o.address, "listen-address", ":8443", "Address the webhook server listens on")
+	fs.StringVar(&o.certFile, "tls-cert-file", "/etc/webhook/certs/tls.crt", "Path to the TLS certificate")
+	fs.StringVar(&o.keyFile, "tls-key-file", "/etc/webhook/certs/tls.key", "Path to the TLS private key")
+	config.Default().AddFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return nil, nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	return o, fs, nil
+}
+
+// newHandler serves the validating webhook on /validate and a health check on /healthz
+func newHandler(validator http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/validate", validator)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// serve serves handler over TLS on listener until ctx is done, then shuts
+// the server down gracefully
+func serve(ctx context.Context, listener net.Listener, handler http.Handler, certFile, keyFile string) error {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			klog.Errorf("Failed to shut down webhook server: %v", err)
+		}
+	}()
+
+	if err := server.ServeTLS(listener, certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func getKubeConfig() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	klog.Infof("In-cluster config not available, using kubeconfig: %v", err)
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
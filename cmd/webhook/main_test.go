@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/webhook"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestFlagsOverrideTheSharedConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(configFile, []byte(`annotationKey: example.com/capture
+policy:
+  requireOptIn: true
+  optInKey: example.com/allow-capture
+  deniedNamespaces: [kube-system]
+  hostNetwork: Scope
+  limits:
+    maxFileCount: 20
+`), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	o, fs, err := parseFlags([]string{
+		"--config=" + configFile,
+		"--listen-address=127.0.0.1:9443",
+		"--tls-cert-file=/certs/tls.crt",
+		"--tls-key-file=/certs/tls.key",
+		"--denied-namespaces=kube-system,secrets",
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseFlags() error = %v", err)
+	}
+	want := &options{configFile: configFile, address: "127.0.0.1:9443", certFile: "/certs/tls.crt", keyFile: "/certs/tls.key"}
+	if !reflect.DeepEqual(o, want) {
+		t.Errorf("options = %+v, want %+v", o, want)
+	}
+
+	cfg, err := config.Load(o.configFile, fs)
+	if err != nil {
+		t.Fatalf("config.Load() error = %v", err)
+	}
+	if cfg.AnnotationKey != "example.com/capture" {
+		t.Errorf("AnnotationKey = %q, want the one from the config file", cfg.AnnotationKey)
+	}
+	wantPolicy := policy.Policy{
+		RequireOptIn:     true,
+		OptInKey:         "example.com/allow-capture",
+		DeniedNamespaces: []string{"kube-system", "secrets"},
+		HostNetwork:      policy.HostNetworkScope,
+		Limits:           policy.Limits{MaxFileCount: 20},
+	}
+	if !reflect.DeepEqual(cfg.Policy, wantPolicy) {
+		t.Errorf("Policy = %+v, want %+v", cfg.Policy, wantPolicy)
+	}
+}
+
+func TestParseFlagsRejectsArguments(t *testing.T) {
+	if _, _, err := parseFlags([]string{"serve"}, io.Discard); err == nil {
+		t.Error("parseFlags() should reject positional arguments")
+	}
+	if _, _, err := parseFlags([]string{"--max-file-count=5"}, io.Discard); err == nil {
+		t.Error("parseFlags() should reject flags that are not part of the config")
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, pool := writeCertificate(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	validator := webhook.NewValidator(capture.CaptureAnnotation, policy.Default(), capture.ConfigDefaults(config.Default()), corelisters.NewNamespaceLister(indexer))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, listener, newHandler(validator), certFile, keyFile) }()
+
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		Timeout:   5 * time.Second,
+	}
+	url := "https://" + listener.Addr().String()
+
+	resp, err := client.Get(url + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /healthz status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	pod, _ := json.Marshal(&corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "shop", Annotations: map[string]string{capture.CaptureAnnotation: "5"}},
+	})
+	body, _ := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uid-1",
+			Operation: admissionv1.Create,
+			Namespace: "shop",
+			Name:      "web-0",
+			Object:    runtime.RawExtension{Raw: pod},
+		},
+	})
+	resp, err = client.Post(url+"/validate", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST /validate error = %v", err)
+	}
+	review := &admissionv1.AdmissionReview{}
+	err = json.NewDecoder(resp.Body).Decode(review)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode AdmissionReview: %v", err)
+	}
+	if review.Response == nil || review.Response.Allowed {
+		t.Errorf("Capture in a namespace without opt-in should be denied, got %+v", review.Response)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("serve() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("serve() did not return after the context was cancelled")
+	}
+}
+
+func TestServeFailsWithoutCertificate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	dir := t.TempDir()
+	err = serve(context.Background(), listener, http.NotFoundHandler(), filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	if err == nil {
+		t.Error("serve() should fail when the certificate is missing")
+	}
+}
+
+// writeCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key, and returns their paths and a pool trusting the certificate
+func writeCertificate(t *testing.T) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "packet-capture-webhook"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
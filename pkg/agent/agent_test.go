@@ -0,0 +1,300 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newAuthClientset returns a fake clientset whose reviews accept alice-token,
+// which may capture every pod in namespace shop, and bob-token, which may
+// only capture shop/web-0
+func newAuthClientset(objects ...runtime.Object) *fake.Clientset {
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "alice-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		case "bob-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "bob"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		switch review.Spec.User {
+		case "alice":
+			review.Status.Allowed = attrs.Namespace == "shop"
+		case "bob":
+			review.Status.Allowed = attrs.Namespace == "shop" && attrs.Name == "web-0"
+		}
+		return true, review, nil
+	})
+	return clientset
+}
+
+// handlerResponse answers a pod proxy request of the fake clientset with
+// handler, carrying alice-token like ForwardToken would
+type handlerResponse struct {
+	handler http.Handler
+	target  string
+}
+
+func (r handlerResponse) DoRaw(ctx context.Context) ([]byte, error) {
+	stream, err := r.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func (r handlerResponse) Stream(context.Context) (io.ReadCloser, error) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, r.target, nil)
+	req.Header.Set(TokenHeader, "alice-token")
+	r.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	return io.NopCloser(rec.Body), nil
+}
+
+func proxyTo(handler http.Handler) k8stesting.ProxyReactionFunc {
+	return func(action k8stesting.Action) (bool, restclient.ResponseWrapper, error) {
+		proxy := action.(k8stesting.ProxyGetAction)
+		query := url.Values{}
+		for k, v := range proxy.GetParams() {
+			query.Set(k, v)
+		}
+		return true, handlerResponse{handler: handler, target: proxy.GetPath() + "?" + query.Encode()}, nil
+	}
+}
+
+func writeTestSession(t *testing.T, root, namespace, pod, session string) {
+	t.Helper()
+	dir := filepath.Join(root, namespace, pod, session)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session dir: %v", err)
+	}
+	manifest := capture.Manifest{SessionID: session, CaptureID: namespace + "/" + pod, StartTime: time.Now().UTC()}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	files := map[string][]byte{
+		capture.ManifestFileName: data,
+		"capture.pcap0":          []byte("pcap0"),
+		"capture.pcap1":          []byte("pcap1"),
+		"tcpdump.log":            []byte("not served"),
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestHandlerServesOnlySessionFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTestSession(t, root, "shop", "web-0", "pod_20261018T101530Z-3f9a1c2b")
+	if err := os.WriteFile(filepath.Join(root, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	handler := NewHandler(root, newAuthClientset())
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+		wantBody string
+	}{
+		{name: "pcap file", target: "/api/v1/sessions/shop/web-0/pod_20261018T101530Z-3f9a1c2b/files/capture.pcap1", wantCode: http.StatusOK, wantBody: "pcap1"},
+		{name: "missing file", target: "/api/v1/sessions/shop/web-0/pod_20261018T101530Z-3f9a1c2b/files/capture.pcap7", wantCode: http.StatusNotFound},
+		{name: "file not written by a session", target: "/api/v1/sessions/shop/web-0/pod_20261018T101530Z-3f9a1c2b/files/tcpdump.log", wantCode: http.StatusBadRequest},
+		{name: "encoded traversal in session", target: "/api/v1/sessions/shop/web-0/%2e%2e/files/capture.pcap0", wantCode: http.StatusBadRequest},
+		{name: "encoded traversal in file", target: "/api/v1/sessions/shop/web-0/pod_x/files/..%2f..%2fsecret", wantCode: http.StatusBadRequest},
+		{name: "invalid namespace", target: "/api/v1/sessions/Shop/web-0/pod_x/files/capture.pcap0", wantCode: http.StatusBadRequest},
+		{name: "pod without namespace", target: "/api/v1/sessions?pod=web-0", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req.Header.Set("Authorization", "Bearer alice-token")
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantBody != "" && rec.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestClientListsSessionsOfTheNodeAgent(t *testing.T) {
+	root := t.TempDir()
+	writeTestSession(t, root, "shop", "web-0", "pod_20261018T101530Z-3f9a1c2b")
+	writeTestSession(t, root, "shop", "web-1", "pod_20261018T101530Z-0000aaaa")
+
+	agentPod := func(name, node string, phase corev1.PodPhase) runtime.Object {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: DefaultNamespace, Labels: map[string]string{"app": "packet-capture-controller"}},
+			Spec:       corev1.PodSpec{NodeName: node},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+	}
+	clientset := newAuthClientset(
+		agentPod("agent-a", "node-1", corev1.PodRunning),
+		agentPod("agent-b", "node-2", corev1.PodPending),
+	)
+	clientset.AddProxyReactor("pods", proxyTo(NewHandler(root, clientset)))
+	client := NewClient(clientset)
+	ctx := context.Background()
+
+	if _, err := client.AgentFor(ctx, "node-2"); err == nil {
+		t.Error("AgentFor() should not return an agent that is not running")
+	}
+	agent, err := client.AgentFor(ctx, "node-1")
+	if err != nil || agent != "agent-a" {
+		t.Fatalf("AgentFor(node-1) = %q, %v, want agent-a", agent, err)
+	}
+
+	sessions, err := client.Sessions(ctx, agent, "shop", "web-0")
+	if err != nil {
+		t.Fatalf("Sessions() returned error: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Manifest == nil || sessions[0].Manifest.CaptureID != "shop/web-0" {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+	if files := sessions[0].PcapFiles(); len(files) != 2 {
+		t.Errorf("PcapFiles() = %v, want two pcap files", files)
+	}
+	if len(sessions[0].Files) != 3 {
+		t.Errorf("files = %+v, want the manifest and two pcap files", sessions[0].Files)
+	}
+
+	stream, err := client.OpenFile(ctx, agent, &sessions[0], "capture.pcap0")
+	if err != nil {
+		t.Fatalf("OpenFile() returned error: %v", err)
+	}
+	defer stream.Close()
+	if data, _ := io.ReadAll(stream); string(data) != "pcap0" {
+		t.Errorf("file content = %q, want pcap0", data)
+	}
+}
+
+func TestHandlerServesOnlyPodsTheUserMayCapture(t *testing.T) {
+	root := t.TempDir()
+	writeTestSession(t, root, "shop", "web-0", "pod_20261018T101530Z-3f9a1c2b")
+	writeTestSession(t, root, "shop", "web-1", "pod_20261018T101530Z-0000aaaa")
+	writeTestSession(t, root, "bank", "ledger-0", "pod_20261018T101530Z-1111bbbb")
+	handler := NewHandler(root, newAuthClientset())
+
+	serve := func(target string, header http.Header) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header = header
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(token string) []string {
+		rec := serve(SessionsPath, http.Header{TokenHeader: {token}})
+		var sessions []SessionInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &sessions); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("listing sessions answered %d: %s", rec.Code, rec.Body.String())
+		}
+		var pods []string
+		for _, s := range sessions {
+			pods = append(pods, s.Namespace+"/"+s.Pod)
+		}
+		return pods
+	}
+	if got := fmt.Sprint(list("alice-token")); got != "[shop/web-0 shop/web-1]" {
+		t.Errorf("alice lists %s, want the pods of shop", got)
+	}
+	if got := fmt.Sprint(list("bob-token")); got != "[shop/web-0]" {
+		t.Errorf("bob lists %s, want only shop/web-0", got)
+	}
+
+	file := "/api/v1/sessions/shop/web-1/pod_20261018T101530Z-0000aaaa/files/capture.pcap0"
+	live := "/api/v1/sessions/shop/web-1/pod_20261018T101530Z-0000aaaa/live"
+	tests := []struct {
+		name     string
+		target   string
+		header   http.Header
+		wantCode int
+	}{
+		{name: "list without token", target: SessionsPath, wantCode: http.StatusUnauthorized},
+		{name: "file without token", target: file, wantCode: http.StatusUnauthorized},
+		{name: "live without token", target: live, wantCode: http.StatusUnauthorized},
+		{name: "unknown token", target: file, header: http.Header{"Authorization": {"Bearer eve-token"}}, wantCode: http.StatusUnauthorized},
+		{name: "file of a pod the user may not capture", target: file, header: http.Header{TokenHeader: {"bob-token"}}, wantCode: http.StatusForbidden},
+		{name: "live of a pod the user may not capture", target: live, header: http.Header{TokenHeader: {"bob-token"}}, wantCode: http.StatusForbidden},
+		{name: "file through the pod proxy", target: file, header: http.Header{TokenHeader: {"alice-token"}}, wantCode: http.StatusOK},
+		{name: "health without token", target: HealthPath, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = http.Header{}
+			}
+			if rec := serve(tt.target, header); rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d (body %q)", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestForwardTokenAddsTokenToPodProxyRequests(t *testing.T) {
+	var got []string
+	rt := ForwardToken(roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = append(got, req.Header.Get(TokenHeader))
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}))
+	send := func(ctx context.Context, path string) {
+		req := httptest.NewRequest(http.MethodGet, "https://api.example"+path, nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer client-token")
+		if _, err := rt.RoundTrip(req); err != nil {
+			t.Fatalf("RoundTrip() returned error: %v", err)
+		}
+		if req.Header.Get(TokenHeader) != "" {
+			t.Error("RoundTrip() modified the caller's request")
+		}
+	}
+	proxy := "/api/v1/namespaces/default/pods/agent-a:8081/proxy/api/v1/sessions"
+	send(context.Background(), proxy)
+	send(WithToken(context.Background(), "user-token"), proxy)
+	send(context.Background(), "/api/v1/namespaces/shop/pods/web-0")
+	if fmt.Sprint(got) != "[client-token user-token ]" {
+		t.Errorf("forwarded tokens = %q, want the client token, the context token and none outside the pod proxy", got)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,457 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/kubeauth"
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/rules"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+// AlertsPath receives Alertmanager webhook notifications
+const AlertsPath = "/api/v1/alerts"
+
+// Labels, or annotations, of alerts the receiver reads
+const (
+	AlertLabelNamespace = "namespace"
+	AlertLabelPod       = "pod"
+	// AlertLabelSelector is a label selector of the pods to capture in the
+	// alert's namespace, for alerts not about a single pod
+	AlertLabelSelector = "capture_selector"
+	// AlertLabelProfile names the configured capture profile to use
+	AlertLabelProfile = "capture_profile"
+	// AlertLabelDuration overrides the duration of the profile
+	AlertLabelDuration = "capture_duration"
+)
+
+const (
+	// alertIDPrefix starts the IDs of the captures the receiver adds to the
+	// capture list of a pod
+	alertIDPrefix = "alert-"
+	// maxAlertPayload bounds the size of a notification
+	maxAlertPayload = 1 << 20
+)
+
+// Results of the capture of a pod requested by an alert
+const (
+	AlertResultStarted   = "started"
+	AlertResultDuplicate = "duplicate"
+	AlertResultRemoved   = "removed"
+	AlertResultRefused   = "refused"
+	AlertResultFailed    = "failed"
+)
+
+// AlertSettingsFunc returns the current settings of the receiver
+type AlertSettingsFunc func() config.AlertReceiver
+
+// AlertResult reports what the receiver did for one alert and pod
+type AlertResult struct {
+	Alert   string `json:"alert"`
+	Pod     string `json:"pod,omitempty"`
+	ID      string `json:"id,omitempty"`
+	Result  string `json:"result"`
+	Message string `json:"message,omitempty"`
+}
+
+// AlertResponse is the response to a notification
+type AlertResponse struct {
+	Results []AlertResult `json:"results"`
+}
+
+// describe names the capture of a result for logs
+func (r *AlertResult) describe() string {
+	if r.Pod == "" {
+		return "request"
+	}
+	return fmt.Sprintf("%s of pod %s", r.ID, r.Pod)
+}
+
+// alertNotification is the payload of Alertmanager's webhook receiver
+type alertNotification struct {
+	Version string  `json:"version"`
+	Status  string  `json:"status"`
+	Alerts  []alert `json:"alerts"`
+}
+
+type alert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// NewAlertHandler returns the Alertmanager webhook receiver of the node agent:
+//
+//	POST /api/v1/alerts
+//
+// Each firing alert adds a capture to the capture list of the pods its labels
+// point at: the pod label, or the pods matching the capture_selector label or
+// annotation in the alert's namespace. The capture's ID is derived from the
+// alert's fingerprint and start time, so repeated notifications of the same
+// firing, including those sent by other Alertmanager replicas to other node
+// agents, find their capture already there. Resolved alerts remove their
+// captures, whose files are kept for their retention.
+//
+// Alertmanager authenticates with a bearer token of a user allowed to patch
+// the pods, as configured in its http_config.
+func NewAlertHandler(settings AlertSettingsFunc, client kubernetes.Interface, annotationKey string) http.Handler {
+	h := &alertHandler{settings: settings, client: client, auth: kubeauth.NewAuthorizer(client), annotationKey: annotationKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+AlertsPath, h.serveAlerts)
+	return mux
+}
+
+type alertHandler struct {
+	settings      AlertSettingsFunc
+	client        kubernetes.Interface
+	auth          *kubeauth.Authorizer
+	annotationKey string
+}
+
+func (h *alertHandler) serveAlerts(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "bearer token required", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.auth.Authenticate(r.Context(), token)
+	if err != nil {
+		klog.V(2).Infof("Refused alert notification: %v", err)
+		http.Error(w, "authentication failed", http.StatusUnauthorized)
+		return
+	}
+
+	var notification alertNotification
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAlertPayload)).Decode(&notification); err != nil {
+		http.Error(w, fmt.Sprintf("invalid notification: %v", err), http.StatusBadRequest)
+		return
+	}
+	if notification.Version != "" && notification.Version != "4" {
+		http.Error(w, fmt.Sprintf("unsupported notification version %q", notification.Version), http.StatusBadRequest)
+		return
+	}
+
+	settings := h.settings()
+	var response AlertResponse
+	status := http.StatusOK
+	for _, a := range notification.Alerts {
+		for _, result := range h.handleAlert(r.Context(), user, a, settings) {
+			metrics.AlertCaptures.WithLabelValues(result.Result).Inc()
+			switch result.Result {
+			case AlertResultFailed:
+				// Alertmanager retries the whole notification, which the
+				// captures already added ignore as duplicates
+				status = http.StatusInternalServerError
+				klog.Errorf("Alert %s: capture %s failed: %s", result.Alert, result.describe(), result.Message)
+			case AlertResultRefused:
+				klog.Warningf("Alert %s: refused capture %s: %s", result.Alert, result.describe(), result.Message)
+			case AlertResultStarted, AlertResultRemoved:
+				klog.Infof("Alert %s by %s: capture %s of pod %s %s", result.Alert, user.Username, result.ID, result.Pod, result.Result)
+			}
+			response.Results = append(response.Results, result)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		klog.Errorf("Failed to write alert response: %v", err)
+	}
+}
+
+// handleAlert adds or removes the captures of the pods an alert is about
+func (h *alertHandler) handleAlert(ctx context.Context, user authenticationv1.UserInfo, a alert, settings config.AlertReceiver) []AlertResult {
+	name := a.Labels["alertname"]
+	refuse := func(format string, args ...any) []AlertResult {
+		return []AlertResult{{Alert: name, Result: AlertResultRefused, Message: fmt.Sprintf(format, args...)}}
+	}
+
+	namespace := a.Labels[AlertLabelNamespace]
+	if namespace == "" {
+		return refuse("alert has no %s label", AlertLabelNamespace)
+	}
+	if err := validateNames(namespace, a.Labels[AlertLabelPod]); err != nil {
+		return refuse("%v", err)
+	}
+	entry, err := alertEntry(a, settings)
+	if err != nil {
+		return refuse("%v", err)
+	}
+	pods, err := h.alertPods(ctx, a, namespace, settings.MaxPods)
+	if err != nil {
+		if apierrors.IsNotFound(err) || errors.Is(err, errInvalidSelector) {
+			return refuse("%v", err)
+		}
+		return []AlertResult{{Alert: name, Result: AlertResultFailed, Message: fmt.Sprintf("failed to find the pods in namespace %s: %v", namespace, err)}}
+	}
+	if len(pods) == 0 {
+		return refuse("no pods to capture")
+	}
+
+	id := alertCaptureID(a)
+	entry["id"] = id
+	resolved := a.Status == "resolved"
+	var results []AlertResult
+	for _, pod := range pods {
+		result := AlertResult{Alert: name, Pod: namespace + "/" + pod, ID: id}
+		allowed, err := h.auth.MayCapture(ctx, user, namespace, pod)
+		switch {
+		case err != nil:
+			result.Result, result.Message = AlertResultFailed, fmt.Sprintf("authorization failed: %v", err)
+		case !allowed:
+			result.Result, result.Message = AlertResultRefused, fmt.Sprintf("user %q may not capture the pod", user.Username)
+		case resolved:
+			result.Result, result.Message = h.removeCapture(ctx, namespace, pod, id)
+		default:
+			result.Result, result.Message = h.addCapture(ctx, namespace, pod, entry, fmt.Sprintf("alert %s", name))
+		}
+		if result.Result == "" {
+			continue
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+var errInvalidSelector = errors.New("invalid pod selector")
+
+// alertPods returns the names of the pods an alert is about, at most maxPods of
+// those matching its selector
+func (h *alertHandler) alertPods(ctx context.Context, a alert, namespace string, maxPods int) ([]string, error) {
+	if name := a.Labels[AlertLabelPod]; name != "" {
+		pod, err := h.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if pod.DeletionTimestamp != nil {
+			return nil, nil
+		}
+		return []string{name}, nil
+	}
+
+	value := alertValue(a, AlertLabelSelector)
+	if value == "" {
+		return nil, fmt.Errorf("%w: alert has neither a %s nor a %s label", errInvalidSelector, AlertLabelPod, AlertLabelSelector)
+	}
+	selector, err := labels.Parse(value)
+	if err != nil || selector.Empty() {
+		return nil, fmt.Errorf("%w %q", errInvalidSelector, value)
+	}
+	list, err := h.client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := range list.Items {
+		if pod := &list.Items[i]; pod.DeletionTimestamp == nil && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			names = append(names, pod.Name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > maxPods {
+		klog.Warningf("Alert %s selects %d pods in namespace %s, capturing the first %d", a.Labels["alertname"], len(names), namespace, maxPods)
+		names = names[:maxPods]
+	}
+	return names, nil
+}
+
+// addCapture adds entry to the capture list of a pod unless it is there
+// already, and triggers the pod's armed captures
+func (h *alertHandler) addCapture(ctx context.Context, namespace, name string, entry map[string]any, reason string) (string, string) {
+	id := entry["id"].(string)
+	result, message := AlertResultStarted, ""
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := h.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current := pod.Annotations[h.annotationKey]
+		if strings.TrimSpace(current) != "" && !capture.IsCaptureList(current) {
+			result, message = AlertResultRefused, "the pod has a single capture, not a capture list"
+			return nil
+		}
+		if hasCaptureEntry(current, id) {
+			result = AlertResultDuplicate
+			return nil
+		}
+		value, err := capture.UpdateCaptureList(current, id, entry)
+		if err != nil {
+			result, message = AlertResultRefused, err.Error()
+			return nil
+		}
+		trigger := fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339Nano), reason)
+		return h.patchAnnotations(ctx, pod, map[string]*string{
+			h.annotationKey: &value,
+			h.annotationKey + capture.TriggerAnnotationSuffix: &trigger,
+		})
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return AlertResultRefused, "the pod no longer exists"
+		}
+		return AlertResultFailed, err.Error()
+	}
+	return result, message
+}
+
+// removeCapture removes the capture with id from the capture list of a pod.
+// Pods without it yield no result.
+func (h *alertHandler) removeCapture(ctx context.Context, namespace, name, id string) (string, string) {
+	result := ""
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := h.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		current := pod.Annotations[h.annotationKey]
+		if !capture.IsCaptureList(current) || !hasCaptureEntry(current, id) {
+			return nil
+		}
+		value, err := capture.UpdateCaptureList(current, id, nil)
+		if err != nil {
+			return err
+		}
+		update := &value
+		if value == "[]" {
+			update = nil
+		}
+		result = AlertResultRemoved
+		return h.patchAnnotations(ctx, pod, map[string]*string{h.annotationKey: update})
+	})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", ""
+		}
+		return AlertResultFailed, err.Error()
+	}
+	return result, ""
+}
+
+// patchAnnotations sets annotations of pod, removing those set to nil. The
+// patch only applies to the version of the pod that was read.
+func (h *alertHandler) patchAnnotations(ctx context.Context, pod *corev1.Pod, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"resourceVersion": pod.ResourceVersion,
+			"annotations":     annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = h.client.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// hasCaptureEntry reports whether a capture list has an entry with id
+func hasCaptureEntry(value, id string) bool {
+	var list []struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(value), &list); err != nil {
+		return false
+	}
+	for _, entry := range list {
+		if entry.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// alertCaptureID returns the capture ID for a firing of an alert: the same
+// for every notification about it and a new one when it fires again
+func alertCaptureID(a alert) string {
+	key := a.Fingerprint
+	if key == "" {
+		names := make([]string, 0, len(a.Labels))
+		for name := range a.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key += name + "=" + a.Labels[name] + ","
+		}
+	}
+	sum := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s%s-%s", alertIDPrefix, hex.EncodeToString(sum[:4]), a.StartsAt.UTC().Format("20060102t150405"))
+}
+
+// alertEntry returns the capture list entry for an alert from its profile
+// and duration, without its ID
+func alertEntry(a alert, settings config.AlertReceiver) (map[string]any, error) {
+	var options rules.Capture
+	name := alertValue(a, AlertLabelProfile)
+	if name == "" {
+		name = settings.DefaultProfile
+	}
+	if name != "" {
+		profile, ok := settings.Profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capture profile %q", name)
+		}
+		options = profile
+	}
+	if value := alertValue(a, AlertLabelDuration); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", AlertLabelDuration, value)
+		}
+		options.Duration = metav1.Duration{Duration: d}
+	}
+	if options.Duration.Duration == 0 {
+		options.Duration = metav1.Duration{Duration: rules.DefaultDuration}
+	}
+	if options.Duration.Duration > rules.MaxDuration {
+		return nil, fmt.Errorf("capture duration %s exceeds %s", options.Duration.Duration, rules.MaxDuration)
+	}
+	// Like those of trigger rules, nobody asked for these files explicitly
+	if options.Retention.Duration == 0 {
+		options.Retention = metav1.Duration{Duration: rules.DefaultRetention}
+	}
+
+	data, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	// Refuse options the node agents would refuse
+	if _, err := capture.ParseCaptureSpecWithDefaults(string(data), capture.CaptureSpec{}); err != nil {
+		return nil, err
+	}
+	entry := map[string]any{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// alertValue returns a label of an alert, or else the annotation with the
+// same name
+func alertValue(a alert, name string) string {
+	if value := a.Labels[name]; value != "" {
+		return value
+	}
+	return a.Annotations[name]
+}
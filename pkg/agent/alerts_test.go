@@ -0,0 +1,298 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/rules"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const alertAnnotationKey = "tcpdump.antrea.io"
+
+// newAlertServer serves the receiver for alertmanager-token, allowed to
+// capture pods in namespace shop, and bob-token, allowed nothing
+func newAlertServer(t *testing.T, settings config.AlertReceiver, pods ...*corev1.Pod) (*httptest.Server, *fake.Clientset) {
+	t.Helper()
+	objects := make([]runtime.Object, len(pods))
+	for i, pod := range pods {
+		objects[i] = pod
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "alertmanager-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alertmanager"}}
+		case "bob-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "bob"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		review.Status.Allowed = review.Spec.User == "alertmanager" && review.Spec.ResourceAttributes.Namespace == "shop"
+		return true, review, nil
+	})
+
+	server := httptest.NewTLSServer(NewAlertHandler(func() config.AlertReceiver { return settings }, clientset, alertAnnotationKey))
+	t.Cleanup(server.Close)
+	return server, clientset
+}
+
+func alertPod(name string, labels map[string]string, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: name, Labels: labels, Annotations: annotations},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+// postAlerts sends a notification the way Alertmanager does
+func postAlerts(t *testing.T, server *httptest.Server, token string, alerts ...map[string]any) (int, AlertResponse) {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"version":  "4",
+		"status":   "firing",
+		"receiver": "packet-capture",
+		"alerts":   alerts,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode notification: %v", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, server.URL+AlertsPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", AlertsPath, err)
+	}
+	defer resp.Body.Close()
+	var response AlertResponse
+	if resp.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+	}
+	return resp.StatusCode, response
+}
+
+func testAlert(status string, startsAt time.Time, labels map[string]string) map[string]any {
+	return map[string]any{
+		"status":      status,
+		"labels":      labels,
+		"annotations": map[string]string{"summary": "checkout errors"},
+		"startsAt":    startsAt.Format(time.RFC3339),
+		"endsAt":      "0001-01-01T00:00:00Z",
+		"fingerprint": "4b3e1f2a9c7d6e50",
+	}
+}
+
+func podAnnotations(t *testing.T, clientset *fake.Clientset, name string) map[string]string {
+	t.Helper()
+	pod, err := clientset.CoreV1().Pods("shop").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod %s: %v", name, err)
+	}
+	return pod.Annotations
+}
+
+func resultsOf(response AlertResponse) []string {
+	var results []string
+	for _, r := range response.Results {
+		results = append(results, r.Result)
+	}
+	return results
+}
+
+func TestAlertReceiverCapturesOncePerFiring(t *testing.T) {
+	settings := config.AlertReceiver{
+		Profiles:       map[string]rules.Capture{"short": {Duration: metav1.Duration{Duration: 5 * time.Minute}, Filter: "tcp port 8080"}},
+		DefaultProfile: "short",
+		MaxPods:        10,
+	}
+	server, clientset := newAlertServer(t, settings,
+		alertPod("cart", nil, map[string]string{alertAnnotationKey: `[{"id":"dns","filter":"port 53"}]`}))
+
+	startsAt := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	firing := testAlert("firing", startsAt, map[string]string{"alertname": "CheckoutErrors", "namespace": "shop", "pod": "cart"})
+	status, response := postAlerts(t, server, "alertmanager-token", firing)
+	if status != http.StatusOK || len(response.Results) != 1 || response.Results[0].Result != AlertResultStarted {
+		t.Fatalf("firing alert: status %d, results %+v", status, response.Results)
+	}
+	id := response.Results[0].ID
+	if !strings.HasPrefix(id, alertIDPrefix) || !strings.HasSuffix(id, "-20261018t093000") {
+		t.Errorf("capture ID = %q, want one derived from the alert", id)
+	}
+
+	annotations := podAnnotations(t, clientset, "cart")
+	specs, err := capture.ParseSessionSpecs(annotations[alertAnnotationKey], capture.CaptureSpec{})
+	if err != nil || len(specs) != 2 {
+		t.Fatalf("capture list %q: %v", annotations[alertAnnotationKey], err)
+	}
+	if specs[0].ID != "dns" || specs[1].ID != id || specs[1].Duration.Duration != 5*time.Minute ||
+		specs[1].Filter != "tcp port 8080" || specs[1].Retention.Duration != rules.DefaultRetention {
+		t.Errorf("capture list = %+v, want the existing capture and the alert's from the default profile", specs)
+	}
+	trigger := annotations[alertAnnotationKey+capture.TriggerAnnotationSuffix]
+	if !strings.HasSuffix(trigger, " alert CheckoutErrors") {
+		t.Errorf("trigger annotation = %q, want it set for the alert", trigger)
+	}
+
+	// Alertmanager repeats notifications while the alert fires
+	if status, response := postAlerts(t, server, "alertmanager-token", firing); status != http.StatusOK ||
+		len(response.Results) != 1 || response.Results[0].Result != AlertResultDuplicate {
+		t.Fatalf("repeated alert: status %d, results %+v", status, response.Results)
+	}
+	if got := podAnnotations(t, clientset, "cart"); got[alertAnnotationKey+capture.TriggerAnnotationSuffix] != trigger {
+		t.Errorf("a repeated alert triggered the pod's armed captures again")
+	}
+
+	resolved := testAlert("resolved", startsAt, map[string]string{"alertname": "CheckoutErrors", "namespace": "shop", "pod": "cart"})
+	if status, response := postAlerts(t, server, "alertmanager-token", resolved); status != http.StatusOK ||
+		len(response.Results) != 1 || response.Results[0].Result != AlertResultRemoved {
+		t.Fatalf("resolved alert: status %d, results %+v", status, response.Results)
+	}
+	if got := podAnnotations(t, clientset, "cart")[alertAnnotationKey]; got != `[{"filter":"port 53","id":"dns"}]` {
+		t.Errorf("capture list after resolution = %q, want the other capture only", got)
+	}
+	if status, response := postAlerts(t, server, "alertmanager-token", resolved); status != http.StatusOK || len(response.Results) != 0 {
+		t.Errorf("repeated resolution: status %d, results %+v", status, response.Results)
+	}
+
+	// A new firing of the same alert starts a new capture
+	refired := testAlert("firing", startsAt.Add(time.Hour), map[string]string{"alertname": "CheckoutErrors", "namespace": "shop", "pod": "cart"})
+	if _, response := postAlerts(t, server, "alertmanager-token", refired); len(response.Results) != 1 ||
+		response.Results[0].Result != AlertResultStarted || response.Results[0].ID == id {
+		t.Errorf("new firing: results %+v, want a new capture", response.Results)
+	}
+}
+
+func TestAlertReceiverCapturesSelectedPods(t *testing.T) {
+	web := map[string]string{"app": "web"}
+	server, clientset := newAlertServer(t, config.AlertReceiver{MaxPods: 2},
+		alertPod("web-c", web, nil), alertPod("web-a", web, nil), alertPod("web-b", web, nil), alertPod("db", nil, nil))
+
+	alert := testAlert("firing", time.Now(), map[string]string{"alertname": "HighLatency", "namespace": "shop", "capture_duration": "30s"})
+	alert["annotations"] = map[string]string{"capture_selector": "app=web"}
+	status, response := postAlerts(t, server, "alertmanager-token", alert)
+	if status != http.StatusOK || len(response.Results) != 2 ||
+		response.Results[0].Pod != "shop/web-a" || response.Results[1].Pod != "shop/web-b" {
+		t.Fatalf("selector alert: status %d, results %+v, want the first 2 matching pods", status, response.Results)
+	}
+	specs, err := capture.ParseSessionSpecs(podAnnotations(t, clientset, "web-a")[alertAnnotationKey], capture.CaptureSpec{})
+	if err != nil || len(specs) != 1 || specs[0].Duration.Duration != 30*time.Second {
+		t.Errorf("capture list of web-a = %+v (%v), want a 30s capture", specs, err)
+	}
+	for _, name := range []string{"web-c", "db"} {
+		if value, ok := podAnnotations(t, clientset, name)[alertAnnotationKey]; ok {
+			t.Errorf("pod %s got capture %q", name, value)
+		}
+	}
+}
+
+func TestAlertReceiverRequiresAToken(t *testing.T) {
+	server, clientset := newAlertServer(t, config.AlertReceiver{MaxPods: 10}, alertPod("cart", nil, nil))
+	body, err := json.Marshal(map[string]any{
+		"version": "4",
+		"status":  "firing",
+		"alerts":  []map[string]any{testAlert("firing", time.Now(), map[string]string{"namespace": "shop", "pod": "cart"})},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode notification: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+	}{
+		{"missing", ""},
+		{"empty", "Bearer "},
+		{"basic auth", "Basic YWxlcnRtYW5hZ2VyOnNlY3JldA=="},
+		{"wrong token", "Bearer unknown"},
+	} {
+		req, err := http.NewRequest(http.MethodPost, server.URL+AlertsPath, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if tc.authorization != "" {
+			req.Header.Set("Authorization", tc.authorization)
+		}
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("%s: POST %s failed: %v", tc.name, AlertsPath, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want %d", tc.name, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+	if value, ok := podAnnotations(t, clientset, "cart")[alertAnnotationKey]; ok {
+		t.Errorf("unauthenticated alerts added captures: %q", value)
+	}
+}
+
+func TestAlertReceiverRefusesRequests(t *testing.T) {
+	settings := config.AlertReceiver{
+		Profiles: map[string]rules.Capture{"short": {Duration: metav1.Duration{Duration: time.Minute}}},
+		MaxPods:  10,
+	}
+	server, clientset := newAlertServer(t, settings,
+		alertPod("cart", nil, nil), alertPod("legacy", nil, map[string]string{alertAnnotationKey: `{"duration":"1m"}`}))
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		labels map[string]string
+	}{
+		{"forbidden", "bob-token", map[string]string{"namespace": "shop", "pod": "cart"}},
+		{"other namespace", "alertmanager-token", map[string]string{"namespace": "kube-system", "pod": "cart"}},
+		{"no namespace", "alertmanager-token", map[string]string{"pod": "cart"}},
+		{"no pod or selector", "alertmanager-token", map[string]string{"namespace": "shop"}},
+		{"missing pod", "alertmanager-token", map[string]string{"namespace": "shop", "pod": "checkout"}},
+		{"unknown profile", "alertmanager-token", map[string]string{"namespace": "shop", "pod": "cart", "capture_profile": "long"}},
+		{"duration too long", "alertmanager-token", map[string]string{"namespace": "shop", "pod": "cart", "capture_duration": "2h"}},
+		{"single capture", "alertmanager-token", map[string]string{"namespace": "shop", "pod": "legacy"}},
+	} {
+		status, response := postAlerts(t, server, tc.token, testAlert("firing", now, tc.labels))
+		if status != http.StatusOK || len(response.Results) != 1 || response.Results[0].Result != AlertResultRefused {
+			t.Errorf("%s: status %d, results %v, want one refusal", tc.name, status, resultsOf(response))
+		}
+	}
+	if value, ok := podAnnotations(t, clientset, "cart")[alertAnnotationKey]; ok {
+		t.Errorf("refused alerts added captures: %q", value)
+	}
+}
+
+func TestAlertReceiverAsksForRetryOnAPIErrors(t *testing.T) {
+	server, clientset := newAlertServer(t, config.AlertReceiver{MaxPods: 10}, alertPod("cart", nil, nil))
+	clientset.PrependReactor("patch", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("etcd unavailable")
+	})
+
+	alert := testAlert("firing", time.Now(), map[string]string{"namespace": "shop", "pod": "cart"})
+	status, response := postAlerts(t, server, "alertmanager-token", alert)
+	if status != http.StatusInternalServerError || len(response.Results) != 1 || response.Results[0].Result != AlertResultFailed {
+		t.Errorf("status %d, results %+v, want a failure Alertmanager retries", status, response.Results)
+	}
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultNamespace is the namespace the node agent DaemonSet runs in
+	DefaultNamespace = "default"
+	// DefaultSelector selects the node agent pods
+	DefaultSelector = "app=packet-capture-controller"
+	// DefaultPort is the port the session API listens on
+	DefaultPort = "8081"
+)
+
+// Client reaches the session API of the node agents through the API
+// server's pod proxy, so callers only need RBAC access to pods/proxy in the
+// agent namespace and no network path to the nodes.
+type Client struct {
+	client    kubernetes.Interface
+	Namespace string
+	Selector  string
+	Port      string
+}
+
+// NewClient returns a client for node agents deployed with the defaults
+func NewClient(client kubernetes.Interface) *Client {
+	return &Client{
+		client:    client,
+		Namespace: DefaultNamespace,
+		Selector:  DefaultSelector,
+		Port:      DefaultPort,
+	}
+}
+
+// AgentFor returns the name of the running node agent pod on node
+func (c *Client) AgentFor(ctx context.Context, node string) (string, error) {
+	if node == "" {
+		return "", fmt.Errorf("pod is not scheduled to a node yet")
+	}
+	agents, err := c.Agents(ctx)
+	if err != nil {
+		return "", err
+	}
+	// The field selector on spec.nodeName is not supported by every client,
+	// including the fake one, so the node is matched here
+	for _, pod := range agents {
+		if pod.Spec.NodeName == node {
+			return pod.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no running node agent with labels %s on node %s in namespace %s", c.Selector, node, c.Namespace)
+}
+
+// Agents returns the running node agent pods, one per node
+func (c *Client) Agents(ctx context.Context) ([]corev1.Pod, error) {
+	pods, err := c.client.CoreV1().Pods(c.Namespace).List(ctx, metav1.ListOptions{LabelSelector: c.Selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list node agents in namespace %s: %w", c.Namespace, err)
+	}
+	var running []corev1.Pod
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.DeletionTimestamp == nil {
+			running = append(running, pod)
+		}
+	}
+	return running, nil
+}
+
+// Sessions lists the sessions the agent stores for a pod, or for every pod
+// when namespace and pod are empty
+func (c *Client) Sessions(ctx context.Context, agent, namespace, pod string) ([]SessionInfo, error) {
+	params := map[string]string{"namespace": namespace, "pod": pod}
+	data, err := c.client.CoreV1().Pods(c.Namespace).ProxyGet("http", agent, c.Port, SessionsPath, params).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions from node agent %s: %w", agent, err)
+	}
+	var sessions []SessionInfo
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("invalid session list from node agent %s: %w", agent, err)
+	}
+	return sessions, nil
+}
+
+// Ping checks that the session API of the agent answers
+func (c *Client) Ping(ctx context.Context, agent string) error {
+	if _, err := c.client.CoreV1().Pods(c.Namespace).ProxyGet("http", agent, c.Port, HealthPath, nil).DoRaw(ctx); err != nil {
+		return fmt.Errorf("node agent %s does not answer: %w", agent, err)
+	}
+	return nil
+}
+
+// OpenFile streams a file of a session from the agent
+func (c *Client) OpenFile(ctx context.Context, agent string, session *SessionInfo, file string) (io.ReadCloser, error) {
+	stream, err := c.client.CoreV1().Pods(c.Namespace).ProxyGet("http", agent, c.Port, session.FilePath(file), nil).Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s of session %s from node agent %s: %w", file, session.Session, agent, err)
+	}
+	return stream, nil
+}
+
+// Live streams the packets of a running session as they are captured. The
+// stream ends when the session stops.
+func (c *Client) Live(ctx context.Context, agent string, session *SessionInfo) (io.ReadCloser, error) {
+	stream, err := c.client.CoreV1().Pods(c.Namespace).ProxyGet("http", agent, c.Port, session.LivePath(), nil).Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stream session %s from node agent %s: %w", session.Session, agent, err)
+	}
+	return stream, nil
+}
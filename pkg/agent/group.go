@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/pcap"
+)
+
+// NodeSession is a session stored by the node agent pod Agent on Node
+type NodeSession struct {
+	Node  string `json:"node"`
+	Agent string `json:"agent"`
+	SessionInfo
+}
+
+// ID returns <node>/<namespace>/<pod>/<session>, which tells the session
+// apart across the cluster
+func (s *NodeSession) ID() string {
+	return s.Node + "/" + s.Namespace + "/" + s.Pod + "/" + s.Session
+}
+
+// GroupSessions returns the sessions of the latest window of capture group
+// group that have pcap files, only the latest session of each pod, ordered
+// by pod
+func GroupSessions(sessions []NodeSession, group string) []NodeSession {
+	var latest time.Time
+	members := map[string]NodeSession{}
+	for _, s := range sessions {
+		if s.Manifest == nil || s.Manifest.Spec.Group != group || len(s.PcapFiles()) == 0 {
+			continue
+		}
+		windowStart, _ := s.Manifest.Spec.Window()
+		switch {
+		case windowStart.Before(latest):
+			continue
+		case windowStart.After(latest):
+			latest = windowStart
+			members = map[string]NodeSession{}
+		}
+		pod := s.Namespace + "/" + s.Pod
+		if m, ok := members[pod]; ok && !s.Manifest.StartTime.After(m.Manifest.StartTime) {
+			continue
+		}
+		members[pod] = s
+	}
+
+	pods := make([]string, 0, len(members))
+	for pod := range members {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	result := make([]NodeSession, 0, len(pods))
+	for _, pod := range pods {
+		result = append(result, members[pod])
+	}
+	return result
+}
+
+// MergeSessions writes sessions, possibly of different nodes, to w as one
+// pcapng file ordered by packet time, with an interface per session named
+// after its pod and described by its session and node
+func (c *Client) MergeSessions(ctx context.Context, w io.Writer, sessions []NodeSession) error {
+	var sources []pcap.Source
+	for i := range sessions {
+		s := &sessions[i]
+		source := pcap.Source{
+			Name:        s.Namespace + "/" + s.Pod,
+			Description: fmt.Sprintf("session %s on node %s", s.Session, s.Node),
+		}
+		for _, file := range s.PcapFiles() {
+			stream, err := c.OpenFile(ctx, s.Agent, &s.SessionInfo, file)
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			source.Inputs = append(source.Inputs, stream)
+		}
+		sources = append(sources, source)
+	}
+	return pcap.MergeSources(w, sources...)
+}
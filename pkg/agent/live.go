@@ -0,0 +1,286 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/pcap"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// livePollInterval is how often a live stream checks for new packets
+	livePollInterval = 250 * time.Millisecond
+	// liveWriteTimeout drops live clients that stop reading altogether
+	liveWriteTimeout = 30 * time.Second
+	// liveBatchSize bounds the packets written between two flushes
+	liveBatchSize = 256
+)
+
+// LivePath returns the API path streaming the packets of a running session
+func (s *SessionInfo) LivePath() string {
+	return fmt.Sprintf("%s/%s/%s/%s/live", SessionsPath, s.Namespace, s.Pod, s.Session)
+}
+
+// serveLive streams the packets tcpdump writes to a session as one
+// continuous pcap stream, starting with the next packet captured, until the
+// session stops or the client goes away.
+//
+// The stream follows the files on disk instead of tcpdump itself, so a slow
+// client can never hold up the capture: it only falls behind, and once it is
+// a whole file behind it skips ahead to the file tcpdump is writing.
+func (s *server) serveLive(w http.ResponseWriter, r *http.Request) {
+	namespace, pod, session := r.PathValue("namespace"), r.PathValue("pod"), r.PathValue("session")
+	if err := validateNames(namespace, pod); err != nil || namespace == "" {
+		http.Error(w, "invalid namespace or pod name", http.StatusBadRequest)
+		return
+	}
+	if !validSessionName(session) {
+		http.Error(w, "invalid session name", http.StatusBadRequest)
+		return
+	}
+	dir := filepath.Join(s.captureDir, namespace, pod, session)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	metrics.LiveStreams.Inc()
+	defer metrics.LiveStreams.Dec()
+	klog.Infof("Streaming session %s/%s/%s to %s", namespace, pod, session, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	flush := func() error {
+		// Unsupported deadlines only mean a stalled client is not dropped
+		_ = rc.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		return rc.Flush()
+	}
+
+	f := &follower{dir: dir, w: w}
+	defer f.close()
+	if err := f.run(r.Context(), flush); err != nil && !errors.Is(err, context.Canceled) {
+		klog.Warningf("Live stream of session %s/%s/%s ended: %v", namespace, pod, session, err)
+		return
+	}
+	klog.Infof("Live stream of session %s/%s/%s finished after %d packets, skipped ahead %d times", namespace, pod, session, f.packets, f.skips)
+}
+
+// follower reads the packets appended to the pcap files of a session
+type follower struct {
+	dir string
+	w   io.Writer
+	out *pcap.Writer
+
+	// file is the pcap file being read, at offset bytes after the last
+	// complete record
+	file   string
+	f      *os.File
+	r      *pcap.Reader
+	offset int64
+
+	packets int
+	skips   int
+}
+
+type pcapFileState struct {
+	name    string
+	modTime time.Time
+}
+
+// run streams packets until the session finished and every file was read
+func (f *follower) run(ctx context.Context, flush func() error) error {
+	for {
+		finished := sessionFinished(f.dir)
+		progressed, err := f.poll()
+		if err != nil {
+			return err
+		}
+		if progressed {
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if finished {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(livePollInterval):
+		}
+	}
+}
+
+// poll writes the packets available now and reports whether there were any
+// or the follower moved to another file
+func (f *follower) poll() (bool, error) {
+	files, err := listPcapFiles(f.dir)
+	if err != nil {
+		return false, err
+	}
+	if len(files) == 0 {
+		return false, nil
+	}
+	active := files[0]
+	for _, file := range files[1:] {
+		if file.modTime.After(active.modTime) {
+			active = file
+		}
+	}
+
+	if f.f == nil {
+		// Start at the next packet tcpdump writes, not the beginning of the file
+		return f.open(active.name, true)
+	}
+	if info, err := f.f.Stat(); err != nil || info.Size() < f.offset {
+		// tcpdump came round its ring and rewrote the file being read
+		return f.skipTo(active.name)
+	}
+
+	n, err := f.readPackets(false)
+	if err != nil {
+		klog.V(2).Infof("Resynchronizing live stream of %s: %v", f.dir, err)
+		return f.skipTo(active.name)
+	}
+	if n > 0 || active.name == f.file {
+		return n > 0, nil
+	}
+
+	// tcpdump closed this file before opening the next one, so everything in
+	// it has been read. Move to the next file of the ring unless tcpdump is
+	// already past it.
+	next := ""
+	for i, file := range files {
+		if file.name == f.file {
+			next = files[(i+1)%len(files)].name
+		}
+	}
+	if next != active.name {
+		return f.skipTo(active.name)
+	}
+	return f.open(active.name, false)
+}
+
+func (f *follower) skipTo(name string) (bool, error) {
+	f.skips++
+	metrics.LiveStreamSkips.Inc()
+	return f.open(name, false)
+}
+
+// open switches to name, skipping its existing packets if fastForward is set.
+// It reports false while tcpdump has not written the file header yet.
+func (f *follower) open(name string, fastForward bool) (bool, error) {
+	file, err := os.Open(filepath.Join(f.dir, name))
+	if err != nil {
+		return false, err
+	}
+	r, err := pcap.NewReader(file)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	f.close()
+	f.file, f.f, f.r, f.offset = name, file, r, int64(pcap.HeaderLen)
+	if f.out == nil {
+		if f.out, err = pcap.NewWriter(f.w, r.Header); err != nil {
+			return false, err
+		}
+	}
+	if fastForward {
+		if _, err := f.readPackets(true); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// readPackets writes the complete records after offset and leaves the file
+// positioned before a record tcpdump is still writing
+func (f *follower) readPackets(skip bool) (int, error) {
+	n := 0
+	for skip || n < liveBatchSize {
+		p, err := f.r.Next()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// A short read of a record header or body is a record tcpdump
+			// is still writing, unless the file was truncated under the
+			// reader. Timestamps say nothing here: packets are not always
+			// written in time order.
+			info, statErr := f.f.Stat()
+			if statErr != nil {
+				return n, statErr
+			}
+			if info.Size() < f.offset {
+				return n, fmt.Errorf("%s was truncated to %d bytes while reading at %d", f.file, info.Size(), f.offset)
+			}
+			_, err := f.f.Seek(f.offset, io.SeekStart)
+			return n, err
+		}
+		if err != nil {
+			return n, err
+		}
+		f.offset += int64(pcap.RecordHeaderLen + len(p.Data))
+		if skip {
+			continue
+		}
+		if err := f.out.WritePacket(p); err != nil {
+			return n, err
+		}
+		n++
+		f.packets++
+	}
+	return n, nil
+}
+
+func (f *follower) close() {
+	if f.f != nil {
+		f.f.Close()
+		f.f = nil
+	}
+}
+
+// listPcapFiles returns the pcap files of a session in ring order
+func listPcapFiles(dir string) ([]pcapFileState, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []pcapFileState
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !capture.IsPcapFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, pcapFileState{name: entry.Name(), modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// sessionFinished reports whether the session's manifest records a stop
+func sessionFinished(dir string) bool {
+	manifest, err := capture.ReadManifest(dir)
+	return err == nil && manifest.StopTime != nil
+}
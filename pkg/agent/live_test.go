@@ -0,0 +1,216 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/pcap"
+)
+
+var liveStart = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+// appendPackets writes packets stamped at the given seconds after liveStart
+// to a pcap file of dir, creating it with a header if needed
+func appendPackets(t *testing.T, dir, name string, seconds ...int) {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := pcap.NewWriter(&buf, pcap.Header{SnapLen: 262144, LinkType: 1})
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %v", err)
+	}
+	for _, s := range seconds {
+		if err := w.WritePacket(&pcap.Packet{Timestamp: liveStart.Add(time.Duration(s) * time.Second), Data: []byte{byte(s)}}); err != nil {
+			t.Fatalf("WritePacket() returned error: %v", err)
+		}
+	}
+	data := buf.Bytes()
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		data = data[pcap.HeaderLen:]
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", name, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatalf("Failed to append to %s: %v", name, err)
+	}
+}
+
+func touch(t *testing.T, dir, name string, offset time.Duration) {
+	t.Helper()
+	mtime := time.Now().Add(offset)
+	if err := os.Chtimes(filepath.Join(dir, name), mtime, mtime); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+}
+
+func finishSession(t *testing.T, dir string) {
+	t.Helper()
+	stop := time.Now()
+	data, err := json.Marshal(capture.Manifest{StartTime: liveStart, StopTime: &stop, StopReason: capture.StopReasonStopped})
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, capture.ManifestFileName), data, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+}
+
+func packetSeconds(t *testing.T, r *pcap.Reader, n int) []int {
+	t.Helper()
+	var seconds []int
+	for len(seconds) < n {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next() returned error after %v: %v", seconds, err)
+		}
+		seconds = append(seconds, int(p.Timestamp.Sub(liveStart)/time.Second))
+	}
+	return seconds
+}
+
+func TestLiveStreamFollowsRotation(t *testing.T) {
+	root := t.TempDir()
+	session := "pod_20261018T100000Z-3f9a1c2b"
+	dir := filepath.Join(root, "shop", "web-0", session)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session dir: %v", err)
+	}
+	appendPackets(t, dir, "capture.pcap0", 1, 2)
+
+	server := httptest.NewServer(NewHandler(root, newAuthClientset()))
+	defer server.Close()
+	req, err := http.NewRequest(http.MethodGet, server.URL+(&SessionInfo{Namespace: "shop", Pod: "web-0", Session: session}).LivePath(), nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer alice-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET live returned error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	// The header arrives once the stream is positioned after the existing packets
+	r, err := pcap.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("NewReader() returned error: %v", err)
+	}
+	appendPackets(t, dir, "capture.pcap0", 3)
+	if got := packetSeconds(t, r, 1); got[0] != 3 {
+		t.Errorf("first streamed packet = %d, want 3", got[0])
+	}
+
+	appendPackets(t, dir, "capture.pcap1", 4, 5)
+	touch(t, dir, "capture.pcap1", time.Second)
+	if got := packetSeconds(t, r, 2); got[0] != 4 || got[1] != 5 {
+		t.Errorf("packets after rotation = %v, want [4 5]", got)
+	}
+
+	finishSession(t, dir)
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("stream should end when the session stops, got %v", err)
+	}
+}
+
+func TestLiveStreamSkipsAheadWhenBehind(t *testing.T) {
+	dir := t.TempDir()
+	appendPackets(t, dir, "capture.pcap0", 1)
+
+	var out bytes.Buffer
+	f := &follower{dir: dir, w: &out}
+	defer f.close()
+	if progressed, err := f.poll(); err != nil || !progressed {
+		t.Fatalf("poll() = %v, %v, want the stream to start", progressed, err)
+	}
+
+	// tcpdump wrote a whole file while the client was not reading
+	appendPackets(t, dir, "capture.pcap1", 2)
+	touch(t, dir, "capture.pcap1", time.Second)
+	appendPackets(t, dir, "capture.pcap2", 3)
+	touch(t, dir, "capture.pcap2", 2*time.Second)
+	for i := 0; i < 3; i++ {
+		if _, err := f.poll(); err != nil {
+			t.Fatalf("poll() returned error: %v", err)
+		}
+	}
+
+	r, err := pcap.NewReader(&out)
+	if err != nil {
+		t.Fatalf("NewReader() returned error: %v", err)
+	}
+	if got := packetSeconds(t, r, 1); got[0] != 3 {
+		t.Errorf("streamed packet = %d, want 3 from the file tcpdump is writing", got[0])
+	}
+	if f.skips != 1 {
+		t.Errorf("skips = %d, want 1", f.skips)
+	}
+}
+
+func TestLiveStreamKeepsPacketsOutOfTimeOrder(t *testing.T) {
+	dir := t.TempDir()
+	appendPackets(t, dir, "capture.pcap0", 1)
+
+	var out bytes.Buffer
+	f := &follower{dir: dir, w: &out}
+	defer f.close()
+	if progressed, err := f.poll(); err != nil || !progressed {
+		t.Fatalf("poll() = %v, %v, want the stream to start", progressed, err)
+	}
+
+	// tcpdump writes packets in the order it gets them, which is not always
+	// the order of their timestamps
+	appendPackets(t, dir, "capture.pcap0", 5, 3)
+	if _, err := f.poll(); err != nil {
+		t.Fatalf("poll() returned error: %v", err)
+	}
+
+	// A record tcpdump is still writing is picked up once it is complete
+	var record bytes.Buffer
+	w, err := pcap.NewWriter(&record, pcap.Header{SnapLen: 262144, LinkType: 1})
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %v", err)
+	}
+	if err := w.WritePacket(&pcap.Packet{Timestamp: liveStart.Add(2 * time.Second), Data: []byte{2}}); err != nil {
+		t.Fatalf("WritePacket() returned error: %v", err)
+	}
+	data := record.Bytes()[pcap.HeaderLen:]
+	file, err := os.OpenFile(filepath.Join(dir, "capture.pcap0"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open capture file: %v", err)
+	}
+	defer file.Close()
+	for _, part := range [][]byte{data[:10], data[10:]} {
+		if _, err := file.Write(part); err != nil {
+			t.Fatalf("Failed to append to capture file: %v", err)
+		}
+		if _, err := f.poll(); err != nil {
+			t.Fatalf("poll() returned error: %v", err)
+		}
+	}
+
+	r, err := pcap.NewReader(&out)
+	if err != nil {
+		t.Fatalf("NewReader() returned error: %v", err)
+	}
+	if got := packetSeconds(t, r, 3); got[0] != 5 || got[1] != 3 || got[2] != 2 {
+		t.Errorf("streamed packets = %v, want [5 3 2]", got)
+	}
+	if f.skips != 0 {
+		t.Errorf("skips = %d, want 0", f.skips)
+	}
+}
@@ -0,0 +1,338 @@
+// Package agent serves the capture sessions stored by a node agent over HTTP
+// and provides the client used to reach that API through the Kubernetes API
+// server's pod proxy.
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/kubeauth"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// SessionsPath lists the sessions stored by the node agent
+	SessionsPath = "/api/v1/sessions"
+	// HealthPath answers while the session API is up
+	HealthPath = "/healthz"
+)
+
+// SessionInfo describes one session directory stored by a node agent
+type SessionInfo struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	// Session is the directory name of the session below <namespace>/<pod>
+	Session string `json:"session"`
+	// Manifest is nil when the session has not written its manifest yet
+	Manifest *capture.Manifest `json:"manifest,omitempty"`
+	Files    []FileInfo        `json:"files"`
+}
+
+// FileInfo is a file of a session as currently stored on disk, which for a
+// running session includes the pcap file tcpdump is writing
+type FileInfo struct {
+	Name      string    `json:"name"`
+	SizeBytes int64     `json:"sizeBytes"`
+	ModTime   time.Time `json:"modTime"`
+}
+
+// PcapFiles returns the names of the session's pcap files
+func (s *SessionInfo) PcapFiles() []string {
+	var files []string
+	for _, f := range s.Files {
+		if capture.IsPcapFile(f.Name) {
+			files = append(files, f.Name)
+		}
+	}
+	return files
+}
+
+// FilePath returns the API path of a file of the session
+func (s *SessionInfo) FilePath(file string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/files/%s", SessionsPath, s.Namespace, s.Pod, s.Session, file)
+}
+
+// NewHandler returns the read-only session API for the capture directory:
+//
+//	GET /api/v1/sessions?namespace=<ns>&pod=<pod>
+//	GET /api/v1/sessions/{namespace}/{pod}/{session}/files/{file}
+//	GET /api/v1/sessions/{namespace}/{pod}/{session}/live
+//	GET /healthz
+//
+// Only files a session writes are served and every path element is
+// validated, so the API cannot be used to read anything else on the node.
+// Requests to /api carry a bearer token, in TokenHeader when they pass the
+// API server's pod proxy. Sessions are listed and served only for pods the
+// token's user may capture, the permission that also lets it request a
+// capture through the annotation.
+func NewHandler(captureDir string, client kubernetes.Interface) http.Handler {
+	s := &server{captureDir: filepath.Clean(captureDir), auth: kubeauth.NewAuthorizer(client)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+SessionsPath, s.listSessions)
+	mux.HandleFunc("GET "+SessionsPath+"/{namespace}/{pod}/{session}/files/{file}", s.authorized(s.serveFile))
+	mux.HandleFunc("GET "+SessionsPath+"/{namespace}/{pod}/{session}/live", s.authorized(s.serveLive))
+	mux.HandleFunc("GET "+HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+type server struct {
+	captureDir string
+	auth       *kubeauth.Authorizer
+}
+
+// authenticate returns the user of the request's token, answering the
+// request and returning false if there is none or it is not valid
+func (s *server) authenticate(w http.ResponseWriter, r *http.Request) (authenticationv1.UserInfo, bool) {
+	token, ok := requestToken(r)
+	if !ok {
+		http.Error(w, "bearer token required", http.StatusUnauthorized)
+		return authenticationv1.UserInfo{}, false
+	}
+	user, err := s.auth.Authenticate(r.Context(), token)
+	if err != nil {
+		klog.V(2).Infof("Refused session API request %s: %v", r.URL.Path, err)
+		http.Error(w, "authentication failed", http.StatusUnauthorized)
+		return authenticationv1.UserInfo{}, false
+	}
+	return user, true
+}
+
+// authorized serves requests for the sessions of a pod the user of the
+// request's token may capture
+func (s *server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, pod := r.PathValue("namespace"), r.PathValue("pod")
+		if err := validateNames(namespace, pod); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user, ok := s.authenticate(w, r)
+		if !ok {
+			return
+		}
+		allowed, err := s.auth.MayCapture(r.Context(), user, namespace, pod)
+		if err != nil {
+			klog.Errorf("Failed to authorize access to pod %s/%s for %s: %v", namespace, pod, user.Username, err)
+			http.Error(w, "authorization failed", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, fmt.Sprintf("user %q may not capture pod %s/%s", user.Username, namespace, pod), http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) listSessions(w http.ResponseWriter, r *http.Request) {
+	namespace, pod := r.URL.Query().Get("namespace"), r.URL.Query().Get("pod")
+	if err := validateNames(namespace, pod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	stored, err := s.sessions(namespace, pod)
+	if err != nil {
+		klog.Errorf("Failed to list capture sessions: %v", err)
+		http.Error(w, "failed to list capture sessions", http.StatusInternalServerError)
+		return
+	}
+	access := s.auth.AccessChecker(r.Context(), user)
+	sessions := []SessionInfo{}
+	for _, session := range stored {
+		allowed, err := access(session.Namespace, session.Pod)
+		if err != nil {
+			klog.Errorf("Failed to authorize listing of pod %s/%s for %s: %v", session.Namespace, session.Pod, user.Username, err)
+			http.Error(w, "authorization failed", http.StatusInternalServerError)
+			return
+		}
+		if allowed {
+			sessions = append(sessions, session)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		klog.Errorf("Failed to write session list: %v", err)
+	}
+}
+
+func (s *server) serveFile(w http.ResponseWriter, r *http.Request) {
+	namespace, pod := r.PathValue("namespace"), r.PathValue("pod")
+	session, file := r.PathValue("session"), r.PathValue("file")
+	if namespace == "" || pod == "" {
+		http.Error(w, "namespace and pod are required", http.StatusBadRequest)
+		return
+	}
+	if err := validateNames(namespace, pod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validSessionName(session) || !capture.IsSessionFile(file) {
+		http.Error(w, "invalid session or file name", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(s.captureDir, namespace, pod, session, file)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		klog.Errorf("Failed to open %s: %v", path, err)
+		http.Error(w, "failed to open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
+
+// sessions returns the sessions stored for pod, or for every pod of
+// namespace, or for every pod when both are empty
+func (s *server) sessions(namespace, pod string) ([]SessionInfo, error) {
+	namespaces := []string{namespace}
+	if namespace == "" {
+		var err error
+		if namespaces, err = subdirs(s.captureDir); err != nil {
+			return nil, err
+		}
+	}
+
+	sessions := []SessionInfo{}
+	for _, ns := range namespaces {
+		if validation.IsDNS1123Label(ns) != nil {
+			continue
+		}
+		pods := []string{pod}
+		if pod == "" {
+			var err error
+			if pods, err = subdirs(filepath.Join(s.captureDir, ns)); err != nil {
+				return nil, err
+			}
+		}
+		for _, p := range pods {
+			names, err := subdirs(filepath.Join(s.captureDir, ns, p))
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if !validSessionName(name) {
+					continue
+				}
+				sessions = append(sessions, readSession(filepath.Join(s.captureDir, ns, p, name), ns, p, name))
+			}
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Pod != b.Pod {
+			return a.Pod < b.Pod
+		}
+		return a.Session < b.Session
+	})
+	return sessions, nil
+}
+
+func readSession(dir, namespace, pod, name string) SessionInfo {
+	info := SessionInfo{Namespace: namespace, Pod: pod, Session: name, Files: []FileInfo{}}
+	if manifest, err := capture.ReadManifest(dir); err == nil {
+		info.Manifest = manifest
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		klog.Warningf("Failed to read manifest of %s: %v", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		klog.Warningf("Failed to list %s: %v", dir, err)
+		return info
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !capture.IsSessionFile(entry.Name()) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		info.Files = append(info.Files, FileInfo{Name: entry.Name(), SizeBytes: fi.Size(), ModTime: fi.ModTime().UTC()})
+	}
+	return info
+}
+
+// subdirs returns the names of the directories in dir, or none if dir does
+// not exist
+func subdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func validateNames(namespace, pod string) error {
+	if namespace == "" && pod != "" {
+		return fmt.Errorf("pod %q given without a namespace", pod)
+	}
+	if namespace != "" {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q: %v", namespace, errs)
+		}
+	}
+	if pod != "" {
+		if errs := validation.IsDNS1123Subdomain(pod); len(errs) > 0 {
+			return fmt.Errorf("invalid pod name %q: %v", pod, errs)
+		}
+	}
+	return nil
+}
+
+// validSessionName accepts the directory names sessionName produces
+func validSessionName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 253 {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
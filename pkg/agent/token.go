@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// TokenHeader carries the caller's bearer token to the session API. The
+// API server's pod proxy consumes the Authorization header of a request, so
+// clients reaching the node agent through it repeat their token here.
+const TokenHeader = "X-Packet-Capture-Token"
+
+type tokenKey struct{}
+
+// WithToken returns a context whose requests to the node agents carry token
+// instead of the token the client authenticates to the API server with
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// ForwardToken wraps the transport of a Kubernetes client so its pod proxy
+// requests carry a token for the session API: the one set with WithToken,
+// or else the bearer token of the client itself. Use it as
+//
+//	restConfig.Wrap(agent.ForwardToken)
+//
+// Clients authenticating with certificates have no token to forward and
+// need WithToken.
+func ForwardToken(rt http.RoundTripper) http.RoundTripper {
+	return tokenForwarder{next: rt}
+}
+
+type tokenForwarder struct {
+	next http.RoundTripper
+}
+
+func (f tokenForwarder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.Contains(req.URL.Path, "/proxy") {
+		return f.next.RoundTrip(req)
+	}
+	token, _ := req.Context().Value(tokenKey{}).(string)
+	if token == "" {
+		token, _ = strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+	if token == "" {
+		return f.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(TokenHeader, token)
+	return f.next.RoundTrip(req)
+}
+
+// requestToken returns the token of a session API request, sent either
+// directly as a bearer token or through the pod proxy in TokenHeader
+func requestToken(r *http.Request) (string, bool) {
+	if token := r.Header.Get(TokenHeader); token != "" {
+		return token, true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
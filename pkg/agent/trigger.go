@@ -0,0 +1,90 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/packet-capture-controller/pkg/kubeauth"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// TriggersPath triggers the armed captures of a pod
+const TriggersPath = "/api/v1/triggers"
+
+// TriggerFunc triggers the armed captures of a pod, recording reason in the
+// sessions written, and returns the IDs of the captures triggered
+type TriggerFunc func(namespace, name, reason string) []string
+
+// TriggerResult is the response to a trigger request
+type TriggerResult struct {
+	Triggered []string `json:"triggered"`
+}
+
+// NewTriggerHandler returns the trigger API of the node agent:
+//
+//	POST /api/v1/triggers/{namespace}/{pod}?reason=<reason>
+//
+// The API server's pod proxy does not forward the caller's credentials, so
+// the endpoint is meant to be called directly, e.g. by in-cluster alerting.
+// Requests carry a bearer token that must belong to a user allowed to patch
+// the pod, the permission that also lets it set the trigger annotation.
+func NewTriggerHandler(trigger TriggerFunc, client kubernetes.Interface) http.Handler {
+	h := &triggerHandler{trigger: trigger, auth: kubeauth.NewAuthorizer(client)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+TriggersPath+"/{namespace}/{pod}", h.serveTrigger)
+	return mux
+}
+
+type triggerHandler struct {
+	trigger TriggerFunc
+	auth    *kubeauth.Authorizer
+}
+
+func (h *triggerHandler) serveTrigger(w http.ResponseWriter, r *http.Request) {
+	namespace, pod := r.PathValue("namespace"), r.PathValue("pod")
+	if err := validateNames(namespace, pod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "bearer token required", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.auth.Authenticate(r.Context(), token)
+	if err != nil {
+		klog.V(2).Infof("Refused trigger of pod %s/%s: %v", namespace, pod, err)
+		http.Error(w, "authentication failed", http.StatusUnauthorized)
+		return
+	}
+	allowed, err := h.auth.MayCapture(r.Context(), user, namespace, pod)
+	if err != nil {
+		klog.Errorf("Failed to authorize trigger of pod %s/%s by %s: %v", namespace, pod, user.Username, err)
+		http.Error(w, "authorization failed", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("user %q may not capture pod %s/%s", user.Username, namespace, pod), http.StatusForbidden)
+		return
+	}
+
+	reason := fmt.Sprintf("api: %s", user.Username)
+	if r := r.URL.Query().Get("reason"); r != "" {
+		reason = fmt.Sprintf("%s (%s)", reason, r)
+	}
+	ids := h.trigger(namespace, pod, reason)
+	if len(ids) == 0 {
+		http.Error(w, fmt.Sprintf("pod %s/%s has no armed capture on this node", namespace, pod), http.StatusNotFound)
+		return
+	}
+	klog.Infof("Triggered armed captures %s of pod %s/%s: %s", strings.Join(ids, ", "), namespace, pod, reason)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(TriggerResult{Triggered: ids}); err != nil {
+		klog.Errorf("Failed to write trigger result: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestTriggerRequiresAnAuthorizedToken(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "alice-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		case "bob-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "bob"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Namespace == "shop" && attrs.Verb == "patch" && attrs.Resource == "pods"
+		return true, review, nil
+	})
+
+	var reasons []string
+	trigger := func(namespace, name, reason string) []string {
+		if namespace != "shop" || name != "cart" {
+			return nil
+		}
+		reasons = append(reasons, reason)
+		return []string{"shop/cart/armed"}
+	}
+	server := httptest.NewServer(NewTriggerHandler(trigger, clientset))
+	defer server.Close()
+
+	post := func(path, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		return resp
+	}
+
+	for _, tc := range []struct {
+		path, token string
+		want        int
+	}{
+		{TriggersPath + "/shop/cart", "", http.StatusUnauthorized},
+		{TriggersPath + "/shop/cart", "unknown", http.StatusUnauthorized},
+		{TriggersPath + "/shop/cart", "bob-token", http.StatusForbidden},
+		{TriggersPath + "/shop/Cart", "alice-token", http.StatusBadRequest},
+		{TriggersPath + "/shop/checkout", "alice-token", http.StatusNotFound},
+	} {
+		resp := post(tc.path, tc.token)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("POST %s with token %q: status %d, want %d", tc.path, tc.token, resp.StatusCode, tc.want)
+		}
+	}
+	if len(reasons) != 0 {
+		t.Fatalf("refused requests triggered captures: %v", reasons)
+	}
+
+	resp := post(TriggersPath+"/shop/cart?reason=HighLatency", "alice-token")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("authorized trigger returned status %d", resp.StatusCode)
+	}
+	var result TriggerResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode trigger result: %v", err)
+	}
+	if len(result.Triggered) != 1 || result.Triggered[0] != "shop/cart/armed" {
+		t.Errorf("Triggered = %v, want the armed capture", result.Triggered)
+	}
+	if len(reasons) != 1 || reasons[0] != "api: alice (HighLatency)" {
+		t.Errorf("trigger reasons = %v, want the user and the given reason", reasons)
+	}
+}
@@ -0,0 +1,200 @@
+// Package aggregator implements the cluster aggregator: a Deployment that
+// talks to every node agent and serves one cluster-wide API for listing,
+// downloading and merging their capture sessions.
+package aggregator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/kubeauth"
+	"github.com/packet-capture-controller/pkg/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultProbeInterval is how often the node agents are probed
+	DefaultProbeInterval = 30 * time.Second
+
+	// probeTimeout bounds how long a single node agent may take to answer
+	probeTimeout = 5 * time.Second
+)
+
+// AgentStatus is the availability of the node agent of one node
+type AgentStatus struct {
+	Node string `json:"node"`
+	Pod  string `json:"pod"`
+	// Available reports whether the agent's session API answered the last probe
+	Available bool `json:"available"`
+	// Since is when Available last changed
+	Since time.Time `json:"since"`
+	// LastSeen is when the agent last answered a probe
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	// Error explains why the agent is unavailable
+	Error string `json:"error,omitempty"`
+}
+
+// Aggregator tracks the availability of the node agents and serves the
+// cluster API in front of them while it is the leader
+type Aggregator struct {
+	client  kubernetes.Interface
+	agents  *agent.Client
+	auth    *kubeauth.Authorizer
+	leading atomic.Bool
+
+	mu sync.Mutex
+	// statuses are the results of the last probe by node
+	statuses map[string]AgentStatus
+}
+
+// New returns an Aggregator reaching the node agents through agents
+func New(client kubernetes.Interface, agents *agent.Client) *Aggregator {
+	return &Aggregator{
+		client:   client,
+		agents:   agents,
+		auth:     kubeauth.NewAuthorizer(client),
+		statuses: map[string]AgentStatus{},
+	}
+}
+
+// SetLeader records whether the aggregator holds the leader lease. Only the
+// leader serves the cluster API and reports ready.
+func (a *Aggregator) SetLeader(leading bool) {
+	a.leading.Store(leading)
+	if leading {
+		metrics.AggregatorLeader.Set(1)
+	} else {
+		metrics.AggregatorLeader.Set(0)
+	}
+}
+
+// Run probes the node agents every interval until ctx is done
+func (a *Aggregator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		a.probe(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Agents returns the availability of the node agents as of the last probe,
+// ordered by node
+func (a *Aggregator) Agents() []AgentStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	statuses := make([]AgentStatus, 0, len(a.statuses))
+	for _, s := range a.statuses {
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Node < statuses[j].Node })
+	return statuses
+}
+
+// agentFor returns the node agent pod of node if it answered the last probe
+func (a *Aggregator) agentFor(node string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status, ok := a.statuses[node]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("no node agent on node %s", node)
+	case !status.Available:
+		return "", fmt.Errorf("node agent %s on node %s is unavailable: %s", status.Pod, node, status.Error)
+	}
+	return status.Pod, nil
+}
+
+// probe lists the node agent pods and checks that the session API of each
+// one answers. Nodes whose agents changed availability are logged.
+func (a *Aggregator) probe(ctx context.Context) {
+	pods, err := a.client.CoreV1().Pods(a.agents.Namespace).List(ctx, metav1.ListOptions{LabelSelector: a.agents.Selector})
+	if err != nil {
+		klog.Errorf("Failed to list node agents in namespace %s: %v", a.agents.Namespace, err)
+		return
+	}
+
+	// During a rollout a node can have an old and a new agent pod; the
+	// running one counts
+	candidates := map[string]*corev1.Pod{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if current, ok := candidates[pod.Spec.NodeName]; ok && current.Status.Phase == corev1.PodRunning {
+			continue
+		}
+		candidates[pod.Spec.NodeName] = pod
+	}
+
+	results := make(chan AgentStatus, len(candidates))
+	var wg sync.WaitGroup
+	for node, pod := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status := AgentStatus{Node: node, Pod: pod.Name}
+			if pod.Status.Phase != corev1.PodRunning {
+				status.Error = fmt.Sprintf("pod %s is %s", pod.Name, pod.Status.Phase)
+			} else {
+				probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+				defer cancel()
+				if err := a.agents.Ping(probeCtx, pod.Name); err != nil {
+					status.Error = err.Error()
+				} else {
+					status.Available = true
+				}
+			}
+			results <- status
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	now := time.Now()
+	available := 0
+	a.mu.Lock()
+	previous := a.statuses
+	a.statuses = make(map[string]AgentStatus, len(candidates))
+	for status := range results {
+		prev, known := previous[status.Node]
+		if status.Available {
+			available++
+			status.LastSeen = &now
+		} else {
+			status.LastSeen = prev.LastSeen
+		}
+		status.Since = now
+		switch {
+		case known && prev.Available == status.Available:
+			status.Since = prev.Since
+		case status.Available:
+			klog.Infof("Node agent %s on node %s is available", status.Pod, status.Node)
+		default:
+			klog.Warningf("Node agent %s on node %s is unavailable: %s", status.Pod, status.Node, status.Error)
+		}
+		a.statuses[status.Node] = status
+	}
+	for node, prev := range previous {
+		if _, ok := a.statuses[node]; !ok {
+			klog.Infof("Node agent %s on node %s is gone", prev.Pod, node)
+		}
+	}
+	a.mu.Unlock()
+
+	metrics.AggregatorAgents.WithLabelValues("available").Set(float64(available))
+	metrics.AggregatorAgents.WithLabelValues("unavailable").Set(float64(len(candidates) - available))
+}
@@ -0,0 +1,310 @@
+package aggregator
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/pcap"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// handlerResponse answers a pod proxy request of the fake clientset with
+// handler. The fake clientset bypasses the transport, so the request carries
+// alice-token in place of the token ForwardToken would add.
+type handlerResponse struct {
+	handler http.Handler
+	target  string
+}
+
+func (r handlerResponse) DoRaw(ctx context.Context) ([]byte, error) {
+	stream, err := r.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	return io.ReadAll(stream)
+}
+
+func (r handlerResponse) Stream(context.Context) (io.ReadCloser, error) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, r.target, nil)
+	req.Header.Set(agent.TokenHeader, "alice-token")
+	r.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	return io.NopCloser(rec.Body), nil
+}
+
+func agentPod(name, node string, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: agent.DefaultNamespace, Labels: map[string]string{"app": "packet-capture-controller"}},
+		Spec:       corev1.PodSpec{NodeName: node},
+		Status:     corev1.PodStatus{Phase: phase},
+	}
+}
+
+// testCluster has running node agents on node-1 and node-2, serving the
+// capture directories in dirs, and a pending one on node-3. The agent on
+// node-2 only answers while node2Up is set. alice-token may capture every
+// pod in namespace shop, bob-token only shop/api-0.
+type testCluster struct {
+	aggregator *Aggregator
+	dirs       map[string]string
+	node2Up    atomic.Bool
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	t.Helper()
+	c := &testCluster{dirs: map[string]string{"agent-1": t.TempDir(), "agent-2": t.TempDir()}}
+	c.node2Up.Store(true)
+	clientset := fake.NewSimpleClientset(
+		agentPod("agent-1", "node-1", corev1.PodRunning),
+		agentPod("agent-2", "node-2", corev1.PodRunning),
+		agentPod("agent-3", "node-3", corev1.PodPending),
+	)
+	handlers := map[string]http.Handler{}
+	clientset.AddProxyReactor("pods", func(action k8stesting.Action) (bool, restclient.ResponseWrapper, error) {
+		proxy := action.(k8stesting.ProxyGetAction)
+		handler, ok := handlers[proxy.GetName()]
+		if !ok || (proxy.GetName() == "agent-2" && !c.node2Up.Load()) {
+			// The fake clientset drops reactor errors, so the failure is
+			// answered like an unreachable pod would be
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "connection refused", http.StatusBadGateway)
+			})
+		}
+		query := url.Values{}
+		for k, v := range proxy.GetParams() {
+			query.Set(k, v)
+		}
+		return true, handlerResponse{handler: handler, target: proxy.GetPath() + "?" + query.Encode()}, nil
+	})
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		switch review.Spec.Token {
+		case "alice-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		case "bob-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "bob"}}
+		case "carol-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "carol"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		switch review.Spec.User {
+		case "alice":
+			review.Status.Allowed = attrs.Namespace == "shop"
+		case "bob":
+			review.Status.Allowed = attrs.Namespace == "shop" && attrs.Name == "api-0"
+		}
+		return true, review, nil
+	})
+	for name, dir := range c.dirs {
+		handlers[name] = agent.NewHandler(dir, clientset)
+	}
+	c.aggregator = New(clientset, agent.NewClient(clientset))
+	return c
+}
+
+// writeSession stores a session of shop/<pod> in capture group checkout on
+// the node of agentPod, with a packet at every offset from start
+func (c *testCluster) writeSession(t *testing.T, agentPod, pod, session string, start time.Time, offsets ...time.Duration) {
+	t.Helper()
+	dir := filepath.Join(c.dirs[agentPod], "shop", pod, session)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session dir: %v", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "capture.pcap0"))
+	if err != nil {
+		t.Fatalf("Failed to create pcap file: %v", err)
+	}
+	defer f.Close()
+	w, err := pcap.NewWriter(f, pcap.Header{SnapLen: 262144, LinkType: 1})
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %v", err)
+	}
+	for _, offset := range offsets {
+		if err := w.WritePacket(&pcap.Packet{Timestamp: start.Add(offset), Data: []byte(pod)}); err != nil {
+			t.Fatalf("WritePacket() returned error: %v", err)
+		}
+	}
+	manifest, err := json.Marshal(capture.Manifest{
+		CaptureID: "shop/" + pod + "/checkout",
+		StartTime: start,
+		Spec:      capture.CaptureSpec{Group: "checkout", StartAt: start.Format(time.RFC3339), Duration: metav1.Duration{Duration: time.Minute}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, capture.ManifestFileName), manifest, 0644); err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+}
+
+func get(t *testing.T, server *httptest.Server, token, path string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp, body
+}
+
+func TestProbeTracksAgentAvailability(t *testing.T) {
+	c := newTestCluster(t)
+	c.node2Up.Store(false)
+	c.aggregator.probe(context.Background())
+
+	statuses := c.aggregator.Agents()
+	if len(statuses) != 3 {
+		t.Fatalf("Agents() = %+v, want one status per node", statuses)
+	}
+	if s := statuses[0]; s.Node != "node-1" || !s.Available || s.LastSeen == nil {
+		t.Errorf("node-1 = %+v, want available", s)
+	}
+	if s := statuses[1]; s.Node != "node-2" || s.Available || s.LastSeen != nil || s.Error == "" {
+		t.Errorf("node-2 = %+v, want unavailable with the probe error", s)
+	}
+	if s := statuses[2]; s.Node != "node-3" || s.Available || s.Error != "pod agent-3 is Pending" {
+		t.Errorf("node-3 = %+v, want unavailable while pending", s)
+	}
+	if _, err := c.aggregator.agentFor("node-2"); err == nil {
+		t.Error("agentFor() should refuse an unavailable node agent")
+	}
+
+	time.Sleep(time.Millisecond)
+	c.node2Up.Store(true)
+	c.aggregator.probe(context.Background())
+	updated := c.aggregator.Agents()
+	if !updated[1].Available || !updated[1].Since.After(statuses[1].Since) {
+		t.Errorf("node-2 = %+v after it answered, want available since the last probe", updated[1])
+	}
+	if !updated[0].Since.Equal(statuses[0].Since) {
+		t.Errorf("node-1 availability changed its time to %v without changing", updated[0].Since)
+	}
+}
+
+func TestClusterAPI(t *testing.T) {
+	c := newTestCluster(t)
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	c.writeSession(t, "agent-1", "web-0", "checkout_20261018T100000Z-1a2b3c4d", start, 0, 2*time.Second)
+	c.writeSession(t, "agent-2", "api-0", "checkout_20261018T100000Z-5e6f7a8b", start, time.Second)
+	c.aggregator.probe(context.Background())
+	server := httptest.NewServer(c.aggregator.Handler())
+	t.Cleanup(server.Close)
+
+	if resp, _ := get(t, server, "alice-token", AgentsPath); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("API of a replica that is not the leader answered %d, want 503", resp.StatusCode)
+	}
+	if resp, _ := get(t, server, "", ReadyPath); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("%s of a replica that is not the leader answered %d, want 503", ReadyPath, resp.StatusCode)
+	}
+	c.aggregator.SetLeader(true)
+	if resp, _ := get(t, server, "", ReadyPath); resp.StatusCode != http.StatusOK {
+		t.Errorf("%s of the leader answered %d, want 200", ReadyPath, resp.StatusCode)
+	}
+	if resp, _ := get(t, server, "", AgentsPath); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("request without a token answered %d, want 401", resp.StatusCode)
+	}
+
+	var list SessionList
+	resp, body := get(t, server, "alice-token", SessionsPath+"?group=checkout")
+	if err := json.Unmarshal(body, &list); resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("listing sessions answered %d: %s", resp.StatusCode, body)
+	}
+	if len(list.Sessions) != 2 || list.Sessions[0].Node != "node-1" || list.Sessions[1].Node != "node-2" {
+		t.Errorf("sessions = %+v, want one on each of node-1 and node-2", list.Sessions)
+	}
+	if fmt.Sprint(list.UnavailableNodes) != "[node-3]" {
+		t.Errorf("unavailable nodes = %v, want [node-3]", list.UnavailableNodes)
+	}
+	_, body = get(t, server, "bob-token", SessionsPath)
+	if err := json.Unmarshal(body, &list); err != nil || len(list.Sessions) != 1 || list.Sessions[0].Pod != "api-0" {
+		t.Errorf("bob sees sessions %+v, want only those of api-0", list.Sessions)
+	}
+
+	resp, body = get(t, server, "alice-token", NodesPath+"/node-2/sessions/shop/api-0/checkout_20261018T100000Z-5e6f7a8b/files/capture.pcap0")
+	if resp.StatusCode != http.StatusOK || len(body) != pcap.HeaderLen+pcap.RecordHeaderLen+len("api-0") {
+		t.Errorf("download answered %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp, _ := get(t, server, "alice-token", NodesPath+"/node-3/sessions/shop/api-0/checkout_20261018T100000Z-5e6f7a8b/files/capture.pcap0"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("download from an unavailable node agent answered %d, want 503", resp.StatusCode)
+	}
+
+	merge := MergePath + "?session=node-1/shop/web-0/checkout_20261018T100000Z-1a2b3c4d&session=node-2/shop/api-0/checkout_20261018T100000Z-5e6f7a8b"
+	for _, path := range []string{merge, GroupsPath + "/checkout/merge"} {
+		resp, body := get(t, server, "alice-token", path)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s answered %d: %s", path, resp.StatusCode, body)
+		}
+		// A section header, an interface per pod and the 3 packets
+		blocks := 0
+		for len(body) >= 12 {
+			blocks++
+			body = body[binary.LittleEndian.Uint32(body[4:]):]
+		}
+		if blocks != 6 {
+			t.Errorf("%s returned %d pcapng blocks, want 6", path, blocks)
+		}
+	}
+	if resp, _ := get(t, server, "bob-token", merge); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("merge including a pod bob may not capture answered %d, want 403", resp.StatusCode)
+	}
+
+	// Group members bob may not capture are left out of his merge, and
+	// refusing carol does not name any of them
+	resp, body = get(t, server, "bob-token", GroupsPath+"/checkout/merge")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bob's merge of the group answered %d: %s", resp.StatusCode, body)
+	}
+	if bytes.Contains(body, []byte("web-0")) || !bytes.Contains(body, []byte("api-0")) {
+		t.Error("bob's merge of the group should only hold the packets of api-0")
+	}
+	resp, body = get(t, server, "carol-token", GroupsPath+"/checkout/merge")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("merge of a group carol may not capture any pod of answered %d, want 403", resp.StatusCode)
+	}
+	if bytes.Contains(body, []byte("web-0")) || bytes.Contains(body, []byte("api-0")) {
+		t.Errorf("refusal %q names pods of the group", body)
+	}
+	if resp, _ := get(t, server, "alice-token", GroupsPath+"/payments/merge"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("merge of an unknown group answered %d, want 404", resp.StatusCode)
+	}
+}
@@ -0,0 +1,374 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/packet-capture-controller/pkg/agent"
+	"github.com/packet-capture-controller/pkg/capture"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// AgentsPath lists the node agents and their availability
+	AgentsPath = "/api/v1/agents"
+	// SessionsPath lists the sessions stored across the cluster
+	SessionsPath = "/api/v1/sessions"
+	// NodesPath serves the files of the sessions stored on a node
+	NodesPath = "/api/v1/nodes"
+	// MergePath merges sessions of any nodes into one pcapng file
+	MergePath = "/api/v1/merge"
+	// GroupsPath merges the latest window of a capture group
+	GroupsPath = "/api/v1/groups"
+	// HealthPath answers while the aggregator runs
+	HealthPath = "/healthz"
+	// ReadyPath answers while the aggregator is the leader
+	ReadyPath = "/readyz"
+)
+
+// SessionList is the response to a session listing
+type SessionList struct {
+	Sessions []agent.NodeSession `json:"sessions"`
+	// UnavailableNodes are the nodes whose sessions are missing because
+	// their node agent did not answer
+	UnavailableNodes []string `json:"unavailableNodes,omitempty"`
+}
+
+// Handler returns the cluster API:
+//
+//	GET /api/v1/agents
+//	GET /api/v1/sessions?namespace=<ns>&pod=<pod>&group=<group>
+//	GET /api/v1/nodes/{node}/sessions/{namespace}/{pod}/{session}/files/{file}
+//	GET /api/v1/merge?session=<node>/<namespace>/<pod>/<session>&session=...
+//	GET /api/v1/groups/{group}/merge
+//	GET /healthz
+//	GET /readyz
+//
+// Requests to /api carry a bearer token. Sessions are listed and served
+// only for pods the user may capture, the permission that also lets it
+// request a capture through the annotation. Replicas that are not the
+// leader refuse the API and report not ready, so the Service only routes
+// to the leader.
+func (a *Aggregator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+AgentsPath, a.authenticated(a.listAgents))
+	mux.HandleFunc("GET "+SessionsPath, a.authenticated(a.listSessions))
+	mux.HandleFunc("GET "+NodesPath+"/{node}/sessions/{namespace}/{pod}/{session}/files/{file}", a.authenticated(a.serveFile))
+	mux.HandleFunc("GET "+MergePath, a.authenticated(a.serveMerge))
+	mux.HandleFunc("GET "+GroupsPath+"/{group}/merge", a.authenticated(a.serveGroup))
+	mux.HandleFunc("GET "+HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET "+ReadyPath, func(w http.ResponseWriter, r *http.Request) {
+		if !a.leading.Load() {
+			http.Error(w, "not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	return mux
+}
+
+// userHandlerFunc serves a request of an authenticated user
+type userHandlerFunc func(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo)
+
+// authenticated serves requests to the leader carrying a valid bearer token
+func (a *Aggregator) authenticated(next userHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.leading.Load() {
+			http.Error(w, "not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+		user, err := a.auth.Authenticate(r.Context(), token)
+		if err != nil {
+			klog.V(2).Infof("Refused cluster API request %s: %v", r.URL.Path, err)
+			http.Error(w, "authentication failed", http.StatusUnauthorized)
+			return
+		}
+		// The node agents check the user's access again
+		next(w, r.WithContext(agent.WithToken(r.Context(), token)), user)
+	}
+}
+
+func (a *Aggregator) listAgents(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo) {
+	writeJSON(w, a.Agents())
+}
+
+func (a *Aggregator) listSessions(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo) {
+	query := r.URL.Query()
+	namespace, pod, group := query.Get("namespace"), query.Get("pod"), query.Get("group")
+	if err := validateNames(namespace, pod); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessions, unavailable := a.collectSessions(r.Context(), namespace, pod)
+	access := a.auth.AccessChecker(r.Context(), user)
+	list := SessionList{Sessions: []agent.NodeSession{}, UnavailableNodes: unavailable}
+	for _, s := range sessions {
+		if group != "" && (s.Manifest == nil || s.Manifest.Spec.Group != group) {
+			continue
+		}
+		allowed, err := access(s.Namespace, s.Pod)
+		if err != nil {
+			klog.Errorf("Failed to authorize listing of pod %s/%s for %s: %v", s.Namespace, s.Pod, user.Username, err)
+			http.Error(w, "authorization failed", http.StatusInternalServerError)
+			return
+		}
+		if allowed {
+			list.Sessions = append(list.Sessions, s)
+		}
+	}
+	writeJSON(w, list)
+}
+
+func (a *Aggregator) serveFile(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo) {
+	node, namespace, pod := r.PathValue("node"), r.PathValue("namespace"), r.PathValue("pod")
+	session := &agent.SessionInfo{Namespace: namespace, Pod: pod, Session: r.PathValue("session")}
+	file := r.PathValue("file")
+	if err := validateNames(namespace, pod); err != nil || namespace == "" || !capture.IsSessionFile(file) {
+		http.Error(w, "invalid namespace, pod or file name", http.StatusBadRequest)
+		return
+	}
+	if !a.authorize(w, r, user, namespace, pod) {
+		return
+	}
+	agentPod, err := a.agentFor(node)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	stream, err := a.agents.OpenFile(r.Context(), agentPod, session, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, stream); err != nil {
+		klog.V(2).Infof("Download of %s of session %s stopped: %v", file, session.Session, err)
+	}
+}
+
+func (a *Aggregator) serveMerge(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo) {
+	ids := r.URL.Query()["session"]
+	if len(ids) == 0 {
+		http.Error(w, "at least one session=<node>/<namespace>/<pod>/<session> is required", http.StatusBadRequest)
+		return
+	}
+
+	var sessions []agent.NodeSession
+	for _, id := range ids {
+		parts := strings.Split(id, "/")
+		if len(parts) != 4 || validateNames(parts[1], parts[2]) != nil || parts[1] == "" || parts[2] == "" {
+			http.Error(w, fmt.Sprintf("invalid session %q, want <node>/<namespace>/<pod>/<session>", id), http.StatusBadRequest)
+			return
+		}
+		if !a.authorize(w, r, user, parts[1], parts[2]) {
+			return
+		}
+		session, status, err := a.findSession(r.Context(), parts[0], parts[1], parts[2], parts[3])
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		sessions = append(sessions, *session)
+	}
+	a.writeMerged(w, r, "merged", sessions)
+}
+
+func (a *Aggregator) serveGroup(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo) {
+	group := r.PathValue("group")
+	if errs := validation.IsDNS1123Label(group); len(errs) > 0 {
+		http.Error(w, fmt.Sprintf("invalid group %q: %v", group, errs), http.StatusBadRequest)
+		return
+	}
+	sessions, unavailable := a.collectSessions(r.Context(), "", "")
+	// Group names are not namespaced, so a group may span pods the user
+	// may not capture. Those are left out before the latest window is
+	// picked, and a refusal does not name them.
+	access := a.auth.AccessChecker(r.Context(), user)
+	var accessible []agent.NodeSession
+	for _, s := range sessions {
+		if s.Manifest == nil || s.Manifest.Spec.Group != group {
+			continue
+		}
+		allowed, err := access(s.Namespace, s.Pod)
+		if err != nil {
+			klog.Errorf("Failed to authorize access to pod %s/%s for %s: %v", s.Namespace, s.Pod, user.Username, err)
+			http.Error(w, "authorization failed", http.StatusInternalServerError)
+			return
+		}
+		if allowed {
+			accessible = append(accessible, s)
+		}
+	}
+	members := agent.GroupSessions(accessible, group)
+	if len(members) == 0 {
+		if len(agent.GroupSessions(sessions, group)) > 0 {
+			http.Error(w, fmt.Sprintf("user %q may not capture the pods of group %s", user.Username, group), http.StatusForbidden)
+			return
+		}
+		http.Error(w, fmt.Sprintf("no stored capture session with pcap files belongs to group %s", group), http.StatusNotFound)
+		return
+	}
+	// A group is merged from the members that can be reached, like in
+	// kubectl pcap group-get; the header tells which nodes are missing
+	if len(unavailable) > 0 {
+		w.Header().Set("X-Unavailable-Nodes", strings.Join(unavailable, ","))
+	}
+	a.writeMerged(w, r, group, members)
+}
+
+// writeMerged writes sessions as one pcapng file named name.pcapng
+func (a *Aggregator) writeMerged(w http.ResponseWriter, r *http.Request, name string, sessions []agent.NodeSession) {
+	for _, s := range sessions {
+		klog.V(2).Infof("Merging session %s into %s", s.ID(), name)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".pcapng"))
+	out := &trackingWriter{w: w}
+	if err := a.agents.MergeSessions(r.Context(), out, sessions); err != nil {
+		if !out.written {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		klog.Errorf("Merging %d sessions into %s failed after the download started: %v", len(sessions), name, err)
+	}
+}
+
+// trackingWriter records whether anything was written, after which errors
+// can no longer change the response status
+type trackingWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	t.written = true
+	return t.w.Write(p)
+}
+
+// authorize checks that user may capture the pod, answering the request
+// and returning false if not
+func (a *Aggregator) authorize(w http.ResponseWriter, r *http.Request, user authenticationv1.UserInfo, namespace, pod string) bool {
+	allowed, err := a.auth.MayCapture(r.Context(), user, namespace, pod)
+	if err != nil {
+		klog.Errorf("Failed to authorize access to pod %s/%s for %s: %v", namespace, pod, user.Username, err)
+		http.Error(w, "authorization failed", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, fmt.Sprintf("user %q may not capture pod %s/%s", user.Username, namespace, pod), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// collectSessions lists the sessions of pod, of every pod of namespace, or
+// of every pod when both are empty, from every available node agent, ordered
+// by node. It returns the nodes whose agents are unavailable or failed to
+// answer.
+func (a *Aggregator) collectSessions(ctx context.Context, namespace, pod string) ([]agent.NodeSession, []string) {
+	type result struct {
+		node     string
+		sessions []agent.NodeSession
+		err      error
+	}
+	statuses := a.Agents()
+	results := make([]result, len(statuses))
+	var wg sync.WaitGroup
+	for i, status := range statuses {
+		results[i].node = status.Node
+		if !status.Available {
+			results[i].err = fmt.Errorf("unavailable")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stored, err := a.agents.Sessions(ctx, status.Pod, namespace, pod)
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			for _, s := range stored {
+				results[i].sessions = append(results[i].sessions, agent.NodeSession{Node: status.Node, Agent: status.Pod, SessionInfo: s})
+			}
+		}()
+	}
+	wg.Wait()
+
+	var sessions []agent.NodeSession
+	var unavailable []string
+	for _, res := range results {
+		if res.err != nil {
+			klog.V(2).Infof("Leaving out sessions of node %s: %v", res.node, res.err)
+			unavailable = append(unavailable, res.node)
+			continue
+		}
+		sessions = append(sessions, res.sessions...)
+	}
+	sort.Strings(unavailable)
+	return sessions, unavailable
+}
+
+// findSession looks up a session of a pod on node, returning the HTTP
+// status to answer with when it cannot be found
+func (a *Aggregator) findSession(ctx context.Context, node, namespace, pod, name string) (*agent.NodeSession, int, error) {
+	agentPod, err := a.agentFor(node)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	stored, err := a.agents.Sessions(ctx, agentPod, namespace, pod)
+	if err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	for _, s := range stored {
+		if s.Session == name {
+			return &agent.NodeSession{Node: node, Agent: agentPod, SessionInfo: s}, http.StatusOK, nil
+		}
+	}
+	return nil, http.StatusNotFound, fmt.Errorf("no session %s of pod %s/%s on node %s", name, namespace, pod, node)
+}
+
+// validateNames checks the namespace and pod of a request, either of which
+// may be empty to select more; a pod needs its namespace
+func validateNames(namespace, pod string) error {
+	if namespace == "" && pod != "" {
+		return fmt.Errorf("pod %q given without a namespace", pod)
+	}
+	if namespace != "" {
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q: %v", namespace, errs)
+		}
+	}
+	if pod != "" {
+		if errs := validation.IsDNS1123Subdomain(pod); len(errs) > 0 {
+			return fmt.Errorf("invalid pod name %q: %v", pod, errs)
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		klog.Errorf("Failed to write response: %v", err)
+	}
+}
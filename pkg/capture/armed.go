@@ -0,0 +1,458 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/pcap"
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// armedQueueLen is how many packets may wait between tcpdump and the
+	// buffer, e.g. while a trigger writes the buffer to disk
+	armedQueueLen = 4096
+	// TriggerReasonAnnotation prefixes the trigger reason of sessions
+	// written because the trigger annotation changed
+	TriggerReasonAnnotation = "annotation"
+	// bytesPerMB matches tcpdump's -C unit, so triggered sessions rotate
+	// like regular ones
+	bytesPerMB = 1000 * 1000
+)
+
+// errFileLimit is returned by flushWriter.write once every file is full
+var errFileLimit = errors.New("every session file is full")
+
+// trigger asks an armed capture to write its buffer to a new session
+type trigger struct {
+	time   time.Time
+	reason string
+}
+
+// packetSource is what an armed capture reads packets from; a *Stream
+// outside of tests
+type packetSource interface {
+	Header() pcap.Header
+	Next() (*pcap.Packet, error)
+	Close() error
+}
+
+// armedState is the part of a session only armed captures have
+type armedState struct {
+	triggers chan trigger
+	// template is the manifest every triggered session starts from
+	template Manifest
+	// annotationSeen and annotationValue track the trigger annotation, so
+	// only changes made while the capture is armed trigger it. Guarded by
+	// Manager.mu, like flushes.
+	annotationSeen  bool
+	annotationValue string
+	// flushes are the sessions written on triggers; they are removed with
+	// the armed capture, after its retention
+	flushes []storedSession
+}
+
+// storedSession is a session directory and the files written to it
+type storedSession struct {
+	dir   string
+	files []string
+}
+
+// startArmedLocked starts an armed capture: tcpdump streams the packets of
+// pod into a buffer holding the latest ones, which are written to a new
+// session whenever the capture is triggered
+func (m *Manager) startArmedLocked(pod *corev1.Pod, key, captureID string, spec *CaptureSpec) error {
+	// Triggered sessions are stored below the capture's directory, so
+	// refuse names that could not hold them right away
+	if _, err := sessionDir(m.captureDir, pod.Namespace, pod.Name, captureID, ""); err != nil {
+		return err
+	}
+	// Buffers live on the heap of the node agent, so together they must
+	// stay well within its memory limit
+	if inUse := m.armedBufferMBLocked(); inUse+spec.BufferSizeMB > m.cfg.MaxArmedBufferMB {
+		return utils.NewArmedBufferBudgetError(key, spec.BufferSizeMB, inUse, m.cfg.MaxArmedBufferMB)
+	}
+	containerID, pid, err := podProcess(pod, spec)
+	if err != nil {
+		return err
+	}
+	inode, err := netnsInode(pid)
+	if err != nil {
+		klog.V(2).Infof("Could not read network namespace of PID %d: %v", pid, err)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if spec.Duration.Duration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), spec.Duration.Duration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	sess := &session{
+		cancel:    cancel,
+		spec:      spec,
+		captureID: captureID,
+		podUID:    pod.UID,
+		done:      make(chan struct{}),
+		armed: &armedState{
+			triggers: make(chan trigger, 1),
+			template: Manifest{
+				CaptureID:   captureID,
+				Pod:         PodIdentity{Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID},
+				Node:        m.nodeName,
+				ContainerID: containerID,
+				PID:         pid,
+				NetnsInode:  inode,
+				Command:     append([]string{"nsenter"}, spec.streamArgs(pid)...),
+				Spec:        *spec,
+			},
+		},
+	}
+	if m.sessions[key] == nil {
+		m.sessions[key] = make(map[string]*session)
+	}
+	sess.defaults = m.specDefaultsLocked()
+	m.sessions[key][captureID] = sess
+
+	klog.Infof("Arming capture %s for pod %s (PID: %d, buffer: %dMB, %s post-trigger)", captureID, key, pid, spec.BufferSizeMB, spec.PostTrigger.Duration)
+	go m.runArmed(ctx, sess, key, func() (packetSource, error) {
+		return startStream(key, pid, spec)
+	})
+	return nil
+}
+
+// armedBufferMBLocked returns the buffer sizes of the armed captures
+// running on the node
+func (m *Manager) armedBufferMBLocked() int {
+	total := 0
+	for _, sessions := range m.sessions {
+		for _, sess := range sessions {
+			if sess.armed != nil && !sess.finished() {
+				total += sess.spec.BufferSizeMB
+			}
+		}
+	}
+	return total
+}
+
+// Trigger makes every armed capture of a pod write its buffer to a new
+// session, followed by the packets of its post-trigger window. It returns
+// the IDs of the captures triggered.
+func (m *Manager) Trigger(namespace, name, reason string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := trigger{time: time.Now(), reason: reason}
+	var ids []string
+	for id, sess := range m.sessions[fmt.Sprintf("%s/%s", namespace, name)] {
+		if sess.armed != nil && !sess.finished() {
+			sess.armed.send(t)
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ObserveTrigger triggers the armed captures of a pod when the value of its
+// trigger annotation changed to a non-empty one since they last saw it. The
+// first value a capture sees, e.g. after the node agent restarted, is only
+// remembered. It returns the IDs of the captures triggered.
+func (m *Manager) ObserveTrigger(namespace, name, value string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := trigger{time: time.Now(), reason: fmt.Sprintf("%s: %s", TriggerReasonAnnotation, value)}
+	var ids []string
+	for id, sess := range m.sessions[fmt.Sprintf("%s/%s", namespace, name)] {
+		a := sess.armed
+		if a == nil {
+			continue
+		}
+		changed := a.annotationSeen && value != "" && value != a.annotationValue
+		a.annotationSeen, a.annotationValue = true, value
+		if changed && !sess.finished() {
+			a.send(t)
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// send queues t unless a trigger is already waiting to be handled
+func (a *armedState) send(t trigger) {
+	select {
+	case a.triggers <- t:
+	default:
+		metrics.ArmedTriggers.WithLabelValues("ignored").Inc()
+	}
+}
+
+// runArmed buffers the packets of an armed capture and writes a session on
+// every trigger until the capture is stopped or tcpdump exits
+func (m *Manager) runArmed(ctx context.Context, sess *session, key string, open func() (packetSource, error)) {
+	defer close(sess.done)
+
+	source, err := open()
+	if err != nil {
+		klog.Error(err)
+		m.mu.Lock()
+		m.removeSessionLocked(key, sess)
+		m.mu.Unlock()
+		return
+	}
+	defer source.Close()
+	stopSource := context.AfterFunc(ctx, func() { source.Close() })
+	defer stopSource()
+
+	packets := make(chan *pcap.Packet, armedQueueLen)
+	go func() {
+		defer close(packets)
+		for {
+			p, err := source.Next()
+			if err != nil {
+				return
+			}
+			packets <- p
+		}
+	}()
+
+	ring := newPacketRing(int64(sess.spec.BufferSizeMB)<<20, sess.spec.BufferDuration.Duration)
+	defer func() { metrics.ArmedBufferBytes.Sub(float64(ring.bytes)) }()
+	var flush *flushWriter
+	var window *time.Timer
+	var windowC <-chan time.Time
+	finishFlush := func(reason string, err error) {
+		flush.finish(reason, err)
+		flush, windowC = nil, nil
+		if window != nil {
+			window.Stop()
+		}
+	}
+
+	for {
+		select {
+		case p, ok := <-packets:
+			if !ok {
+				stopReason := m.armedStopReason(ctx, sess, key)
+				if flush != nil {
+					finishFlush(stopReason, nil)
+				}
+				return
+			}
+			if flush == nil {
+				before := ring.bytes
+				ring.add(p)
+				metrics.ArmedBufferBytes.Add(float64(ring.bytes - before))
+				continue
+			}
+			err := flush.write(p)
+			if err == nil && len(packets) == 0 {
+				err = flush.flush()
+			}
+			switch {
+			case errors.Is(err, errFileLimit):
+				klog.Infof("Triggered session of capture %s for pod %s used all of its files", sess.captureID, key)
+				finishFlush(StopReasonFileLimitReached, nil)
+			case err != nil:
+				klog.Errorf("Failed to write triggered session of capture %s for pod %s: %v", sess.captureID, key, err)
+				finishFlush(StopReasonFailed, err)
+			}
+
+		case t := <-sess.armed.triggers:
+			if flush != nil {
+				klog.Infof("Ignoring trigger of capture %s for pod %s (%s): the previous trigger is still being written", sess.captureID, key, t.reason)
+				metrics.ArmedTriggers.WithLabelValues("ignored").Inc()
+				continue
+			}
+			before := ring.bytes
+			buffered := ring.take(t.time)
+			metrics.ArmedBufferBytes.Sub(float64(before))
+			klog.Infof("Capture %s for pod %s triggered (%s), writing %d buffered packets", sess.captureID, key, t.reason, len(buffered))
+			flush, err = m.startFlush(sess, source.Header(), buffered, t)
+			if err != nil {
+				klog.Errorf("Failed to write triggered session of capture %s for pod %s: %v", sess.captureID, key, err)
+				if flush != nil {
+					finishFlush(StopReasonFailed, err)
+				}
+				continue
+			}
+			metrics.ArmedTriggers.WithLabelValues("flushed").Inc()
+			if post := sess.spec.PostTrigger.Duration; post > 0 {
+				window = time.NewTimer(post)
+				windowC = window.C
+			} else {
+				finishFlush(StopReasonFlushed, nil)
+			}
+
+		case <-windowC:
+			finishFlush(StopReasonFlushed, nil)
+		}
+	}
+}
+
+// armedStopReason returns why the packets of an armed capture ended and
+// forgets captures whose tcpdump exited on its own, so they are restarted
+func (m *Manager) armedStopReason(ctx context.Context, sess *session, key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return sess.stopReason
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		klog.Infof("Armed capture %s for pod %s reached its duration of %s", sess.captureID, key, sess.spec.Duration.Duration)
+		return StopReasonDurationReached
+	default:
+		klog.Error(utils.NewTcpdumpExecutionError(key, fmt.Errorf("tcpdump of armed capture %s exited", sess.captureID)))
+		m.removeSessionLocked(key, sess)
+		return StopReasonExited
+	}
+}
+
+// startFlush creates the session written for trigger t and writes the
+// buffered packets to it. The buffer always fits, as the session gets the
+// files it needs for the buffer on top of the capture's fileCount for the
+// post-trigger window.
+func (m *Manager) startFlush(sess *session, header pcap.Header, buffered []*pcap.Packet, t trigger) (*flushWriter, error) {
+	manifest := sess.armed.template
+	manifest.SessionID = newSessionID(t.time)
+	manifest.StartTime = t.time
+	if len(buffered) > 0 {
+		manifest.StartTime = buffered[0].Timestamp
+	}
+	triggerTime := t.time
+	manifest.TriggerTime = &triggerTime
+	manifest.TriggerReason = t.reason
+
+	dir, err := sessionDir(m.captureDir, manifest.Pod.Namespace, manifest.Pod.Name, sess.captureID, manifest.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, utils.NewCaptureDirError(dir, err)
+	}
+	fileBytes := int64(sess.spec.FileSizeMB) * bytesPerMB
+	files := rotatedFiles(filepath.Join(dir, pcapBaseName), filesFor(buffered, fileBytes)+sess.spec.FileCount)
+
+	m.mu.Lock()
+	sess.armed.flushes = append(sess.armed.flushes, storedSession{dir: dir, files: withMetadataFiles(dir, files)})
+	m.mu.Unlock()
+
+	w := &flushWriter{
+		files:     files,
+		header:    header,
+		fileBytes: fileBytes,
+		manifest:  newManifestWriter(dir, files, manifest, m.signingKey),
+	}
+	if err := w.manifest.start(); err != nil {
+		return w, err
+	}
+	for _, p := range buffered {
+		if err := w.write(p); err != nil {
+			return w, err
+		}
+	}
+	return w, w.flush()
+}
+
+// filesFor returns how many files of fileBytes the packets fill
+func filesFor(packets []*pcap.Packet, fileBytes int64) int {
+	files, size := 0, int64(0)
+	for _, p := range packets {
+		if files == 0 || size+recordSize(p) > fileBytes && size > pcap.HeaderLen {
+			files++
+			size = pcap.HeaderLen
+		}
+		size += recordSize(p)
+	}
+	return files
+}
+
+// flushWriter writes a triggered session into its files one after another.
+// Unlike tcpdump it never overwrites a file, so the buffered packets are
+// kept however long the post-trigger window runs.
+type flushWriter struct {
+	files     []string
+	next      int
+	header    pcap.Header
+	fileBytes int64
+	f         *os.File
+	buf       *bufio.Writer
+	w         *pcap.Writer
+	size      int64
+	manifest  *manifestWriter
+}
+
+// write appends p, moving on to the next file when the current one is full
+func (w *flushWriter) write(p *pcap.Packet) error {
+	if w.f == nil || w.size+recordSize(p) > w.fileBytes && w.size > pcap.HeaderLen {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := w.w.WritePacket(p); err != nil {
+		return err
+	}
+	w.size += recordSize(p)
+	return nil
+}
+
+func (w *flushWriter) rotate() error {
+	if w.next == len(w.files) {
+		return errFileLimit
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	f, err := os.Create(w.files[w.next])
+	if err != nil {
+		return err
+	}
+	w.next++
+	w.f, w.buf = f, bufio.NewWriter(f)
+	if w.w, err = pcap.NewWriter(w.buf, w.header); err != nil {
+		return err
+	}
+	w.size = pcap.HeaderLen
+	return w.manifest.checkRotation()
+}
+
+// flush writes buffered data to the current file, so live streams see it
+func (w *flushWriter) flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	return w.buf.Flush()
+}
+
+func (w *flushWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.flush()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f, w.buf, w.w = nil, nil, nil
+	return err
+}
+
+// finish closes the current file and writes the final manifest
+func (w *flushWriter) finish(reason string, err error) {
+	if cerr := w.close(); err == nil && cerr != nil {
+		reason, err = StopReasonFailed, cerr
+	}
+	if werr := w.manifest.finish(time.Now(), reason, err); werr != nil {
+		klog.Errorf("Failed to write manifest in %s: %v", w.manifest.dir, werr)
+	}
+}
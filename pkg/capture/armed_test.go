@@ -0,0 +1,276 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/pcap"
+	"github.com/packet-capture-controller/pkg/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeSource hands out the packets sent to it until it is closed
+type fakeSource struct {
+	packets chan *pcap.Packet
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{packets: make(chan *pcap.Packet), closed: make(chan struct{})}
+}
+
+func (s *fakeSource) Header() pcap.Header {
+	return pcap.Header{SnapLen: 262144, LinkType: 1}
+}
+
+func (s *fakeSource) Next() (*pcap.Packet, error) {
+	select {
+	case p := <-s.packets:
+		return p, nil
+	case <-s.closed:
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeSource) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func testPacket(ts time.Time) *pcap.Packet {
+	return &pcap.Packet{Timestamp: ts, Data: []byte{0xab}}
+}
+
+func TestPacketRingKeepsLatestPackets(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	record := recordSize(testPacket(start))
+
+	bySize := newPacketRing(3*record, 0)
+	for i := 0; i < 10; i++ {
+		bySize.add(testPacket(start.Add(time.Duration(i) * time.Second)))
+	}
+	if got := bySize.take(start.Add(time.Hour)); len(got) != 3 || !got[0].Timestamp.Equal(start.Add(7*time.Second)) {
+		t.Errorf("size-bound ring kept %d packets starting at %v, want the last 3", len(got), got[0].Timestamp)
+	}
+	if bySize.bytes != 0 || len(bySize.take(start)) != 0 {
+		t.Errorf("take() should empty the ring")
+	}
+
+	byAge := newPacketRing(1<<20, 2500*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		byAge.add(testPacket(start.Add(time.Duration(i) * time.Second)))
+	}
+	if got := byAge.take(start.Add(9 * time.Second)); len(got) != 3 {
+		t.Errorf("age-bound ring kept %d packets, want 3", len(got))
+	}
+	byAge.add(testPacket(start))
+	if got := byAge.take(start.Add(time.Minute)); len(got) != 0 {
+		t.Errorf("packets older than the buffer duration at trigger time should be dropped, got %d", len(got))
+	}
+}
+
+// addArmedSession registers an armed capture of pod test-ns/test-pod reading
+// from source, as StartCapture would without running tcpdump
+func addArmedSession(t *testing.T, manager *Manager, spec *CaptureSpec, source packetSource) *session {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		cancel:    cancel,
+		spec:      spec,
+		captureID: "test-ns/test-pod/armed",
+		podUID:    "uid-1",
+		done:      make(chan struct{}),
+		armed: &armedState{
+			triggers: make(chan trigger, 1),
+			template: Manifest{CaptureID: "test-ns/test-pod/armed", Pod: PodIdentity{Namespace: "test-ns", Name: "test-pod", UID: "uid-1"}, Spec: *spec},
+		},
+	}
+	manager.mu.Lock()
+	manager.sessions["test-ns/test-pod"] = map[string]*session{sess.captureID: sess}
+	manager.mu.Unlock()
+	go manager.runArmed(ctx, sess, "test-ns/test-pod", func() (packetSource, error) { return source, nil })
+	return sess
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readSession returns the manifest and packets of the only session written
+// below the armed capture of test-ns/test-pod
+func readSession(t *testing.T, manager *Manager) (*Manifest, []*pcap.Packet) {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(manager.captureDir, "test-ns", "test-pod", "armed_*"))
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("expected one triggered session, found %v (%v)", dirs, err)
+	}
+	manifest, err := ReadManifest(dirs[0])
+	if err != nil {
+		t.Fatalf("ReadManifest() returned error: %v", err)
+	}
+	var packets []*pcap.Packet
+	for _, file := range manifest.Files {
+		f, err := os.Open(filepath.Join(dirs[0], file.Name))
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", file.Name, err)
+		}
+		r, err := pcap.NewReader(f)
+		if err != nil {
+			t.Fatalf("NewReader() returned error: %v", err)
+		}
+		for {
+			p, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Next() returned error: %v", err)
+			}
+			packets = append(packets, p)
+		}
+		f.Close()
+	}
+	return manifest, packets
+}
+
+func TestArmedCaptureWritesBufferOnTrigger(t *testing.T) {
+	manager := newTestManager(t)
+	spec := &CaptureSpec{FileCount: 1, FileSizeMB: 1, Mode: ModeArmed, BufferSizeMB: 1, BufferDuration: metav1.Duration{Duration: 5500 * time.Millisecond}}
+	source := newFakeSource()
+	sess := addArmedSession(t, manager, spec, source)
+
+	// The annotation value seen first is only remembered
+	if ids := manager.ObserveTrigger("test-ns", "test-pod", "before"); len(ids) != 0 {
+		t.Errorf("first trigger annotation value triggered %v", ids)
+	}
+
+	now := time.Now().Truncate(time.Microsecond)
+	for i := 10; i > 0; i-- {
+		source.packets <- testPacket(now.Add(-time.Duration(i) * time.Second))
+	}
+	// Six packets are within 5.5s of the newest one
+	record := float64(recordSize(testPacket(now)))
+	waitFor(t, "buffered packets", func() bool { return testutil.ToFloat64(metrics.ArmedBufferBytes) == 6*record })
+
+	if ids := manager.ObserveTrigger("test-ns", "test-pod", "oom"); len(ids) != 1 || ids[0] != sess.captureID {
+		t.Fatalf("ObserveTrigger() = %v, want the armed capture", ids)
+	}
+	waitFor(t, "triggered session", func() bool {
+		m, err := readTriggeredManifest(manager.captureDir)
+		return err == nil && m.StopTime != nil
+	})
+
+	manifest, packets := readSession(t, manager)
+	if manifest.StopReason != StopReasonFlushed || manifest.TriggerReason != "annotation: oom" || manifest.TriggerTime == nil {
+		t.Errorf("manifest stopped with %q, triggered by %q at %v", manifest.StopReason, manifest.TriggerReason, manifest.TriggerTime)
+	}
+	// The oldest buffered packet is more than 5.5s old by the time of the trigger
+	if len(packets) != 5 || !packets[0].Timestamp.Equal(now.Add(-5*time.Second)) {
+		t.Fatalf("triggered session holds %d packets, want the 5 of the last 5.5s", len(packets))
+	}
+	if !manifest.StartTime.Equal(packets[0].Timestamp) {
+		t.Errorf("StartTime = %v, want the time of the oldest packet %v", manifest.StartTime, packets[0].Timestamp)
+	}
+	if got := testutil.ToFloat64(metrics.ArmedBufferBytes); got != 0 {
+		t.Errorf("armed_buffer_bytes = %v after the trigger, want 0", got)
+	}
+
+	manager.StopSession("test-ns", "test-pod", sess.captureID)
+	<-sess.done
+	waitFor(t, "removal of the triggered session", func() bool {
+		_, err := os.Stat(filepath.Join(manager.captureDir, "test-ns"))
+		return os.IsNotExist(err)
+	})
+}
+
+func TestArmedCaptureWritesPostTriggerWindow(t *testing.T) {
+	manager := newTestManager(t)
+	spec := &CaptureSpec{FileCount: 1, FileSizeMB: 1, Mode: ModeArmed, BufferSizeMB: 1, PostTrigger: metav1.Duration{Duration: time.Hour}, Retention: metav1.Duration{Duration: time.Hour}}
+	source := newFakeSource()
+	sess := addArmedSession(t, manager, spec, source)
+
+	now := time.Now().Truncate(time.Microsecond)
+	source.packets <- testPacket(now.Add(-time.Second))
+	if ids := manager.Trigger("test-ns", "test-pod", "alert"); len(ids) != 1 {
+		t.Fatalf("Trigger() = %v, want the armed capture", ids)
+	}
+	waitFor(t, "triggered session", func() bool {
+		_, err := readTriggeredManifest(manager.captureDir)
+		return err == nil
+	})
+	source.packets <- testPacket(now)
+	source.packets <- testPacket(now.Add(time.Second))
+
+	manager.StopSession("test-ns", "test-pod", sess.captureID)
+	<-sess.done
+	manifest, packets := readSession(t, manager)
+	if manifest.StopReason != StopReasonStopped || manifest.TriggerReason != "alert" {
+		t.Errorf("manifest stopped with %q, triggered by %q", manifest.StopReason, manifest.TriggerReason)
+	}
+	if len(packets) != 3 {
+		t.Errorf("triggered session holds %d packets, want the buffered one and 2 of the post-trigger window", len(packets))
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].SHA256 == "" {
+		t.Errorf("manifest files = %+v, want one hashed pcap file", manifest.Files)
+	}
+}
+
+func TestArmedCapturesShareTheBufferBudget(t *testing.T) {
+	manager := newTestManager(t)
+	manager.cfg.MaxArmedBufferMB = 48
+	sess := addArmedSession(t, manager, &CaptureSpec{Mode: ModeArmed, BufferSizeMB: 32}, newFakeSource())
+	defer func() {
+		manager.StopSession("test-ns", "test-pod", sess.captureID)
+		<-sess.done
+	}()
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "other-pod", UID: "uid-2"}}
+	start := func(bufferSizeMB int) error {
+		spec, err := ParseCaptureSpec(fmt.Sprintf(`{"mode":"armed","bufferSizeMB":%d}`, bufferSizeMB))
+		if err != nil {
+			t.Fatalf("ParseCaptureSpec() returned error: %v", err)
+		}
+		return manager.StartCapture(pod, "test-ns/other-pod", spec)
+	}
+	var budgetErr *utils.CaptureError
+	if err := start(32); !errors.As(err, &budgetErr) || utils.IsPermanent(err) {
+		t.Errorf("StartCapture() = %v, want a transient error while the budget is held by another capture", err)
+	}
+	if err := start(64); !errors.As(err, &budgetErr) || !utils.IsPermanent(err) {
+		t.Errorf("StartCapture() = %v, want a permanent error for a buffer above the whole budget", err)
+	}
+	// A buffer that fits gets past the budget and only fails to find the
+	// pod's process
+	if err := start(16); err == nil || strings.Contains(err.Error(), "budget") {
+		t.Errorf("StartCapture() = %v, want the budget to admit a buffer that fits", err)
+	}
+}
+
+// readTriggeredManifest reads the manifest of the first triggered session of
+// test-ns/test-pod
+func readTriggeredManifest(captureDir string) (*Manifest, error) {
+	dirs, err := filepath.Glob(filepath.Join(captureDir, "test-ns", "test-pod", "armed_*"))
+	if err != nil || len(dirs) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return ReadManifest(dirs[0])
+}
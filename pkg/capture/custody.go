@@ -0,0 +1,135 @@
+package capture
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CustodyLogFileName is the append-only, hash-chained log of every finalised
+// segment of a session, kept next to its manifest
+const CustodyLogFileName = "custody.log"
+
+// Custody log events
+const (
+	// CustodyEventStart opens the chain of a session
+	CustodyEventStart = "start"
+	// CustodyEventSegment records a pcap file tcpdump finished writing
+	CustodyEventSegment = "segment"
+	// CustodyEventStop closes the chain when the session stops
+	CustodyEventStop = "stop"
+)
+
+// CustodyEntry is one line of the custody log. Hash covers every other field,
+// including PrevHash, so no entry can be altered, dropped or reordered
+// without breaking the chain.
+type CustodyEntry struct {
+	Seq       int       `json:"seq"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	SessionID string    `json:"sessionID,omitempty"`
+	// File is relative to the session directory
+	File      string `json:"file,omitempty"`
+	SizeBytes int64  `json:"sizeBytes,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+	PrevHash  string `json:"prevHash"`
+	Hash      string `json:"hash"`
+}
+
+// computeHash returns the hash of the entry with its Hash field cleared
+func (e CustodyEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// custodyLog appends entries to the custody log of a session
+type custodyLog struct {
+	path string
+	seq  int
+	head string
+}
+
+func newCustodyLog(dir string) *custodyLog {
+	return &custodyLog{path: filepath.Join(dir, CustodyLogFileName)}
+}
+
+// append links entry to the chain and writes it as one JSON line
+func (l *custodyLog) append(entry CustodyEntry) error {
+	entry.Seq = l.seq
+	entry.Time = entry.Time.UTC()
+	entry.PrevHash = l.head
+	hash, err := entry.computeHash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	l.seq++
+	l.head = hash
+	return nil
+}
+
+// ReadCustodyLog reads the custody log in a session directory and checks that
+// its entries form an unbroken chain
+func ReadCustodyLog(dir string) ([]CustodyEntry, error) {
+	f, err := os.Open(filepath.Join(dir, CustodyLogFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []CustodyEntry
+	prev := ""
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var entry CustodyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("custody log line %d is not valid JSON: %w", line, err)
+		}
+		if entry.Seq != len(entries) {
+			return nil, fmt.Errorf("custody log line %d has sequence %d, want %d", line, entry.Seq, len(entries))
+		}
+		if entry.PrevHash != prev {
+			return nil, fmt.Errorf("custody log entry %d does not link to the previous entry", entry.Seq)
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return nil, err
+		}
+		if hash != entry.Hash {
+			return nil, fmt.Errorf("custody log entry %d was modified: hash %s, want %s", entry.Seq, entry.Hash, hash)
+		}
+		entries = append(entries, entry)
+		prev = entry.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,205 @@
+package capture
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestKeys writes a generated Ed25519 key pair as PEM files
+func writeTestKeys(t *testing.T, dir string) (privatePath, publicPath string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %v", err)
+	}
+	privatePath, publicPath = filepath.Join(dir, "key.pem"), filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+		t.Fatalf("Failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	return privatePath, publicPath
+}
+
+// writeTestBundle runs a manifest writer through a session with two segments
+func writeTestBundle(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+	dir := t.TempDir()
+	files := rotatedFiles(filepath.Join(dir, pcapBaseName), 2)
+	w := newManifestWriter(dir, files, Manifest{SessionID: "s1", CaptureID: "shop/web-0", StartTime: time.Now()}, key)
+	if err := w.start(); err != nil {
+		t.Fatalf("start() returned error: %v", err)
+	}
+
+	if err := os.WriteFile(files[0], []byte("first"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := w.checkRotation(); err != nil {
+		t.Fatalf("checkRotation() returned error: %v", err)
+	}
+	if err := os.WriteFile(files[1], []byte("second"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(files[1], later, later); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	if err := w.checkRotation(); err != nil {
+		t.Fatalf("checkRotation() returned error: %v", err)
+	}
+	if err := w.finish(time.Now(), StopReasonStopped, nil); err != nil {
+		t.Fatalf("finish() returned error: %v", err)
+	}
+	return dir
+}
+
+func TestCustodyLogChain(t *testing.T) {
+	dir := writeTestBundle(t, nil)
+
+	entries, err := ReadCustodyLog(dir)
+	if err != nil {
+		t.Fatalf("ReadCustodyLog() returned error: %v", err)
+	}
+	var events []string
+	for _, e := range entries {
+		events = append(events, e.Event+":"+e.File)
+	}
+	if got, want := strings.Join(events, ","), "start:,segment:capture.pcap0,segment:capture.pcap1,stop:"; got != want {
+		t.Errorf("custody events = %s, want %s", got, want)
+	}
+
+	result, err := VerifyBundle(dir, nil)
+	if err != nil {
+		t.Fatalf("VerifyBundle() returned error: %v", err)
+	}
+	if result.Segments != 2 || !result.Complete || result.Signed {
+		t.Errorf("unexpected verification result: %+v", result)
+	}
+}
+
+func TestVerifyBundleDetectsTampering(t *testing.T) {
+	keyDir := t.TempDir()
+	privatePath, publicPath := writeTestKeys(t, keyDir)
+	signingKey, err := LoadSigningKey(privatePath)
+	if err != nil {
+		t.Fatalf("LoadSigningKey() returned error: %v", err)
+	}
+	publicKey, err := LoadVerificationKey(publicPath)
+	if err != nil {
+		t.Fatalf("LoadVerificationKey() returned error: %v", err)
+	}
+	_, otherPublic := writeTestKeys(t, t.TempDir())
+	otherKey, err := LoadVerificationKey(otherPublic)
+	if err != nil {
+		t.Fatalf("LoadVerificationKey() returned error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		signed  bool
+		key     ed25519.PublicKey
+		tamper  func(dir string) error
+		wantErr string
+	}{
+		{name: "untouched signed bundle", signed: true, key: publicKey},
+		{
+			name:   "modified pcap",
+			signed: true,
+			key:    publicKey,
+			tamper: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "capture.pcap0"), []byte("forged"), 0644)
+			},
+			wantErr: "modified after capture",
+		},
+		{
+			name:   "edited custody entry",
+			signed: true,
+			key:    publicKey,
+			tamper: func(dir string) error {
+				path := filepath.Join(dir, CustodyLogFileName)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(path, []byte(strings.Replace(string(data), `"sizeBytes":5`, `"sizeBytes":6`, 1)), 0644)
+			},
+			wantErr: "was modified",
+		},
+		{
+			name:   "dropped custody entry",
+			signed: true,
+			key:    publicKey,
+			tamper: func(dir string) error {
+				path := filepath.Join(dir, CustodyLogFileName)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				lines := strings.SplitAfter(string(data), "\n")
+				return os.WriteFile(path, []byte(lines[0]+strings.Join(lines[2:], "")), 0644)
+			},
+			wantErr: "sequence",
+		},
+		{
+			name:   "edited manifest",
+			signed: true,
+			key:    publicKey,
+			tamper: func(dir string) error {
+				path := filepath.Join(dir, ManifestFileName)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(path, []byte(strings.Replace(string(data), "shop/web-0", "shop/web-1", 1)), 0644)
+			},
+			wantErr: "signature does not match",
+		},
+		{name: "signed with another key", signed: true, key: otherKey, wantErr: "signature does not match"},
+		{name: "unsigned bundle", key: publicKey, wantErr: "not signed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var key ed25519.PrivateKey
+			if tt.signed {
+				key = signingKey
+			}
+			dir := writeTestBundle(t, key)
+			if tt.tamper != nil {
+				if err := tt.tamper(dir); err != nil {
+					t.Fatalf("Failed to tamper with bundle: %v", err)
+				}
+			}
+
+			result, err := VerifyBundle(dir, tt.key)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("VerifyBundle() returned error: %v", err)
+				}
+				if !result.Signed {
+					t.Error("signature should have been checked")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyBundle() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,145 +3,519 @@ package capture
 import (
 	"bufio"
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/utils"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
 )
 
 const (
-	CaptureAnnotation = "tcpdump.antrea.io"
-	CaptureDir        = "/var/log/antrea-captures"
+	CaptureAnnotation = config.DefaultAnnotationKey
+	CaptureDir        = config.DefaultCaptureDir
 )
 
 type session struct {
-	cancel context.CancelFunc
+	cancel    context.CancelFunc
+	spec      *CaptureSpec
+	captureID string
+	sessionID string
+	// defaults are the configured defaults spec was completed with
+	defaults CaptureSpec
+	// podUID identifies the pod instance captured, which outlives reuse of
+	// its name by a recreated pod
+	podUID types.UID
+	// dir is the <namespace>/<pod>/<session> directory of the session
+	dir string
+	// pcapFile is the base name tcpdump rotates into pcapFile0, pcapFile1, ...
+	pcapFile string
+	// files lists every file tcpdump may write, so cleanup never has to
+	// match names
+	files []string
+	// stopReason is recorded in the manifest when the session is stopped
+	stopReason string
+	// done is closed once tcpdump exited and the final manifest is written
+	done chan struct{}
+	// armed is set for armed captures, which have no directory of their own
+	// and write a session on every trigger instead
+	armed *armedState
+	// scheduled is set for scheduled captures, which write a session on
+	// every run instead
+	scheduled *scheduledState
+}
+
+// sessionFiles returns every file the session may have written
+func (s *session) sessionFiles() []string {
+	return withMetadataFiles(s.dir, s.files)
+}
+
+// withMetadataFiles adds the files written next to the pcap files of a
+// session in dir
+func withMetadataFiles(dir string, files []string) []string {
+	files = append([]string(nil), files...)
+	for _, name := range []string{ManifestFileName, SignatureFileName, CustodyLogFileName} {
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files
+}
+
+func (s *session) finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
 }
 
 type Manager struct {
-	mu       sync.Mutex
-	sessions map[string]*session
+	mu sync.Mutex
+	// sessions holds the running sessions of each pod, keyed by
+	// namespace/name and then by capture ID
+	sessions   map[string]map[string]*session
+	cfg        *config.Config
+	captureDir string
+	// nodeName is recorded in session manifests
+	nodeName string
+	// signingKey signs session manifests when configured
+	signingKey ed25519.PrivateKey
 }
 
-func NewManager() *Manager {
-	if err := os.MkdirAll(CaptureDir, 0755); err != nil {
+func NewManager(cfg *config.Config, nodeName string) *Manager {
+	captureDir := filepath.Clean(cfg.CaptureDir)
+	if err := os.MkdirAll(captureDir, 0755); err != nil {
 		klog.Errorf("Failed to create capture directory: %v", err)
 	}
+	migrateFlatLayout(captureDir)
+
+	var signingKey ed25519.PrivateKey
+	if cfg.SigningKeyFile != "" {
+		key, err := LoadSigningKey(cfg.SigningKeyFile)
+		if err != nil {
+			klog.Errorf("Failed to load signing key, manifests will not be signed: %v", err)
+		}
+		signingKey = key
+	}
+
 	return &Manager{
-		sessions: make(map[string]*session),
+		sessions:   make(map[string]map[string]*session),
+		cfg:        cfg,
+		captureDir: captureDir,
+		nodeName:   nodeName,
+		signingKey: signingKey,
 	}
 }
 
-func (m *Manager) StartCapture(pod *corev1.Pod) error {
+// UpdateConfig applies a reloaded configuration. New defaults only affect
+// sessions started afterwards; running tcpdump processes keep their options.
+func (m *Manager) UpdateConfig(cfg *config.Config) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.cfg = cfg
+}
 
-	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
-	if _, exists := m.sessions[key]; exists {
-		klog.V(2).Infof("Capture already running for pod %s", key)
-		return nil
+// SpecDefaults returns the configured defaults for options a capture request leaves unset
+func (m *Manager) SpecDefaults() CaptureSpec {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.specDefaultsLocked()
+}
+
+func (m *Manager) specDefaultsLocked() CaptureSpec {
+	return ConfigDefaults(m.cfg)
+}
+
+// ConfigDefaults returns the options captures take from cfg when their
+// annotation leaves them unset
+func ConfigDefaults(cfg *config.Config) CaptureSpec {
+	return CaptureSpec{
+		FileCount:  cfg.DefaultFileCount,
+		FileSizeMB: cfg.DefaultFileSizeMB,
 	}
+}
 
-	limit, ok := pod.Annotations[CaptureAnnotation]
-	if !ok {
-		return fmt.Errorf("capture annotation not found")
+// sameRequestLocked reports whether spec asks for the capture sess runs.
+// An option the session took from the configured defaults still matches
+// when spec takes it from the current defaults, so a reload that only
+// changes the defaults leaves running captures alone.
+func (m *Manager) sameRequestLocked(sess *session, spec *CaptureSpec) bool {
+	if sess.spec == nil {
+		return false
+	}
+	running, requested := *sess.spec, *spec
+	started, current := resolvedDefaults(sess.defaults), resolvedDefaults(m.specDefaultsLocked())
+	if running.FileCount == started.FileCount && requested.FileCount == current.FileCount {
+		requested.FileCount = running.FileCount
+	}
+	if running.FileSizeMB == started.FileSizeMB && requested.FileSizeMB == current.FileSizeMB {
+		requested.FileSizeMB = running.FileSizeMB
 	}
+	return running == requested
+}
+
+// resolvedDefaults returns the values setDefaults fills in with defaults
+func resolvedDefaults(defaults CaptureSpec) CaptureSpec {
+	var resolved CaptureSpec
+	resolved.setDefaults(defaults)
+	return resolved
+}
+
+// CaptureIDs returns the sorted capture IDs of the sessions running for a pod
+func (m *Manager) CaptureIDs(namespace, name string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if _, err := strconv.Atoi(limit); err != nil {
-		limit = "10"
-		klog.Warningf("Invalid capture limit for pod %s, using default: 10", key)
+	var ids []string
+	for id := range m.sessions[fmt.Sprintf("%s/%s", namespace, name)] {
+		ids = append(ids, id)
 	}
+	sort.Strings(ids)
+	return ids
+}
 
-	if len(pod.Status.ContainerStatuses) == 0 {
-		return fmt.Errorf("no container statuses found for pod %s", key)
+// StartCapture starts a capture session of pod with the given options,
+// identified by captureID. Sessions with different IDs run independently
+// with their own files. A running session with the same ID and options is
+// left alone; one with the same ID but different options is replaced.
+func (m *Manager) StartCapture(pod *corev1.Pod, captureID string, spec *CaptureSpec) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+	m.stopStaleLocked(key, pod.UID)
+	if sess, exists := m.sessions[key][captureID]; exists {
+		if m.sameRequestLocked(sess, spec) {
+			klog.V(2).Infof("Capture %s already running for pod %s", captureID, key)
+			if sess.scheduled != nil {
+				// Later runs enter the containers the pod has then
+				sess.scheduled.pod = pod
+			}
+			return nil
+		}
+		klog.Infof("Options of capture %s for pod %s changed, restarting", captureID, key)
+		m.stopSessionLocked(key, captureID, StopReasonOptionsChanged)
+	}
+	switch {
+	case spec.Armed():
+		return m.startArmedLocked(pod, key, captureID, spec)
+	case spec.Scheduled():
+		return m.startScheduledLocked(pod, key, captureID, spec)
 	}
 
-	containerID := pod.Status.ContainerStatuses[0].ContainerID
-	parts := strings.Split(containerID, "://")
-	if len(parts) < 2 {
-		return fmt.Errorf("invalid container ID format: %s", containerID)
+	sess, manifest, err := m.newSession(pod, captureID, spec, time.Now())
+	if err != nil {
+		return err
 	}
-	cid := parts[1]
+	var ctx context.Context
+	var cancel context.CancelFunc
+	_, end := spec.Window()
+	switch {
+	case !end.IsZero():
+		// Captures with a window stop at its end however late they started,
+		// so the members of a group stop together
+		ctx, cancel = context.WithDeadline(context.Background(), end)
+	case spec.Duration.Duration > 0:
+		ctx, cancel = context.WithTimeout(context.Background(), spec.Duration.Duration)
+	default:
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	sess.cancel = cancel
+	if m.sessions[key] == nil {
+		m.sessions[key] = make(map[string]*session)
+	}
+	sess.defaults = m.specDefaultsLocked()
+	m.sessions[key][captureID] = sess
 
-	pid, err := findPidByContainerID(cid)
+	klog.Infof("Starting capture %s for pod %s (PID: %d, files: %d x %dMB)", captureID, key, manifest.manifest.PID, spec.FileCount, spec.FileSizeMB)
+	go m.runTcpdump(ctx, sess, key, manifest)
+
+	return nil
+}
+
+// newSession creates the directory of a new session of pod started at
+// startTime and the manifest describing it, ready for runTcpdump. The caller
+// sets the session's cancel function.
+func (m *Manager) newSession(pod *corev1.Pod, captureID string, spec *CaptureSpec, startTime time.Time) (*session, *manifestWriter, error) {
+	sessionID := newSessionID(startTime)
+	dir, err := sessionDir(m.captureDir, pod.Namespace, pod.Name, captureID, sessionID)
 	if err != nil {
-		return fmt.Errorf("failed to find PID for container %s: %w", cid, err)
+		return nil, nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	m.sessions[key] = &session{cancel: cancel}
+	containerID, pid, err := podProcess(pod, spec)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	klog.Infof("Starting capture for pod %s (PID: %d, limit: %s)", key, pid, limit)
-	go m.runTcpdump(ctx, pod, pid, limit, key)
+	inode, err := netnsInode(pid)
+	if err != nil {
+		klog.V(2).Infof("Could not read network namespace of PID %d: %v", pid, err)
+	}
 
-	return nil
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, utils.NewCaptureDirError(dir, err)
+	}
+
+	sess := &session{
+		spec:      spec,
+		captureID: captureID,
+		sessionID: sessionID,
+		podUID:    pod.UID,
+		dir:       dir,
+		pcapFile:  filepath.Join(dir, pcapBaseName),
+		done:      make(chan struct{}),
+	}
+	sess.files = rotatedFiles(sess.pcapFile, spec.FileCount)
+
+	manifest := newManifestWriter(dir, sess.files, Manifest{
+		SessionID:   sessionID,
+		CaptureID:   captureID,
+		Pod:         PodIdentity{Namespace: pod.Namespace, Name: pod.Name, UID: pod.UID},
+		Node:        m.nodeName,
+		ContainerID: containerID,
+		PID:         pid,
+		NetnsInode:  inode,
+		Command:     append([]string{"nsenter"}, spec.tcpdumpArgs(pid, sess.pcapFile)...),
+		Spec:        *spec,
+		StartTime:   startTime,
+	}, m.signingKey)
+	return sess, manifest, nil
 }
 
+// StopCapture stops every capture session of a pod
 func (m *Manager) StopCapture(namespace, name string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	key := fmt.Sprintf("%s/%s", namespace, name)
-	if sess, exists := m.sessions[key]; exists {
-		klog.Infof("Stopping capture for pod %s", key)
-		sess.cancel()
-		delete(m.sessions, key)
-		m.cleanupFiles(namespace, name)
+	for captureID := range m.sessions[key] {
+		m.stopSessionLocked(key, captureID, StopReasonStopped)
 	}
 }
 
-func (m *Manager) runTcpdump(ctx context.Context, pod *corev1.Pod, pid int, limit, key string) {
-	pcapFile := filepath.Join(CaptureDir, fmt.Sprintf("capture-%s-%s.pcap", pod.Namespace, pod.Name))
+// StopStaleSessions stops the sessions still running for an earlier pod with
+// the same namespace and name as the pod with the given UID, e.g. a
+// StatefulSet pod that was deleted and recreated before its deletion was
+// processed
+func (m *Manager) StopStaleSessions(namespace, name string, uid types.UID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopStaleLocked(fmt.Sprintf("%s/%s", namespace, name), uid)
+}
 
-	args := []string{
-		"-t", fmt.Sprintf("%d", pid),
-		"-n",
-		"--",
-		"tcpdump",
-		"-Z", "root",
-		"-i", "any",
-		"-C", "1",
-		"-W", limit,
-		"-w", pcapFile,
+func (m *Manager) stopStaleLocked(key string, uid types.UID) {
+	for captureID, sess := range m.sessions[key] {
+		if sess.podUID != uid {
+			klog.Infof("Pod %s was recreated, stopping capture %s of pod UID %s", key, captureID, sess.podUID)
+			m.stopSessionLocked(key, captureID, StopReasonPodRecreated)
+		}
+	}
+}
+
+// StopSession stops a single capture session of a pod, leaving its other
+// sessions running
+func (m *Manager) StopSession(namespace, name, captureID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopSessionLocked(fmt.Sprintf("%s/%s", namespace, name), captureID, StopReasonStopped)
+}
+
+func (m *Manager) stopSessionLocked(key, captureID, reason string) {
+	sess, exists := m.sessions[key][captureID]
+	if !exists {
+		return
+	}
+	klog.Infof("Stopping capture %s for pod %s", captureID, key)
+	sess.stopReason = reason
+	if sess.scheduled != nil && sess.scheduled.run != nil {
+		sess.scheduled.run.stopReason = reason
+	}
+	sess.cancel()
+	m.releaseSessionLocked(key, sess)
+}
+
+// releaseSessionLocked forgets sess and removes the files it tracks once
+// tcpdump exited and the session's retention has passed
+func (m *Manager) releaseSessionLocked(key string, sess *session) {
+	m.removeSessionLocked(key, sess)
+
+	if sess.dir == "" && sess.armed == nil && sess.scheduled == nil {
+		return
+	}
+	var retention time.Duration
+	if sess.spec != nil {
+		retention = sess.spec.Retention.Duration
+	}
+	if retention == 0 && sess.finished() {
+		m.removeStoredLocked(sess)
+		return
+	}
+
+	// Files are removed once tcpdump exited and the final manifest is written
+	if retention > 0 {
+		klog.V(2).Infof("Keeping files of capture %s for pod %s for %s", sess.captureID, key, retention)
+	}
+	cleanup := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.removeStoredLocked(sess)
+	}
+	go func() {
+		<-sess.done
+		time.AfterFunc(retention, cleanup)
+	}()
+}
+
+// removeStoredLocked removes the files sess wrote: those of its directory, of
+// every session an armed capture wrote when triggered, or of the runs a
+// scheduled capture kept
+func (m *Manager) removeStoredLocked(sess *session) {
+	var stored []storedSession
+	switch {
+	case sess.armed != nil:
+		stored = sess.armed.flushes
+	case sess.scheduled != nil:
+		stored = sess.scheduled.runs
+	default:
+		removeSessionFiles(m.captureDir, sess.dir, sess.sessionFiles())
+		return
+	}
+	for _, s := range stored {
+		removeSessionFiles(m.captureDir, s.dir, s.files)
+	}
+}
+
+// removeSessionLocked forgets sess if it is still the session registered
+// under its capture ID
+func (m *Manager) removeSessionLocked(key string, sess *session) {
+	podSessions := m.sessions[key]
+	if podSessions[sess.captureID] != sess {
+		return
+	}
+	delete(podSessions, sess.captureID)
+	if len(podSessions) == 0 {
+		delete(m.sessions, key)
 	}
+}
 
-	klog.V(2).Infof("Executing: nsenter %v", args)
-	cmd := exec.CommandContext(ctx, "nsenter", args...)
+func (m *Manager) runTcpdump(ctx context.Context, sess *session, key string, manifest *manifestWriter) {
+	defer close(sess.done)
+
+	command := manifest.manifest.Command
+	klog.V(2).Infof("Executing: %v", command)
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
-		if ctx.Err() == context.Canceled {
-			klog.V(2).Infof("Capture stopped gracefully for pod %s", key)
-		} else {
-			klog.Errorf("tcpdump exited with error for pod %s: %v", key, err)
+	err := cmd.Start()
+	if err == nil {
+		if werr := manifest.start(); werr != nil {
+			klog.Errorf("Failed to write manifest of capture %s for pod %s: %v", sess.captureID, key, werr)
 		}
+		err = waitTcpdump(cmd, manifest)
 	}
 
-	m.mu.Lock()
-	delete(m.sessions, key)
-	m.mu.Unlock()
+	stopReason, runErr := StopReasonExited, err
+	switch {
+	case ctx.Err() == context.Canceled:
+		m.mu.Lock()
+		stopReason, runErr = sess.stopReason, nil
+		m.mu.Unlock()
+		klog.V(2).Infof("Capture %s stopped gracefully for pod %s", sess.captureID, key)
+	case ctx.Err() == context.DeadlineExceeded:
+		stopReason, runErr = StopReasonDurationReached, nil
+		klog.Infof("Capture %s for pod %s reached its duration of %s", sess.captureID, key, sess.spec.Duration.Duration)
+	case err != nil:
+		stopReason = StopReasonFailed
+		klog.Error(utils.NewTcpdumpExecutionError(key, err))
+	}
+	if werr := manifest.finish(time.Now(), stopReason, runErr); werr != nil {
+		klog.Errorf("Failed to write manifest of capture %s for pod %s: %v", sess.captureID, key, werr)
+	}
+
+	// Sessions that reached their duration are kept so the capture is not
+	// restarted and the files are still cleaned up when it is stopped.
+	// Sessions whose tcpdump exited on its own are released, so the next
+	// sync may start a new one, and their files follow their retention.
+	if stopReason == StopReasonExited || stopReason == StopReasonFailed {
+		m.mu.Lock()
+		if m.sessions[key][sess.captureID] == sess {
+			m.releaseSessionLocked(key, sess)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// waitTcpdump waits for tcpdump to exit, updating the manifest whenever it
+// rotates to the next file
+func waitTcpdump(cmd *exec.Cmd, manifest *manifestWriter) error {
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ticker := time.NewTicker(manifestUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-exited:
+			return err
+		case <-ticker.C:
+			if err := manifest.checkRotation(); err != nil {
+				klog.Errorf("Failed to update manifest in %s: %v", manifest.dir, err)
+			}
+		}
+	}
 }
 
-func (m *Manager) cleanupFiles(namespace, podName string) {
-	pattern := filepath.Join(CaptureDir, fmt.Sprintf("capture-%s-%s.pcap*", namespace, podName))
-	matches, err := filepath.Glob(pattern)
+// podProcess returns the container whose network namespace spec captures and
+// the PID of one of its processes
+func podProcess(pod *corev1.Pod, spec *CaptureSpec) (string, int, error) {
+	containerID, err := containerIDForSpec(pod, spec)
 	if err != nil {
-		klog.Errorf("Failed to glob cleanup files: %v", err)
-		return
+		return "", 0, err
+	}
+	parts := strings.Split(containerID, "://")
+	if len(parts) < 2 {
+		return "", 0, utils.NewContainerNotFoundError(fmt.Sprintf("%s/%s", pod.Namespace, pod.Name), fmt.Errorf("invalid container ID format: %q", containerID))
+	}
+	cid := parts[1]
+
+	pid, err := findPidByContainerID(cid)
+	if err != nil {
+		return "", 0, utils.NewProcessNotFoundError(cid, err)
+	}
+	return containerID, pid, nil
+}
+
+// containerIDForSpec returns the runtime ID of the container named in spec,
+// or of the first container when spec does not name one.
+func containerIDForSpec(pod *corev1.Pod, spec *CaptureSpec) (string, error) {
+	podName := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+	if len(pod.Status.ContainerStatuses) == 0 {
+		return "", utils.NewContainerNotFoundError(podName, fmt.Errorf("no container statuses found"))
+	}
+	if spec.Container == "" {
+		return pod.Status.ContainerStatuses[0].ContainerID, nil
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == spec.Container {
+			return status.ContainerID, nil
+		}
 	}
-	for _, f := range matches {
-		if err := os.Remove(f); err != nil {
-			klog.Errorf("Failed to remove capture file %s: %v", f, err)
-		} else {
-			klog.V(2).Infof("Removed capture file: %s", f)
+	for _, container := range pod.Spec.Containers {
+		if container.Name == spec.Container {
+			return "", utils.NewContainerNotFoundError(podName, fmt.Errorf("container %q has no status yet", spec.Container))
 		}
 	}
+	return "", utils.NewAnnotationParseError(spec.Container, fmt.Errorf("pod has no container named %q", spec.Container))
 }
 
 func findPidByContainerID(containerID string) (int, error) {
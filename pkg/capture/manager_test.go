@@ -1,15 +1,22 @@
 package capture
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
 	"github.com/leanovate/gopter/prop"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var testCaptureDir = CaptureDir
@@ -69,12 +76,12 @@ func TestFileCleanupOnCaptureStop(t *testing.T) {
 }
 
 func TestCompleteSessionCleanup(t *testing.T) {
-	manager := NewManager()
+	manager := NewManager(config.Default(), "node-1")
 
 	key := "test-ns/test-pod"
 
 	manager.mu.Lock()
-	manager.sessions[key] = &session{cancel: func() {}}
+	manager.sessions[key] = map[string]*session{key: {captureID: key, cancel: func() {}}}
 	manager.mu.Unlock()
 
 	manager.StopCapture("test-ns", "test-pod")
@@ -89,15 +96,16 @@ func TestCompleteSessionCleanup(t *testing.T) {
 }
 
 func TestProcessTerminationOnAnnotationRemoval(t *testing.T) {
-	manager := NewManager()
+	manager := NewManager(config.Default(), "node-1")
 
 	key := "test-ns/test-pod"
 	cancelled := false
 
 	manager.mu.Lock()
-	manager.sessions[key] = &session{
-		cancel: func() { cancelled = true },
-	}
+	manager.sessions[key] = map[string]*session{key: {
+		captureID: key,
+		cancel:    func() { cancelled = true },
+	}}
 	manager.mu.Unlock()
 
 	manager.StopCapture("test-ns", "test-pod")
@@ -116,3 +124,279 @@ func TestProcessTerminationOnAnnotationRemoval(t *testing.T) {
 		t.Error("Session still exists after stop")
 	}
 }
+
+// addTestSession registers a session of pod test-ns/<name> with one file on
+// disk, as StartCapture would without running tcpdump
+func addTestSession(t *testing.T, manager *Manager, name string, uid types.UID, captureID string, cancel func()) *session {
+	t.Helper()
+	dir, err := sessionDir(manager.captureDir, "test-ns", name, captureID, newSessionID(time.Now()))
+	if err != nil {
+		t.Fatalf("sessionDir() returned error: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session directory: %v", err)
+	}
+	done := make(chan struct{})
+	close(done)
+	sess := &session{captureID: captureID, podUID: uid, dir: dir, pcapFile: filepath.Join(dir, pcapBaseName), cancel: cancel, done: done}
+	sess.files = rotatedFiles(sess.pcapFile, 2)
+	if err := os.WriteFile(sess.files[0], []byte("test"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	key := "test-ns/" + name
+	manager.mu.Lock()
+	if manager.sessions[key] == nil {
+		manager.sessions[key] = make(map[string]*session)
+	}
+	manager.sessions[key][captureID] = sess
+	manager.mu.Unlock()
+	return sess
+}
+
+func newTestManager(t *testing.T) *Manager {
+	cfg := config.Default()
+	cfg.CaptureDir = t.TempDir()
+	return NewManager(cfg, "node-1")
+}
+
+func TestSessionsOfAPodAreIndependent(t *testing.T) {
+	manager := newTestManager(t)
+
+	key := "test-ns/test-pod"
+	stopped := map[string]bool{}
+	newSession := func(captureID string) *session {
+		return addTestSession(t, manager, "test-pod", "uid-1", captureID, func() { stopped[captureID] = true })
+	}
+	dns, burst := newSession(key+"/dns"), newSession(key+"/burst")
+
+	if got := manager.CaptureIDs("test-ns", "test-pod"); len(got) != 2 || got[0] != burst.captureID {
+		t.Fatalf("CaptureIDs() = %v, want both sessions sorted", got)
+	}
+
+	manager.StopSession("test-ns", "test-pod", burst.captureID)
+
+	if !stopped[burst.captureID] || stopped[dns.captureID] {
+		t.Errorf("only the burst session should be stopped, stopped = %v", stopped)
+	}
+	if got := manager.CaptureIDs("test-ns", "test-pod"); len(got) != 1 || got[0] != dns.captureID {
+		t.Errorf("CaptureIDs() = %v, want only %s", got, dns.captureID)
+	}
+	if _, err := os.Stat(burst.dir); !os.IsNotExist(err) {
+		t.Errorf("directory of the stopped session should be removed")
+	}
+	if _, err := os.Stat(dns.files[0]); err != nil {
+		t.Errorf("files of the running session should be kept: %v", err)
+	}
+}
+
+func TestSessionDir(t *testing.T) {
+	root := "/captures"
+	tests := []struct {
+		namespace string
+		name      string
+		captureID string
+		want      string
+		wantErr   bool
+	}{
+		{namespace: "shop", name: "web-0", captureID: "shop/web-0", want: "/captures/shop/web-0/pod_s1"},
+		{namespace: "shop", name: "web-0", captureID: "shop/web-0/dns", want: "/captures/shop/web-0/dns_s1"},
+		{namespace: "shop", name: "web-0", captureID: "shop/Deployment/web", want: "/captures/shop/web-0/Deployment_web_s1"},
+		{namespace: "shop", name: "web-0", captureID: "shop/all", want: "/captures/shop/web-0/all_s1"},
+		{namespace: "a", name: "b-c", captureID: "a/b-c", want: "/captures/a/b-c/pod_s1"},
+		{namespace: "a-b", name: "c", captureID: "a-b/c", want: "/captures/a-b/c/pod_s1"},
+		{namespace: "..", name: "web-0", captureID: "../web-0", wantErr: true},
+		{namespace: "shop", name: "../../etc", captureID: "shop/../../etc", wantErr: true},
+		{namespace: "Shop", name: "web-0", captureID: "Shop/web-0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sessionDir(root, tt.namespace, tt.name, tt.captureID, "s1")
+		if tt.wantErr {
+			if !utils.IsPermanent(err) {
+				t.Errorf("sessionDir(%q, %q, %q) = %q, want a permanent error, got %v", tt.namespace, tt.name, tt.captureID, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("sessionDir(%q, %q, %q) = %q, %v, want %q", tt.namespace, tt.name, tt.captureID, got, err, tt.want)
+		}
+	}
+
+	if _, err := sessionDir(root, "shop", "web-0", "shop/web-0/..", ""); !utils.IsPermanent(err) {
+		t.Errorf("session name %q must be refused, got %v", "..", err)
+	}
+
+	start := time.Now()
+	if a, b := newSessionID(start), newSessionID(start); a == b {
+		t.Errorf("session IDs of sessions started at the same time must differ, got %s twice", a)
+	}
+}
+
+func TestRotatedFiles(t *testing.T) {
+	tests := []struct {
+		count int
+		want  []string
+	}{
+		{1, []string{"c.pcap"}},
+		{3, []string{"c.pcap0", "c.pcap1", "c.pcap2"}},
+		{11, []string{"c.pcap00", "c.pcap01", "c.pcap02", "c.pcap03", "c.pcap04", "c.pcap05", "c.pcap06", "c.pcap07", "c.pcap08", "c.pcap09", "c.pcap10"}},
+	}
+	for _, tt := range tests {
+		if got := rotatedFiles("c.pcap", tt.count); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("rotatedFiles(%d) = %v, want %v", tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupOnlyRemovesTrackedFiles(t *testing.T) {
+	manager := newTestManager(t)
+
+	// Pod b in namespace a and pod b-c in namespace a shared a file name prefix
+	// in the flat layout
+	stopped := addTestSession(t, manager, "b", "uid-1", "test-ns/b", func() {})
+	kept := addTestSession(t, manager, "b-c", "uid-2", "test-ns/b-c", func() {})
+	unknown := filepath.Join(stopped.dir, "notes.txt")
+	if err := os.WriteFile(unknown, []byte("keep"), 0644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+
+	manager.StopCapture("test-ns", "b")
+
+	if _, err := os.Stat(stopped.files[0]); !os.IsNotExist(err) {
+		t.Error("tracked file of the stopped session should be removed")
+	}
+	if _, err := os.Stat(unknown); err != nil {
+		t.Errorf("untracked file must be kept: %v", err)
+	}
+	if _, err := os.Stat(kept.files[0]); err != nil {
+		t.Errorf("files of another pod must be kept: %v", err)
+	}
+
+	manager.StopCapture("test-ns", "b-c")
+	if _, err := os.Stat(filepath.Dir(kept.dir)); !os.IsNotExist(err) {
+		t.Error("empty pod directory should be removed with its last session")
+	}
+	if _, err := os.Stat(filepath.Join(manager.captureDir, "test-ns")); err != nil {
+		t.Errorf("namespace directory still holding files must be kept: %v", err)
+	}
+}
+
+func TestMigrateFlatLayout(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"capture-a-b-c.pcap0", "capture-a-b-c.pcap1", "other.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("test"), 0644); err != nil {
+			t.Fatalf("Failed to create file: %v", err)
+		}
+	}
+
+	cfg := config.Default()
+	cfg.CaptureDir = root
+	NewManager(cfg, "node-1")
+
+	for _, name := range []string{"capture-a-b-c.pcap0", "capture-a-b-c.pcap1"} {
+		if _, err := os.Stat(filepath.Join(root, MigratedDir, name)); err != nil {
+			t.Errorf("%s should be migrated: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should no longer be in the capture directory", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "other.txt")); err != nil {
+		t.Errorf("unrelated files must be left alone: %v", err)
+	}
+}
+
+func TestRecreatedPodStopsStaleSessions(t *testing.T) {
+	manager := newTestManager(t)
+
+	key := "test-ns/web-0"
+	cancelled := false
+	old := addTestSession(t, manager, "web-0", "old-uid", key, func() { cancelled = true })
+
+	newDir, err := sessionDir(manager.captureDir, "test-ns", "web-0", key, newSessionID(time.Now()))
+	if err != nil {
+		t.Fatalf("sessionDir() returned error: %v", err)
+	}
+	if newDir == old.dir {
+		t.Fatal("a recreated pod must not share the session directory of its predecessor")
+	}
+
+	manager.StopStaleSessions("test-ns", "web-0", "old-uid")
+	if cancelled {
+		t.Fatal("sessions of the current pod must not be stopped")
+	}
+
+	manager.StopStaleSessions("test-ns", "web-0", "new-uid")
+	if !cancelled {
+		t.Error("session of the earlier pod should be stopped")
+	}
+	if ids := manager.CaptureIDs("test-ns", "web-0"); len(ids) != 0 {
+		t.Errorf("CaptureIDs() = %v, want none", ids)
+	}
+	if _, err := os.Stat(old.dir); !os.IsNotExist(err) {
+		t.Error("files of the earlier pod should be removed")
+	}
+}
+
+func TestReloadedDefaultsKeepRunningCaptures(t *testing.T) {
+	manager := newTestManager(t)
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "test-ns", Name: "test-pod", UID: "uid-1"}}
+	key := "test-ns/test-pod"
+	cancelled := false
+	sess := addTestSession(t, manager, "test-pod", "uid-1", key, func() { cancelled = true })
+	parse := func(value string) *CaptureSpec {
+		spec, err := ParseCaptureSpecWithDefaults(value, manager.SpecDefaults())
+		if err != nil {
+			t.Fatalf("ParseCaptureSpecWithDefaults(%q) returned error: %v", value, err)
+		}
+		return spec
+	}
+	sess.spec = parse(`{"filter":"port 53"}`)
+	sess.defaults = manager.SpecDefaults()
+
+	cfg := config.Default()
+	cfg.CaptureDir = manager.captureDir
+	cfg.DefaultFileCount = sess.spec.FileCount + 3
+	cfg.DefaultFileSizeMB = sess.spec.FileSizeMB + 10
+	manager.UpdateConfig(cfg)
+
+	if err := manager.StartCapture(pod, key, parse(`{"filter":"port 53"}`)); err != nil || cancelled {
+		t.Fatalf("StartCapture() = %v, cancelled = %v; a capture relying on reloaded defaults should keep running", err, cancelled)
+	}
+	if _, err := os.Stat(sess.files[0]); err != nil {
+		t.Errorf("files of the running capture should be kept: %v", err)
+	}
+
+	// The session has no process to restart, so only the stop is checked
+	_ = manager.StartCapture(pod, key, parse(`{"filter":"port 53","snaplen":96}`))
+	if !cancelled {
+		t.Error("a capture whose requested options changed should be restarted")
+	}
+}
+
+func TestExitedSessionFilesFollowRetention(t *testing.T) {
+	manager := newTestManager(t)
+	key := "test-ns/test-pod"
+	run := func(captureID string, retention time.Duration) *session {
+		sess := addTestSession(t, manager, "test-pod", "uid-1", captureID, func() {})
+		sess.spec = &CaptureSpec{Retention: metav1.Duration{Duration: retention}}
+		sess.done = make(chan struct{})
+		// tcpdump failing right away, e.g. because the pod's process is gone
+		manifest := newManifestWriter(sess.dir, sess.files, Manifest{CaptureID: captureID, Command: []string{"sh", "-c", "exit 1"}}, nil)
+		manager.runTcpdump(context.Background(), sess, key, manifest)
+		return sess
+	}
+
+	failed := run(key+"/failed", 0)
+	kept := run(key+"/kept", time.Hour)
+	if ids := manager.CaptureIDs("test-ns", "test-pod"); len(ids) != 0 {
+		t.Errorf("CaptureIDs() = %v, want failed sessions released for a restart", ids)
+	}
+	waitFor(t, "removal of the failed session", func() bool {
+		_, err := os.Stat(failed.dir)
+		return os.IsNotExist(err)
+	})
+	if _, err := os.Stat(kept.files[0]); err != nil {
+		t.Errorf("files of a failed session with retention should be kept: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package capture
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// ManifestFileName is the metadata file written next to the pcap files
+	// of every session
+	ManifestFileName = "manifest.json"
+
+	// manifestUpdateInterval is how often a running session checks whether
+	// tcpdump rotated to the next file
+	manifestUpdateInterval = 10 * time.Second
+)
+
+// Stop reasons recorded in the manifest
+const (
+	// StopReasonStopped means the capture was no longer requested or the pod went away
+	StopReasonStopped = "Stopped"
+	// StopReasonOptionsChanged means the session was replaced by one with new options
+	StopReasonOptionsChanged = "OptionsChanged"
+	// StopReasonPodRecreated means a new pod with the same name replaced the captured one
+	StopReasonPodRecreated = "PodRecreated"
+	// StopReasonDurationReached means the requested duration elapsed
+	StopReasonDurationReached = "DurationReached"
+	// StopReasonExited means tcpdump exited on its own
+	StopReasonExited = "Exited"
+	// StopReasonFailed means tcpdump could not be started or failed
+	StopReasonFailed = "Failed"
+	// StopReasonFlushed means an armed capture wrote its buffer and the
+	// post-trigger window
+	StopReasonFlushed = "Flushed"
+	// StopReasonFileLimitReached means a triggered session used every file
+	// it may write before the post-trigger window ended
+	StopReasonFileLimitReached = "FileLimitReached"
+)
+
+// PodIdentity identifies the pod instance a session captured
+type PodIdentity struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid"`
+}
+
+// ManifestFile describes one pcap file of a session
+type ManifestFile struct {
+	// Name is relative to the session directory
+	Name      string `json:"name"`
+	SizeBytes int64  `json:"sizeBytes"`
+	SHA256    string `json:"sha256"`
+}
+
+// Manifest records when, where and how a capture session ran. It is written
+// to ManifestFileName in the session directory at start, on every file
+// rotation and when the session stops.
+type Manifest struct {
+	SessionID   string      `json:"sessionID"`
+	CaptureID   string      `json:"captureID"`
+	Pod         PodIdentity `json:"pod"`
+	Node        string      `json:"node"`
+	ContainerID string      `json:"containerID"`
+	PID         int         `json:"pid"`
+	// NetnsInode identifies the network namespace tcpdump entered
+	NetnsInode uint64 `json:"netnsInode,omitempty"`
+	// Command is the exact command line that ran tcpdump
+	Command    []string       `json:"command"`
+	Spec       CaptureSpec    `json:"spec"`
+	StartTime  time.Time      `json:"startTime"`
+	StopTime   *time.Time     `json:"stopTime,omitempty"`
+	StopReason string         `json:"stopReason,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Files      []ManifestFile `json:"files"`
+	// TriggerTime and TriggerReason record when and why an armed capture
+	// wrote this session; StartTime is then the time of its oldest packet
+	TriggerTime   *time.Time `json:"triggerTime,omitempty"`
+	TriggerReason string     `json:"triggerReason,omitempty"`
+	// CustodyHead is the hash of the last custody log entry when the
+	// manifest was written, so a signed manifest also vouches for the log
+	CustodyHead string `json:"custodyHead,omitempty"`
+}
+
+// ReadManifest reads the manifest in a session directory
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %w", dir, err)
+	}
+	return manifest, nil
+}
+
+// fileDigest caches the hash of a file that has not changed since
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// manifestWriter keeps the manifest and custody log of a running session up
+// to date. It is owned by the goroutine running tcpdump.
+type manifestWriter struct {
+	dir      string
+	files    []string
+	manifest Manifest
+	digests  map[string]fileDigest
+	// current is the file tcpdump was last seen writing to
+	current string
+	custody *custodyLog
+	// logged is the state of each file when it was last logged as a segment
+	logged map[string]fileDigest
+	// signingKey signs every manifest written when set
+	signingKey ed25519.PrivateKey
+}
+
+func newManifestWriter(dir string, files []string, manifest Manifest, signingKey ed25519.PrivateKey) *manifestWriter {
+	return &manifestWriter{
+		dir:        dir,
+		files:      files,
+		manifest:   manifest,
+		digests:    make(map[string]fileDigest),
+		custody:    newCustodyLog(dir),
+		logged:     make(map[string]fileDigest),
+		signingKey: signingKey,
+	}
+}
+
+// start opens the custody log and writes the first manifest
+func (w *manifestWriter) start() error {
+	err := w.custody.append(CustodyEntry{
+		Time:      w.manifest.StartTime,
+		Event:     CustodyEventStart,
+		SessionID: w.manifest.SessionID,
+	})
+	if err != nil {
+		return err
+	}
+	return w.write()
+}
+
+// checkRotation logs the segments tcpdump finished and rewrites the manifest
+// when tcpdump moved on to another file
+func (w *manifestWriter) checkRotation() error {
+	var current string
+	var latest time.Time
+	for _, f := range w.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if current == "" || info.ModTime().After(latest) {
+			current, latest = f, info.ModTime()
+		}
+	}
+	if current == w.current {
+		return nil
+	}
+	w.current = current
+	if err := w.logSegments(current); err != nil {
+		return err
+	}
+	return w.write()
+}
+
+// finish logs the remaining segments, closes the custody log, records how
+// the session ended and writes the final manifest
+func (w *manifestWriter) finish(stopTime time.Time, reason string, err error) error {
+	if lerr := w.logSegments(""); lerr != nil {
+		return lerr
+	}
+	if lerr := w.custody.append(CustodyEntry{Time: stopTime, Event: CustodyEventStop}); lerr != nil {
+		return lerr
+	}
+	w.manifest.StopTime = &stopTime
+	w.manifest.StopReason = reason
+	if err != nil {
+		w.manifest.Error = err.Error()
+	}
+	return w.write()
+}
+
+// logSegments appends a custody entry for every file other than active that
+// changed since it was last logged, oldest first
+func (w *manifestWriter) logSegments(active string) error {
+	type segment struct {
+		path string
+		info os.FileInfo
+	}
+	var segments []segment
+	for _, f := range w.files {
+		if f == active {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			segments = append(segments, segment{f, info})
+		}
+	}
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].info.ModTime().Before(segments[j].info.ModTime())
+	})
+
+	for _, seg := range segments {
+		d, err := w.digest(seg.path, seg.info)
+		if err != nil {
+			return err
+		}
+		if w.logged[seg.path] == d {
+			continue
+		}
+		err = w.custody.append(CustodyEntry{
+			Time:      time.Now(),
+			Event:     CustodyEventSegment,
+			File:      filepath.Base(seg.path),
+			SizeBytes: d.size,
+			SHA256:    d.sum,
+		})
+		if err != nil {
+			return err
+		}
+		w.logged[seg.path] = d
+	}
+	return nil
+}
+
+// write refreshes the file list, atomically replaces the manifest and signs
+// it when a signing key is configured
+func (w *manifestWriter) write() error {
+	w.manifest.Files = w.manifest.Files[:0]
+	for _, f := range w.files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		d, err := w.digest(f, info)
+		if err != nil {
+			return err
+		}
+		w.manifest.Files = append(w.manifest.Files, ManifestFile{
+			Name:      filepath.Base(f),
+			SizeBytes: info.Size(),
+			SHA256:    d.sum,
+		})
+	}
+	w.manifest.CustodyHead = w.custody.head
+
+	data, err := json.MarshalIndent(&w.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(w.dir, ManifestFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if w.signingKey != nil {
+		return signManifest(w.dir, data, w.signingKey)
+	}
+	return nil
+}
+
+func (w *manifestWriter) digest(path string, info os.FileInfo) (fileDigest, error) {
+	if d, ok := w.digests[path]; ok && d.size == info.Size() && d.modTime.Equal(info.ModTime()) {
+		return d, nil
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		return fileDigest{}, err
+	}
+	d := fileDigest{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	w.digests[path] = d
+	return d, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// netnsInode returns the inode of the network namespace of pid, which tells
+// namespaces apart even after PIDs are reused
+func netnsInode(pid int) (uint64, error) {
+	info, err := os.Stat(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("unexpected stat type %T", info.Sys())
+	}
+	return stat.Ino, nil
+}
@@ -0,0 +1,136 @@
+package capture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifestWriterTracksRotation(t *testing.T) {
+	dir := t.TempDir()
+	files := rotatedFiles(filepath.Join(dir, pcapBaseName), 3)
+	w := newManifestWriter(dir, files, Manifest{SessionID: "s1", CaptureID: "shop/web-0", Node: "node-1"}, nil)
+
+	if err := os.WriteFile(files[0], []byte("first"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := w.checkRotation(); err != nil {
+		t.Fatalf("checkRotation() returned error: %v", err)
+	}
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadManifest() returned error: %v", err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Name != "capture.pcap0" || manifest.Files[0].SHA256 != sha256Hex("first") {
+		t.Fatalf("unexpected files after first write: %+v", manifest.Files)
+	}
+
+	// No rotation: the manifest is left alone
+	if err := os.Remove(filepath.Join(dir, ManifestFileName)); err != nil {
+		t.Fatalf("Failed to remove manifest: %v", err)
+	}
+	if err := w.checkRotation(); err != nil {
+		t.Fatalf("checkRotation() returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestFileName)); !os.IsNotExist(err) {
+		t.Error("manifest should only be rewritten on rotation")
+	}
+
+	if err := os.WriteFile(files[1], []byte("second"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(files[1], later, later); err != nil {
+		t.Fatalf("Failed to set file time: %v", err)
+	}
+	if err := w.checkRotation(); err != nil {
+		t.Fatalf("checkRotation() returned error: %v", err)
+	}
+	manifest, err = ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadManifest() returned error: %v", err)
+	}
+	if len(manifest.Files) != 2 || manifest.Files[1].SizeBytes != int64(len("second")) || manifest.Files[1].SHA256 != sha256Hex("second") {
+		t.Errorf("unexpected files after rotation: %+v", manifest.Files)
+	}
+	if manifest.StopTime != nil {
+		t.Errorf("running session should have no stop time, got %v", manifest.StopTime)
+	}
+}
+
+func TestSessionManifestRecordsStop(t *testing.T) {
+	manager := newTestManager(t)
+
+	key := "test-ns/web-0"
+	dir, err := sessionDir(manager.captureDir, "test-ns", "web-0", key, "s1")
+	if err != nil {
+		t.Fatalf("sessionDir() returned error: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Failed to create session directory: %v", err)
+	}
+
+	spec := &CaptureSpec{FileCount: 2, FileSizeMB: 1, Retention: metav1.Duration{Duration: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		cancel:    cancel,
+		spec:      spec,
+		captureID: key,
+		sessionID: "s1",
+		dir:       dir,
+		pcapFile:  filepath.Join(dir, pcapBaseName),
+		done:      make(chan struct{}),
+	}
+	sess.files = rotatedFiles(sess.pcapFile, spec.FileCount)
+	manager.mu.Lock()
+	manager.sessions[key] = map[string]*session{key: sess}
+	manager.mu.Unlock()
+
+	// A stand-in for tcpdump that writes one file and keeps running
+	command := []string{"sh", "-c", "printf data > " + sess.files[0] + " && exec sleep 30"}
+	w := newManifestWriter(dir, sess.files, Manifest{SessionID: "s1", CaptureID: key, Command: command, Spec: *spec, StartTime: time.Now()}, nil)
+	go manager.runTcpdump(ctx, sess, key, w)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(sess.files[0]); err == nil && string(data) == "data" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stand-in tcpdump did not write its file")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	manager.StopSession("test-ns", "web-0", key)
+	select {
+	case <-sess.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not finish after stop")
+	}
+
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		t.Fatalf("ReadManifest() returned error: %v", err)
+	}
+	if manifest.StopReason != StopReasonStopped || manifest.StopTime == nil || manifest.Error != "" {
+		t.Errorf("unexpected stop in manifest: reason %q, time %v, error %q", manifest.StopReason, manifest.StopTime, manifest.Error)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].SHA256 != sha256Hex("data") {
+		t.Errorf("unexpected files in final manifest: %+v", manifest.Files)
+	}
+	if len(manifest.Command) != 3 || manifest.Command[0] != "sh" {
+		t.Errorf("manifest should record the exact command, got %v", manifest.Command)
+	}
+}
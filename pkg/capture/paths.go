@@ -0,0 +1,161 @@
+package capture
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// pcapBaseName is the file tcpdump rotates into inside a session directory
+	pcapBaseName = "capture.pcap"
+	// podSessionName names the session of a pod's own single-capture annotation
+	podSessionName = "pod"
+	// MigratedDir holds files of the flat capture-<ns>-<pod>.pcap layout,
+	// whose namespace and pod cannot be told apart reliably. Its name is not
+	// a valid namespace so it never collides with one.
+	MigratedDir = "_migrated"
+)
+
+// newSessionID returns an ID that sorts by start time and stays unique when a
+// session is restarted within the same second
+func newSessionID(start time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		klog.Errorf("Failed to generate session ID suffix: %v", err)
+	}
+	return fmt.Sprintf("%s-%s", start.UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+}
+
+// sessionName returns the directory name of a capture session: the capture
+// ID relative to the pod, followed by the session ID so neither a restarted
+// session nor a recreated pod shares files with its predecessor.
+func sessionName(namespace, name, captureID, sessionID string) string {
+	podID := fmt.Sprintf("%s/%s", namespace, name)
+	session := podSessionName
+	if captureID != podID && captureID != "" {
+		session = strings.TrimPrefix(captureID, podID+"/")
+		session = strings.TrimPrefix(session, namespace+"/")
+	}
+	if sessionID != "" {
+		session = fmt.Sprintf("%s_%s", session, sessionID)
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == '_' {
+			return r
+		}
+		return '_'
+	}, session)
+}
+
+// sessionDir returns the <root>/<namespace>/<pod>/<session> directory of a
+// capture session. Namespace and pod name must be valid Kubernetes names and
+// the result must stay below root, so no request can write elsewhere.
+func sessionDir(root, namespace, name, captureID, sessionID string) (string, error) {
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return "", utils.NewUnsafePathError(namespace, fmt.Errorf("invalid namespace %q: %v", namespace, errs))
+	}
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", utils.NewUnsafePathError(name, fmt.Errorf("invalid pod name %q: %v", name, errs))
+	}
+	session := sessionName(namespace, name, captureID, sessionID)
+	if session == "." || session == ".." {
+		return "", utils.NewUnsafePathError(session, fmt.Errorf("invalid session name %q", session))
+	}
+
+	dir := filepath.Join(root, namespace, name, session)
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", utils.NewUnsafePathError(dir, fmt.Errorf("path escapes capture directory %s", root))
+	}
+	return dir, nil
+}
+
+// IsSessionFile reports whether name is one of the files a session writes to
+// its directory: a pcap file, the manifest, its signature or the custody log
+func IsSessionFile(name string) bool {
+	switch name {
+	case ManifestFileName, SignatureFileName, CustodyLogFileName:
+		return true
+	}
+	suffix, ok := strings.CutPrefix(name, pcapBaseName)
+	return ok && strings.Trim(suffix, "0123456789") == ""
+}
+
+// IsPcapFile reports whether name is a pcap file of a session
+func IsPcapFile(name string) bool {
+	return strings.HasPrefix(name, pcapBaseName) && IsSessionFile(name)
+}
+
+// rotatedFiles returns the files tcpdump writes for "-w pcapFile -W count":
+// pcapFile itself for a single file, otherwise pcapFile suffixed with the
+// file number zero-padded to the digits of count-1.
+func rotatedFiles(pcapFile string, count int) []string {
+	digits := 0
+	for x := count - 1; x > 0; x /= 10 {
+		digits++
+	}
+	if digits == 0 {
+		return []string{pcapFile}
+	}
+	files := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		files = append(files, fmt.Sprintf("%s%0*d", pcapFile, digits, i))
+	}
+	return files
+}
+
+// removeSessionFiles removes the tracked files of a session, then its
+// directory and the pod and namespace directories above it once empty
+func removeSessionFiles(root, dir string, files []string) {
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			if !os.IsNotExist(err) {
+				klog.Error(utils.NewFileCleanupError(f, err))
+			}
+			continue
+		}
+		klog.V(2).Infof("Removed capture file: %s", f)
+	}
+	for d := dir; d != root && strings.HasPrefix(d, root+string(filepath.Separator)); d = filepath.Dir(d) {
+		if err := os.Remove(d); err != nil {
+			// Not empty: files of another session or of unknown origin remain
+			break
+		}
+	}
+}
+
+// migrateFlatLayout moves capture files written flat into root by earlier
+// versions into root/_migrated, where they are kept for manual inspection
+func migrateFlatLayout(root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		klog.Errorf("Failed to read capture directory %s: %v", root, err)
+		return
+	}
+
+	migrated := filepath.Join(root, MigratedDir)
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), "capture-") || !strings.Contains(e.Name(), ".pcap") {
+			continue
+		}
+		if err := os.MkdirAll(migrated, 0755); err != nil {
+			klog.Error(utils.NewCaptureDirError(migrated, err))
+			return
+		}
+		from, to := filepath.Join(root, e.Name()), filepath.Join(migrated, e.Name())
+		if err := os.Rename(from, to); err != nil {
+			klog.Errorf("Failed to migrate capture file %s: %v", from, err)
+			continue
+		}
+		klog.Infof("Migrated capture file %s to %s", from, to)
+	}
+}
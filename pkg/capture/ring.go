@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/packet-capture-controller/pkg/pcap"
+)
+
+// packetRing keeps the latest packets of an armed capture. Packets are
+// dropped oldest first once the buffered records exceed maxBytes or are more
+// than maxAge older than the newest packet.
+type packetRing struct {
+	maxBytes int64
+	// maxAge is zero when the ring is only bounded by size
+	maxAge  time.Duration
+	packets []*pcap.Packet
+	// head is the index of the oldest packet still buffered in packets
+	head  int
+	bytes int64
+}
+
+func newPacketRing(maxBytes int64, maxAge time.Duration) *packetRing {
+	return &packetRing{maxBytes: maxBytes, maxAge: maxAge}
+}
+
+// recordSize is the space a packet takes in a pcap file
+func recordSize(p *pcap.Packet) int64 {
+	return int64(pcap.RecordHeaderLen + len(p.Data))
+}
+
+// add buffers p and drops the packets that no longer fit
+func (r *packetRing) add(p *pcap.Packet) {
+	r.packets = append(r.packets, p)
+	r.bytes += recordSize(p)
+	for r.head < len(r.packets) && r.bytes > r.maxBytes {
+		r.dropOldest()
+	}
+	r.expire(p.Timestamp)
+}
+
+// expire drops the packets more than maxAge older than now
+func (r *packetRing) expire(now time.Time) {
+	if r.maxAge <= 0 {
+		return
+	}
+	for r.head < len(r.packets) && now.Sub(r.packets[r.head].Timestamp) > r.maxAge {
+		r.dropOldest()
+	}
+}
+
+func (r *packetRing) dropOldest() {
+	r.bytes -= recordSize(r.packets[r.head])
+	r.packets[r.head] = nil
+	r.head++
+	// Reuse the backing array once most of it only holds dropped packets
+	if r.head > len(r.packets)/2 {
+		n := copy(r.packets, r.packets[r.head:])
+		clear(r.packets[n:])
+		r.packets = r.packets[:n]
+		r.head = 0
+	}
+}
+
+// take returns the buffered packets no older than maxAge before now, oldest
+// first, and empties the ring
+func (r *packetRing) take(now time.Time) []*pcap.Packet {
+	r.expire(now)
+	packets := append([]*pcap.Packet(nil), r.packets[r.head:]...)
+	r.packets, r.head, r.bytes = nil, 0, 0
+	return packets
+}
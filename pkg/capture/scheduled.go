@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"context"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/schedule"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// scheduleAfter returns a channel receiving once a scheduled run is due; a
+// variable so tests need not wait for the schedule
+var scheduleAfter = time.After
+
+// scheduledState is the part of a session only scheduled captures have
+type scheduledState struct {
+	schedule *schedule.Schedule
+	// pod is the latest version of the captured pod, whose containers may
+	// have restarted since the capture started. Guarded by Manager.mu, like
+	// the fields below.
+	pod *corev1.Pod
+	// run is the run in progress
+	run *session
+	// runs are the sessions of the latest runs, oldest first, at most
+	// keepRuns of them
+	runs []storedSession
+}
+
+// startRunFunc starts a run of a scheduled capture at start, returning
+// its session whose done channel is closed when the run ends. It is called
+// with Manager.mu held.
+type startRunFunc func(ctx context.Context, start time.Time) (*session, error)
+
+// startScheduledLocked starts a scheduled capture, which runs tcpdump for the
+// capture's duration at the times of its schedule and writes a new session
+// every time
+func (m *Manager) startScheduledLocked(pod *corev1.Pod, key, captureID string, spec *CaptureSpec) error {
+	sched, err := schedule.Parse(spec.Schedule)
+	if err != nil {
+		return err
+	}
+	// Runs are stored below the capture's directory, so refuse names that
+	// could not hold them right away
+	if _, err := sessionDir(m.captureDir, pod.Namespace, pod.Name, captureID, ""); err != nil {
+		return err
+	}
+	if _, err := containerIDForSpec(pod, spec); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		cancel:    cancel,
+		spec:      spec,
+		captureID: captureID,
+		podUID:    pod.UID,
+		done:      make(chan struct{}),
+		scheduled: &scheduledState{schedule: sched, pod: pod},
+	}
+	if m.sessions[key] == nil {
+		m.sessions[key] = make(map[string]*session)
+	}
+	sess.defaults = m.specDefaultsLocked()
+	m.sessions[key][captureID] = sess
+
+	klog.Infof("Scheduling capture %s for pod %s at %q for %s, keeping %d runs", captureID, key, spec.Schedule, spec.Duration.Duration, spec.KeepRuns)
+	go m.runScheduled(ctx, sess, key, func(ctx context.Context, start time.Time) (*session, error) {
+		run, manifest, err := m.newSession(sess.scheduled.pod, captureID, spec, start)
+		if err != nil {
+			return nil, err
+		}
+		runCtx, cancel := context.WithTimeout(ctx, spec.Duration.Duration)
+		run.cancel = cancel
+		go func() {
+			defer cancel()
+			m.runTcpdump(runCtx, run, key, manifest)
+		}()
+		return run, nil
+	})
+	return nil
+}
+
+// runScheduled starts a run whenever the schedule of a capture is due, until
+// the capture is stopped. A run still going when the next one is due makes
+// the capture skip it.
+func (m *Manager) runScheduled(ctx context.Context, sess *session, key string, startRun startRunFunc) {
+	defer close(sess.done)
+
+	state := sess.scheduled
+	for {
+		next := state.schedule.Next(time.Now())
+		if next.IsZero() {
+			klog.Infof("Schedule %q of capture %s for pod %s does not fire anymore", sess.spec.Schedule, sess.captureID, key)
+			return
+		}
+		klog.V(2).Infof("Next run of capture %s for pod %s at %s", sess.captureID, key, next)
+		select {
+		case <-ctx.Done():
+			return
+		case <-scheduleAfter(time.Until(next)):
+		}
+
+		m.mu.Lock()
+		// A capture stopped while its run was due must not start it
+		if ctx.Err() != nil {
+			m.mu.Unlock()
+			return
+		}
+		run, err := startRun(ctx, time.Now())
+		if err != nil {
+			m.mu.Unlock()
+			klog.Errorf("Failed to start scheduled run of capture %s for pod %s: %v", sess.captureID, key, err)
+			metrics.ScheduledRuns.WithLabelValues("failed").Inc()
+			continue
+		}
+		state.run = run
+		state.runs = append(state.runs, storedSession{dir: run.dir, files: run.sessionFiles()})
+		var expired []storedSession
+		if extra := len(state.runs) - sess.spec.KeepRuns; extra > 0 {
+			expired = append(expired, state.runs[:extra]...)
+			state.runs = append([]storedSession(nil), state.runs[extra:]...)
+		}
+		m.mu.Unlock()
+
+		klog.Infof("Scheduled run %s of capture %s for pod %s started for %s", run.sessionID, sess.captureID, key, sess.spec.Duration.Duration)
+		metrics.ScheduledRuns.WithLabelValues("started").Inc()
+		for _, s := range expired {
+			klog.V(2).Infof("Removing run %s of capture %s for pod %s beyond the last %d", s.dir, sess.captureID, key, sess.spec.KeepRuns)
+			removeSessionFiles(m.captureDir, s.dir, s.files)
+		}
+
+		<-run.done
+		m.mu.Lock()
+		state.run = nil
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,138 @@
+package capture
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/schedule"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// addScheduledSession registers a scheduled capture of pod test-ns/test-pod
+// whose runs write a single file and last until a value is sent on end, as
+// StartCapture would without running tcpdump. Every run started is sent on
+// the returned channel.
+func addScheduledSession(t *testing.T, manager *Manager, spec *CaptureSpec, end <-chan struct{}) (*session, <-chan *session) {
+	t.Helper()
+	sched, err := schedule.Parse(spec.Schedule)
+	if err != nil {
+		t.Fatalf("Parse() returned error: %v", err)
+	}
+	// Runs are due right away
+	scheduleAfter = func(time.Duration) <-chan time.Time {
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}
+	t.Cleanup(func() { scheduleAfter = time.After })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sess := &session{
+		cancel:    cancel,
+		spec:      spec,
+		captureID: "test-ns/test-pod/nightly",
+		podUID:    "uid-1",
+		done:      make(chan struct{}),
+		scheduled: &scheduledState{schedule: sched},
+	}
+	manager.mu.Lock()
+	manager.sessions["test-ns/test-pod"] = map[string]*session{sess.captureID: sess}
+	manager.mu.Unlock()
+
+	started := make(chan *session, 10)
+	go manager.runScheduled(ctx, sess, "test-ns/test-pod", func(ctx context.Context, start time.Time) (*session, error) {
+		sessionID := newSessionID(start)
+		dir, err := sessionDir(manager.captureDir, "test-ns", "test-pod", sess.captureID, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		file := filepath.Join(dir, pcapBaseName+"0")
+		if err := os.WriteFile(file, []byte("pcap"), 0644); err != nil {
+			return nil, err
+		}
+		run := &session{captureID: sess.captureID, sessionID: sessionID, dir: dir, files: []string{file}, done: make(chan struct{})}
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-end:
+			}
+			close(run.done)
+		}()
+		started <- run
+		return run, nil
+	})
+	return sess, started
+}
+
+func runDirs(t *testing.T, manager *Manager) []string {
+	t.Helper()
+	dirs, err := filepath.Glob(filepath.Join(manager.captureDir, "test-ns", "test-pod", "nightly_*"))
+	if err != nil {
+		t.Fatalf("Glob() returned error: %v", err)
+	}
+	return dirs
+}
+
+func TestScheduledCaptureKeepsLastRuns(t *testing.T) {
+	manager := newTestManager(t)
+	spec := &CaptureSpec{FileCount: 1, FileSizeMB: 1, Duration: metav1.Duration{Duration: time.Minute}, Schedule: "@daily", KeepRuns: 2}
+	end := make(chan struct{})
+	sess, started := addScheduledSession(t, manager, spec, end)
+
+	var runs []*session
+	for i := 0; i < 3; i++ {
+		run := <-started
+		runs = append(runs, run)
+		// A run does not start before the previous one ended
+		select {
+		case extra := <-started:
+			t.Fatalf("run %s started while %s was running", extra.sessionID, run.sessionID)
+		case <-time.After(20 * time.Millisecond):
+		}
+		if i < 2 {
+			end <- struct{}{}
+		}
+	}
+
+	dirs := runDirs(t, manager)
+	if len(dirs) != 2 || dirs[0] == runs[0].dir || dirs[1] == runs[0].dir {
+		t.Fatalf("run directories = %v, want those of the last 2 runs", dirs)
+	}
+	if _, err := os.Stat(runs[0].dir); !os.IsNotExist(err) {
+		t.Errorf("oldest run %s was kept", runs[0].dir)
+	}
+
+	manager.StopSession("test-ns", "test-pod", sess.captureID)
+	<-sess.done
+	if runs[2].stopReason != StopReasonStopped {
+		t.Errorf("run in progress stopped with %q, want %q", runs[2].stopReason, StopReasonStopped)
+	}
+	waitFor(t, "removal of the kept runs", func() bool {
+		_, err := os.Stat(filepath.Join(manager.captureDir, "test-ns"))
+		return os.IsNotExist(err)
+	})
+}
+
+func TestScheduledCaptureKeepsRunsForRetention(t *testing.T) {
+	manager := newTestManager(t)
+	spec := &CaptureSpec{FileCount: 1, FileSizeMB: 1, Duration: metav1.Duration{Duration: time.Minute}, Schedule: "@hourly", KeepRuns: 3, Retention: metav1.Duration{Duration: time.Hour}}
+	sess, started := addScheduledSession(t, manager, spec, make(chan struct{}))
+
+	run := <-started
+	manager.StopSession("test-ns", "test-pod", sess.captureID)
+	<-sess.done
+	select {
+	case <-run.done:
+	default:
+		t.Fatal("stopping the capture did not end its run")
+	}
+	if dirs := runDirs(t, manager); len(dirs) != 1 {
+		t.Errorf("run directories = %v, want the run kept for the retention", dirs)
+	}
+}
@@ -0,0 +1,121 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// ServiceCapture is the capture annotation of a Service. It accepts the same
+// values as a pod annotation plus FilterServicePorts, e.g.
+// {"fileCount":5,"filterServicePorts":true}.
+type ServiceCapture struct {
+	CaptureSpec
+	// FilterServicePorts restricts the capture to the Service's endpoint ports
+	FilterServicePorts bool `json:"filterServicePorts,omitempty"`
+}
+
+// ParseServiceCapture parses the capture annotation of a Service. Any
+// returned error is permanent.
+func ParseServiceCapture(value string, defaults CaptureSpec) (*ServiceCapture, error) {
+	trimmed := strings.TrimSpace(value)
+	if !strings.HasPrefix(trimmed, "{") {
+		spec, err := ParseCaptureSpecWithDefaults(value, defaults)
+		if err != nil {
+			return nil, err
+		}
+		return &ServiceCapture{CaptureSpec: *spec}, nil
+	}
+
+	sc := &ServiceCapture{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(sc); err != nil {
+		return nil, utils.NewAnnotationParseError(value, err)
+	}
+	sc.CaptureSpec.setDefaults(defaults)
+	if err := sc.CaptureSpec.Validate(); err != nil {
+		return nil, utils.NewAnnotationParseError(value, err)
+	}
+	return sc, nil
+}
+
+// SpecForPorts returns the capture options for a backend of the Service. With
+// FilterServicePorts set, the user's filter is narrowed to ports.
+func (sc *ServiceCapture) SpecForPorts(ports []discoveryv1.EndpointPort) *CaptureSpec {
+	if !sc.FilterServicePorts {
+		spec := sc.CaptureSpec
+		return &spec
+	}
+	return sc.CaptureSpec.WithPortFilter(PortFilter(ports))
+}
+
+// PortFilter builds a BPF expression matching the given endpoint ports, e.g.
+// "(tcp port 8080 or udp port 53)". Ports without a number are skipped.
+func PortFilter(ports []discoveryv1.EndpointPort) string {
+	var terms []string
+	for _, p := range ports {
+		if p.Port == nil {
+			continue
+		}
+		protocol := corev1.ProtocolTCP
+		if p.Protocol != nil {
+			protocol = *p.Protocol
+		}
+		terms = append(terms, portTerm(protocol, *p.Port))
+	}
+	return joinPortTerms(terms)
+}
+
+// PodPortFilter builds a BPF expression matching the container ports
+// declared in the pod spec, or returns "" when it declares none.
+func PodPortFilter(pod *corev1.Pod) string {
+	var terms []string
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			terms = append(terms, portTerm(protocol, p.ContainerPort))
+		}
+	}
+	return joinPortTerms(terms)
+}
+
+// WithPortFilter returns a copy of s whose filter is narrowed to portFilter
+func (s CaptureSpec) WithPortFilter(portFilter string) *CaptureSpec {
+	if portFilter != "" {
+		if s.Filter == "" {
+			s.Filter = portFilter
+		} else {
+			s.Filter = fmt.Sprintf("(%s) and %s", s.Filter, portFilter)
+		}
+	}
+	return &s
+}
+
+func portTerm(protocol corev1.Protocol, port int32) string {
+	return strings.ToLower(string(protocol)) + " port " + strconv.Itoa(int(port))
+}
+
+func joinPortTerms(terms []string) string {
+	if len(terms) == 0 {
+		return ""
+	}
+	sort.Strings(terms)
+	unique := terms[:1]
+	for _, t := range terms[1:] {
+		if t != unique[len(unique)-1] {
+			unique = append(unique, t)
+		}
+	}
+	return "(" + strings.Join(unique, " or ") + ")"
+}
@@ -0,0 +1,73 @@
+package capture
+
+import (
+	"testing"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+func endpointPort(protocol corev1.Protocol, port int32) discoveryv1.EndpointPort {
+	return discoveryv1.EndpointPort{Protocol: &protocol, Port: &port}
+}
+
+func TestPortFilter(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{
+		endpointPort(corev1.ProtocolTCP, 8080),
+		endpointPort(corev1.ProtocolUDP, 53),
+		endpointPort(corev1.ProtocolTCP, 8080),
+		{Name: new(string)},
+	}
+
+	if got, want := PortFilter(ports), "(tcp port 8080 or udp port 53)"; got != want {
+		t.Errorf("PortFilter() = %q, want %q", got, want)
+	}
+	if got := PortFilter(nil); got != "" {
+		t.Errorf("PortFilter(nil) = %q, want empty", got)
+	}
+}
+
+func TestPodPortFilter(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{Ports: []corev1.ContainerPort{{ContainerPort: 53, Protocol: corev1.ProtocolUDP}}},
+			{Ports: []corev1.ContainerPort{{ContainerPort: 9153}}},
+		},
+	}}
+
+	if got, want := PodPortFilter(pod), "(tcp port 9153 or udp port 53)"; got != want {
+		t.Errorf("PodPortFilter() = %q, want %q", got, want)
+	}
+	if got := PodPortFilter(&corev1.Pod{}); got != "" {
+		t.Errorf("PodPortFilter() without ports = %q, want empty", got)
+	}
+}
+
+func TestServiceCaptureSpecForPorts(t *testing.T) {
+	ports := []discoveryv1.EndpointPort{endpointPort(corev1.ProtocolTCP, 443)}
+
+	tests := []struct {
+		value      string
+		wantFilter string
+	}{
+		{"5", ""},
+		{`{"filter":"host 10.0.0.1"}`, "host 10.0.0.1"},
+		{`{"filterServicePorts":true}`, "(tcp port 443)"},
+		{`{"filter":"host 10.0.0.1","filterServicePorts":true}`, "(host 10.0.0.1) and (tcp port 443)"},
+	}
+
+	for _, tt := range tests {
+		sc, err := ParseServiceCapture(tt.value, CaptureSpec{})
+		if err != nil {
+			t.Fatalf("ParseServiceCapture(%s) returned error: %v", tt.value, err)
+		}
+		if got := sc.SpecForPorts(ports).Filter; got != tt.wantFilter {
+			t.Errorf("filter for %s = %q, want %q", tt.value, got, tt.wantFilter)
+		}
+	}
+
+	if _, err := ParseServiceCapture(`{"filterPorts":true}`, CaptureSpec{}); !utils.IsPermanent(err) {
+		t.Errorf("unknown field should be a permanent error, got: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package capture
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SignatureFileName holds the base64 Ed25519 signature of the manifest
+const SignatureFileName = ManifestFileName + ".sig"
+
+// LoadSigningKey reads a PEM-encoded PKCS #8 Ed25519 private key, as written
+// by "openssl genpkey -algorithm ed25519"
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is a %T, want an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+// LoadVerificationKey reads a PEM-encoded PKIX Ed25519 public key, as written
+// by "openssl pkey -pubout"
+func LoadVerificationKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is a %T, want an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+	return block, nil
+}
+
+// signManifest writes the signature of the manifest bytes next to it
+func signManifest(dir string, manifest []byte, key ed25519.PrivateKey) error {
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest))
+	path := filepath.Join(dir, SignatureFileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(signature+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// verifyManifestSignature checks the signature of the manifest in dir
+func verifyManifestSignature(dir string, key ed25519.PublicKey) error {
+	manifest, err := os.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		return err
+	}
+	encoded, err := os.ReadFile(filepath.Join(dir, SignatureFileName))
+	if err != nil {
+		return fmt.Errorf("manifest is not signed: %w", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("invalid manifest signature: %w", err)
+	}
+	if !ed25519.Verify(key, manifest, signature) {
+		return fmt.Errorf("manifest signature does not match the public key")
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/schedule"
+	"github.com/packet-capture-controller/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	DefaultFileCount  = config.DefaultDefaultFileCount
+	DefaultFileSizeMB = config.DefaultDefaultFileSizeMB
+	DefaultInterface  = "any"
+
+	DefaultBufferSizeMB = 16
+	DefaultKeepRuns     = 7
+
+	MaxFileCount    = 1000
+	MaxFileSizeMB   = 1024
+	MaxSnaplen      = 262144
+	MaxBufferSizeMB = 256
+	MaxKeepRuns     = 100
+)
+
+// Capture modes
+const (
+	// ModeRecord writes packets to the session files as they are captured
+	ModeRecord = ""
+	// ModeArmed keeps the latest packets in memory and only writes them to a
+	// session when the capture is triggered
+	ModeArmed = "armed"
+)
+
+// CaptureSpec holds the options of a single capture session, parsed from the
+// capture annotation. The annotation is either a legacy integer file count,
+// e.g. "5", or a JSON object, e.g. {"fileCount":5,"filter":"port 53"}.
+type CaptureSpec struct {
+	// FileCount is the number of rotated pcap files tcpdump keeps (-W)
+	FileCount int `json:"fileCount,omitempty"`
+	// FileSizeMB is the size at which tcpdump rotates to the next file (-C)
+	FileSizeMB int `json:"fileSizeMB,omitempty"`
+	// Duration stops the capture after the given time; zero runs until the
+	// annotation is removed
+	Duration metav1.Duration `json:"duration,omitempty"`
+	// Filter is a BPF expression passed to tcpdump
+	Filter string `json:"filter,omitempty"`
+	// Snaplen limits the bytes captured per packet (-s); zero keeps tcpdump's default
+	Snaplen int `json:"snaplen,omitempty"`
+	// Interface is the interface inside the pod network namespace (-i)
+	Interface string `json:"interface,omitempty"`
+	// Container selects the container whose PID is used to enter the pod
+	// network namespace; empty means the first container
+	Container string `json:"container,omitempty"`
+	// Retention keeps capture files for the given time after the capture is
+	// stopped; zero deletes them immediately
+	Retention metav1.Duration `json:"retention,omitempty"`
+	// Mode is ModeRecord or ModeArmed
+	Mode string `json:"mode,omitempty"`
+	// BufferSizeMB bounds the packets an armed capture keeps in memory
+	BufferSizeMB int `json:"bufferSizeMB,omitempty"`
+	// BufferDuration drops packets older than this from the buffer of an
+	// armed capture; zero only bounds the buffer by size
+	BufferDuration metav1.Duration `json:"bufferDuration,omitempty"`
+	// PostTrigger keeps writing packets for this long after an armed capture
+	// was triggered
+	PostTrigger metav1.Duration `json:"postTrigger,omitempty"`
+	// Schedule is a cron expression, evaluated in UTC, at which the capture
+	// runs for Duration each time; empty captures right away
+	Schedule string `json:"schedule,omitempty"`
+	// KeepRuns is the number of runs of a scheduled capture whose files are
+	// kept; older runs are removed when a new one starts
+	KeepRuns int `json:"keepRuns,omitempty"`
+	// Group names the capture group the session belongs to, whose members
+	// are captured over the same window and merged into one file
+	Group string `json:"group,omitempty"`
+	// StartAt is an RFC 3339 time before which the capture does not start;
+	// together with Duration it fixes the capture window, so captures of
+	// different pods start and stop at the same time
+	StartAt string `json:"startAt,omitempty"`
+	// Live writes every packet to the files as it arrives (-U), so live
+	// streams of the session follow it closely; otherwise tcpdump buffers
+	// packets and live streams lag behind by up to a buffer
+	Live bool `json:"live,omitempty"`
+}
+
+// ParseCaptureSpec parses an annotation value into a CaptureSpec with the
+// package defaults applied. Any returned error is permanent.
+func ParseCaptureSpec(value string) (*CaptureSpec, error) {
+	return ParseCaptureSpecWithDefaults(value, CaptureSpec{})
+}
+
+// ParseCaptureSpecWithDefaults is like ParseCaptureSpec but takes unset
+// options from defaults before falling back to the package defaults.
+func ParseCaptureSpecWithDefaults(value string, defaults CaptureSpec) (*CaptureSpec, error) {
+	trimmed := strings.TrimSpace(value)
+	spec := &CaptureSpec{}
+
+	if strings.HasPrefix(trimmed, "{") {
+		dec := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(spec); err != nil {
+			return nil, utils.NewAnnotationParseError(value, err)
+		}
+	} else {
+		n, err := strconv.Atoi(trimmed)
+		if err != nil {
+			return nil, utils.NewAnnotationParseError(value, err)
+		}
+		if n <= 0 {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("file count must be positive, got %d", n))
+		}
+		spec.FileCount = n
+	}
+
+	spec.setDefaults(defaults)
+	if err := spec.Validate(); err != nil {
+		return nil, utils.NewAnnotationParseError(value, err)
+	}
+	return spec, nil
+}
+
+// SessionSpec is one of the captures requested by an annotation. ID tells
+// the sessions of a pod apart and is empty when the annotation holds a single
+// capture.
+type SessionSpec struct {
+	ID string `json:"id"`
+	CaptureSpec
+}
+
+// ParseSessionSpecs parses a capture annotation holding either a single
+// capture, as accepted by ParseCaptureSpecWithDefaults, or a JSON list of
+// captures with distinct IDs that run concurrently, e.g.
+// [{"id":"dns","filter":"port 53"},{"id":"burst","duration":"1m"}].
+// Any returned error is permanent.
+func ParseSessionSpecs(value string, defaults CaptureSpec) ([]SessionSpec, error) {
+	trimmed := strings.TrimSpace(value)
+	if !strings.HasPrefix(trimmed, "[") {
+		spec, err := ParseCaptureSpecWithDefaults(value, defaults)
+		if err != nil {
+			return nil, err
+		}
+		return []SessionSpec{{CaptureSpec: *spec}}, nil
+	}
+
+	var sessions []SessionSpec
+	dec := json.NewDecoder(bytes.NewReader([]byte(trimmed)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sessions); err != nil {
+		return nil, utils.NewAnnotationParseError(value, err)
+	}
+	if len(sessions) == 0 {
+		return nil, utils.NewAnnotationParseError(value, fmt.Errorf("capture list must not be empty"))
+	}
+
+	seen := make(map[string]bool, len(sessions))
+	for i := range sessions {
+		s := &sessions[i]
+		if errs := validation.IsDNS1123Label(s.ID); len(errs) > 0 {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("invalid capture id %q: %v", s.ID, errs))
+		}
+		if seen[s.ID] {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("duplicate capture id %q", s.ID))
+		}
+		seen[s.ID] = true
+
+		s.CaptureSpec.setDefaults(defaults)
+		if err := s.CaptureSpec.Validate(); err != nil {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("capture %q: %w", s.ID, err))
+		}
+	}
+	return sessions, nil
+}
+
+// IsCaptureList reports whether a capture annotation holds a list of
+// captures rather than a single one
+func IsCaptureList(value string) bool {
+	return strings.HasPrefix(strings.TrimSpace(value), "[")
+}
+
+// UpdateCaptureList replaces the entry with id in a capture list, appends it
+// if there is none, or removes it when entry is nil. Other entries keep their
+// values as written, without the node agent's defaults filled in.
+func UpdateCaptureList(value, id string, entry map[string]any) (string, error) {
+	var list []map[string]json.RawMessage
+	if strings.TrimSpace(value) != "" {
+		if err := json.Unmarshal([]byte(value), &list); err != nil {
+			return "", fmt.Errorf("invalid capture list %q: %w", value, err)
+		}
+	}
+
+	var updated []any
+	found := false
+	for _, existing := range list {
+		var existingID string
+		_ = json.Unmarshal(existing["id"], &existingID)
+		if existingID != id {
+			updated = append(updated, existing)
+			continue
+		}
+		found = true
+		if entry != nil {
+			updated = append(updated, entry)
+		}
+	}
+	if !found {
+		if entry == nil {
+			return "", fmt.Errorf("no capture with ID %q", id)
+		}
+		updated = append(updated, entry)
+	}
+	if updated == nil {
+		updated = []any{}
+	}
+	data, err := json.Marshal(updated)
+	return string(data), err
+}
+
+func (s *CaptureSpec) setDefaults(defaults CaptureSpec) {
+	if defaults.FileCount == 0 {
+		defaults.FileCount = DefaultFileCount
+	}
+	if defaults.FileSizeMB == 0 {
+		defaults.FileSizeMB = DefaultFileSizeMB
+	}
+	if defaults.Interface == "" {
+		defaults.Interface = DefaultInterface
+	}
+
+	if s.FileCount == 0 {
+		s.FileCount = defaults.FileCount
+	}
+	if s.FileSizeMB == 0 {
+		s.FileSizeMB = defaults.FileSizeMB
+	}
+	if s.Interface == "" {
+		s.Interface = defaults.Interface
+	}
+	if s.Mode == ModeArmed && s.BufferSizeMB == 0 {
+		s.BufferSizeMB = DefaultBufferSizeMB
+	}
+	if s.Schedule != "" && s.KeepRuns == 0 {
+		s.KeepRuns = DefaultKeepRuns
+	}
+}
+
+// Validate checks that every option is within the range tcpdump accepts and
+// that string options cannot be mistaken for command line flags.
+func (s *CaptureSpec) Validate() error {
+	if s.FileCount < 1 || s.FileCount > MaxFileCount {
+		return fmt.Errorf("fileCount must be between 1 and %d, got %d", MaxFileCount, s.FileCount)
+	}
+	if s.FileSizeMB < 1 || s.FileSizeMB > MaxFileSizeMB {
+		return fmt.Errorf("fileSizeMB must be between 1 and %d, got %d", MaxFileSizeMB, s.FileSizeMB)
+	}
+	if s.Duration.Duration < 0 {
+		return fmt.Errorf("duration must not be negative, got %s", s.Duration.Duration)
+	}
+	if s.Retention.Duration < 0 {
+		return fmt.Errorf("retention must not be negative, got %s", s.Retention.Duration)
+	}
+	if s.Snaplen < 0 || s.Snaplen > MaxSnaplen {
+		return fmt.Errorf("snaplen must be between 0 and %d, got %d", MaxSnaplen, s.Snaplen)
+	}
+	if strings.HasPrefix(s.Filter, "-") {
+		return fmt.Errorf("filter must not start with '-'")
+	}
+	if strings.HasPrefix(s.Interface, "-") || strings.ContainsAny(s.Interface, " \t/") {
+		return fmt.Errorf("invalid interface name %q", s.Interface)
+	}
+	switch s.Mode {
+	case ModeRecord:
+		if s.BufferSizeMB != 0 || s.BufferDuration.Duration != 0 || s.PostTrigger.Duration != 0 {
+			return fmt.Errorf("bufferSizeMB, bufferDuration and postTrigger require mode %q", ModeArmed)
+		}
+	case ModeArmed:
+		if s.BufferSizeMB < 1 || s.BufferSizeMB > MaxBufferSizeMB {
+			return fmt.Errorf("bufferSizeMB must be between 1 and %d, got %d", MaxBufferSizeMB, s.BufferSizeMB)
+		}
+		if s.BufferDuration.Duration < 0 {
+			return fmt.Errorf("bufferDuration must not be negative, got %s", s.BufferDuration.Duration)
+		}
+		if s.PostTrigger.Duration < 0 {
+			return fmt.Errorf("postTrigger must not be negative, got %s", s.PostTrigger.Duration)
+		}
+	default:
+		return fmt.Errorf("mode must be %q or empty, got %q", ModeArmed, s.Mode)
+	}
+	if s.Group != "" {
+		if errs := validation.IsDNS1123Label(s.Group); len(errs) > 0 {
+			return fmt.Errorf("invalid group %q: %v", s.Group, errs)
+		}
+	}
+	if s.StartAt != "" {
+		if _, err := time.Parse(time.RFC3339, s.StartAt); err != nil {
+			return fmt.Errorf("startAt must be an RFC 3339 time: %w", err)
+		}
+		if s.Duration.Duration == 0 {
+			return fmt.Errorf("startAt needs a duration to end the capture window")
+		}
+		if s.Armed() || s.Schedule != "" {
+			return fmt.Errorf("startAt cannot be combined with mode %q or a schedule", ModeArmed)
+		}
+	}
+	if s.Schedule == "" {
+		if s.KeepRuns != 0 {
+			return fmt.Errorf("keepRuns requires a schedule")
+		}
+		return nil
+	}
+	if _, err := schedule.Parse(s.Schedule); err != nil {
+		return err
+	}
+	if s.Armed() {
+		return fmt.Errorf("mode %q cannot be scheduled", ModeArmed)
+	}
+	if s.Duration.Duration == 0 {
+		return fmt.Errorf("a scheduled capture needs the duration of each run")
+	}
+	if s.KeepRuns < 1 || s.KeepRuns > MaxKeepRuns {
+		return fmt.Errorf("keepRuns must be between 1 and %d, got %d", MaxKeepRuns, s.KeepRuns)
+	}
+	return nil
+}
+
+// Armed reports whether the capture buffers packets until it is triggered
+func (s *CaptureSpec) Armed() bool {
+	return s.Mode == ModeArmed
+}
+
+// Scheduled reports whether the capture runs at the times of its schedule
+func (s *CaptureSpec) Scheduled() bool {
+	return s.Schedule != ""
+}
+
+// Window returns the capture window fixed by StartAt, or zero times when
+// the capture starts as soon as it is requested
+func (s *CaptureSpec) Window() (start, end time.Time) {
+	start, err := time.Parse(time.RFC3339, s.StartAt)
+	if err != nil {
+		return time.Time{}, time.Time{}
+	}
+	return start, start.Add(s.Duration.Duration)
+}
+
+// PolicyRequest returns the parts of the spec the capture policy checks
+func (s *CaptureSpec) PolicyRequest() policy.Request {
+	return policy.Request{
+		FileCount:    s.FileCount,
+		FileSizeMB:   s.FileSizeMB,
+		Duration:     s.Duration.Duration,
+		BufferSizeMB: s.BufferSizeMB,
+		KeepRuns:     s.KeepRuns,
+		Retention:    s.Retention.Duration,
+	}
+}
+
+// tcpdumpArgs returns the nsenter arguments that run tcpdump for this spec in
+// the network namespace of pid, writing to pcapFile.
+func (s *CaptureSpec) tcpdumpArgs(pid int, pcapFile string) []string {
+	args := []string{
+		"-t", fmt.Sprintf("%d", pid),
+		"-n",
+		"--",
+		"tcpdump",
+		"-Z", "root",
+	}
+	if s.Live {
+		args = append(args, "-U")
+	}
+	args = append(args,
+		"-i", s.Interface,
+		"-C", strconv.Itoa(s.FileSizeMB),
+		"-W", strconv.Itoa(s.FileCount),
+		"-w", pcapFile,
+	)
+	if s.Snaplen > 0 {
+		args = append(args, "-s", strconv.Itoa(s.Snaplen))
+	}
+	if s.Filter != "" {
+		args = append(args, s.Filter)
+	}
+	return args
+}
@@ -0,0 +1,249 @@
+package capture
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLegacyAnnotationParsing(t *testing.T) {
+	properties := gopter.NewProperties(nil)
+
+	properties.Property("integer annotation sets file count and defaults", prop.ForAll(
+		func(n int) bool {
+			spec, err := ParseCaptureSpec(strconv.Itoa(n))
+			if err != nil {
+				return false
+			}
+			return spec.FileCount == n &&
+				spec.FileSizeMB == DefaultFileSizeMB &&
+				spec.Interface == DefaultInterface &&
+				spec.Filter == ""
+		},
+		gen.IntRange(1, MaxFileCount),
+	))
+
+	properties.TestingRun(t, gopter.ConsoleReporter(false))
+}
+
+func TestParseCaptureSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    *CaptureSpec
+		wantErr bool
+	}{
+		{
+			name:  "json with all options",
+			value: `{"fileCount":3,"fileSizeMB":5,"duration":"2m","filter":"port 53","snaplen":128,"interface":"eth0","container":"app","retention":"1h"}`,
+			want: &CaptureSpec{
+				FileCount:  3,
+				FileSizeMB: 5,
+				Duration:   metav1.Duration{Duration: 2 * time.Minute},
+				Filter:     "port 53",
+				Snaplen:    128,
+				Interface:  "eth0",
+				Container:  "app",
+				Retention:  metav1.Duration{Duration: time.Hour},
+			},
+		},
+		{
+			name:  "json with defaults",
+			value: ` {"filter":"tcp"} `,
+			want: &CaptureSpec{
+				FileCount:  DefaultFileCount,
+				FileSizeMB: DefaultFileSizeMB,
+				Filter:     "tcp",
+				Interface:  DefaultInterface,
+			},
+		},
+		{name: "non numeric", value: "ten", wantErr: true},
+		{name: "zero file count", value: "0", wantErr: true},
+		{name: "negative file count", value: "-3", wantErr: true},
+		{name: "too many files", value: "100000", wantErr: true},
+		{name: "unknown json field", value: `{"fileCnt":3}`, wantErr: true},
+		{name: "malformed json", value: `{"fileCount":`, wantErr: true},
+		{name: "bad duration", value: `{"duration":"soon"}`, wantErr: true},
+		{name: "negative duration", value: `{"duration":"-1m"}`, wantErr: true},
+		{name: "snaplen too large", value: `{"snaplen":300000}`, wantErr: true},
+		{name: "filter looks like flag", value: `{"filter":"-r /etc/passwd"}`, wantErr: true},
+		{name: "interface with path", value: `{"interface":"../eth0"}`, wantErr: true},
+		{
+			name:  "armed with defaults",
+			value: `{"mode":"armed","postTrigger":"30s"}`,
+			want: &CaptureSpec{
+				FileCount:    DefaultFileCount,
+				FileSizeMB:   DefaultFileSizeMB,
+				Interface:    DefaultInterface,
+				Mode:         ModeArmed,
+				BufferSizeMB: DefaultBufferSizeMB,
+				PostTrigger:  metav1.Duration{Duration: 30 * time.Second},
+			},
+		},
+		{name: "unknown mode", value: `{"mode":"ring"}`, wantErr: true},
+		{name: "buffer without armed mode", value: `{"bufferDuration":"10s"}`, wantErr: true},
+		{name: "buffer too large", value: `{"mode":"armed","bufferSizeMB":1024}`, wantErr: true},
+		{name: "negative post trigger", value: `{"mode":"armed","postTrigger":"-1s"}`, wantErr: true},
+		{
+			name:  "scheduled with defaults",
+			value: `{"schedule":"0 2 * * *","duration":"15m"}`,
+			want: &CaptureSpec{
+				FileCount:  DefaultFileCount,
+				FileSizeMB: DefaultFileSizeMB,
+				Interface:  DefaultInterface,
+				Duration:   metav1.Duration{Duration: 15 * time.Minute},
+				Schedule:   "0 2 * * *",
+				KeepRuns:   DefaultKeepRuns,
+			},
+		},
+		{name: "invalid schedule", value: `{"schedule":"0 25 * * *","duration":"15m"}`, wantErr: true},
+		{name: "schedule without duration", value: `{"schedule":"@daily"}`, wantErr: true},
+		{name: "scheduled armed capture", value: `{"schedule":"@daily","duration":"1m","mode":"armed"}`, wantErr: true},
+		{name: "keep runs without schedule", value: `{"keepRuns":3}`, wantErr: true},
+		{name: "too many runs kept", value: `{"schedule":"@hourly","duration":"1m","keepRuns":1000}`, wantErr: true},
+		{
+			name:  "group member",
+			value: `{"group":"checkout","startAt":"2026-10-18T10:00:00Z","duration":"5m"}`,
+			want: &CaptureSpec{
+				FileCount:  DefaultFileCount,
+				FileSizeMB: DefaultFileSizeMB,
+				Interface:  DefaultInterface,
+				Duration:   metav1.Duration{Duration: 5 * time.Minute},
+				Group:      "checkout",
+				StartAt:    "2026-10-18T10:00:00Z",
+			},
+		},
+		{name: "invalid group", value: `{"group":"Checkout"}`, wantErr: true},
+		{name: "invalid start time", value: `{"startAt":"10:00","duration":"5m"}`, wantErr: true},
+		{name: "start time without duration", value: `{"startAt":"2026-10-18T10:00:00Z"}`, wantErr: true},
+		{name: "armed capture with start time", value: `{"startAt":"2026-10-18T10:00:00Z","duration":"5m","mode":"armed"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCaptureSpec(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q, got spec %+v", tt.value, got)
+				}
+				if !utils.IsPermanent(err) {
+					t.Errorf("parse errors should be permanent, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *got != *tt.want {
+				t.Errorf("ParseCaptureSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSessionSpecs(t *testing.T) {
+	sessions, err := ParseSessionSpecs(`[{"id":"dns","filter":"port 53"},{"id":"burst","duration":"1m","fileCount":2}]`, CaptureSpec{FileCount: 4})
+	if err != nil {
+		t.Fatalf("ParseSessionSpecs() returned error: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %d", len(sessions))
+	}
+	if sessions[0].ID != "dns" || sessions[0].Filter != "port 53" || sessions[0].FileCount != 4 {
+		t.Errorf("unexpected first session: %+v", sessions[0])
+	}
+	if sessions[1].ID != "burst" || sessions[1].Duration.Duration != time.Minute || sessions[1].FileCount != 2 {
+		t.Errorf("unexpected second session: %+v", sessions[1])
+	}
+
+	single, err := ParseSessionSpecs("5", CaptureSpec{})
+	if err != nil {
+		t.Fatalf("ParseSessionSpecs() returned error: %v", err)
+	}
+	if len(single) != 1 || single[0].ID != "" || single[0].FileCount != 5 {
+		t.Errorf("single capture annotation = %+v, want one unnamed session", single)
+	}
+
+	invalid := []string{
+		`[]`,
+		`[{"filter":"port 53"}]`,
+		`[{"id":"DNS"}]`,
+		`[{"id":"dns"},{"id":"dns"}]`,
+		`[{"id":"dns","fileCount":-1}]`,
+		`[{"id":"dns","selector":"app=web"}]`,
+	}
+	for _, value := range invalid {
+		if _, err := ParseSessionSpecs(value, CaptureSpec{}); !utils.IsPermanent(err) {
+			t.Errorf("ParseSessionSpecs(%s) should return a permanent error, got: %v", value, err)
+		}
+	}
+}
+
+func TestTcpdumpArgs(t *testing.T) {
+	spec := &CaptureSpec{
+		FileCount:  4,
+		FileSizeMB: 2,
+		Interface:  "eth0",
+		Snaplen:    96,
+		Filter:     "udp port 53",
+	}
+
+	got := spec.tcpdumpArgs(1234, "/captures/test.pcap")
+	want := []string{
+		"-t", "1234", "-n", "--",
+		"tcpdump", "-Z", "root",
+		"-i", "eth0",
+		"-C", "2",
+		"-W", "4",
+		"-w", "/captures/test.pcap",
+		"-s", "96",
+		"udp port 53",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tcpdumpArgs() = %v, want %v", got, want)
+	}
+
+	// Only sessions meant to be streamed write packet by packet
+	spec.Live = true
+	got = spec.tcpdumpArgs(1234, "/captures/test.pcap")
+	want = append(want[:7:7], append([]string{"-U"}, want[7:]...)...)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("tcpdumpArgs() with live = %v, want %v", got, want)
+	}
+}
+
+func TestContainerSelection(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}, {Name: "sidecar"}, {Name: "late"}},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", ContainerID: "containerd://aaa"},
+				{Name: "sidecar", ContainerID: "containerd://bbb"},
+			},
+		},
+	}
+
+	if id, err := containerIDForSpec(pod, &CaptureSpec{}); err != nil || id != "containerd://aaa" {
+		t.Errorf("default container = %q, %v; want first container", id, err)
+	}
+	if id, err := containerIDForSpec(pod, &CaptureSpec{Container: "sidecar"}); err != nil || id != "containerd://bbb" {
+		t.Errorf("named container = %q, %v; want sidecar", id, err)
+	}
+	if _, err := containerIDForSpec(pod, &CaptureSpec{Container: "late"}); err == nil || utils.IsPermanent(err) {
+		t.Errorf("container without status should be a transient error, got: %v", err)
+	}
+	if _, err := containerIDForSpec(pod, &CaptureSpec{Container: "missing"}); !utils.IsPermanent(err) {
+		t.Errorf("unknown container should be a permanent error, got: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package capture
+
+import (
+	"encoding/json"
+)
+
+// StatusAnnotationSuffix is appended to the capture annotation key to form
+// the pod annotation in which the node agent reports the capture state,
+// e.g. tcpdump.antrea.io/status.
+const StatusAnnotationSuffix = "/status"
+
+// TriggerAnnotationSuffix is appended to the capture annotation key to form
+// the pod annotation that triggers the pod's armed captures whenever its
+// value changes, e.g. tcpdump.antrea.io/trigger.
+const TriggerAnnotationSuffix = "/trigger"
+
+// Capture states reported in Status
+const (
+	StateCapturing = "Capturing"
+	StateArmed     = "Armed"
+	StateScheduled = "Scheduled"
+	StateWaiting   = "Waiting"
+	StateFinished  = "Finished"
+	StateRefused   = "Refused"
+)
+
+// HostNetwork decisions reported in Status
+const (
+	HostNetworkRefused = "Refused"
+	HostNetworkScoped  = "Scoped"
+)
+
+// Status is the capture state the node agent records on a pod
+type Status struct {
+	Node string `json:"node"`
+	// State is StateCapturing while any session runs and StateRefused otherwise
+	State string `json:"state"`
+	// Message explains a refusal that applies to the whole pod
+	Message string `json:"message,omitempty"`
+	// HostNetwork records how a hostNetwork pod was handled
+	HostNetwork string `json:"hostNetwork,omitempty"`
+	// Sessions lists the requested captures by capture ID
+	Sessions []SessionStatus `json:"sessions,omitempty"`
+}
+
+// SessionStatus is the state of one capture session of a pod
+type SessionStatus struct {
+	CaptureID string `json:"captureID"`
+	// State is StateArmed for an armed capture waiting for a trigger and
+	// StateScheduled for a capture running at the times of its schedule.
+	// A capture with a window is StateWaiting before and StateFinished after it.
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+	// Filter is the BPF filter tcpdump runs with, including any added scoping
+	Filter string `json:"filter,omitempty"`
+}
+
+// ParseStatus decodes a status annotation value
+func ParseStatus(value string) (*Status, error) {
+	status := &Status{}
+	if err := json.Unmarshal([]byte(value), status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// String encodes the status as an annotation value
+func (s *Status) String() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
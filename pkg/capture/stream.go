@@ -0,0 +1,130 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/pcap"
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// streamHeaderTimeout bounds how long StartStream waits for tcpdump to write
+// the capture header
+const streamHeaderTimeout = 10 * time.Second
+
+// Stream is a tcpdump process writing the packets of a pod to a pipe. Unlike
+// a capture session it stores nothing on the node and writes no manifest.
+type Stream struct {
+	cmd       *exec.Cmd
+	cancel    context.CancelFunc
+	reader    *pcap.Reader
+	closeOnce sync.Once
+}
+
+// StartStream runs tcpdump with spec in the network namespace of pod and
+// returns once tcpdump is capturing. Only the interface, snaplen, filter and
+// container of spec apply.
+func StartStream(pod *corev1.Pod, spec *CaptureSpec) (*Stream, error) {
+	_, pid, err := podProcess(pod, spec)
+	if err != nil {
+		return nil, err
+	}
+	return startStream(fmt.Sprintf("%s/%s", pod.Namespace, pod.Name), pid, spec)
+}
+
+// startStream runs tcpdump with spec in the network namespace of pid, which
+// belongs to the pod with the namespace/name key
+func startStream(key string, pid int, spec *CaptureSpec) (*Stream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	args := spec.streamArgs(pid)
+	klog.V(2).Infof("Executing: nsenter %v", args)
+	cmd := exec.CommandContext(ctx, "nsenter", args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, utils.NewTcpdumpExecutionError(key, err)
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, utils.NewTcpdumpExecutionError(key, err)
+	}
+	s := &Stream{cmd: cmd, cancel: cancel}
+
+	// tcpdump -U writes the header as soon as it starts capturing
+	type result struct {
+		reader *pcap.Reader
+		err    error
+	}
+	started := make(chan result, 1)
+	go func() {
+		r, err := pcap.NewReader(stdout)
+		started <- result{r, err}
+	}()
+	select {
+	case res := <-started:
+		if res.err != nil {
+			s.Close()
+			return nil, utils.NewTcpdumpExecutionError(key, fmt.Errorf("reading capture header: %w", res.err))
+		}
+		s.reader = res.reader
+	case <-time.After(streamHeaderTimeout):
+		s.Close()
+		return nil, utils.NewTcpdumpExecutionError(key, fmt.Errorf("tcpdump did not start within %s", streamHeaderTimeout))
+	}
+	return s, nil
+}
+
+// LinkType returns the link-layer header type of the packets
+func (s *Stream) LinkType() uint32 {
+	return s.reader.Header.LinkType
+}
+
+// Header returns the capture header tcpdump wrote
+func (s *Stream) Header() pcap.Header {
+	return s.reader.Header
+}
+
+// Next returns the next captured packet, blocking until there is one
+func (s *Stream) Next() (*pcap.Packet, error) {
+	return s.reader.Next()
+}
+
+// Close stops tcpdump
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		// tcpdump is killed by the cancellation, so its exit status is expected
+		_ = s.cmd.Wait()
+	})
+	return nil
+}
+
+// streamArgs returns the nsenter arguments that run tcpdump for this spec in
+// the network namespace of pid, writing every packet to stdout as it arrives
+func (s *CaptureSpec) streamArgs(pid int) []string {
+	args := []string{
+		"-t", strconv.Itoa(pid),
+		"-n",
+		"--",
+		"tcpdump",
+		"-Z", "root",
+		"-U",
+		"-i", s.Interface,
+		"-w", "-",
+	}
+	if s.Snaplen > 0 {
+		args = append(args, "-s", strconv.Itoa(s.Snaplen))
+	}
+	if s.Filter != "" {
+		args = append(args, s.Filter)
+	}
+	return args
+}
@@ -0,0 +1,86 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// TargetsAnnotationSuffix is appended to the capture annotation key to form
+// the namespace annotation that lists selector-based capture targets,
+// e.g. tcpdump.antrea.io/targets.
+const TargetsAnnotationSuffix = "/targets"
+
+// CaptureTarget requests a capture on every pod of a namespace matching
+// Selector. All sessions started for a target report the same ID. The
+// capture options are inlined, e.g.
+// [{"id":"web-debug","selector":"app=web","fileCount":5,"filter":"port 80"}].
+type CaptureTarget struct {
+	// ID identifies the capture across pods and nodes
+	ID string `json:"id"`
+	// Selector is a label selector in kubectl syntax; empty selects every pod
+	Selector string `json:"selector,omitempty"`
+	CaptureSpec
+
+	selector labels.Selector
+}
+
+// ParseCaptureTargets parses the JSON list of targets in a namespace
+// annotation, applying defaults to each target's options. Any returned error
+// is permanent.
+func ParseCaptureTargets(value string, defaults CaptureSpec) ([]CaptureTarget, error) {
+	var targets []CaptureTarget
+	dec := json.NewDecoder(bytes.NewReader([]byte(value)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&targets); err != nil {
+		return nil, utils.NewAnnotationParseError(value, err)
+	}
+
+	seen := make(map[string]bool, len(targets))
+	for i := range targets {
+		t := &targets[i]
+		if errs := validation.IsDNS1123Label(t.ID); len(errs) > 0 {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("invalid target id %q: %v", t.ID, errs))
+		}
+		if seen[t.ID] {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("duplicate target id %q", t.ID))
+		}
+		seen[t.ID] = true
+
+		selector, err := labels.Parse(t.Selector)
+		if err != nil {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("invalid selector for target %q: %w", t.ID, err))
+		}
+		t.selector = selector
+
+		t.CaptureSpec.setDefaults(defaults)
+		if err := t.CaptureSpec.Validate(); err != nil {
+			return nil, utils.NewAnnotationParseError(value, fmt.Errorf("target %q: %w", t.ID, err))
+		}
+	}
+	return targets, nil
+}
+
+// Matches reports whether the target selects pod
+func (t *CaptureTarget) Matches(pod *corev1.Pod) bool {
+	if t.selector == nil {
+		return false
+	}
+	return t.selector.Matches(labels.Set(pod.Labels))
+}
+
+// MatchTargets returns every target selecting pod, in annotation order
+func MatchTargets(targets []CaptureTarget, pod *corev1.Pod) []*CaptureTarget {
+	var matched []*CaptureTarget
+	for i := range targets {
+		if targets[i].Matches(pod) {
+			matched = append(matched, &targets[i])
+		}
+	}
+	return matched
+}
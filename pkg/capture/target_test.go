@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCaptureTargets(t *testing.T) {
+	targets, err := ParseCaptureTargets(
+		`[{"id":"web","selector":"app=web,tier in (frontend)","filter":"port 80"},{"id":"all"}]`,
+		CaptureSpec{FileCount: 3},
+	)
+	if err != nil {
+		t.Fatalf("ParseCaptureTargets() returned error: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(targets))
+	}
+	if targets[0].Filter != "port 80" || targets[0].FileCount != 3 || targets[0].FileSizeMB != DefaultFileSizeMB {
+		t.Errorf("unexpected options for first target: %+v", targets[0].CaptureSpec)
+	}
+
+	invalid := []string{
+		`{"id":"web"}`,
+		`[{"id":"Web"}]`,
+		`[{"id":""}]`,
+		`[{"id":"web"},{"id":"web"}]`,
+		`[{"id":"web","selector":"app in web"}]`,
+		`[{"id":"web","fileCount":0,"snaplen":-1}]`,
+		`[{"id":"web","labels":"app=web"}]`,
+	}
+	for _, value := range invalid {
+		if _, err := ParseCaptureTargets(value, CaptureSpec{}); !utils.IsPermanent(err) {
+			t.Errorf("ParseCaptureTargets(%s) should return a permanent error, got: %v", value, err)
+		}
+	}
+}
+
+func TestMatchTargets(t *testing.T) {
+	targets, err := ParseCaptureTargets(`[{"id":"web","selector":"app=web"},{"id":"rest"}]`, CaptureSpec{})
+	if err != nil {
+		t.Fatalf("ParseCaptureTargets() returned error: %v", err)
+	}
+
+	tests := []struct {
+		labels  map[string]string
+		wantIDs []string
+	}{
+		{map[string]string{"app": "web"}, []string{"web", "rest"}},
+		{map[string]string{"app": "db"}, []string{"rest"}},
+		{nil, []string{"rest"}},
+	}
+	for _, tt := range tests {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: tt.labels}}
+		var gotIDs []string
+		for _, target := range MatchTargets(targets, pod) {
+			gotIDs = append(gotIDs, target.ID)
+		}
+		if strings.Join(gotIDs, ",") != strings.Join(tt.wantIDs, ",") {
+			t.Errorf("MatchTargets(%v) = %v, want %v", tt.labels, gotIDs, tt.wantIDs)
+		}
+	}
+
+	if matched := MatchTargets(targets[:1], &corev1.Pod{}); len(matched) != 0 {
+		t.Errorf("pod without labels should not match selector, got %s", matched[0].ID)
+	}
+}
@@ -0,0 +1,106 @@
+package capture
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verification summarises a successfully verified session bundle
+type Verification struct {
+	SessionID string
+	// Segments is the number of pcap files matching the custody log
+	Segments int
+	// Signed reports whether the manifest signature was checked
+	Signed bool
+	// Complete reports whether the session had stopped, so the bundle holds
+	// its final manifest
+	Complete bool
+}
+
+// VerifyBundle checks a downloaded session directory: the custody log must
+// form an unbroken chain for the session, the manifest must point into it,
+// every pcap file must match the last hash logged for it and, when key is
+// set, the manifest must carry a valid signature.
+func VerifyBundle(dir string, key ed25519.PublicKey) (*Verification, error) {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ReadCustodyLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || entries[0].Event != CustodyEventStart || entries[0].SessionID != manifest.SessionID {
+		return nil, fmt.Errorf("custody log does not start session %s", manifest.SessionID)
+	}
+
+	head := -1
+	for i := range entries {
+		if entries[i].Hash == manifest.CustodyHead {
+			head = i
+		}
+	}
+	if head < 0 {
+		return nil, fmt.Errorf("manifest refers to custody entry %s, which is not in the log", manifest.CustodyHead)
+	}
+	complete := manifest.StopTime != nil
+	if complete && (head != len(entries)-1 || entries[head].Event != CustodyEventStop) {
+		return nil, fmt.Errorf("custody log does not end with the stop recorded in the manifest")
+	}
+
+	logged := make(map[string]string)
+	for _, e := range entries {
+		if e.Event == CustodyEventSegment {
+			logged[e.File] = e.SHA256
+		}
+	}
+
+	result := &Verification{SessionID: manifest.SessionID, Complete: complete}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range dirEntries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), pcapBaseName) {
+			continue
+		}
+		want, ok := logged[e.Name()]
+		if !ok {
+			if complete {
+				return nil, fmt.Errorf("%s is not recorded in the custody log", e.Name())
+			}
+			// The file tcpdump is still writing is logged once it is finalised
+			continue
+		}
+		sum, err := sha256File(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if sum != want {
+			return nil, fmt.Errorf("%s was modified after capture: sha256 %s, custody log has %s", e.Name(), sum, want)
+		}
+		result.Segments++
+	}
+
+	if complete {
+		for _, f := range manifest.Files {
+			if logged[f.Name] != f.SHA256 {
+				return nil, fmt.Errorf("manifest entry for %s does not match the custody log", f.Name)
+			}
+			if _, err := os.Stat(filepath.Join(dir, f.Name)); err != nil {
+				return nil, fmt.Errorf("%s listed in the manifest is missing from the bundle", f.Name)
+			}
+		}
+	}
+
+	if key != nil {
+		if err := verifyManifestSignature(dir, key); err != nil {
+			return nil, err
+		}
+		result.Signed = true
+	}
+	return result, nil
+}
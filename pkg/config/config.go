@@ -0,0 +1,250 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/rules"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DefaultCaptureDir        = "/var/log/antrea-captures"
+	DefaultAnnotationKey     = "tcpdump.antrea.io"
+	DefaultWorkerCount       = 1
+	DefaultResyncPeriod      = 30 * time.Second
+	DefaultDefaultFileCount  = 10
+	DefaultDefaultFileSizeMB = 1
+	DefaultMetricsAddress    = ":8080"
+	DefaultAPIAddress        = ":8081"
+	DefaultAlertMaxPods      = 10
+	// DefaultMaxArmedBufferMB leaves room for the rest of the node agent
+	// within the 512Mi memory limit of deploy/daemonset.yaml
+	DefaultMaxArmedBufferMB = 128
+)
+
+// Config holds the node agent settings. Values come from the defaults below,
+// then an optional YAML file, then flags set on the command line. The file is
+// reloaded at runtime; see Reloader for which settings need a restart.
+type Config struct {
+	// CaptureDir is the host directory pcap files are written to
+	CaptureDir string `json:"captureDir"`
+	// AnnotationKey is the pod annotation that requests a capture
+	AnnotationKey string `json:"annotationKey"`
+	// WorkerCount is the number of workers processing the pod queue
+	WorkerCount int `json:"workerCount"`
+	// ResyncPeriod is the informer resync interval
+	ResyncPeriod metav1.Duration `json:"resyncPeriod"`
+	// DefaultFileCount is used when the annotation does not set fileCount
+	DefaultFileCount int `json:"defaultFileCount"`
+	// DefaultFileSizeMB is used when the annotation does not set fileSizeMB
+	DefaultFileSizeMB int `json:"defaultFileSizeMB"`
+	// MaxArmedBufferMB bounds the memory the buffers of all armed captures
+	// on the node may use together; armed captures that do not fit are
+	// refused, and zero refuses every armed capture
+	MaxArmedBufferMB int `json:"maxArmedBufferMB"`
+	// MetricsAddress is the address the Prometheus metrics endpoint listens on
+	MetricsAddress string `json:"metricsAddress"`
+	// APIAddress is the address the session API used by kubectl-pcap listens
+	// on; empty disables it
+	APIAddress string `json:"apiAddress"`
+	// RPCAPAddress is the address the rpcap server for Wireshark remote
+	// interfaces listens on; empty disables it. It requires ServingCertFile
+	// and ServingKeyFile since clients send their token as password
+	RPCAPAddress string `json:"rpcapAddress,omitempty"`
+	// ServingCertFile and ServingKeyFile are the PEM-encoded certificate and
+	// private key, usually mounted from a Secret, the rpcap server and the
+	// Alertmanager receiver serve TLS with
+	ServingCertFile string `json:"servingCertFile,omitempty"`
+	ServingKeyFile  string `json:"servingKeyFile,omitempty"`
+	// Policy decides which namespaces may be captured and within which limits
+	Policy policy.Policy `json:"policy"`
+	// TriggerRules start captures of pods showing failure signals
+	TriggerRules []rules.Rule `json:"triggerRules,omitempty"`
+	// AlertReceiver starts captures of the pods Alertmanager alerts are about
+	AlertReceiver AlertReceiver `json:"alertReceiver"`
+	// SigningKeyFile is an optional PEM-encoded Ed25519 private key, usually
+	// mounted from a Secret, used to sign session manifests
+	SigningKeyFile string `json:"signingKeyFile,omitempty"`
+}
+
+// AlertReceiver configures the Alertmanager webhook receiver
+type AlertReceiver struct {
+	// Address is the address the receiver listens on; empty disables it
+	Address string `json:"address,omitempty"`
+	// Profiles are the capture options alerts select by name with their
+	// capture_profile label or annotation
+	Profiles map[string]rules.Capture `json:"profiles,omitempty"`
+	// DefaultProfile is used by alerts that select no profile; empty uses
+	// the capture defaults
+	DefaultProfile string `json:"defaultProfile,omitempty"`
+	// MaxPods caps the pods captured for an alert with a pod selector
+	MaxPods int `json:"maxPods"`
+}
+
+// Validate reports the first invalid setting of the receiver
+func (a *AlertReceiver) Validate() error {
+	if a.MaxPods < 1 {
+		return fmt.Errorf("alertReceiver.maxPods must be at least 1, got %d", a.MaxPods)
+	}
+	if _, ok := a.Profiles[a.DefaultProfile]; a.DefaultProfile != "" && !ok {
+		return fmt.Errorf("alertReceiver.defaultProfile %q is not a profile", a.DefaultProfile)
+	}
+	for name, profile := range a.Profiles {
+		if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+			return fmt.Errorf("alertReceiver.profiles: name %q must be a DNS-1123 label: %s", name, strings.Join(errs, ", "))
+		}
+		if d := profile.Duration.Duration; d < 0 || d > rules.MaxDuration {
+			return fmt.Errorf("alertReceiver.profiles.%s: duration must be between 0 and %s, got %s", name, rules.MaxDuration, d)
+		}
+	}
+	return nil
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		CaptureDir:        DefaultCaptureDir,
+		AnnotationKey:     DefaultAnnotationKey,
+		WorkerCount:       DefaultWorkerCount,
+		ResyncPeriod:      metav1.Duration{Duration: DefaultResyncPeriod},
+		DefaultFileCount:  DefaultDefaultFileCount,
+		DefaultFileSizeMB: DefaultDefaultFileSizeMB,
+		MaxArmedBufferMB:  DefaultMaxArmedBufferMB,
+		MetricsAddress:    DefaultMetricsAddress,
+		APIAddress:        DefaultAPIAddress,
+		Policy:            policy.Default(),
+		AlertReceiver:     AlertReceiver{MaxPods: DefaultAlertMaxPods},
+	}
+}
+
+// AddFlags registers a flag for every field of c, using its current values as defaults
+func (c *Config) AddFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.CaptureDir, "capture-dir", c.CaptureDir, "Directory capture files are written to")
+	fs.StringVar(&c.AnnotationKey, "annotation-key", c.AnnotationKey, "Pod annotation that requests a capture")
+	fs.IntVar(&c.WorkerCount, "worker-count", c.WorkerCount, "Number of workers processing pod events")
+	fs.DurationVar(&c.ResyncPeriod.Duration, "resync-period", c.ResyncPeriod.Duration, "Informer resync period")
+	fs.IntVar(&c.DefaultFileCount, "default-file-count", c.DefaultFileCount, "Number of capture files kept when the annotation does not set fileCount")
+	fs.IntVar(&c.DefaultFileSizeMB, "default-file-size-mb", c.DefaultFileSizeMB, "Capture file size in MB when the annotation does not set fileSizeMB")
+	fs.IntVar(&c.MaxArmedBufferMB, "max-armed-buffer-mb", c.MaxArmedBufferMB, "Memory in MB the buffers of all armed captures on the node may use together")
+	fs.StringVar(&c.MetricsAddress, "metrics-address", c.MetricsAddress, "Address the metrics endpoint listens on")
+	fs.StringVar(&c.APIAddress, "api-address", c.APIAddress, "Address the session API listens on; empty disables it")
+	fs.StringVar(&c.RPCAPAddress, "rpcap-address", c.RPCAPAddress, "Address the rpcap server listens on, e.g. :2002; empty disables it")
+	fs.StringVar(&c.ServingCertFile, "serving-cert-file", c.ServingCertFile, "PEM-encoded certificate the rpcap server and the Alertmanager receiver serve TLS with")
+	fs.StringVar(&c.ServingKeyFile, "serving-key-file", c.ServingKeyFile, "PEM-encoded private key of the serving certificate")
+	fs.StringVar(&c.AlertReceiver.Address, "alert-receiver-address", c.AlertReceiver.Address, "Address the Alertmanager webhook receiver listens on, e.g. :8082; empty disables it")
+	fs.BoolVar(&c.Policy.RequireOptIn, "require-namespace-opt-in", c.Policy.RequireOptIn, "Only capture in namespaces labelled or annotated with the opt-in key")
+	fs.Var((*stringList)(&c.Policy.DeniedNamespaces), "denied-namespaces", "Comma-separated namespaces in which captures are refused")
+	fs.StringVar(&c.SigningKeyFile, "signing-key-file", c.SigningKeyFile, "PEM-encoded Ed25519 private key used to sign session manifests")
+}
+
+// stringList is a flag.Value for comma-separated lists
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Load reads the optional YAML file at path on top of the defaults and then
+// applies every flag explicitly set on fs, so the command line always wins.
+func Load(path string, fs *flag.FlagSet) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	if fs != nil {
+		overrides := flag.NewFlagSet("overrides", flag.ContinueOnError)
+		cfg.AddFlags(overrides)
+
+		var err error
+		fs.Visit(func(f *flag.Flag) {
+			if err != nil || overrides.Lookup(f.Name) == nil {
+				return
+			}
+			err = overrides.Set(f.Name, f.Value.String())
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply flag overrides: %w", err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports the first invalid setting in c
+func (c *Config) Validate() error {
+	if c.CaptureDir == "" || !filepath.IsAbs(c.CaptureDir) {
+		return fmt.Errorf("captureDir must be an absolute path, got %q", c.CaptureDir)
+	}
+	if errs := validation.IsQualifiedName(c.AnnotationKey); len(errs) > 0 {
+		return fmt.Errorf("annotationKey %q is not a valid annotation key: %v", c.AnnotationKey, errs)
+	}
+	if c.WorkerCount < 1 {
+		return fmt.Errorf("workerCount must be at least 1, got %d", c.WorkerCount)
+	}
+	if c.ResyncPeriod.Duration < 0 {
+		return fmt.Errorf("resyncPeriod must not be negative, got %s", c.ResyncPeriod.Duration)
+	}
+	if c.DefaultFileCount < 1 {
+		return fmt.Errorf("defaultFileCount must be at least 1, got %d", c.DefaultFileCount)
+	}
+	if c.DefaultFileSizeMB < 1 {
+		return fmt.Errorf("defaultFileSizeMB must be at least 1, got %d", c.DefaultFileSizeMB)
+	}
+	if c.MaxArmedBufferMB < 0 {
+		return fmt.Errorf("maxArmedBufferMB must not be negative, got %d", c.MaxArmedBufferMB)
+	}
+	if c.SigningKeyFile != "" && !filepath.IsAbs(c.SigningKeyFile) {
+		return fmt.Errorf("signingKeyFile must be an absolute path, got %q", c.SigningKeyFile)
+	}
+	if (c.ServingCertFile == "") != (c.ServingKeyFile == "") {
+		return fmt.Errorf("servingCertFile and servingKeyFile must be set together")
+	}
+	if c.ServingCertFile != "" && (!filepath.IsAbs(c.ServingCertFile) || !filepath.IsAbs(c.ServingKeyFile)) {
+		return fmt.Errorf("servingCertFile and servingKeyFile must be absolute paths, got %q and %q", c.ServingCertFile, c.ServingKeyFile)
+	}
+	if c.RPCAPAddress != "" && c.ServingCertFile == "" {
+		return fmt.Errorf("rpcapAddress requires servingCertFile and servingKeyFile")
+	}
+	if c.AlertReceiver.Address != "" && c.ServingCertFile == "" {
+		return fmt.Errorf("alertReceiver.address requires servingCertFile and servingKeyFile")
+	}
+	if err := rules.Validate(c.TriggerRules); err != nil {
+		return err
+	}
+	if err := c.AlertReceiver.Validate(); err != nil {
+		return err
+	}
+	return c.Policy.Validate()
+}
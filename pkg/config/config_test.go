@@ -0,0 +1,110 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestDefaultsMatchPreviousConstants(t *testing.T) {
+	cfg, err := Load("", nil)
+	if err != nil {
+		t.Fatalf("Load() with no file returned error: %v", err)
+	}
+	if cfg.CaptureDir != "/var/log/antrea-captures" ||
+		cfg.AnnotationKey != "tcpdump.antrea.io" ||
+		cfg.WorkerCount != 1 ||
+		cfg.ResyncPeriod.Duration != 30*time.Second ||
+		cfg.DefaultFileCount != 10 ||
+		cfg.DefaultFileSizeMB != 1 {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	path := writeConfigFile(t, `
+captureDir: /data/captures
+workerCount: 4
+resyncPeriod: 1m
+defaultFileCount: 20
+`)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	Default().AddFlags(fs)
+	if err := fs.Parse([]string{"--worker-count=2", "--default-file-size-mb=5"}); err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+
+	cfg, err := Load(path, fs)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+
+	if cfg.CaptureDir != "/data/captures" {
+		t.Errorf("CaptureDir = %q, want value from file", cfg.CaptureDir)
+	}
+	if cfg.WorkerCount != 2 {
+		t.Errorf("WorkerCount = %d, want flag value 2", cfg.WorkerCount)
+	}
+	if cfg.ResyncPeriod.Duration != time.Minute {
+		t.Errorf("ResyncPeriod = %s, want value from file", cfg.ResyncPeriod.Duration)
+	}
+	if cfg.DefaultFileCount != 20 {
+		t.Errorf("DefaultFileCount = %d, want value from file", cfg.DefaultFileCount)
+	}
+	if cfg.DefaultFileSizeMB != 5 {
+		t.Errorf("DefaultFileSizeMB = %d, want flag value 5", cfg.DefaultFileSizeMB)
+	}
+	if cfg.AnnotationKey != DefaultAnnotationKey {
+		t.Errorf("AnnotationKey = %q, want default", cfg.AnnotationKey)
+	}
+}
+
+func TestInvalidConfigIsRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown field", "workers: 2"},
+		{"relative capture dir", "captureDir: captures"},
+		{"zero workers", "workerCount: 0"},
+		{"invalid annotation key", "annotationKey: 'not a key!'"},
+		{"negative resync", "resyncPeriod: -1s"},
+		{"zero default file count", "defaultFileCount: 0"},
+		{"malformed yaml", "workerCount: [1"},
+		{"trigger rule without signals", "triggerRules: [{name: web}]"},
+		{"unknown trigger rule field", "triggerRules: [{name: web, signals: [OOMKilled], cooldwn: 1m}]"},
+		{"unknown default alert profile", "alertReceiver: {defaultProfile: short}"},
+		{"alert profile too long", "alertReceiver: {profiles: {long: {duration: 2h}}}"},
+		{"zero alert max pods", "alertReceiver: {maxPods: 0}"},
+		{"rpcap without serving certificate", "rpcapAddress: ':2002'"},
+		{"alert receiver without serving certificate", "alertReceiver: {address: ':8082'}"},
+		{"serving certificate without key", "servingCertFile: /etc/tls/tls.crt"},
+		{"relative serving certificate", "{servingCertFile: tls.crt, servingKeyFile: tls.key}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(writeConfigFile(t, tt.content), nil); err == nil {
+				t.Errorf("Load() should reject %q", tt.content)
+			}
+		})
+	}
+}
+
+func TestMissingConfigFile(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), nil); err == nil {
+		t.Error("Load() should fail for a missing file")
+	}
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"crypto/sha256"
+	"flag"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// DefaultReloadInterval is how often the config file is checked for changes.
+// ConfigMap updates reach the mount through a symlink swap, so polling the
+// content is more reliable than watching the file.
+const DefaultReloadInterval = 10 * time.Second
+
+// Reloader re-reads the config file when its content changes or when Reload
+// is called, e.g. on SIGHUP, and passes each valid configuration to the
+// registered handlers. Invalid files are logged and the previous
+// configuration stays in effect.
+type Reloader struct {
+	path string
+	fs   *flag.FlagSet
+
+	// reloadMu serialises reloads; mu guards the fields below it
+	reloadMu sync.Mutex
+	mu       sync.Mutex
+	current  *Config
+	hash     [sha256.Size]byte
+	handlers []func(*Config)
+}
+
+// NewReloader returns a Reloader for the file at path, starting from initial.
+// Flags explicitly set on fs keep overriding the file on every reload.
+func NewReloader(path string, fs *flag.FlagSet, initial *Config) *Reloader {
+	r := &Reloader{path: path, fs: fs, current: initial}
+	if path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			r.hash = sha256.Sum256(data)
+		}
+	}
+	return r
+}
+
+// OnReload registers fn to be called with every successfully reloaded configuration
+func (r *Reloader) OnReload(fn func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers = append(r.handlers, fn)
+}
+
+// Current returns the configuration in effect
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads the config file and applies it. Settings that need a restart
+// keep their current values and a warning is logged when they differ.
+func (r *Reloader) Reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	if r.path != "" {
+		if data, err := os.ReadFile(r.path); err == nil {
+			r.mu.Lock()
+			r.hash = sha256.Sum256(data)
+			r.mu.Unlock()
+		}
+	}
+
+	next, err := Load(r.path, r.fs)
+	if err != nil {
+		klog.Errorf("Failed to reload configuration, keeping previous settings: %v", err)
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		return err
+	}
+
+	r.mu.Lock()
+	for _, field := range next.keepRestartOnly(r.current) {
+		klog.Warningf("Configuration setting %s changed but only takes effect after a restart", field)
+	}
+	r.current = next
+	handlers := append([]func(*Config){}, r.handlers...)
+	r.mu.Unlock()
+
+	for _, fn := range handlers {
+		fn(next)
+	}
+
+	klog.Infof("Reloaded configuration: %+v", *next)
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	metrics.ConfigLastReloadSuccess.SetToCurrentTime()
+	return nil
+}
+
+// Run polls the config file every interval and reloads it when its content
+// changes, until stopCh is closed.
+func (r *Reloader) Run(interval time.Duration, stopCh <-chan struct{}) {
+	if r.path == "" {
+		return
+	}
+	wait.Until(func() {
+		data, err := os.ReadFile(r.path)
+		if err != nil {
+			klog.V(2).Infof("Failed to read config file %s: %v", r.path, err)
+			return
+		}
+
+		r.mu.Lock()
+		changed := sha256.Sum256(data) != r.hash
+		r.mu.Unlock()
+
+		if changed {
+			klog.Infof("Config file %s changed, reloading", r.path)
+			_ = r.Reload()
+		}
+	}, interval, stopCh)
+}
+
+// keepRestartOnly copies the settings that cannot change at runtime from
+// running into c and returns the names of those that differed.
+func (c *Config) keepRestartOnly(running *Config) []string {
+	var changed []string
+	if c.CaptureDir != running.CaptureDir {
+		changed = append(changed, "captureDir")
+		c.CaptureDir = running.CaptureDir
+	}
+	if c.AnnotationKey != running.AnnotationKey {
+		changed = append(changed, "annotationKey")
+		c.AnnotationKey = running.AnnotationKey
+	}
+	if c.WorkerCount != running.WorkerCount {
+		changed = append(changed, "workerCount")
+		c.WorkerCount = running.WorkerCount
+	}
+	if c.ResyncPeriod != running.ResyncPeriod {
+		changed = append(changed, "resyncPeriod")
+		c.ResyncPeriod = running.ResyncPeriod
+	}
+	if c.MetricsAddress != running.MetricsAddress {
+		changed = append(changed, "metricsAddress")
+		c.MetricsAddress = running.MetricsAddress
+	}
+	if c.APIAddress != running.APIAddress {
+		changed = append(changed, "apiAddress")
+		c.APIAddress = running.APIAddress
+	}
+	if c.RPCAPAddress != running.RPCAPAddress {
+		changed = append(changed, "rpcapAddress")
+		c.RPCAPAddress = running.RPCAPAddress
+	}
+	if c.ServingCertFile != running.ServingCertFile || c.ServingKeyFile != running.ServingKeyFile {
+		changed = append(changed, "servingCertFile")
+		c.ServingCertFile, c.ServingKeyFile = running.ServingCertFile, running.ServingKeyFile
+	}
+	if c.AlertReceiver.Address != running.AlertReceiver.Address {
+		changed = append(changed, "alertReceiver.address")
+		c.AlertReceiver.Address = running.AlertReceiver.Address
+	}
+	if c.SigningKeyFile != running.SigningKeyFile {
+		changed = append(changed, "signingKeyFile")
+		c.SigningKeyFile = running.SigningKeyFile
+	}
+	return changed
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloadAppliesNewDefaults(t *testing.T) {
+	path := writeConfigFile(t, "defaultFileCount: 5\n")
+	initial, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+
+	r := NewReloader(path, nil, initial)
+	var applied *Config
+	r.OnReload(func(cfg *Config) { applied = cfg })
+
+	if err := os.WriteFile(path, []byte("defaultFileCount: 7\ncaptureDir: /other\n"), 0644); err != nil {
+		t.Fatalf("Failed to update config file: %v", err)
+	}
+
+	successes := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues("success"))
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() returned error: %v", err)
+	}
+
+	if applied == nil || applied.DefaultFileCount != 7 {
+		t.Fatalf("handler should receive new defaults, got %+v", applied)
+	}
+	if applied.CaptureDir != DefaultCaptureDir {
+		t.Errorf("captureDir needs a restart and should stay %q, got %q", DefaultCaptureDir, applied.CaptureDir)
+	}
+	if r.Current() != applied {
+		t.Error("Current() should return the reloaded configuration")
+	}
+	if got := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues("success")); got != successes+1 {
+		t.Errorf("success counter = %v, want %v", got, successes+1)
+	}
+}
+
+func TestReloadKeepsPreviousConfigOnError(t *testing.T) {
+	path := writeConfigFile(t, "workerCount: 2\n")
+	initial, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+
+	r := NewReloader(path, nil, initial)
+	called := false
+	r.OnReload(func(*Config) { called = true })
+
+	if err := os.WriteFile(path, []byte("defaultFileCount: -1\n"), 0644); err != nil {
+		t.Fatalf("Failed to update config file: %v", err)
+	}
+
+	failures := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues("failure"))
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload() should fail for an invalid file")
+	}
+
+	if called {
+		t.Error("handlers must not run for an invalid configuration")
+	}
+	if r.Current() != initial {
+		t.Error("previous configuration should stay in effect")
+	}
+	if got := testutil.ToFloat64(metrics.ConfigReloads.WithLabelValues("failure")); got != failures+1 {
+		t.Errorf("failure counter = %v, want %v", got, failures+1)
+	}
+}
+
+func TestRunReloadsOnFileChange(t *testing.T) {
+	path := writeConfigFile(t, "defaultFileSizeMB: 2\n")
+	initial, err := Load(path, nil)
+	if err != nil {
+		t.Fatalf("Load() returned error: %v", err)
+	}
+
+	r := NewReloader(path, nil, initial)
+	reloaded := make(chan *Config, 1)
+	r.OnReload(func(cfg *Config) { reloaded <- cfg })
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go r.Run(10*time.Millisecond, stopCh)
+
+	if err := os.WriteFile(path, []byte("defaultFileSizeMB: 3\n"), 0644); err != nil {
+		t.Fatalf("Failed to update config file: %v", err)
+	}
+
+	select {
+	case cfg := <-reloaded:
+		if cfg.DefaultFileSizeMB != 3 {
+			t.Errorf("DefaultFileSizeMB = %d, want 3", cfg.DefaultFileSizeMB)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("config change was not picked up")
+	}
+}
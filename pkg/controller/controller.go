@@ -1,50 +1,140 @@
 package controller
 
 import (
+	"context"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/rules"
+	"github.com/packet-capture-controller/pkg/utils"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
-const CaptureAnnotation = "tcpdump.antrea.io"
+const (
+	CaptureAnnotation = config.DefaultAnnotationKey
+
+	// maxRetries bounds how often a transient failure is requeued before the
+	// pod is dropped until its next update or resync
+	maxRetries = 5
+)
 
 type Controller struct {
-	clientset      kubernetes.Interface
-	podInformer    cache.SharedIndexInformer
-	queue          workqueue.TypedRateLimitingInterface[string]
-	nodeName       string
-	workerCount    int
-	captureManager *capture.Manager
+	clientset         kubernetes.Interface
+	podInformer       cache.SharedIndexInformer
+	namespaceInformer cache.SharedIndexInformer
+	namespaceLister   corelisters.NamespaceLister
+	serviceInformer   cache.SharedIndexInformer
+	serviceLister     corelisters.ServiceLister
+	cacheSyncs        []cache.InformerSynced
+	queue             workqueue.TypedRateLimitingInterface[string]
+	nodeName          string
+	workerCount       int
+	annotationKey     string
+	captureManager    *capture.Manager
+	eventBroadcaster  record.EventBroadcaster
+	recorder          record.EventRecorder
+
+	policyMu sync.RWMutex
+	policy   policy.Policy
+
+	// workloadsMu guards the Deployments owning the ReplicaSets of local
+	// pods and the capture annotations of their workloads, read from the
+	// API server on demand instead of watching every workload of the cluster
+	workloadsMu         sync.Mutex
+	replicaSetOwners    map[string]*workloadRef
+	workloadAnnotations map[workloadRef]workloadAnnotation
+
+	// started filters out events from before the node agent started
+	started time.Time
+	// rulesMu guards the trigger rules, the captures they started by pod
+	// key and rule name, and when each rule last captured each pod
+	rulesMu      sync.Mutex
+	rules        []rules.Rule
+	ruleCaptures map[string]map[string]*ruleCapture
+	ruleFired    map[string]map[string]time.Time
+
+	// eventsMu guards the Unhealthy event informer, which only exists while
+	// a trigger rule needs events, and the context it runs in once Run is called
+	eventsMu      sync.Mutex
+	resyncPeriod  time.Duration
+	eventsCtx     context.Context
+	eventInformer cache.SharedIndexInformer
+	stopEvents    context.CancelFunc
+
+	// slicesMu guards the EndpointSlice informers of the labelled Services,
+	// by namespace/name, and the context they run in once Run is called
+	slicesMu      sync.Mutex
+	slicesCtx     context.Context
+	serviceSlices map[string]*serviceSlices
 }
 
+// NewController creates a controller watching node-local pods through
+// informerFactory, which must be restricted to nodeName, and cluster-scoped
+// objects such as namespaces through clusterInformerFactory. Of the Services,
+// only the ones labelled with the capture annotation key are watched.
 func NewController(
 	clientset kubernetes.Interface,
 	informerFactory informers.SharedInformerFactory,
+	clusterInformerFactory informers.SharedInformerFactory,
 	nodeName string,
+	cfg *config.Config,
 ) *Controller {
 	queue := workqueue.NewTypedRateLimitingQueue(
 		workqueue.DefaultTypedControllerRateLimiter[string](),
 	)
 
 	podInformer := informerFactory.Core().V1().Pods().Informer()
+	namespaces := clusterInformerFactory.Core().V1().Namespaces()
+	serviceInformer := clusterInformerFactory.InformerFor(&corev1.Service{},
+		func(client kubernetes.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+			return newServiceInformer(client, cfg.AnnotationKey, resyncPeriod)
+		})
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "packet-capture-controller", Host: nodeName})
 
 	controller := &Controller{
-		clientset:      clientset,
-		podInformer:    podInformer,
-		queue:          queue,
-		nodeName:       nodeName,
-		workerCount:    1,
-		captureManager: capture.NewManager(),
+		clientset:           clientset,
+		podInformer:         podInformer,
+		namespaceInformer:   namespaces.Informer(),
+		namespaceLister:     namespaces.Lister(),
+		serviceInformer:     serviceInformer,
+		serviceLister:       corelisters.NewServiceLister(serviceInformer.GetIndexer()),
+		queue:               queue,
+		nodeName:            nodeName,
+		workerCount:         cfg.WorkerCount,
+		annotationKey:       cfg.AnnotationKey,
+		captureManager:      capture.NewManager(cfg, nodeName),
+		eventBroadcaster:    eventBroadcaster,
+		recorder:            recorder,
+		policy:              cfg.Policy,
+		replicaSetOwners:    make(map[string]*workloadRef),
+		workloadAnnotations: make(map[workloadRef]workloadAnnotation),
+		started:             time.Now(),
+		ruleCaptures:        make(map[string]map[string]*ruleCapture),
+		ruleFired:           make(map[string]map[string]time.Time),
+		resyncPeriod:        cfg.ResyncPeriod.Duration,
+		serviceSlices:       make(map[string]*serviceSlices),
 	}
+	controller.setRules(cfg.TriggerRules)
 
 	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    controller.handlePodAdd,
@@ -52,6 +142,24 @@ func NewController(
 		DeleteFunc: controller.handlePodDelete,
 	})
 
+	controller.namespaceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.handleNamespaceAdd,
+		UpdateFunc: controller.handleNamespaceUpdate,
+		DeleteFunc: controller.handleNamespaceDelete,
+	})
+
+	serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.handleServiceAdd,
+		UpdateFunc: controller.handleServiceUpdate,
+		DeleteFunc: controller.handleServiceDelete,
+	})
+
+	controller.cacheSyncs = []cache.InformerSynced{
+		podInformer.HasSynced,
+		controller.namespaceInformer.HasSynced,
+		serviceInformer.HasSynced,
+	}
+
 	return controller
 }
 
@@ -63,9 +171,12 @@ func (c *Controller) handlePodAdd(obj interface{}) {
 		return
 	}
 
-	if _, hasAnnotation := pod.Annotations[CaptureAnnotation]; hasAnnotation {
+	if _, hasAnnotation := pod.Annotations[c.annotationKey]; hasAnnotation {
 		klog.V(2).Infof("Pod added with capture annotation: %s", key)
 		c.queue.Add(key)
+	} else if c.mayCapture(pod) {
+		klog.V(2).Infof("Pod added with inherited capture request: %s", key)
+		c.queue.Add(key)
 	}
 }
 
@@ -83,8 +194,8 @@ func (c *Controller) handlePodUpdate(oldObj, newObj interface{}) {
 		return
 	}
 
-	oldValue, oldHasAnnotation := oldPod.Annotations[CaptureAnnotation]
-	newValue, newHasAnnotation := newPod.Annotations[CaptureAnnotation]
+	oldValue, oldHasAnnotation := oldPod.Annotations[c.annotationKey]
+	newValue, newHasAnnotation := newPod.Annotations[c.annotationKey]
 
 	if (!oldHasAnnotation && newHasAnnotation) || (oldHasAnnotation && newHasAnnotation && oldValue != newValue) {
 		klog.V(2).Infof("Pod annotation added/changed: %s", key)
@@ -95,6 +206,28 @@ func (c *Controller) handlePodUpdate(oldObj, newObj interface{}) {
 		klog.V(2).Infof("Pod annotation removed: %s", key)
 		c.queue.Add(key)
 	}
+
+	if !newHasAnnotation && !equality.Semantic.DeepEqual(oldPod.Labels, newPod.Labels) && c.namespaceHasTargets(newPod.Namespace) {
+		klog.V(2).Infof("Pod labels changed in namespace with capture targets: %s", key)
+		c.queue.Add(key)
+	}
+
+	if newPod.Annotations[c.triggerAnnotationKey()] != oldPod.Annotations[c.triggerAnnotationKey()] && c.isCapturing(newPod) {
+		klog.V(2).Infof("Pod trigger annotation changed: %s", key)
+		c.queue.Add(key)
+	}
+
+	if signals := rules.PodSignals(oldPod, newPod); len(signals) > 0 {
+		c.handleSignals(newPod, signals)
+	}
+
+	// Transient errors are only retried a few times, so a pod whose
+	// containers were not running yet is picked up again once they are.
+	if c.mayCapture(newPod) && !c.isCapturing(newPod) &&
+		!equality.Semantic.DeepEqual(oldPod.Status.ContainerStatuses, newPod.Status.ContainerStatuses) {
+		klog.V(2).Infof("Container status changed for pod awaiting capture: %s", key)
+		c.queue.Add(key)
+	}
 }
 
 func (c *Controller) handlePodDelete(obj interface{}) {
@@ -119,8 +252,36 @@ func (c *Controller) handlePodDelete(obj interface{}) {
 		return
 	}
 
-	if _, hasAnnotation := pod.Annotations[CaptureAnnotation]; hasAnnotation {
-		klog.V(2).Infof("Pod deleted with capture annotation: %s", key)
+	if _, hasAnnotation := pod.Annotations[c.annotationKey]; hasAnnotation || c.isCapturing(pod) {
+		klog.V(2).Infof("Pod deleted with capture: %s", key)
+		c.queue.Add(key)
+	}
+}
+
+// ApplyConfig hands a reloaded configuration to the capture manager and
+// resyncs every pod that may be captured so the new settings are evaluated
+// against running sessions too.
+func (c *Controller) ApplyConfig(cfg *config.Config) {
+	c.captureManager.UpdateConfig(cfg)
+
+	c.policyMu.Lock()
+	c.policy = cfg.Policy
+	c.policyMu.Unlock()
+	c.setRules(cfg.TriggerRules)
+
+	for _, obj := range c.podInformer.GetStore().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		if !c.mayCapture(pod) && !c.isCapturing(pod) {
+			continue
+		}
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			klog.Errorf("Failed to get key for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
 		c.queue.Add(key)
 	}
 }
@@ -128,14 +289,20 @@ func (c *Controller) handlePodDelete(obj interface{}) {
 func (c *Controller) Run(stopCh <-chan struct{}) error {
 	defer runtime.HandleCrash()
 	defer c.queue.ShutDown()
+	defer c.eventBroadcaster.Shutdown()
 
 	klog.Info("Starting packet capture controller")
 
-	if !cache.WaitForCacheSync(stopCh, c.podInformer.HasSynced) {
+	if !cache.WaitForCacheSync(stopCh, c.cacheSyncs...) {
 		return fmt.Errorf("failed to wait for cache sync")
 	}
+	if !c.runServiceSlices(stopCh) {
+		return fmt.Errorf("failed to wait for EndpointSlice cache sync")
+	}
 
 	klog.Info("Cache synced, starting workers")
+	c.runEventInformer(stopCh)
+	go wait.Until(c.refreshWorkloads, workloadRefreshInterval, stopCh)
 
 	for i := 0; i < c.workerCount; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
@@ -167,8 +334,20 @@ func (c *Controller) processNextWorkItem() bool {
 		return true
 	}
 
-	runtime.HandleError(fmt.Errorf("error syncing pod %q: %v", key, err))
-	c.queue.AddRateLimited(key)
+	if utils.IsPermanent(err) {
+		runtime.HandleError(fmt.Errorf("not retrying pod %q: %v", key, err))
+		c.queue.Forget(key)
+		return true
+	}
+
+	if c.queue.NumRequeues(key) < maxRetries {
+		klog.V(2).Infof("Transient error syncing pod %q, retrying: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	runtime.HandleError(fmt.Errorf("dropping pod %q after %d retries: %v", key, maxRetries, err))
+	c.queue.Forget(key)
 
 	return true
 }
@@ -187,28 +366,136 @@ func (c *Controller) syncHandler(key string) error {
 	if !exists {
 		klog.V(2).Infof("Pod %s no longer exists, cleaning up", key)
 		c.captureManager.StopCapture(namespace, name)
+		c.forgetRules(key)
 		return nil
 	}
 
 	pod := obj.(*corev1.Pod)
 
+	// Sessions of an earlier pod with the same name are stale: the pod was
+	// deleted and recreated before its deletion was processed.
+	c.captureManager.StopStaleSessions(namespace, name, pod.UID)
+
 	if pod.DeletionTimestamp != nil {
 		klog.V(2).Infof("Pod %s is being deleted, stopping capture", key)
 		c.captureManager.StopCapture(namespace, name)
 		return nil
 	}
 
-	_, hasAnnotation := pod.Annotations[CaptureAnnotation]
-	if hasAnnotation {
-		klog.V(2).Infof("Starting capture for pod %s", key)
-		if err := c.captureManager.StartCapture(pod); err != nil {
-			return fmt.Errorf("failed to start capture for pod %s: %w", key, err)
+	if err := c.syncPod(pod); err != nil {
+		if utils.IsPermanent(err) {
+			c.reportRefusal(pod, err)
 		}
-	} else {
-		klog.V(2).Infof("Stopping capture for pod %s (annotation removed)", key)
-		c.captureManager.StopCapture(namespace, name)
+		return fmt.Errorf("failed to sync capture for pod %s: %w", key, err)
 	}
 
 	klog.V(4).Infof("Successfully synced pod %s/%s", namespace, name)
 	return nil
 }
+
+// checkWindow returns StateWaiting and when the capture starts if the
+// window of spec has not opened yet, or StateFinished if it has closed, and
+// an empty state while the capture may run. The pod is synced again when the
+// window opens and closes, so captures of a group start and stop together.
+func (c *Controller) checkWindow(pod *corev1.Pod, captureID string, spec *capture.CaptureSpec) (string, string) {
+	start, end := spec.Window()
+	if start.IsZero() {
+		return "", ""
+	}
+	key := pod.Namespace + "/" + pod.Name
+	now := time.Now()
+	switch {
+	case now.Before(start):
+		// A session of an earlier window with the same ID is over
+		c.captureManager.StopSession(pod.Namespace, pod.Name, captureID)
+		c.queue.AddAfter(key, start.Sub(now))
+		return capture.StateWaiting, fmt.Sprintf("starts at %s", start.Format(time.RFC3339))
+	case !now.Before(end):
+		return capture.StateFinished, fmt.Sprintf("window ended at %s", end.Format(time.RFC3339))
+	}
+	c.queue.AddAfter(key, end.Sub(now))
+	return "", ""
+}
+
+// syncPod starts, restarts or stops the capture sessions of a live pod to
+// match its current capture requests and the capture policy. Refused
+// sessions are reported on the pod; the first transient error is returned so
+// the pod is retried.
+func (c *Controller) syncPod(pod *corev1.Pod) error {
+	reqs, err := c.captureRequestsFor(pod)
+	if err != nil {
+		return err
+	}
+	reqs = append(reqs, c.ruleRequests(pod)...)
+
+	if len(reqs) == 0 {
+		klog.V(2).Infof("Stopping captures for pod %s/%s (no longer requested)", pod.Namespace, pod.Name)
+		c.captureManager.StopCapture(pod.Namespace, pod.Name)
+		c.clearStatus(pod)
+		return nil
+	}
+
+	status := &capture.Status{Node: c.nodeName, State: capture.StateRefused}
+	requested := make(map[string]bool, len(reqs))
+	var retryErr error
+	for _, req := range reqs {
+		requested[req.id] = true
+		sessionStatus := capture.SessionStatus{CaptureID: req.id, State: capture.StateRefused}
+
+		spec, err := c.admit(pod, req)
+		var windowState string
+		if err == nil {
+			windowState, sessionStatus.Message = c.checkWindow(pod, req.id, spec)
+		}
+		if err == nil && windowState == "" {
+			klog.V(2).Infof("Starting capture %s for pod %s/%s", req.id, pod.Namespace, pod.Name)
+			err = c.captureManager.StartCapture(pod, req.id, spec)
+		}
+		switch {
+		case err == nil:
+			switch {
+			case windowState != "":
+				sessionStatus.State = windowState
+			case spec.Armed():
+				sessionStatus.State = capture.StateArmed
+			case spec.Scheduled():
+				sessionStatus.State = capture.StateScheduled
+			default:
+				sessionStatus.State = capture.StateCapturing
+			}
+			sessionStatus.Filter = spec.Filter
+			status.State = capture.StateCapturing
+		case utils.IsPermanent(err):
+			c.captureManager.StopSession(pod.Namespace, pod.Name, req.id)
+			c.recorder.Event(pod, corev1.EventTypeWarning, ReasonCaptureRefused, err.Error())
+			sessionStatus.Message = err.Error()
+		default:
+			if retryErr == nil {
+				retryErr = err
+			}
+			continue
+		}
+		status.Sessions = append(status.Sessions, sessionStatus)
+	}
+
+	for _, id := range c.captureManager.CaptureIDs(pod.Namespace, pod.Name) {
+		if !requested[id] {
+			klog.V(2).Infof("Stopping capture %s for pod %s/%s (no longer requested)", id, pod.Namespace, pod.Name)
+			c.captureManager.StopSession(pod.Namespace, pod.Name, id)
+		}
+	}
+	if ids := c.captureManager.ObserveTrigger(pod.Namespace, pod.Name, pod.Annotations[c.triggerAnnotationKey()]); len(ids) > 0 {
+		c.recorder.Eventf(pod, corev1.EventTypeNormal, ReasonCaptureTriggered, "Triggered armed captures %s by annotation", strings.Join(ids, ", "))
+	}
+
+	if pod.Spec.HostNetwork {
+		status.HostNetwork = capture.HostNetworkRefused
+		if status.State == capture.StateCapturing {
+			status.HostNetwork = capture.HostNetworkScoped
+		}
+	}
+	if len(status.Sessions) > 0 {
+		c.updateStatus(pod, status)
+	}
+	return retryErr
+}
@@ -1,12 +1,16 @@
 package controller
 
 import (
+	"context"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
 	"github.com/leanovate/gopter/prop"
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/informers"
@@ -20,7 +24,7 @@ func TestAnnotationChangeDetection(t *testing.T) {
 		func(podName, namespace, nodeName, annotationValue string) bool {
 			clientset := fake.NewSimpleClientset()
 			informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
-			ctrl := NewController(clientset, informerFactory, nodeName)
+			ctrl := NewController(clientset, informerFactory, informerFactory, nodeName, config.Default())
 
 			oldPod := &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
@@ -63,7 +67,7 @@ func TestAnnotationRemovalDetection(t *testing.T) {
 		func(podName, namespace, nodeName, annotationValue string) bool {
 			clientset := fake.NewSimpleClientset()
 			informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
-			ctrl := NewController(clientset, informerFactory, nodeName)
+			ctrl := NewController(clientset, informerFactory, informerFactory, nodeName, config.Default())
 
 			oldPod := &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
@@ -101,3 +105,147 @@ func TestAnnotationRemovalDetection(t *testing.T) {
 	properties.TestingRun(t, gopter.ConsoleReporter(false))
 }
 
+func TestRetryClassification(t *testing.T) {
+	tests := []struct {
+		name         string
+		pod          *corev1.Pod
+		wantRequeues int
+	}{
+		{
+			name: "malformed annotation is not retried",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "bad-annotation",
+					Namespace:   "default",
+					Annotations: map[string]string{CaptureAnnotation: "ten"},
+				},
+			},
+			wantRequeues: 0,
+		},
+		{
+			name: "hostNetwork pod is not retried",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "host-net",
+					Namespace:   "default",
+					Annotations: map[string]string{CaptureAnnotation: "5"},
+				},
+				Spec: corev1.PodSpec{HostNetwork: true},
+			},
+			wantRequeues: 0,
+		},
+		{
+			name: "pod without container status is retried",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "pending",
+					Namespace:   "default",
+					Annotations: map[string]string{CaptureAnnotation: "5"},
+				},
+			},
+			wantRequeues: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientset := fake.NewSimpleClientset()
+			informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+			ctrl := NewController(clientset, informerFactory, informerFactory, "node-1", config.Default())
+
+			if err := ctrl.namespaceInformer.GetIndexer().Add(optedInNamespace("default")); err != nil {
+				t.Fatalf("Failed to add namespace to indexer: %v", err)
+			}
+			if err := ctrl.podInformer.GetIndexer().Add(tt.pod); err != nil {
+				t.Fatalf("Failed to add pod to indexer: %v", err)
+			}
+			key := tt.pod.Namespace + "/" + tt.pod.Name
+			ctrl.queue.Add(key)
+
+			ctrl.processNextWorkItem()
+
+			if got := ctrl.queue.NumRequeues(key); got != tt.wantRequeues {
+				t.Errorf("NumRequeues() = %d, want %d", got, tt.wantRequeues)
+			}
+		})
+	}
+}
+
+func TestTransientErrorRetriesAreBounded(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+	ctrl := NewController(clientset, informerFactory, informerFactory, "node-1", config.Default())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pending",
+			Namespace:   "default",
+			Annotations: map[string]string{CaptureAnnotation: "5"},
+		},
+	}
+	if err := ctrl.namespaceInformer.GetIndexer().Add(optedInNamespace("default")); err != nil {
+		t.Fatalf("Failed to add namespace to indexer: %v", err)
+	}
+	if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+		t.Fatalf("Failed to add pod to indexer: %v", err)
+	}
+	key := "default/pending"
+
+	for i := 0; i < maxRetries; i++ {
+		ctrl.queue.AddRateLimited(key)
+	}
+	ctrl.queue.Add(key)
+	ctrl.processNextWorkItem()
+
+	if got := ctrl.queue.NumRequeues(key); got != 0 {
+		t.Errorf("NumRequeues() = %d after exhausting retries, want 0", got)
+	}
+}
+
+func TestCaptureWindowIsWaitedForAndEnds(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		startAt   time.Time
+		wantState string
+	}{
+		{name: "before the window", startAt: now.Add(time.Hour), wantState: capture.StateWaiting},
+		{name: "after the window", startAt: now.Add(-time.Hour), wantState: capture.StateFinished},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := fmt.Sprintf(`[{"id":"checkout","group":"checkout","startAt":%q,"duration":"5m"}]`, tt.startAt.Format(time.RFC3339))
+			pod := testPod("default", "web-0", nil, map[string]string{CaptureAnnotation: value})
+			clientset := fake.NewSimpleClientset(pod)
+			informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+			ctrl := NewController(clientset, informerFactory, informerFactory, "node-1", config.Default())
+
+			if err := ctrl.namespaceInformer.GetIndexer().Add(optedInNamespace("default")); err != nil {
+				t.Fatalf("Failed to add namespace: %v", err)
+			}
+			if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+				t.Fatalf("Failed to add pod: %v", err)
+			}
+			drainQueue(ctrl)
+
+			ctrl.queue.Add("default/web-0")
+			ctrl.processNextWorkItem()
+
+			if ids := ctrl.captureManager.CaptureIDs("default", "web-0"); len(ids) != 0 {
+				t.Errorf("capture outside its window started: %v", ids)
+			}
+			updated, err := clientset.CoreV1().Pods("default").Get(context.TODO(), "web-0", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Failed to get pod: %v", err)
+			}
+			status, err := capture.ParseStatus(updated.Annotations[CaptureAnnotation+capture.StatusAnnotationSuffix])
+			if err != nil {
+				t.Fatalf("ParseStatus() error = %v", err)
+			}
+			if len(status.Sessions) != 1 || status.Sessions[0].State != tt.wantState {
+				t.Errorf("sessions = %+v, want one in state %s", status.Sessions, tt.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog/v2"
+)
+
+// Event reasons recorded on pods whose capture request is refused or whose
+// armed captures are triggered
+const (
+	ReasonCaptureRefused   = "CaptureRefused"
+	ReasonCaptureTriggered = "CaptureTriggered"
+)
+
+func (c *Controller) currentPolicy() policy.Policy {
+	c.policyMu.RLock()
+	defer c.policyMu.RUnlock()
+	return c.policy
+}
+
+// admit applies the capture policy to req on pod. It returns the options the
+// session runs with, or a permanent error when the capture is refused.
+func (c *Controller) admit(pod *corev1.Pod, req captureRequest) (*capture.CaptureSpec, error) {
+	if err := c.checkPolicy(pod, req); err != nil {
+		return nil, err
+	}
+	if pod.Spec.HostNetwork {
+		return c.scopeHostNetwork(pod, req.spec)
+	}
+	return req.spec, nil
+}
+
+// checkPolicy returns a permanent error when the capture policy refuses req for pod
+func (c *Controller) checkPolicy(pod *corev1.Pod, req captureRequest) error {
+	ns := policy.Namespace{Name: pod.Namespace}
+	obj, err := c.namespaceLister.Get(pod.Namespace)
+	if err == nil {
+		ns.Labels = obj.Labels
+		ns.Annotations = obj.Annotations
+	} else if !errors.IsNotFound(err) {
+		klog.Errorf("Failed to get namespace %s from cache: %v", pod.Namespace, err)
+	}
+
+	p := c.currentPolicy()
+	return p.Evaluate(ns, req.spec.PolicyRequest())
+}
+
+// scopeHostNetwork applies the hostNetwork policy to a capture of pod, which
+// shares the node's network namespace. It returns the spec restricted to the
+// pod's declared ports, or a permanent error when the capture is refused.
+func (c *Controller) scopeHostNetwork(pod *corev1.Pod, spec *capture.CaptureSpec) (*capture.CaptureSpec, error) {
+	podName := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+
+	p := c.currentPolicy()
+	if p.HostNetwork != policy.HostNetworkScope {
+		return nil, utils.NewHostNetworkRefusedError(podName)
+	}
+
+	portFilter := capture.PodPortFilter(pod)
+	if portFilter == "" {
+		return nil, utils.NewHostNetworkUnscopedError(podName)
+	}
+	klog.V(2).Infof("Scoping capture of hostNetwork pod %s to %s", podName, portFilter)
+	return spec.WithPortFilter(portFilter), nil
+}
+
+// reportRefusal tells the requester why a capture will not run by recording
+// a warning event and the refused state on the pod
+func (c *Controller) reportRefusal(pod *corev1.Pod, err error) {
+	c.recorder.Event(pod, corev1.EventTypeWarning, ReasonCaptureRefused, err.Error())
+
+	status := &capture.Status{Node: c.nodeName, State: capture.StateRefused, Message: err.Error()}
+	if pod.Spec.HostNetwork {
+		status.HostNetwork = capture.HostNetworkRefused
+	}
+	c.updateStatus(pod, status)
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func optedInNamespace(name string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{policy.DefaultOptInKey: "true"},
+	}}
+}
+
+func TestPolicyRefusalIsReportedAndNotRetried(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace *corev1.Namespace
+		value     string
+		wantEvent string
+	}{
+		{
+			name:      "namespace not opted in",
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+			value:     "5",
+			wantEvent: "has not opted in",
+		},
+		{
+			name:      "denied namespace",
+			namespace: optedInNamespace("kube-system"),
+			value:     "5",
+			wantEvent: "not allowed in namespace kube-system",
+		},
+		{
+			name:      "over namespace limit",
+			namespace: optedInNamespace("shop"),
+			value:     `{"fileCount":50}`,
+			wantEvent: "exceeds the limit of 20",
+		},
+		{
+			name:      "armed buffer over namespace limit",
+			namespace: optedInNamespace("shop"),
+			value:     `{"mode":"armed","bufferSizeMB":64}`,
+			wantEvent: "bufferSizeMB 64 exceeds the limit of 32",
+		},
+		{
+			name:      "retention over namespace limit",
+			namespace: optedInNamespace("shop"),
+			value:     `{"retention":"48h"}`,
+			wantEvent: "retention 48h0m0s exceeds the limit of 24h0m0s",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(t)
+			recorder := record.NewFakeRecorder(10)
+			ctrl.recorder = recorder
+
+			cfg := config.Default()
+			cfg.Policy.NamespaceLimits = map[string]policy.Limits{"shop": {
+				MaxFileCount:    20,
+				MaxBufferSizeMB: 32,
+				MaxRetention:    metav1.Duration{Duration: 24 * time.Hour},
+			}}
+			ctrl.ApplyConfig(cfg)
+
+			if err := ctrl.namespaceInformer.GetIndexer().Add(tt.namespace); err != nil {
+				t.Fatalf("Failed to add namespace: %v", err)
+			}
+			pod := testPod(tt.namespace.Name, "web-0", nil, map[string]string{CaptureAnnotation: tt.value})
+			if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+				t.Fatalf("Failed to add pod: %v", err)
+			}
+			drainQueue(ctrl)
+
+			key := pod.Namespace + "/" + pod.Name
+			ctrl.queue.Add(key)
+			ctrl.processNextWorkItem()
+
+			if got := ctrl.queue.NumRequeues(key); got != 0 {
+				t.Errorf("refused capture should not be retried, NumRequeues() = %d", got)
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if !strings.Contains(event, ReasonCaptureRefused) || !strings.Contains(event, tt.wantEvent) {
+					t.Errorf("event %q should mention %q", event, tt.wantEvent)
+				}
+			default:
+				t.Error("expected a CaptureRefused event")
+			}
+		})
+	}
+}
+
+func TestHostNetworkPolicy(t *testing.T) {
+	ports := []corev1.ContainerPort{{ContainerPort: 53, Protocol: corev1.ProtocolUDP}, {ContainerPort: 9153}}
+
+	tests := []struct {
+		name       string
+		mode       policy.HostNetworkMode
+		ports      []corev1.ContainerPort
+		filter     string
+		wantErr    string
+		wantFilter string
+	}{
+		{name: "refused by default", mode: policy.HostNetworkRefuse, ports: ports, wantErr: "uses hostNetwork"},
+		{name: "scoped to declared ports", mode: policy.HostNetworkScope, ports: ports, wantFilter: "(tcp port 9153 or udp port 53)"},
+		{name: "scope narrows user filter", mode: policy.HostNetworkScope, ports: ports, filter: "host 10.0.0.1", wantFilter: "(host 10.0.0.1) and (tcp port 9153 or udp port 53)"},
+		{name: "no ports to scope to", mode: policy.HostNetworkScope, wantErr: "declares no container ports"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(t)
+			cfg := config.Default()
+			cfg.Policy.HostNetwork = tt.mode
+			ctrl.ApplyConfig(cfg)
+
+			pod := testPod("default", "dns-0", nil, nil)
+			pod.Spec.HostNetwork = true
+			pod.Spec.Containers = []corev1.Container{{Name: "dns", Ports: tt.ports}}
+
+			spec, err := ctrl.scopeHostNetwork(pod, &capture.CaptureSpec{Filter: tt.filter})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("scopeHostNetwork() error = %v, want %q", err, tt.wantErr)
+				}
+				if !utils.IsPermanent(err) {
+					t.Errorf("hostNetwork refusal should be permanent: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("scopeHostNetwork() error = %v", err)
+			}
+			if spec.Filter != tt.wantFilter {
+				t.Errorf("Filter = %q, want %q", spec.Filter, tt.wantFilter)
+			}
+		})
+	}
+}
+
+func TestRefusalIsRecordedInStatusAnnotation(t *testing.T) {
+	pod := testPod("default", "dns-0", nil, map[string]string{CaptureAnnotation: "5"})
+	pod.Spec.HostNetwork = true
+
+	clientset := fake.NewSimpleClientset(pod)
+	informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+	ctrl := NewController(clientset, informerFactory, informerFactory, "node-1", config.Default())
+	ctrl.recorder = record.NewFakeRecorder(10)
+
+	if err := ctrl.namespaceInformer.GetIndexer().Add(optedInNamespace("default")); err != nil {
+		t.Fatalf("Failed to add namespace: %v", err)
+	}
+	if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+		t.Fatalf("Failed to add pod: %v", err)
+	}
+	drainQueue(ctrl)
+
+	ctrl.queue.Add("default/dns-0")
+	ctrl.processNextWorkItem()
+
+	updated, err := clientset.CoreV1().Pods("default").Get(context.TODO(), "dns-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	value, ok := updated.Annotations[CaptureAnnotation+capture.StatusAnnotationSuffix]
+	if !ok {
+		t.Fatal("expected a status annotation on the refused pod")
+	}
+	status, err := capture.ParseStatus(value)
+	if err != nil {
+		t.Fatalf("ParseStatus() error = %v", err)
+	}
+	if status.State != capture.StateRefused || status.HostNetwork != capture.HostNetworkRefused || status.Node != "node-1" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
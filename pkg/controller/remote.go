@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// remoteCaptureID is reported in policy decisions for remote captures, which
+// are not requested through an annotation
+const remoteCaptureID = "remote"
+
+// CapturablePods returns the running pods on this node that the capture
+// policy allows to be captured with the default options, sorted by
+// namespace and name. Remote capture clients are offered these pods.
+func (c *Controller) CapturablePods() []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, obj := range c.podInformer.GetIndexer().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if _, err := c.admitRemote(pod); err != nil {
+			continue
+		}
+		pods = append(pods, pod)
+	}
+	sort.Slice(pods, func(i, j int) bool {
+		if pods[i].Namespace != pods[j].Namespace {
+			return pods[i].Namespace < pods[j].Namespace
+		}
+		return pods[i].Name < pods[j].Name
+	})
+	return pods
+}
+
+// OpenStream applies the capture policy to a remote capture of a pod on this
+// node and starts streaming its packets. Captures of hostNetwork pods are
+// scoped like annotated ones.
+func (c *Controller) OpenStream(namespace, name string) (*capture.Stream, error) {
+	obj, exists, err := c.podInformer.GetIndexer().GetByKey(fmt.Sprintf("%s/%s", namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !exists || !ok || pod.Status.Phase != corev1.PodRunning {
+		return nil, fmt.Errorf("pod %s/%s is not running on node %s", namespace, name, c.nodeName)
+	}
+
+	spec, err := c.admitRemote(pod)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Starting remote capture stream for pod %s/%s", namespace, name)
+	return capture.StartStream(pod, spec)
+}
+
+func (c *Controller) admitRemote(pod *corev1.Pod) (*capture.CaptureSpec, error) {
+	spec := c.captureManager.SpecDefaults()
+	spec.Interface = capture.DefaultInterface
+	return c.admit(pod, captureRequest{id: remoteCaptureID, spec: &spec})
+}
@@ -0,0 +1,319 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/metrics"
+	"github.com/packet-capture-controller/pkg/rules"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// ruleCapture is a capture a trigger rule started on a pod
+type ruleCapture struct {
+	spec  *capture.CaptureSpec
+	until time.Time
+}
+
+// ruleCaptureID is the capture ID the captures of a rule are reported under
+func ruleCaptureID(namespace, rule string) string {
+	return fmt.Sprintf("%s/rule/%s", namespace, rule)
+}
+
+// ruleSpec returns the options of the captures rule starts
+func ruleSpec(rule *rules.Rule, defaults capture.CaptureSpec) (*capture.CaptureSpec, error) {
+	options := rule.Capture
+	options.Duration = metav1.Duration{Duration: rule.CaptureDuration()}
+	if options.Retention.Duration == 0 {
+		options.Retention = metav1.Duration{Duration: rules.DefaultRetention}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	return capture.ParseCaptureSpecWithDefaults(string(data), defaults)
+}
+
+// setRules replaces the trigger rules. Captures already started keep running
+// for their duration.
+func (c *Controller) setRules(triggerRules []rules.Rule) {
+	defaults := c.captureManager.SpecDefaults()
+	for i := range triggerRules {
+		if _, err := ruleSpec(&triggerRules[i], defaults); err != nil {
+			klog.Errorf("Trigger rule %s will not start captures: %v", triggerRules[i].Name, err)
+		}
+	}
+
+	c.rulesMu.Lock()
+	c.rules = triggerRules
+	c.rulesMu.Unlock()
+
+	c.setEventInformer(rules.NeedEvents(triggerRules))
+}
+
+// setEventInformer creates the Unhealthy event informer when needed and
+// starts it if the controller runs, or stops and drops it when not needed
+func (c *Controller) setEventInformer(needed bool) {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	if !needed {
+		if c.eventInformer != nil {
+			klog.Info("No trigger rule needs events any more, stopping the Unhealthy event informer")
+			if c.stopEvents != nil {
+				c.stopEvents()
+			}
+			c.eventInformer, c.stopEvents = nil, nil
+		}
+		return
+	}
+	if c.eventInformer == nil {
+		c.eventInformer = newUnhealthyEventInformer(c.clientset, c.nodeName, c.resyncPeriod)
+		_, err := c.eventInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { c.handleEvent(nil, obj) },
+			UpdateFunc: c.handleEvent,
+		})
+		if err != nil {
+			klog.Errorf("Failed to watch Unhealthy events: %v", err)
+		}
+	}
+	c.startEventInformerLocked()
+}
+
+// runEventInformer starts the Unhealthy event informer, if trigger rules
+// need one, and any created later until stopCh is closed
+func (c *Controller) runEventInformer(stopCh <-chan struct{}) {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+	c.eventsCtx = wait.ContextForChannel(stopCh)
+	c.startEventInformerLocked()
+}
+
+func (c *Controller) startEventInformerLocked() {
+	if c.eventsCtx == nil || c.eventInformer == nil || c.stopEvents != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.eventsCtx)
+	c.stopEvents = cancel
+	klog.Infof("Watching Unhealthy events of pods on node %s for trigger rules", c.nodeName)
+	go c.eventInformer.Run(ctx.Done())
+}
+
+// handleSignals starts the captures of the rules matching the failure
+// signals of pod and triggers the pod's armed captures
+func (c *Controller) handleSignals(pod *corev1.Pod, signals []rules.Signal) {
+	for _, signal := range signals {
+		c.fireRules(pod, signal)
+	}
+}
+
+func (c *Controller) fireRules(pod *corev1.Pod, signal rules.Signal) {
+	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+	defaults := c.captureManager.SpecDefaults()
+	now := time.Now()
+
+	c.rulesMu.Lock()
+	var started []rules.Rule
+	for i := range c.rules {
+		rule := &c.rules[i]
+		if !rule.Matches(pod, signal) {
+			continue
+		}
+		if active, ok := c.ruleCaptures[key][rule.Name]; ok && now.Before(active.until) {
+			metrics.RuleTriggers.WithLabelValues(rule.Name, "active").Inc()
+			continue
+		}
+		if last, ok := c.ruleFired[key][rule.Name]; ok && now.Sub(last) < rule.CooldownDuration() {
+			klog.V(2).Infof("Rule %s matched %s of pod %s during its cooldown", rule.Name, signal, key)
+			metrics.RuleTriggers.WithLabelValues(rule.Name, "cooldown").Inc()
+			continue
+		}
+		if rule.MaxActive > 0 && c.activeRuleCapturesLocked(rule.Name, now) >= rule.MaxActive {
+			klog.Infof("Rule %s matched %s of pod %s but already runs %d captures", rule.Name, signal, key, rule.MaxActive)
+			metrics.RuleTriggers.WithLabelValues(rule.Name, "limited").Inc()
+			continue
+		}
+		spec, err := ruleSpec(rule, defaults)
+		if err != nil {
+			klog.Errorf("Trigger rule %s matched %s of pod %s but is invalid: %v", rule.Name, signal, key, err)
+			continue
+		}
+		// Pods the policy does not let the rule capture are left alone, so
+		// they get neither events nor a refused status
+		if _, err := c.admit(pod, captureRequest{id: ruleCaptureID(pod.Namespace, rule.Name), spec: spec}); err != nil {
+			klog.V(2).Infof("Rule %s matched %s of pod %s but the policy refuses it: %v", rule.Name, signal, key, err)
+			metrics.RuleTriggers.WithLabelValues(rule.Name, "refused").Inc()
+			continue
+		}
+
+		if c.ruleFired[key] == nil {
+			c.ruleFired[key] = make(map[string]time.Time)
+		}
+		c.ruleFired[key][rule.Name] = now
+		if c.ruleCaptures[key] == nil {
+			c.ruleCaptures[key] = make(map[string]*ruleCapture)
+		}
+		c.ruleCaptures[key][rule.Name] = &ruleCapture{spec: spec, until: now.Add(rule.CaptureDuration())}
+		started = append(started, *rule)
+	}
+	c.rulesMu.Unlock()
+
+	for i := range started {
+		rule := &started[i]
+		klog.Infof("Rule %s starts a %s capture of pod %s after %s", rule.Name, rule.CaptureDuration(), key, signal)
+		metrics.RuleTriggers.WithLabelValues(rule.Name, "started").Inc()
+		c.recorder.Eventf(pod, corev1.EventTypeNormal, ReasonCaptureTriggered, "Rule %s started a %s capture after %s", rule.Name, rule.CaptureDuration(), signal)
+		// A finished capture of an earlier match is kept for its retention
+		// and replaced by a new session
+		c.captureManager.StopSession(pod.Namespace, pod.Name, ruleCaptureID(pod.Namespace, rule.Name))
+		if ids := c.captureManager.Trigger(pod.Namespace, pod.Name, fmt.Sprintf("rule %s: %s", rule.Name, signal)); len(ids) > 0 {
+			klog.Infof("Rule %s triggered armed captures %v of pod %s", rule.Name, ids, key)
+		}
+		// Resync once the capture is over so its request is dropped
+		c.queue.AddAfter(key, rule.CaptureDuration()+time.Second)
+	}
+	if len(started) > 0 {
+		c.queue.Add(key)
+	}
+}
+
+// activeRuleCapturesLocked counts the pods rule currently captures
+func (c *Controller) activeRuleCapturesLocked(rule string, now time.Time) int {
+	n := 0
+	for _, captures := range c.ruleCaptures {
+		if active, ok := captures[rule]; ok && now.Before(active.until) {
+			n++
+		}
+	}
+	return n
+}
+
+// ruleRequests returns the captures trigger rules currently request for pod
+// and forgets those whose duration is over
+func (c *Controller) ruleRequests(pod *corev1.Pod) []captureRequest {
+	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+	now := time.Now()
+
+	c.rulesMu.Lock()
+	defer c.rulesMu.Unlock()
+	var reqs []captureRequest
+	for name, active := range c.ruleCaptures[key] {
+		if !now.Before(active.until) {
+			delete(c.ruleCaptures[key], name)
+			continue
+		}
+		reqs = append(reqs, captureRequest{id: ruleCaptureID(pod.Namespace, name), spec: active.spec})
+	}
+	if len(c.ruleCaptures[key]) == 0 {
+		delete(c.ruleCaptures, key)
+	}
+	return reqs
+}
+
+// forgetRules drops the rule captures and cooldowns of a deleted pod
+func (c *Controller) forgetRules(key string) {
+	c.rulesMu.Lock()
+	defer c.rulesMu.Unlock()
+	delete(c.ruleCaptures, key)
+	delete(c.ruleFired, key)
+}
+
+// newUnhealthyEventInformer watches the Unhealthy events the kubelet of
+// nodeName reports about pods, which include failed probes. The API server
+// cannot select events by source host, so every node agent still lists and
+// watches the Unhealthy pod events of the whole cluster; those of other
+// nodes are only dropped on arrival and never reach the cache.
+func newUnhealthyEventInformer(client kubernetes.Interface, nodeName string, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	selector := fields.Set{"involvedObject.kind": "Pod", "reason": "Unhealthy", "source": "kubelet"}.AsSelector().String()
+	events := client.CoreV1().Events(metav1.NamespaceAll)
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			list, err := events.List(context.TODO(), options)
+			if err != nil {
+				return nil, err
+			}
+			items := list.Items[:0]
+			for i := range list.Items {
+				if list.Items[i].Source.Host == nodeName {
+					items = append(items, list.Items[i])
+				}
+			}
+			list.Items = items
+			return list, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			w, err := events.Watch(context.TODO(), options)
+			if err != nil {
+				return nil, err
+			}
+			return watch.Filter(w, func(e watch.Event) (watch.Event, bool) {
+				switch e.Type {
+				case watch.Added, watch.Modified, watch.Deleted:
+					event, ok := e.Object.(*corev1.Event)
+					return e, ok && event.Source.Host == nodeName
+				}
+				// Bookmarks and errors carry no event
+				return e, true
+			}), nil
+		},
+	}
+	return cache.NewSharedIndexInformer(lw, &corev1.Event{}, resyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
+
+// handleEvent matches failure signals reported by events about local pods.
+// Events seen again on updates only count when they were observed again, and
+// events from before the node agent started are ignored.
+func (c *Controller) handleEvent(oldObj, newObj interface{}) {
+	event, ok := newObj.(*corev1.Event)
+	if !ok {
+		return
+	}
+	signal, ok := rules.EventSignal(event)
+	if !ok {
+		return
+	}
+	observed := eventTime(event)
+	if !observed.After(c.started) {
+		return
+	}
+	if old, ok := oldObj.(*corev1.Event); ok && !eventTime(old).Before(observed) {
+		return
+	}
+
+	obj, exists, err := c.podInformer.GetIndexer().GetByKey(fmt.Sprintf("%s/%s", event.InvolvedObject.Namespace, event.InvolvedObject.Name))
+	if err != nil || !exists {
+		return
+	}
+	pod := obj.(*corev1.Pod)
+	if pod.UID != event.InvolvedObject.UID || pod.DeletionTimestamp != nil {
+		return
+	}
+	c.fireRules(pod, signal)
+}
+
+// eventTime returns when an event was last observed
+func eventTime(event *corev1.Event) time.Time {
+	switch {
+	case event.Series != nil:
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
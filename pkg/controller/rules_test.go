@@ -0,0 +1,219 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/rules"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// restartedPod returns old and new versions of a pod of app=web whose
+// container was restarted after an OOM kill
+func restartedPod(name string) (*corev1.Pod, *corev1.Pod) {
+	oldPod := testPod("shop", name, map[string]string{"app": "web"}, nil)
+	oldPod.UID = types.UID(name + "-uid")
+	oldPod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "app"}}
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Status.ContainerStatuses[0].RestartCount = 1
+	newPod.Status.ContainerStatuses[0].LastTerminationState.Terminated = &corev1.ContainerStateTerminated{Reason: "OOMKilled"}
+	return oldPod, newPod
+}
+
+// newRulesTestController returns a controller whose namespace shop has
+// opted in to captures
+func newRulesTestController(t *testing.T) *Controller {
+	t.Helper()
+	ctrl := newTestController(t)
+	if err := ctrl.namespaceInformer.GetIndexer().Add(optedInNamespace("shop")); err != nil {
+		t.Fatalf("Failed to add namespace: %v", err)
+	}
+	return ctrl
+}
+
+func TestTriggerRulesStartTimeBoundedCaptures(t *testing.T) {
+	ctrl := newRulesTestController(t)
+	cfg := config.Default()
+	cfg.TriggerRules = []rules.Rule{{
+		Name:      "web-oom",
+		Selector:  "app=web",
+		Signals:   []rules.Signal{rules.SignalOOMKilled},
+		Capture:   rules.Capture{Duration: metav1.Duration{Duration: time.Minute}, Filter: "tcp port 80"},
+		MaxActive: 1,
+	}}
+	ctrl.ApplyConfig(cfg)
+	drainQueue(ctrl)
+
+	oldPod, newPod := restartedPod("web-0")
+	ctrl.handlePodUpdate(oldPod, newPod)
+	if ctrl.queue.Len() != 1 {
+		t.Fatalf("OOM kill matched by a rule should enqueue the pod, queue length %d", ctrl.queue.Len())
+	}
+	reqs := ctrl.ruleRequests(newPod)
+	if len(reqs) != 1 || reqs[0].id != "shop/rule/web-oom" {
+		t.Fatalf("ruleRequests() = %+v, want the capture of rule web-oom", reqs)
+	}
+	spec := reqs[0].spec
+	if spec.Duration.Duration != time.Minute || spec.Filter != "tcp port 80" || spec.Retention.Duration != rules.DefaultRetention {
+		t.Errorf("rule capture spec = %+v", spec)
+	}
+
+	// The cap on active captures holds back a second pod
+	oldOther, newOther := restartedPod("web-1")
+	ctrl.handlePodUpdate(oldOther, newOther)
+	if reqs := ctrl.ruleRequests(newOther); len(reqs) != 0 {
+		t.Errorf("rule with maxActive 1 started a second capture: %+v", reqs)
+	}
+
+	// Once the capture is over, its request is dropped and the cooldown
+	// keeps the pod from being captured again right away
+	ctrl.rulesMu.Lock()
+	ctrl.ruleCaptures["shop/web-0"]["web-oom"].until = time.Now().Add(-time.Second)
+	ctrl.rulesMu.Unlock()
+	if reqs := ctrl.ruleRequests(newPod); len(reqs) != 0 {
+		t.Fatalf("expired rule capture is still requested: %+v", reqs)
+	}
+	ctrl.fireRules(newPod, rules.SignalOOMKilled)
+	if reqs := ctrl.ruleRequests(newPod); len(reqs) != 0 {
+		t.Errorf("rule captured the pod again during its cooldown: %+v", reqs)
+	}
+
+	// A deleted pod is forgotten, cooldown included
+	ctrl.forgetRules("shop/web-0")
+	ctrl.fireRules(newPod, rules.SignalOOMKilled)
+	if reqs := ctrl.ruleRequests(newPod); len(reqs) != 1 {
+		t.Errorf("rule should capture a recreated pod, got %+v", reqs)
+	}
+}
+
+func TestTriggerRulesSkipPodsThePolicyRefuses(t *testing.T) {
+	ctrl := newRulesTestController(t)
+	recorder := record.NewFakeRecorder(10)
+	ctrl.recorder = recorder
+	cfg := config.Default()
+	cfg.TriggerRules = []rules.Rule{{Name: "oom", Signals: []rules.Signal{rules.SignalOOMKilled}}}
+	ctrl.ApplyConfig(cfg)
+	if err := ctrl.namespaceInformer.GetIndexer().Add(optedInNamespace("kube-system")); err != nil {
+		t.Fatalf("Failed to add namespace: %v", err)
+	}
+
+	for _, namespace := range []string{"kube-system", "other"} {
+		_, pod := restartedPod("web-0")
+		pod.Namespace = namespace
+		drainQueue(ctrl)
+		ctrl.fireRules(pod, rules.SignalOOMKilled)
+		if reqs := ctrl.ruleRequests(pod); len(reqs) != 0 {
+			t.Errorf("rule captured pod in namespace %s: %+v", namespace, reqs)
+		}
+		if ctrl.queue.Len() != 0 {
+			t.Errorf("refused pod in namespace %s was enqueued", namespace)
+		}
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("refused pods got event %q", event)
+	default:
+	}
+}
+
+func TestLivenessEventsTriggerRules(t *testing.T) {
+	ctrl := newRulesTestController(t)
+	cfg := config.Default()
+	cfg.TriggerRules = []rules.Rule{{Name: "liveness", Signals: []rules.Signal{rules.SignalLivenessProbeFailed}}}
+	ctrl.ApplyConfig(cfg)
+
+	_, pod := restartedPod("web-0")
+	if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+		t.Fatalf("Failed to add pod: %v", err)
+	}
+	event := func(uid types.UID, seen time.Time) *corev1.Event {
+		return &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "web-0.1", Namespace: "shop"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "shop", Name: "web-0", UID: uid},
+			Reason:         "Unhealthy",
+			Message:        "Liveness probe failed: connection refused",
+			LastTimestamp:  metav1.NewTime(seen),
+		}
+	}
+
+	ignored := []struct {
+		name     string
+		old, new *corev1.Event
+	}{
+		{name: "event from before the start", new: event(pod.UID, ctrl.started.Add(-time.Minute))},
+		{name: "event of an earlier pod", new: event("other-uid", time.Now())},
+		{name: "resync of an event", old: event(pod.UID, ctrl.started.Add(time.Second)), new: event(pod.UID, ctrl.started.Add(time.Second))},
+	}
+	for _, tc := range ignored {
+		if tc.old == nil {
+			ctrl.handleEvent(nil, tc.new)
+		} else {
+			ctrl.handleEvent(tc.old, tc.new)
+		}
+		if reqs := ctrl.ruleRequests(pod); len(reqs) != 0 {
+			t.Errorf("%s started a capture", tc.name)
+		}
+	}
+
+	ctrl.handleEvent(event(pod.UID, ctrl.started.Add(time.Second)), event(pod.UID, time.Now().Add(time.Second)))
+	if reqs := ctrl.ruleRequests(pod); len(reqs) != 1 || reqs[0].id != "shop/rule/liveness" {
+		t.Errorf("repeated liveness failure should start a capture, got %+v", reqs)
+	}
+}
+
+func TestEventInformerFollowsTriggerRules(t *testing.T) {
+	ctrl := newTestController(t)
+	for _, host := range []string{"node-1", "node-2"} {
+		_, err := ctrl.clientset.CoreV1().Events("shop").Create(context.TODO(), &corev1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "web." + host, Namespace: "shop"},
+			InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "shop", Name: "web"},
+			Reason:         "Unhealthy",
+			Source:         corev1.EventSource{Component: "kubelet", Host: host},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("Failed to create event: %v", err)
+		}
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ctrl.runEventInformer(stopCh)
+
+	cfg := config.Default()
+	cfg.TriggerRules = []rules.Rule{{Name: "oom", Signals: []rules.Signal{rules.SignalOOMKilled}}}
+	ctrl.ApplyConfig(cfg)
+	if ctrl.eventInformer != nil {
+		t.Fatal("rules without event signals should not watch events")
+	}
+
+	cfg.TriggerRules = append(cfg.TriggerRules, rules.Rule{Name: "liveness", Signals: []rules.Signal{rules.SignalLivenessProbeFailed}})
+	ctrl.ApplyConfig(cfg)
+	informer := ctrl.eventInformer
+	if informer == nil {
+		t.Fatal("a LivenessProbeFailed rule should watch events")
+	}
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		t.Fatal("event informer did not sync")
+	}
+	if keys := informer.GetStore().ListKeys(); len(keys) != 1 || keys[0] != "shop/web.node-1" {
+		t.Errorf("cached events = %v, want only the event of node-1", keys)
+	}
+
+	// Reloading the same rules keeps the running informer
+	ctrl.ApplyConfig(cfg)
+	if ctrl.eventInformer != informer {
+		t.Error("reloading the same rules replaced the event informer")
+	}
+
+	cfg.TriggerRules = cfg.TriggerRules[:1]
+	ctrl.ApplyConfig(cfg)
+	if ctrl.eventInformer != nil || ctrl.stopEvents != nil {
+		t.Error("event informer should stop once no rule needs events")
+	}
+}
@@ -0,0 +1,301 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// endpointSlicePodIndex indexes EndpointSlices by the namespace/name of the
+// pods they point to
+const endpointSlicePodIndex = "byPod"
+
+func endpointSlicePods(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return nil, nil
+	}
+	var keys []string
+	for _, ep := range slice.Endpoints {
+		if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+			keys = append(keys, fmt.Sprintf("%s/%s", slice.Namespace, ep.TargetRef.Name))
+		}
+	}
+	return keys, nil
+}
+
+// serviceRequestFor returns the capture requested by an annotated Service
+// that pod backs. When several annotated Services select the pod, the first
+// by name wins.
+func (c *Controller) serviceRequestFor(pod *corev1.Pod, defaults capture.CaptureSpec) (*captureRequest, error) {
+	for _, svc := range c.annotatedServices(pod.Namespace) {
+		ports, backs, err := c.servicePortsFor(svc, pod)
+		if err != nil {
+			return nil, err
+		}
+		if !backs {
+			continue
+		}
+		sc, err := capture.ParseServiceCapture(svc.Annotations[c.annotationKey], defaults)
+		if err != nil {
+			return nil, err
+		}
+		return &captureRequest{
+			id:   fmt.Sprintf("%s/service/%s", pod.Namespace, svc.Name),
+			spec: sc.SpecForPorts(ports),
+		}, nil
+	}
+	return nil, nil
+}
+
+// backsAnnotatedService reports whether pod is an endpoint of an annotated Service
+func (c *Controller) backsAnnotatedService(pod *corev1.Pod) bool {
+	for _, svc := range c.annotatedServices(pod.Namespace) {
+		if _, backs, err := c.servicePortsFor(svc, pod); err == nil && backs {
+			return true
+		}
+	}
+	return false
+}
+
+// annotatedServices returns the labelled Services of namespace that have a
+// capture annotation, sorted by name
+func (c *Controller) annotatedServices(namespace string) []*corev1.Service {
+	services, err := c.serviceLister.Services(namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Failed to list services in namespace %s from cache: %v", namespace, err)
+		return nil
+	}
+	annotated := services[:0]
+	for _, svc := range services {
+		if _, ok := svc.Annotations[c.annotationKey]; ok {
+			annotated = append(annotated, svc)
+		}
+	}
+	sort.Slice(annotated, func(i, j int) bool { return annotated[i].Name < annotated[j].Name })
+	return annotated
+}
+
+// servicePortsFor returns the endpoint ports of svc and whether pod is one
+// of its endpoints, looked up in the EndpointSlices of svc
+func (c *Controller) servicePortsFor(svc *corev1.Service, pod *corev1.Pod) ([]discoveryv1.EndpointPort, bool, error) {
+	slices := c.serviceSliceIndexer(svc.Namespace, svc.Name)
+	if slices == nil {
+		return nil, false, nil
+	}
+	objs, err := slices.ByIndex(endpointSlicePodIndex, fmt.Sprintf("%s/%s", pod.Namespace, pod.Name))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to look up EndpointSlices for pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	var ports []discoveryv1.EndpointPort
+	for _, obj := range objs {
+		ports = append(ports, obj.(*discoveryv1.EndpointSlice).Ports...)
+	}
+	return ports, len(objs) > 0, nil
+}
+
+func (c *Controller) serviceAnnotated(namespace, name string) bool {
+	if name == "" {
+		return false
+	}
+	svc, err := c.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return false
+	}
+	_, ok := svc.Annotations[c.annotationKey]
+	return ok
+}
+
+func (c *Controller) handleServiceAdd(obj interface{}) {
+	svc := obj.(*corev1.Service)
+	c.watchServiceSlices(svc.Namespace, svc.Name)
+	if _, ok := svc.Annotations[c.annotationKey]; ok {
+		c.enqueueServicePods(svc.Namespace, svc.Name)
+	}
+}
+
+func (c *Controller) handleServiceUpdate(oldObj, newObj interface{}) {
+	oldSvc := oldObj.(*corev1.Service)
+	newSvc := newObj.(*corev1.Service)
+
+	if oldSvc.ResourceVersion == newSvc.ResourceVersion {
+		return
+	}
+
+	oldValue, oldOk := oldSvc.Annotations[c.annotationKey]
+	newValue, newOk := newSvc.Annotations[c.annotationKey]
+	if oldOk != newOk || oldValue != newValue {
+		klog.V(2).Infof("Capture annotation changed on service %s/%s", newSvc.Namespace, newSvc.Name)
+		c.enqueueServicePods(newSvc.Namespace, newSvc.Name)
+	}
+}
+
+// handleServiceDelete also runs when a Service loses the capture label, as
+// the Service informer only watches labelled Services
+func (c *Controller) handleServiceDelete(obj interface{}) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			klog.Errorf("Error decoding object, invalid type")
+			return
+		}
+		svc, ok = tombstone.Obj.(*corev1.Service)
+		if !ok {
+			klog.Errorf("Error decoding tombstone object, invalid type")
+			return
+		}
+	}
+	if _, ok := svc.Annotations[c.annotationKey]; ok {
+		c.enqueueServicePods(svc.Namespace, svc.Name)
+	}
+	c.unwatchServiceSlices(svc.Namespace, svc.Name)
+}
+
+// handleEndpointSliceChange follows endpoint churn of annotated Services by
+// queueing every local pod that was or is an endpoint of the slice
+func (c *Controller) handleEndpointSliceChange(oldObj, newObj interface{}) {
+	for _, obj := range []interface{}{oldObj, newObj} {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		slice, ok := obj.(*discoveryv1.EndpointSlice)
+		if !ok || !c.serviceAnnotated(slice.Namespace, slice.Labels[discoveryv1.LabelServiceName]) {
+			continue
+		}
+		keys, _ := endpointSlicePods(slice)
+		c.enqueueLocalPods(keys)
+	}
+}
+
+// enqueueServicePods queues the local pods backing a Service
+func (c *Controller) enqueueServicePods(namespace, name string) {
+	slices := c.serviceSliceIndexer(namespace, name)
+	if slices == nil {
+		return
+	}
+	for _, obj := range slices.List() {
+		keys, _ := endpointSlicePods(obj)
+		c.enqueueLocalPods(keys)
+	}
+}
+
+// enqueueLocalPods queues the keys of pods scheduled on this node
+func (c *Controller) enqueueLocalPods(keys []string) {
+	for _, key := range keys {
+		if _, exists, err := c.podInformer.GetIndexer().GetByKey(key); err == nil && exists {
+			c.queue.Add(key)
+		}
+	}
+}
+
+// serviceSlices is the EndpointSlice informer of a labelled Service
+type serviceSlices struct {
+	informer cache.SharedIndexInformer
+	stop     context.CancelFunc
+}
+
+// serviceSliceIndexer returns the EndpointSlices of a labelled Service,
+// indexed by endpointSlicePodIndex, or nil if the Service is not watched
+func (c *Controller) serviceSliceIndexer(namespace, name string) cache.Indexer {
+	c.slicesMu.Lock()
+	defer c.slicesMu.Unlock()
+	slices, ok := c.serviceSlices[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	return slices.informer.GetIndexer()
+}
+
+// watchServiceSlices creates the EndpointSlice informer of a labelled
+// Service, which runs once Run is called
+func (c *Controller) watchServiceSlices(namespace, name string) {
+	c.slicesMu.Lock()
+	defer c.slicesMu.Unlock()
+
+	key := namespace + "/" + name
+	if _, ok := c.serviceSlices[key]; ok {
+		return
+	}
+	slices := &serviceSlices{informer: newEndpointSliceInformer(c.clientset, namespace, name, c.resyncPeriod)}
+	_, err := slices.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.handleEndpointSliceChange(nil, obj) },
+		UpdateFunc: c.handleEndpointSliceChange,
+		DeleteFunc: func(obj interface{}) { c.handleEndpointSliceChange(obj, nil) },
+	})
+	if err != nil {
+		klog.Errorf("Failed to watch EndpointSlices of service %s: %v", key, err)
+	}
+	c.serviceSlices[key] = slices
+	c.startServiceSlicesLocked(slices)
+}
+
+// unwatchServiceSlices stops the EndpointSlice informer of a Service that
+// lost its label or was deleted
+func (c *Controller) unwatchServiceSlices(namespace, name string) {
+	c.slicesMu.Lock()
+	defer c.slicesMu.Unlock()
+
+	key := namespace + "/" + name
+	slices, ok := c.serviceSlices[key]
+	if !ok {
+		return
+	}
+	if slices.stop != nil {
+		slices.stop()
+	}
+	delete(c.serviceSlices, key)
+}
+
+// runServiceSlices starts the EndpointSlice informers of the labelled
+// Services, and any created later until stopCh is closed, and waits for the
+// current ones to sync
+func (c *Controller) runServiceSlices(stopCh <-chan struct{}) bool {
+	c.slicesMu.Lock()
+	c.slicesCtx = wait.ContextForChannel(stopCh)
+	synced := make([]cache.InformerSynced, 0, len(c.serviceSlices))
+	for _, slices := range c.serviceSlices {
+		c.startServiceSlicesLocked(slices)
+		synced = append(synced, slices.informer.HasSynced)
+	}
+	c.slicesMu.Unlock()
+	return cache.WaitForCacheSync(stopCh, synced...)
+}
+
+func (c *Controller) startServiceSlicesLocked(slices *serviceSlices) {
+	if c.slicesCtx == nil || slices.stop != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(c.slicesCtx)
+	slices.stop = cancel
+	go slices.informer.Run(ctx.Done())
+}
+
+// newServiceInformer watches only the Services labelled with the capture
+// annotation key, so node agents do not cache every Service of the cluster
+func newServiceInformer(client kubernetes.Interface, labelKey string, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return coreinformers.NewFilteredServiceInformer(client, metav1.NamespaceAll, resyncPeriod,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+		func(options *metav1.ListOptions) { options.LabelSelector = labelKey })
+}
+
+// newEndpointSliceInformer watches the EndpointSlices of a single Service
+func newEndpointSliceInformer(client kubernetes.Interface, namespace, name string, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	selector := labels.Set{discoveryv1.LabelServiceName: name}.AsSelector().String()
+	return discoveryinformers.NewFilteredEndpointSliceInformer(client, namespace, resyncPeriod,
+		cache.Indexers{endpointSlicePodIndex: endpointSlicePods},
+		func(options *metav1.ListOptions) { options.LabelSelector = selector })
+}
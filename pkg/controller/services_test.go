@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testEndpointSlice(name, service string, port int32, pods ...string) *discoveryv1.EndpointSlice {
+	protocol := corev1.ProtocolTCP
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "shop",
+			ResourceVersion: "1",
+			Labels:          map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		Ports: []discoveryv1.EndpointPort{{Protocol: &protocol, Port: &port}},
+	}
+	for _, pod := range pods {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			TargetRef: &corev1.ObjectReference{Kind: "Pod", Namespace: "shop", Name: pod},
+		})
+	}
+	return slice
+}
+
+// testService returns a Service labelled for the node agents, annotated
+// unless annotation is empty
+func testService(name, annotation string) *corev1.Service {
+	svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:            name,
+		Namespace:       "shop",
+		ResourceVersion: "1",
+		Labels:          map[string]string{CaptureAnnotation: "true"},
+	}}
+	if annotation != "" {
+		svc.Annotations = map[string]string{CaptureAnnotation: annotation}
+	}
+	return svc
+}
+
+// addTestService adds svc to the Service cache as the informer would,
+// together with the EndpointSlices of its own informer
+func addTestService(t *testing.T, c *Controller, svc *corev1.Service, slices ...*discoveryv1.EndpointSlice) {
+	t.Helper()
+	if err := c.serviceInformer.GetIndexer().Add(svc); err != nil {
+		t.Fatalf("Failed to add service: %v", err)
+	}
+	c.handleServiceAdd(svc)
+	for _, slice := range slices {
+		if err := c.serviceSliceIndexer(svc.Namespace, svc.Name).Add(slice); err != nil {
+			t.Fatalf("Failed to add EndpointSlice: %v", err)
+		}
+	}
+}
+
+func TestServiceBackendsAreCaptured(t *testing.T) {
+	ctrl := newTestController(t)
+	addTestService(t, ctrl, testService("api", `{"filterServicePorts":true}`), testEndpointSlice("api-1", "api", 8443, "api-0"))
+	addTestService(t, ctrl, testService("plain", ""), testEndpointSlice("plain-1", "plain", 80, "web-0"))
+
+	req, err := requestFor(t, ctrl, testPod("shop", "api-0", nil, nil))
+	if err != nil {
+		t.Fatalf("captureRequestsFor() returned error: %v", err)
+	}
+	if req == nil || req.id != "shop/service/api" {
+		t.Fatalf("capture request = %+v, want shop/service/api", req)
+	}
+	if req.spec.Filter != "(tcp port 8443)" {
+		t.Errorf("filter = %q, want service port filter", req.spec.Filter)
+	}
+
+	if req, _ := requestFor(t, ctrl, testPod("shop", "web-0", nil, nil)); req != nil {
+		t.Errorf("backend of unannotated service should not be captured, got %s", req.id)
+	}
+}
+
+func TestEndpointChurnEnqueuesLocalPods(t *testing.T) {
+	ctrl := newTestController(t)
+	addTestService(t, ctrl, testService("api", "5"))
+	for _, name := range []string{"api-0", "api-1"} {
+		if err := ctrl.podInformer.GetIndexer().Add(testPod("shop", name, nil, nil)); err != nil {
+			t.Fatalf("Failed to add pod: %v", err)
+		}
+	}
+	drainQueue(ctrl)
+
+	oldSlice := testEndpointSlice("api-1", "api", 80, "api-0", "remote-0")
+	newSlice := testEndpointSlice("api-1", "api", 80, "api-1", "remote-0")
+	newSlice.ResourceVersion = "2"
+	ctrl.handleEndpointSliceChange(oldSlice, newSlice)
+
+	if got := ctrl.queue.Len(); got != 2 {
+		t.Errorf("queue length = %d, want the removed and the added local pod", got)
+	}
+}
+
+func TestOnlyLabelledServicesAreWatched(t *testing.T) {
+	labelled := testService("api", "5")
+	unlabelled := testService("web", "5")
+	unlabelled.Labels = nil
+	clientset := fake.NewSimpleClientset(labelled, unlabelled,
+		testEndpointSlice("api-1", "api", 80, "api-0"),
+		testEndpointSlice("web-1", "web", 80, "web-0"))
+	informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+	ctrl := NewController(clientset, informerFactory, informerFactory, "node-1", config.Default())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, ctrl.cacheSyncs...) || !ctrl.runServiceSlices(stopCh) {
+		t.Fatal("Failed to sync caches")
+	}
+
+	if _, err := ctrl.serviceLister.Services("shop").Get("web"); err == nil {
+		t.Error("unlabelled service should not be cached")
+	}
+	slices := ctrl.serviceSliceIndexer("shop", "api")
+	if slices == nil {
+		t.Fatal("EndpointSlices of the labelled service are not watched")
+	}
+	if keys := slices.ListKeys(); len(keys) != 1 || keys[0] != "shop/api-1" {
+		t.Errorf("cached EndpointSlices = %v, want only the ones of the labelled service", keys)
+	}
+	if ctrl.serviceSliceIndexer("shop", "web") != nil {
+		t.Error("EndpointSlices of the unlabelled service should not be watched")
+	}
+
+	ctrl.handleServiceDelete(labelled)
+	if ctrl.serviceSliceIndexer("shop", "api") != nil {
+		t.Error("EndpointSlices of a removed service are still watched")
+	}
+}
@@ -0,0 +1,52 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+func (c *Controller) statusAnnotationKey() string {
+	return c.annotationKey + capture.StatusAnnotationSuffix
+}
+
+// updateStatus records status in the pod's status annotation unless it is
+// already there. Failures are logged since the capture itself is unaffected.
+func (c *Controller) updateStatus(pod *corev1.Pod, status *capture.Status) {
+	value := status.String()
+	if pod.Annotations[c.statusAnnotationKey()] == value {
+		return
+	}
+	c.patchStatusAnnotation(pod, &value)
+}
+
+// clearStatus removes the status annotation from a pod no longer captured
+func (c *Controller) clearStatus(pod *corev1.Pod) {
+	if _, ok := pod.Annotations[c.statusAnnotationKey()]; !ok {
+		return
+	}
+	c.patchStatusAnnotation(pod, nil)
+}
+
+func (c *Controller) patchStatusAnnotation(pod *corev1.Pod, value *string) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{c.statusAnnotationKey(): value},
+		},
+	})
+	if err != nil {
+		klog.Errorf("Failed to build status patch for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+
+	_, err = c.clientset.CoreV1().Pods(pod.Namespace).Patch(
+		context.TODO(), pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		klog.Errorf("Failed to update capture status of pod %s/%s: %v", pod.Namespace, pod.Name, err)
+	}
+}
@@ -0,0 +1,187 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// captureRequest is a capture session a pod should currently have
+type captureRequest struct {
+	// id is reported for the session; pods matched by the same target share it
+	id   string
+	spec *capture.CaptureSpec
+}
+
+// captureRequestsFor resolves the capture sessions requested for pod. In
+// order of precedence the requests come from the pod's own annotation, its
+// Deployment, StatefulSet or DaemonSet, an annotated Service it backs, or the
+// matching namespace targets. No requests means the pod should not be
+// captured.
+func (c *Controller) captureRequestsFor(pod *corev1.Pod) ([]captureRequest, error) {
+	defaults := c.captureManager.SpecDefaults()
+
+	if value, ok := pod.Annotations[c.annotationKey]; ok {
+		sessions, err := capture.ParseSessionSpecs(value, defaults)
+		if err != nil {
+			return nil, err
+		}
+		return sessionRequests(fmt.Sprintf("%s/%s", pod.Namespace, pod.Name), sessions), nil
+	}
+
+	workload, err := c.workloadFor(pod)
+	if err != nil {
+		return nil, err
+	}
+	if workload != nil {
+		if value, ok := c.workloadAnnotation(workload); ok {
+			sessions, err := capture.ParseSessionSpecs(value, defaults)
+			if err != nil {
+				return nil, err
+			}
+			return sessionRequests(workload.String(), sessions), nil
+		}
+	}
+
+	req, err := c.serviceRequestFor(pod, defaults)
+	if err != nil {
+		return nil, err
+	}
+	if req != nil {
+		return []captureRequest{*req}, nil
+	}
+
+	value, ok := c.namespaceTargets(pod.Namespace)
+	if !ok {
+		return nil, nil
+	}
+	targets, err := capture.ParseCaptureTargets(value, defaults)
+	if err != nil {
+		return nil, err
+	}
+	var reqs []captureRequest
+	for _, target := range capture.MatchTargets(targets, pod) {
+		spec := target.CaptureSpec
+		reqs = append(reqs, captureRequest{id: fmt.Sprintf("%s/%s", pod.Namespace, target.ID), spec: &spec})
+	}
+	return reqs, nil
+}
+
+// sessionRequests turns the sessions of an annotation into requests whose
+// IDs extend baseID with the session ID, if any
+func sessionRequests(baseID string, sessions []capture.SessionSpec) []captureRequest {
+	reqs := make([]captureRequest, 0, len(sessions))
+	for i := range sessions {
+		id := baseID
+		if sessions[i].ID != "" {
+			id = fmt.Sprintf("%s/%s", baseID, sessions[i].ID)
+		}
+		spec := sessions[i].CaptureSpec
+		reqs = append(reqs, captureRequest{id: id, spec: &spec})
+	}
+	return reqs
+}
+
+func (c *Controller) targetsAnnotationKey() string {
+	return c.annotationKey + capture.TargetsAnnotationSuffix
+}
+
+// namespaceTargets returns the raw targets annotation of a namespace
+func (c *Controller) namespaceTargets(namespace string) (string, bool) {
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			klog.Errorf("Failed to get namespace %s from cache: %v", namespace, err)
+		}
+		return "", false
+	}
+	value, ok := ns.Annotations[c.targetsAnnotationKey()]
+	return value, ok
+}
+
+func (c *Controller) namespaceHasTargets(namespace string) bool {
+	_, ok := c.namespaceTargets(namespace)
+	return ok
+}
+
+// mayCapture reports whether pod is annotated, belongs to an annotated
+// workload, backs an annotated Service or lives in a namespace with capture
+// targets, i.e. whether syncing it can start a capture
+func (c *Controller) mayCapture(pod *corev1.Pod) bool {
+	if _, ok := pod.Annotations[c.annotationKey]; ok {
+		return true
+	}
+	// Pods whose workload is not cached yet are synced, which reads it
+	if annotated, known := c.cachedWorkloadAnnotated(pod); annotated || !known {
+		return true
+	}
+	return c.backsAnnotatedService(pod) || c.namespaceHasTargets(pod.Namespace)
+}
+
+func (c *Controller) isCapturing(pod *corev1.Pod) bool {
+	return len(c.captureManager.CaptureIDs(pod.Namespace, pod.Name)) > 0
+}
+
+func (c *Controller) handleNamespaceAdd(obj interface{}) {
+	ns := obj.(*corev1.Namespace)
+	if _, ok := ns.Annotations[c.targetsAnnotationKey()]; ok {
+		klog.V(2).Infof("Namespace added with capture targets: %s", ns.Name)
+		c.enqueueNamespacePods(ns.Name)
+	}
+}
+
+func (c *Controller) handleNamespaceUpdate(oldObj, newObj interface{}) {
+	oldNs := oldObj.(*corev1.Namespace)
+	newNs := newObj.(*corev1.Namespace)
+
+	if oldNs.ResourceVersion == newNs.ResourceVersion {
+		return
+	}
+
+	oldValue, oldOk := oldNs.Annotations[c.targetsAnnotationKey()]
+	newValue, newOk := newNs.Annotations[c.targetsAnnotationKey()]
+	if oldOk != newOk || oldValue != newValue {
+		klog.V(2).Infof("Capture targets changed in namespace %s", newNs.Name)
+		c.enqueueNamespacePods(newNs.Name)
+	}
+}
+
+func (c *Controller) handleNamespaceDelete(obj interface{}) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			klog.Errorf("Error decoding object, invalid type")
+			return
+		}
+		ns, ok = tombstone.Obj.(*corev1.Namespace)
+		if !ok {
+			klog.Errorf("Error decoding tombstone object, invalid type")
+			return
+		}
+	}
+	if _, ok := ns.Annotations[c.targetsAnnotationKey()]; ok {
+		c.enqueueNamespacePods(ns.Name)
+	}
+}
+
+// enqueueNamespacePods queues every node-local pod in namespace
+func (c *Controller) enqueueNamespacePods(namespace string) {
+	objs, err := c.podInformer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		klog.Errorf("Failed to list pods in namespace %s: %v", namespace, err)
+		return
+	}
+	for _, obj := range objs {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			klog.Errorf("Failed to get key for pod in namespace %s: %v", namespace, err)
+			continue
+		}
+		c.queue.Add(key)
+	}
+}
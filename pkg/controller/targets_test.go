@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const targetsAnnotation = CaptureAnnotation + capture.TargetsAnnotationSuffix
+
+func newTestController(t *testing.T) *Controller {
+	t.Helper()
+	ctrl, _ := newTestControllerWithFactory(t)
+	return ctrl
+}
+
+// newTestControllerWithFactory returns a controller whose pod and cluster
+// informers share the returned factory, so tests can seed any cache
+func newTestControllerWithFactory(t *testing.T) (*Controller, informers.SharedInformerFactory) {
+	t.Helper()
+	clientset := fake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(clientset, 30*time.Second)
+	return NewController(clientset, informerFactory, informerFactory, "node-1", config.Default()), informerFactory
+}
+
+// requestFor returns the only capture request for pod, or nil when it has none
+func requestFor(t *testing.T, c *Controller, pod *corev1.Pod) (*captureRequest, error) {
+	t.Helper()
+	reqs, err := c.captureRequestsFor(pod)
+	if err != nil || len(reqs) == 0 {
+		return nil, err
+	}
+	if len(reqs) > 1 {
+		t.Fatalf("expected a single capture request for pod %s, got %d", pod.Name, len(reqs))
+	}
+	return &reqs[0], nil
+}
+
+func drainQueue(c *Controller) {
+	for c.queue.Len() > 0 {
+		item, _ := c.queue.Get()
+		c.queue.Done(item)
+	}
+}
+
+func testNamespace(name, targets string) *corev1.Namespace {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: "1"}}
+	if targets != "" {
+		ns.Annotations = map[string]string{targetsAnnotation: targets}
+	}
+	return ns
+}
+
+func testPod(namespace, name string, labels, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       namespace,
+			ResourceVersion: "1",
+			Labels:          labels,
+			Annotations:     annotations,
+		},
+	}
+}
+
+func TestCaptureRequestResolution(t *testing.T) {
+	ctrl := newTestController(t)
+	if err := ctrl.namespaceInformer.GetIndexer().Add(testNamespace("shop", `[{"id":"web","selector":"app=web","filter":"port 80"}]`)); err != nil {
+		t.Fatalf("Failed to add namespace: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		wantID string
+	}{
+		{"matching pod uses target", testPod("shop", "web-1", map[string]string{"app": "web"}, nil), "shop/web"},
+		{"non matching pod is not captured", testPod("shop", "db-1", map[string]string{"app": "db"}, nil), ""},
+		{"pod annotation wins over target", testPod("shop", "web-2", map[string]string{"app": "web"}, map[string]string{CaptureAnnotation: "3"}), "shop/web-2"},
+		{"namespace without targets", testPod("other", "web-1", map[string]string{"app": "web"}, nil), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := requestFor(t, ctrl, tt.pod)
+			if err != nil {
+				t.Fatalf("captureRequestsFor() returned error: %v", err)
+			}
+			gotID := ""
+			if req != nil {
+				gotID = req.id
+			}
+			if gotID != tt.wantID {
+				t.Errorf("capture ID = %q, want %q", gotID, tt.wantID)
+			}
+		})
+	}
+
+	req, _ := requestFor(t, ctrl, tests[0].pod)
+	if req.spec.Filter != "port 80" {
+		t.Errorf("target options not applied: %+v", req.spec)
+	}
+}
+
+func TestMultipleCaptureRequestsPerPod(t *testing.T) {
+	ctrl := newTestController(t)
+	if err := ctrl.namespaceInformer.GetIndexer().Add(testNamespace("shop", `[{"id":"web","selector":"app=web"},{"id":"dns","filter":"port 53"}]`)); err != nil {
+		t.Fatalf("Failed to add namespace: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		wantIDs []string
+	}{
+		{
+			name:    "capture list in pod annotation",
+			pod:     testPod("shop", "web-0", nil, map[string]string{CaptureAnnotation: `[{"id":"dns","filter":"port 53"},{"id":"burst","duration":"1m"}]`}),
+			wantIDs: []string{"shop/web-0/dns", "shop/web-0/burst"},
+		},
+		{
+			name:    "every matching namespace target",
+			pod:     testPod("shop", "web-1", map[string]string{"app": "web"}, nil),
+			wantIDs: []string{"shop/web", "shop/dns"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqs, err := ctrl.captureRequestsFor(tt.pod)
+			if err != nil {
+				t.Fatalf("captureRequestsFor() returned error: %v", err)
+			}
+			var gotIDs []string
+			for _, req := range reqs {
+				gotIDs = append(gotIDs, req.id)
+			}
+			if strings.Join(gotIDs, ",") != strings.Join(tt.wantIDs, ",") {
+				t.Errorf("capture IDs = %v, want %v", gotIDs, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestNamespaceTargetChangeEnqueuesLocalPods(t *testing.T) {
+	ctrl := newTestController(t)
+	for _, pod := range []*corev1.Pod{
+		testPod("shop", "web-1", map[string]string{"app": "web"}, nil),
+		testPod("shop", "db-1", map[string]string{"app": "db"}, nil),
+		testPod("other", "web-1", map[string]string{"app": "web"}, nil),
+	} {
+		if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+			t.Fatalf("Failed to add pod: %v", err)
+		}
+	}
+	drainQueue(ctrl)
+
+	oldNs := testNamespace("shop", "")
+	newNs := testNamespace("shop", `[{"id":"web","selector":"app=web"}]`)
+	newNs.ResourceVersion = "2"
+	ctrl.handleNamespaceUpdate(oldNs, newNs)
+
+	if got := ctrl.queue.Len(); got != 2 {
+		t.Errorf("queue length = %d, want the 2 pods in namespace shop", got)
+	}
+}
+
+func TestLabelChangeEnqueuesPodInTargetedNamespace(t *testing.T) {
+	ctrl := newTestController(t)
+	if err := ctrl.namespaceInformer.GetIndexer().Add(testNamespace("shop", `[{"id":"web","selector":"app=web"}]`)); err != nil {
+		t.Fatalf("Failed to add namespace: %v", err)
+	}
+	drainQueue(ctrl)
+
+	oldPod := testPod("shop", "web-1", map[string]string{"app": "web"}, nil)
+	newPod := oldPod.DeepCopy()
+	newPod.ResourceVersion = "2"
+	newPod.Labels["app"] = "db"
+	ctrl.handlePodUpdate(oldPod, newPod)
+
+	if got := ctrl.queue.Len(); got != 1 {
+		t.Errorf("queue length = %d, want 1 after label change", got)
+	}
+
+	drainQueue(ctrl)
+	otherOld := testPod("other", "web-1", map[string]string{"app": "web"}, nil)
+	otherNew := otherOld.DeepCopy()
+	otherNew.ResourceVersion = "2"
+	otherNew.Labels["app"] = "db"
+	ctrl.handlePodUpdate(otherOld, otherNew)
+
+	if got := ctrl.queue.Len(); got != 0 {
+		t.Errorf("queue length = %d, want 0 for namespace without targets", got)
+	}
+}
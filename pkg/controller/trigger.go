@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func (c *Controller) triggerAnnotationKey() string {
+	return c.annotationKey + capture.TriggerAnnotationSuffix
+}
+
+// Trigger makes the armed captures of a pod on this node write their buffer
+// and records an event on the pod. It returns the IDs of the captures
+// triggered.
+func (c *Controller) Trigger(namespace, name, reason string) []string {
+	ids := c.captureManager.Trigger(namespace, name, reason)
+	if len(ids) == 0 {
+		return nil
+	}
+	obj, exists, err := c.podInformer.GetIndexer().GetByKey(namespace + "/" + name)
+	if err == nil && exists {
+		c.recorder.Eventf(obj.(*corev1.Pod), corev1.EventTypeNormal, ReasonCaptureTriggered, "Triggered armed captures %s: %s", strings.Join(ids, ", "), reason)
+	}
+	return ids
+}
@@ -0,0 +1,245 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// workloadRefreshInterval is how often the capture annotations of the
+// workloads of local pods are read again, so it bounds how long a change of
+// a workload's annotation takes to reach its pods
+const workloadRefreshInterval = time.Minute
+
+// workloadRef identifies the Deployment, StatefulSet or DaemonSet a pod belongs to
+type workloadRef struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func (w workloadRef) String() string {
+	return fmt.Sprintf("%s/%s/%s", w.namespace, w.kind, w.name)
+}
+
+// workloadAnnotation is the capture annotation of a workload, if it has one
+type workloadAnnotation struct {
+	value string
+	ok    bool
+}
+
+// workloadFor resolves the workload owning pod through its controller owner
+// reference, following ReplicaSets up to their Deployment. It returns nil for
+// bare pods and pods owned by other kinds, and a transient error when an
+// owner cannot be read.
+func (c *Controller) workloadFor(pod *corev1.Pod) (*workloadRef, error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil, nil
+	}
+
+	switch owner.Kind {
+	case "StatefulSet":
+		return &workloadRef{kind: "statefulset", namespace: pod.Namespace, name: owner.Name}, nil
+	case "DaemonSet":
+		return &workloadRef{kind: "daemonset", namespace: pod.Namespace, name: owner.Name}, nil
+	case "ReplicaSet":
+		return c.replicaSetOwner(pod, owner.Name)
+	}
+	return nil, nil
+}
+
+// replicaSetOwner returns the Deployment owning the ReplicaSet name of pod,
+// reading the ReplicaSet from the API server unless it is cached
+func (c *Controller) replicaSetOwner(pod *corev1.Pod, name string) (*workloadRef, error) {
+	key := pod.Namespace + "/" + name
+	c.workloadsMu.Lock()
+	ref, cached := c.replicaSetOwners[key]
+	c.workloadsMu.Unlock()
+	if cached {
+		return ref, nil
+	}
+
+	rs, err := c.clientset.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, utils.NewCaptureError(
+				"Owner resolution",
+				fmt.Sprintf("ReplicaSet %s/%s of pod %s was not found", pod.Namespace, name, pod.Name),
+				"Check that the ReplicaSet exists with: kubectl get rs -n "+pod.Namespace,
+				err,
+			)
+		}
+		return nil, err
+	}
+	if rsOwner := metav1.GetControllerOf(rs); rsOwner != nil && rsOwner.Kind == "Deployment" {
+		ref = &workloadRef{kind: "deployment", namespace: pod.Namespace, name: rsOwner.Name}
+	}
+
+	c.workloadsMu.Lock()
+	c.replicaSetOwners[key] = ref
+	c.workloadsMu.Unlock()
+	return ref, nil
+}
+
+// workloadAnnotation returns the capture annotation of a workload, if any,
+// reading the workload from the API server unless it is cached
+func (c *Controller) workloadAnnotation(ref *workloadRef) (string, bool) {
+	c.workloadsMu.Lock()
+	annotation, cached := c.workloadAnnotations[*ref]
+	c.workloadsMu.Unlock()
+	if cached {
+		return annotation.value, annotation.ok
+	}
+
+	annotation, err := c.fetchWorkloadAnnotation(ref)
+	if err != nil {
+		klog.Errorf("Failed to get %s %s: %v", ref.kind, ref, err)
+		return "", false
+	}
+	c.workloadsMu.Lock()
+	c.workloadAnnotations[*ref] = annotation
+	c.workloadsMu.Unlock()
+	return annotation.value, annotation.ok
+}
+
+// cachedWorkloadAnnotated reports from the cache alone whether the workload
+// of pod has a capture annotation. known is false when the cache cannot tell,
+// so pod event handlers never wait for the API server.
+func (c *Controller) cachedWorkloadAnnotated(pod *corev1.Pod) (annotated, known bool) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return false, true
+	}
+
+	c.workloadsMu.Lock()
+	defer c.workloadsMu.Unlock()
+	var ref *workloadRef
+	switch owner.Kind {
+	case "StatefulSet":
+		ref = &workloadRef{kind: "statefulset", namespace: pod.Namespace, name: owner.Name}
+	case "DaemonSet":
+		ref = &workloadRef{kind: "daemonset", namespace: pod.Namespace, name: owner.Name}
+	case "ReplicaSet":
+		var cached bool
+		if ref, cached = c.replicaSetOwners[pod.Namespace+"/"+owner.Name]; !cached {
+			return false, false
+		}
+		if ref == nil {
+			return false, true
+		}
+	default:
+		return false, true
+	}
+	annotation, cached := c.workloadAnnotations[*ref]
+	return annotation.ok, cached
+}
+
+// fetchWorkloadAnnotation reads the capture annotation of a workload from
+// the API server. A workload that does not exist has none.
+func (c *Controller) fetchWorkloadAnnotation(ref *workloadRef) (workloadAnnotation, error) {
+	var meta metav1.Object
+	var err error
+
+	apps := c.clientset.AppsV1()
+	switch ref.kind {
+	case "deployment":
+		meta, err = apps.Deployments(ref.namespace).Get(context.TODO(), ref.name, metav1.GetOptions{})
+	case "statefulset":
+		meta, err = apps.StatefulSets(ref.namespace).Get(context.TODO(), ref.name, metav1.GetOptions{})
+	case "daemonset":
+		meta, err = apps.DaemonSets(ref.namespace).Get(context.TODO(), ref.name, metav1.GetOptions{})
+	default:
+		return workloadAnnotation{}, nil
+	}
+	if errors.IsNotFound(err) {
+		return workloadAnnotation{}, nil
+	}
+	if err != nil {
+		return workloadAnnotation{}, err
+	}
+
+	value, ok := meta.GetAnnotations()[c.annotationKey]
+	return workloadAnnotation{value: value, ok: ok}, nil
+}
+
+// refreshWorkloads reads the capture annotations of the workloads of local
+// pods again and queues the pods of workloads whose annotation changed. The
+// workloads and ReplicaSets no local pod belongs to anymore are forgotten.
+func (c *Controller) refreshWorkloads() {
+	replicaSets := make(map[string]bool)
+	workloads := make(map[workloadRef]bool)
+	for _, obj := range c.podInformer.GetIndexer().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "ReplicaSet" {
+			replicaSets[pod.Namespace+"/"+owner.Name] = true
+		}
+		if ref, err := c.workloadFor(pod); err == nil && ref != nil {
+			workloads[*ref] = true
+		}
+	}
+
+	c.workloadsMu.Lock()
+	for key := range c.replicaSetOwners {
+		if !replicaSets[key] {
+			delete(c.replicaSetOwners, key)
+		}
+	}
+	for ref := range c.workloadAnnotations {
+		if !workloads[ref] {
+			delete(c.workloadAnnotations, ref)
+		}
+	}
+	c.workloadsMu.Unlock()
+
+	for ref := range workloads {
+		annotation, err := c.fetchWorkloadAnnotation(&ref)
+		if err != nil {
+			klog.Errorf("Failed to get %s %s: %v", ref.kind, ref, err)
+			continue
+		}
+		c.workloadsMu.Lock()
+		old, cached := c.workloadAnnotations[ref]
+		c.workloadAnnotations[ref] = annotation
+		c.workloadsMu.Unlock()
+		if (cached && old != annotation) || (!cached && annotation.ok) {
+			klog.V(2).Infof("Capture annotation changed on %s %s", ref.kind, ref)
+			c.enqueueWorkloadPods(&ref)
+		}
+	}
+}
+
+// enqueueWorkloadPods queues every node-local pod owned by ref
+func (c *Controller) enqueueWorkloadPods(ref *workloadRef) {
+	objs, err := c.podInformer.GetIndexer().ByIndex(cache.NamespaceIndex, ref.namespace)
+	if err != nil {
+		klog.Errorf("Failed to list pods in namespace %s: %v", ref.namespace, err)
+		return
+	}
+	for _, obj := range objs {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		owner, err := c.workloadFor(pod)
+		if err != nil || owner == nil || *owner != *ref {
+			continue
+		}
+		key, err := cache.MetaNamespaceKeyFunc(pod)
+		if err != nil {
+			klog.Errorf("Failed to get key for pod %s/%s: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		c.queue.Add(key)
+	}
+}
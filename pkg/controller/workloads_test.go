@@ -0,0 +1,154 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func controllerRef(kind, name string) []metav1.OwnerReference {
+	isController := true
+	return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, Controller: &isController}}
+}
+
+func TestWorkloadAnnotationIsInherited(t *testing.T) {
+	ctrl := newTestController(t)
+	clientset := ctrl.clientset.(*fake.Clientset)
+
+	for _, obj := range []runtime.Object{
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Name: "web", Namespace: "shop",
+			Annotations: map[string]string{CaptureAnnotation: `{"fileCount":4}`},
+		}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Name: "web-abc", Namespace: "shop", OwnerReferences: controllerRef("Deployment", "web"),
+		}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+			Name: "db", Namespace: "shop",
+			Annotations: map[string]string{CaptureAnnotation: "2"},
+		}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "shop"}},
+	} {
+		if err := clientset.Tracker().Add(obj); err != nil {
+			t.Fatalf("Failed to add workload: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		owner     []metav1.OwnerReference
+		wantID    string
+		wantFiles int
+	}{
+		{"deployment pod", controllerRef("ReplicaSet", "web-abc"), "shop/deployment/web", 4},
+		{"statefulset pod", controllerRef("StatefulSet", "db"), "shop/statefulset/db", 2},
+		{"daemonset without annotation", controllerRef("DaemonSet", "agent"), "", 0},
+		{"bare pod", nil, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("shop", "pod-1", nil, nil)
+			pod.OwnerReferences = tt.owner
+
+			req, err := requestFor(t, ctrl, pod)
+			if err != nil {
+				t.Fatalf("captureRequestsFor() returned error: %v", err)
+			}
+			if tt.wantID == "" {
+				if req != nil {
+					t.Errorf("expected no capture, got %s", req.id)
+				}
+				return
+			}
+			if req == nil || req.id != tt.wantID || req.spec.FileCount != tt.wantFiles {
+				t.Errorf("capture request = %+v, want id %s with %d files", req, tt.wantID, tt.wantFiles)
+			}
+		})
+	}
+
+	// Owners and annotations are read once and then served from the cache
+	gets := len(clientset.Actions())
+	pod := testPod("shop", "pod-2", nil, nil)
+	pod.OwnerReferences = controllerRef("ReplicaSet", "web-abc")
+	if req, err := requestFor(t, ctrl, pod); err != nil || req == nil {
+		t.Fatalf("captureRequestsFor() = %v, %v, want the capture of the Deployment", req, err)
+	}
+	if annotated, known := ctrl.cachedWorkloadAnnotated(pod); !annotated || !known {
+		t.Errorf("cachedWorkloadAnnotated() = %v, %v, want the cached annotation", annotated, known)
+	}
+	if got := len(clientset.Actions()); got != gets {
+		t.Errorf("resolving a cached workload made %d API requests", got-gets)
+	}
+}
+
+func TestMissingReplicaSetIsTransient(t *testing.T) {
+	ctrl := newTestController(t)
+
+	pod := testPod("shop", "web-abc-1", nil, nil)
+	pod.OwnerReferences = controllerRef("ReplicaSet", "web-abc")
+	if !ctrl.mayCapture(pod) {
+		t.Error("pod whose ReplicaSet was never read should be synced")
+	}
+
+	_, err := requestFor(t, ctrl, pod)
+	if err == nil {
+		t.Fatal("expected an error while the ReplicaSet does not exist")
+	}
+	if utils.IsPermanent(err) {
+		t.Errorf("missing owner should be retried, got permanent error: %v", err)
+	}
+}
+
+func TestWorkloadAnnotationChangeEnqueuesOwnedPods(t *testing.T) {
+	ctrl := newTestController(t)
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "shop"}}
+	statefulSets := ctrl.clientset.AppsV1().StatefulSets("shop")
+	if _, err := statefulSets.Create(context.TODO(), sts, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create StatefulSet: %v", err)
+	}
+
+	owned := testPod("shop", "db-0", nil, nil)
+	owned.OwnerReferences = controllerRef("StatefulSet", "db")
+	other := testPod("shop", "cache-0", nil, nil)
+	other.OwnerReferences = controllerRef("StatefulSet", "cache")
+	for _, pod := range []*corev1.Pod{owned, other} {
+		if err := ctrl.podInformer.GetIndexer().Add(pod); err != nil {
+			t.Fatalf("Failed to add pod: %v", err)
+		}
+	}
+	ctrl.refreshWorkloads()
+	drainQueue(ctrl)
+
+	sts.Annotations = map[string]string{CaptureAnnotation: "3"}
+	if _, err := statefulSets.Update(context.TODO(), sts, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update StatefulSet: %v", err)
+	}
+	ctrl.refreshWorkloads()
+
+	if got := ctrl.queue.Len(); got != 1 {
+		t.Fatalf("queue length = %d, want 1", got)
+	}
+	key, _ := ctrl.queue.Get()
+	if key != "shop/db-0" {
+		t.Errorf("enqueued %s, want shop/db-0", key)
+	}
+	if value, ok := ctrl.workloadAnnotation(&workloadRef{kind: "statefulset", namespace: "shop", name: "db"}); !ok || value != "3" {
+		t.Errorf("workloadAnnotation() = %q, %v, want the new annotation", value, ok)
+	}
+
+	// Workloads without local pods are forgotten
+	if err := ctrl.podInformer.GetIndexer().Delete(owned); err != nil {
+		t.Fatalf("Failed to delete pod: %v", err)
+	}
+	ctrl.refreshWorkloads()
+	if _, known := ctrl.cachedWorkloadAnnotated(owned); known {
+		t.Error("workload of deleted pods is still cached")
+	}
+}
@@ -0,0 +1,95 @@
+// Package kubeauth checks credentials sent directly to the node agent, past
+// the API server, against the Kubernetes API.
+package kubeauth
+
+import (
+	"context"
+	"fmt"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Authorizer authenticates bearer tokens with a TokenReview and authorizes
+// each pod with a SubjectAccessReview for patching it, the permission that
+// also lets the user request a capture through the annotation.
+type Authorizer struct {
+	client kubernetes.Interface
+}
+
+// NewAuthorizer returns an Authorizer sending its reviews through client
+func NewAuthorizer(client kubernetes.Interface) *Authorizer {
+	return &Authorizer{client: client}
+}
+
+// Authenticate returns the user a bearer token belongs to
+func (a *Authorizer) Authenticate(ctx context.Context, token string) (authenticationv1.UserInfo, error) {
+	review, err := a.client.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return authenticationv1.UserInfo{}, fmt.Errorf("token review failed: %w", err)
+	}
+	if !review.Status.Authenticated {
+		if review.Status.Error != "" {
+			return authenticationv1.UserInfo{}, fmt.Errorf("token not authenticated: %s", review.Status.Error)
+		}
+		return authenticationv1.UserInfo{}, fmt.Errorf("token not authenticated")
+	}
+	return review.Status.User, nil
+}
+
+// MayCapture reports whether user may capture pod name in namespace, or any
+// pod in namespace when name is empty
+func (a *Authorizer) MayCapture(ctx context.Context, user authenticationv1.UserInfo, namespace, name string) (bool, error) {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	review, err := a.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.Username,
+			UID:    user.UID,
+			Groups: user.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "patch",
+				Resource:  "pods",
+				Name:      name,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("subject access review failed: %w", err)
+	}
+	return review.Status.Allowed, nil
+}
+
+// AccessChecker returns a function telling whether user may capture a pod,
+// asking the API server once per namespace and, where the namespace is not
+// allowed as a whole, once per pod. It is meant for filtering the pods of a
+// single request.
+func (a *Authorizer) AccessChecker(ctx context.Context, user authenticationv1.UserInfo) func(namespace, pod string) (bool, error) {
+	decisions := map[string]bool{}
+	check := func(namespace, pod string) (bool, error) {
+		key := namespace + "/" + pod
+		if allowed, ok := decisions[key]; ok {
+			return allowed, nil
+		}
+		allowed, err := a.MayCapture(ctx, user, namespace, pod)
+		if err != nil {
+			return false, err
+		}
+		decisions[key] = allowed
+		return allowed, nil
+	}
+	return func(namespace, pod string) (bool, error) {
+		if allowed, err := check(namespace, ""); allowed || err != nil {
+			return allowed, err
+		}
+		return check(namespace, pod)
+	}
+}
@@ -0,0 +1,152 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "packet_capture"
+
+// Registry holds every metric exported by the node agent and the cluster
+// aggregator
+var Registry = prometheus.NewRegistry()
+
+var (
+	// ConfigReloads counts configuration reload attempts by result ("success" or "failure")
+	ConfigReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "config_reloads_total",
+			Help:      "Number of configuration reload attempts by result.",
+		},
+		[]string{"result"},
+	)
+
+	// ConfigLastReloadSuccess is the Unix time of the last successful reload
+	ConfigLastReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Unix time of the last successful configuration reload.",
+		},
+	)
+
+	// LiveStreams is the number of clients following a running session
+	LiveStreams = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "live_streams",
+			Help:      "Number of clients streaming packets from a running capture session.",
+		},
+	)
+
+	// LiveStreamSkips counts how often a live stream fell a whole file behind
+	// tcpdump and skipped ahead
+	LiveStreamSkips = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "live_stream_skips_total",
+			Help:      "Number of times a slow live stream client skipped ahead to the file tcpdump is writing.",
+		},
+	)
+
+	// ArmedBufferBytes is the size of the packets armed captures keep in memory
+	ArmedBufferBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "armed_buffer_bytes",
+			Help:      "Bytes of packets held in memory by armed captures.",
+		},
+	)
+
+	// ArmedTriggers counts triggers of armed captures by outcome ("flushed"
+	// or "ignored" while an earlier trigger is still being written)
+	ArmedTriggers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "armed_triggers_total",
+			Help:      "Number of triggers of armed captures by outcome.",
+		},
+		[]string{"outcome"},
+	)
+
+	// RuleTriggers counts failure signals matched by trigger rules by rule
+	// and outcome: "started", or "active", "cooldown", "limited" and
+	// "refused" when no capture was started
+	RuleTriggers = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rule_triggers_total",
+			Help:      "Number of pod failure signals matched by trigger rules by rule and outcome.",
+		},
+		[]string{"rule", "outcome"},
+	)
+	// AlertCaptures counts the pods alerts received from Alertmanager asked
+	// to capture by result: "started", "duplicate", "removed", "refused" or
+	// "failed"
+	AlertCaptures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "alert_captures_total",
+			Help:      "Number of pod captures requested by Alertmanager alerts by result.",
+		},
+		[]string{"result"},
+	)
+	// ScheduledRuns counts the runs of scheduled captures by result
+	// ("started" or "failed")
+	ScheduledRuns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "scheduled_runs_total",
+			Help:      "Number of runs of scheduled captures by result.",
+		},
+		[]string{"result"},
+	)
+
+	// AggregatorLeader is 1 while the cluster aggregator holds the leader
+	// lease and serves the cluster API
+	AggregatorLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "aggregator_leader",
+			Help:      "Whether this cluster aggregator is the leader serving the cluster API.",
+		},
+	)
+
+	// AggregatorAgents is the number of node agents the cluster aggregator
+	// found by state ("available" or "unavailable")
+	AggregatorAgents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "aggregator_agents",
+			Help:      "Number of node agents by availability, as last probed by the cluster aggregator.",
+		},
+		[]string{"state"},
+	)
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ConfigReloads,
+		ConfigLastReloadSuccess,
+		LiveStreams,
+		LiveStreamSkips,
+		ArmedBufferBytes,
+		ArmedTriggers,
+		RuleTriggers,
+		AlertCaptures,
+		ScheduledRuns,
+		AggregatorLeader,
+		AggregatorAgents,
+	)
+}
+
+// Handler serves the metrics in Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,256 @@
+// Package pcap reads, writes and merges capture files in the classic libpcap
+// format written by tcpdump, and merges them into pcapng files that keep
+// apart the interfaces packets were captured on.
+package pcap
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	magicMicroseconds = 0xa1b2c3d4
+	magicNanoseconds  = 0xa1b23c4d
+
+	// HeaderLen is the size of the global header at the start of a file
+	HeaderLen = 24
+	// RecordHeaderLen is the size of the header preceding every packet
+	RecordHeaderLen = 16
+
+	// maxPacketLen bounds the record size accepted from a file so a corrupt
+	// header cannot trigger a huge allocation
+	maxPacketLen = 256 * 1024
+)
+
+// Header is the global header of a capture file
+type Header struct {
+	VersionMajor uint16
+	VersionMinor uint16
+	SnapLen      uint32
+	LinkType     uint32
+	// Nanoseconds reports timestamps with nanosecond instead of microsecond
+	// resolution
+	Nanoseconds bool
+}
+
+// Packet is one captured packet
+type Packet struct {
+	Timestamp time.Time
+	// OrigLen is the length of the packet on the wire; Data may be shorter
+	// when it was cut at the snap length
+	OrigLen uint32
+	Data    []byte
+}
+
+// Reader reads packets from a capture file
+type Reader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	Header Header
+}
+
+// NewReader reads the global header of a capture file. It returns io.EOF for
+// an empty input, e.g. a file tcpdump has only just created.
+func NewReader(r io.Reader) (*Reader, error) {
+	buf := make([]byte, HeaderLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated pcap header: %w", err)
+		}
+		return nil, err
+	}
+
+	reader := &Reader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(buf) == magicMicroseconds:
+		reader.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(buf) == magicMicroseconds:
+		reader.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(buf) == magicNanoseconds:
+		reader.order, reader.Header.Nanoseconds = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(buf) == magicNanoseconds:
+		reader.order, reader.Header.Nanoseconds = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("not a pcap file: magic %#x", binary.LittleEndian.Uint32(buf))
+	}
+
+	reader.Header.VersionMajor = reader.order.Uint16(buf[4:])
+	reader.Header.VersionMinor = reader.order.Uint16(buf[6:])
+	reader.Header.SnapLen = reader.order.Uint32(buf[16:])
+	reader.Header.LinkType = reader.order.Uint32(buf[20:])
+	return reader, nil
+}
+
+// Next returns the next packet, io.EOF after the last one, or
+// io.ErrUnexpectedEOF when the file ends inside a record, as it does while
+// tcpdump is still writing it.
+func (r *Reader) Next() (*Packet, error) {
+	buf := make([]byte, RecordHeaderLen)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	seconds := r.order.Uint32(buf[0:])
+	fraction := r.order.Uint32(buf[4:])
+	capLen := r.order.Uint32(buf[8:])
+	origLen := r.order.Uint32(buf[12:])
+	if capLen > maxPacketLen {
+		return nil, fmt.Errorf("packet of %d bytes exceeds the maximum of %d", capLen, maxPacketLen)
+	}
+
+	data := make([]byte, capLen)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	nanos := int64(fraction)
+	if !r.Header.Nanoseconds {
+		nanos *= int64(time.Microsecond)
+	}
+	return &Packet{
+		Timestamp: time.Unix(int64(seconds), nanos).UTC(),
+		OrigLen:   origLen,
+		Data:      data,
+	}, nil
+}
+
+// Writer writes packets to a capture file in little-endian byte order
+type Writer struct {
+	w      io.Writer
+	header Header
+}
+
+// NewWriter writes the global header for h and returns a Writer for its packets
+func NewWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.VersionMajor == 0 {
+		h.VersionMajor, h.VersionMinor = 2, 4
+	}
+	magic := uint32(magicMicroseconds)
+	if h.Nanoseconds {
+		magic = magicNanoseconds
+	}
+
+	buf := make([]byte, HeaderLen)
+	binary.LittleEndian.PutUint32(buf[0:], magic)
+	binary.LittleEndian.PutUint16(buf[4:], h.VersionMajor)
+	binary.LittleEndian.PutUint16(buf[6:], h.VersionMinor)
+	binary.LittleEndian.PutUint32(buf[16:], h.SnapLen)
+	binary.LittleEndian.PutUint32(buf[20:], h.LinkType)
+	if _, err := w.Write(buf); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, header: h}, nil
+}
+
+// WritePacket appends p to the file
+func (w *Writer) WritePacket(p *Packet) error {
+	fraction := uint32(p.Timestamp.Nanosecond())
+	if !w.header.Nanoseconds {
+		fraction /= uint32(time.Microsecond)
+	}
+	origLen := p.OrigLen
+	if origLen < uint32(len(p.Data)) {
+		origLen = uint32(len(p.Data))
+	}
+
+	buf := make([]byte, RecordHeaderLen, RecordHeaderLen+len(p.Data))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(p.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(buf[4:], fraction)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(p.Data)))
+	binary.LittleEndian.PutUint32(buf[12:], origLen)
+	_, err := w.w.Write(append(buf, p.Data...))
+	return err
+}
+
+// Merge writes the packets of every input to w as a single capture file
+// ordered by timestamp. Empty inputs are skipped and an input ending inside
+// a record is read up to its last complete packet. All inputs must share a
+// link type.
+func Merge(w io.Writer, inputs ...io.Reader) error {
+	var readers []*Reader
+	var header Header
+	for i, in := range inputs {
+		r, err := NewReader(in)
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+		if len(readers) == 0 {
+			header = r.Header
+		} else if r.Header.LinkType != header.LinkType {
+			return fmt.Errorf("input %d has link type %d, want %d", i, r.Header.LinkType, header.LinkType)
+		}
+		if r.Header.SnapLen > header.SnapLen {
+			header.SnapLen = r.Header.SnapLen
+		}
+		header.Nanoseconds = header.Nanoseconds || r.Header.Nanoseconds
+		readers = append(readers, r)
+	}
+	if len(readers) == 0 {
+		return fmt.Errorf("no packets to merge: all inputs are empty")
+	}
+
+	writer, err := NewWriter(w, header)
+	if err != nil {
+		return err
+	}
+
+	h := &packetHeap{}
+	for _, r := range readers {
+		if err := h.pushNext(r, 0); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		next := heap.Pop(h).(heapItem)
+		if err := writer.WritePacket(next.packet); err != nil {
+			return err
+		}
+		if err := h.pushNext(next.reader, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type heapItem struct {
+	packet *Packet
+	reader *Reader
+	// iface is the pcapng interface of the reader's packets
+	iface int
+}
+
+// packetHeap orders the next packet of each input by timestamp
+type packetHeap []heapItem
+
+func (h packetHeap) Len() int           { return len(h) }
+func (h packetHeap) Less(i, j int) bool { return h[i].packet.Timestamp.Before(h[j].packet.Timestamp) }
+func (h packetHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *packetHeap) Push(x any)        { *h = append(*h, x.(heapItem)) }
+func (h *packetHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// pushNext queues the next packet of r, captured on iface, if any
+func (h *packetHeap) pushNext(r *Reader, iface int) error {
+	p, err := r.Next()
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	heap.Push(h, heapItem{packet: p, reader: r, iface: iface})
+	return nil
+}
@@ -0,0 +1,201 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+const linkTypeEthernet = 1
+
+func writeTestFile(t *testing.T, h Header, timestamps ...time.Time) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, h)
+	if err != nil {
+		t.Fatalf("NewWriter() returned error: %v", err)
+	}
+	for i, ts := range timestamps {
+		if err := w.WritePacket(&Packet{Timestamp: ts, Data: []byte{byte(i), 0xaa}}); err != nil {
+			t.Fatalf("WritePacket() returned error: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readAll(t *testing.T, data []byte) (*Reader, []*Packet) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewReader() returned error: %v", err)
+	}
+	var packets []*Packet
+	for {
+		p, err := r.Next()
+		if err == io.EOF {
+			return r, packets
+		}
+		if err != nil {
+			t.Fatalf("Next() returned error: %v", err)
+		}
+		packets = append(packets, p)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	base := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	for _, nanos := range []bool{false, true} {
+		ts := base.Add(123456789 * time.Nanosecond)
+		data := writeTestFile(t, Header{SnapLen: 65535, LinkType: linkTypeEthernet, Nanoseconds: nanos}, ts)
+
+		r, packets := readAll(t, data)
+		if r.Header.LinkType != linkTypeEthernet || r.Header.SnapLen != 65535 || r.Header.Nanoseconds != nanos {
+			t.Errorf("unexpected header: %+v", r.Header)
+		}
+		want := ts
+		if !nanos {
+			want = ts.Truncate(time.Microsecond)
+		}
+		if len(packets) != 1 || !packets[0].Timestamp.Equal(want) || !bytes.Equal(packets[0].Data, []byte{0, 0xaa}) {
+			t.Errorf("nanoseconds=%v: unexpected packets %+v", nanos, packets)
+		}
+	}
+}
+
+func TestReadBigEndian(t *testing.T) {
+	var buf bytes.Buffer
+	header := make([]byte, HeaderLen)
+	binary.BigEndian.PutUint32(header[0:], magicMicroseconds)
+	binary.BigEndian.PutUint32(header[20:], linkTypeEthernet)
+	buf.Write(header)
+	record := make([]byte, RecordHeaderLen)
+	binary.BigEndian.PutUint32(record[0:], 100)
+	binary.BigEndian.PutUint32(record[4:], 5)
+	binary.BigEndian.PutUint32(record[8:], 1)
+	binary.BigEndian.PutUint32(record[12:], 60)
+	buf.Write(record)
+	buf.WriteByte(0x42)
+
+	_, packets := readAll(t, buf.Bytes())
+	if len(packets) != 1 || packets[0].Timestamp.Unix() != 100 || packets[0].OrigLen != 60 {
+		t.Errorf("unexpected packets %+v", packets)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	h := Header{SnapLen: 262144, LinkType: linkTypeEthernet}
+	first := writeTestFile(t, h, base, base.Add(2*time.Second))
+	second := writeTestFile(t, h, base.Add(time.Second), base.Add(3*time.Second))
+	// A file tcpdump is still writing ends inside a record
+	second = append(second, 0x01, 0x02, 0x03)
+
+	var out bytes.Buffer
+	if err := Merge(&out, bytes.NewReader(first), bytes.NewReader(nil), bytes.NewReader(second)); err != nil {
+		t.Fatalf("Merge() returned error: %v", err)
+	}
+
+	_, packets := readAll(t, out.Bytes())
+	if len(packets) != 4 {
+		t.Fatalf("expected 4 packets, got %d", len(packets))
+	}
+	for i, p := range packets {
+		if want := base.Add(time.Duration(i) * time.Second); !p.Timestamp.Equal(want) {
+			t.Errorf("packet %d at %v, want %v", i, p.Timestamp, want)
+		}
+	}
+
+	other := writeTestFile(t, Header{LinkType: 113}, base)
+	if err := Merge(io.Discard, bytes.NewReader(first), bytes.NewReader(other)); err == nil {
+		t.Error("merging different link types should fail")
+	}
+	if err := Merge(io.Discard, bytes.NewReader(nil)); err == nil {
+		t.Error("merging only empty inputs should fail")
+	}
+}
+
+// ngBlock is a block of a pcapng file as read by readBlocks
+type ngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readBlocks(t *testing.T, data []byte) []ngBlock {
+	t.Helper()
+	var blocks []ngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: %x", data)
+		}
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("invalid block length %d", length)
+		}
+		blocks = append(blocks, ngBlock{blockType: binary.LittleEndian.Uint32(data), body: data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+// interfaceName returns the if_name option of an interface block
+func interfaceName(body []byte) string {
+	options := body[8:]
+	for len(options) >= 4 {
+		code, length := binary.LittleEndian.Uint16(options), int(binary.LittleEndian.Uint16(options[2:]))
+		if code == optionInterfaceName {
+			return string(options[4 : 4+length])
+		}
+		options = options[4+length+padding(length):]
+	}
+	return ""
+}
+
+func TestMergeSources(t *testing.T) {
+	base := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	client := writeTestFile(t, Header{SnapLen: 65535, LinkType: linkTypeEthernet}, base, base.Add(2*time.Second))
+	server := writeTestFile(t, Header{SnapLen: 262144, LinkType: 113, Nanoseconds: true}, base.Add(time.Second+5*time.Nanosecond))
+
+	var out bytes.Buffer
+	err := MergeSources(&out,
+		Source{Name: "shop/client", Inputs: []io.Reader{bytes.NewReader(client)}},
+		Source{Name: "shop/idle", Inputs: []io.Reader{bytes.NewReader(nil)}},
+		Source{Name: "shop/server", Description: "node-2", Inputs: []io.Reader{bytes.NewReader(server)}},
+	)
+	if err != nil {
+		t.Fatalf("MergeSources() returned error: %v", err)
+	}
+
+	blocks := readBlocks(t, out.Bytes())
+	if len(blocks) != 6 || blocks[0].blockType != blockSectionHeader {
+		t.Fatalf("expected a section header, 2 interfaces and 3 packets, got %d blocks", len(blocks))
+	}
+	for i, want := range []struct {
+		name     string
+		linkType uint16
+	}{{"shop/client", linkTypeEthernet}, {"shop/server", 113}} {
+		b := blocks[1+i]
+		if b.blockType != blockInterfaceDesc || interfaceName(b.body) != want.name || binary.LittleEndian.Uint16(b.body) != want.linkType {
+			t.Errorf("interface %d = %+v, want %s with link type %d", i, b, want.name, want.linkType)
+		}
+	}
+	for i, want := range []struct {
+		iface uint32
+		at    time.Time
+	}{
+		{0, base},
+		{1, base.Add(time.Second + 5*time.Nanosecond)},
+		{0, base.Add(2 * time.Second)},
+	} {
+		b := blocks[3+i]
+		ts := uint64(binary.LittleEndian.Uint32(b.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(b.body[8:]))
+		if b.blockType != blockEnhancedPacket || binary.LittleEndian.Uint32(b.body) != want.iface || int64(ts) != want.at.UnixNano() {
+			t.Errorf("packet %d on interface %d at %d, want interface %d at %d", i, binary.LittleEndian.Uint32(b.body), ts, want.iface, want.at.UnixNano())
+		}
+	}
+
+	if err := MergeSources(io.Discard, Source{Name: "shop/idle"}); err == nil {
+		t.Error("merging sources without packets should fail")
+	}
+}
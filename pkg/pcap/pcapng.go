@@ -0,0 +1,200 @@
+package pcap
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// pcapng block types and options, see
+// https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+const (
+	blockSectionHeader        = 0x0a0d0d0a
+	blockInterfaceDesc        = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+	byteOrderMagic            = 0x1a2b3c4d
+	optionEnd                 = 0
+	optionInterfaceName       = 2
+	optionInterfaceDesc       = 3
+	optionTimestampResolution = 9
+	// tsresolNanoseconds makes the timestamps of an interface count
+	// nanoseconds
+	tsresolNanoseconds = 9
+)
+
+// Interface describes an interface of a pcapng file, e.g. the one a pod was
+// captured on
+type Interface struct {
+	// Name is shown as the interface of its packets, e.g. <namespace>/<pod>
+	Name        string
+	Description string
+	LinkType    uint32
+	SnapLen     uint32
+}
+
+// NGWriter writes packets captured on several interfaces to a pcapng file
+// in little-endian byte order
+type NGWriter struct {
+	w          io.Writer
+	interfaces int
+}
+
+// NewNGWriter writes the section header of a pcapng file and returns an
+// NGWriter for its interfaces and packets
+func NewNGWriter(w io.Writer) (*NGWriter, error) {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1)
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	// The section length is not known in advance
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0))
+	if err := writeBlock(w, blockSectionHeader, body); err != nil {
+		return nil, err
+	}
+	return &NGWriter{w: w}, nil
+}
+
+// AddInterface describes the next interface and returns its ID for
+// WritePacket. Its packets have nanosecond timestamps.
+func (w *NGWriter) AddInterface(i Interface) (int, error) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], uint16(i.LinkType))
+	binary.LittleEndian.PutUint32(body[4:], i.SnapLen)
+	if i.Name != "" {
+		body = appendOption(body, optionInterfaceName, []byte(i.Name))
+	}
+	if i.Description != "" {
+		body = appendOption(body, optionInterfaceDesc, []byte(i.Description))
+	}
+	body = appendOption(body, optionTimestampResolution, []byte{tsresolNanoseconds})
+	body = appendOption(body, optionEnd, nil)
+	if err := writeBlock(w.w, blockInterfaceDesc, body); err != nil {
+		return 0, err
+	}
+	w.interfaces++
+	return w.interfaces - 1, nil
+}
+
+// WritePacket appends p, captured on the interface with the given ID
+func (w *NGWriter) WritePacket(iface int, p *Packet) error {
+	if iface < 0 || iface >= w.interfaces {
+		return fmt.Errorf("unknown interface %d", iface)
+	}
+	origLen := p.OrigLen
+	if origLen < uint32(len(p.Data)) {
+		origLen = uint32(len(p.Data))
+	}
+	timestamp := uint64(p.Timestamp.UnixNano())
+
+	body := make([]byte, 20, 20+len(p.Data)+3)
+	binary.LittleEndian.PutUint32(body[0:], uint32(iface))
+	binary.LittleEndian.PutUint32(body[4:], uint32(timestamp>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(timestamp))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(p.Data)))
+	binary.LittleEndian.PutUint32(body[16:], origLen)
+	body = append(body, p.Data...)
+	body = append(body, make([]byte, padding(len(p.Data)))...)
+	return writeBlock(w.w, blockEnhancedPacket, body)
+}
+
+// writeBlock writes a block with body, which must be padded to 32 bits,
+// between the type and the lengths framing it
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	buf := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(buf[0:], blockType)
+	binary.LittleEndian.PutUint32(buf[4:], length)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, length)
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendOption(body []byte, code uint16, value []byte) []byte {
+	body = binary.LittleEndian.AppendUint16(body, code)
+	body = binary.LittleEndian.AppendUint16(body, uint16(len(value)))
+	body = append(body, value...)
+	return append(body, make([]byte, padding(len(value)))...)
+}
+
+// padding returns the bytes needed to pad n to 32 bits
+func padding(n int) int {
+	return (4 - n%4) % 4
+}
+
+// Source is a set of capture files recorded on one interface, e.g. the files
+// of one pod's session
+type Source struct {
+	Name        string
+	Description string
+	Inputs      []io.Reader
+}
+
+// MergeSources writes the packets of every source to w as a single pcapng
+// file ordered by timestamp, with an interface per source so every packet
+// tells which source captured it. Sources without packets get no
+// interface. The inputs of a source must share a link type; sources may
+// differ.
+func MergeSources(w io.Writer, sources ...Source) error {
+	type source struct {
+		iface   Interface
+		readers []*Reader
+	}
+	var nonEmpty []source
+	for _, src := range sources {
+		s := source{iface: Interface{Name: src.Name, Description: src.Description}}
+		for i, in := range src.Inputs {
+			r, err := NewReader(in)
+			if errors.Is(err, io.EOF) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: input %d: %w", src.Name, i, err)
+			}
+			if len(s.readers) == 0 {
+				s.iface.LinkType = r.Header.LinkType
+			} else if r.Header.LinkType != s.iface.LinkType {
+				return fmt.Errorf("%s: input %d has link type %d, want %d", src.Name, i, r.Header.LinkType, s.iface.LinkType)
+			}
+			if r.Header.SnapLen > s.iface.SnapLen {
+				s.iface.SnapLen = r.Header.SnapLen
+			}
+			s.readers = append(s.readers, r)
+		}
+		if len(s.readers) > 0 {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		return fmt.Errorf("no packets to merge: all inputs are empty")
+	}
+
+	writer, err := NewNGWriter(w)
+	if err != nil {
+		return err
+	}
+	h := &packetHeap{}
+	for _, s := range nonEmpty {
+		id, err := writer.AddInterface(s.iface)
+		if err != nil {
+			return err
+		}
+		for _, r := range s.readers {
+			if err := h.pushNext(r, id); err != nil {
+				return err
+			}
+		}
+	}
+	for h.Len() > 0 {
+		next := heap.Pop(h).(heapItem)
+		if err := writer.WritePacket(next.iface, next.packet); err != nil {
+			return err
+		}
+		if err := h.pushNext(next.reader, next.iface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
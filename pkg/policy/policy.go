@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const DefaultOptInKey = "tcpdump.antrea.io/allow-capture"
+
+// HostNetworkMode decides what happens to captures of hostNetwork pods,
+// whose network namespace is the node's
+type HostNetworkMode string
+
+const (
+	// HostNetworkRefuse refuses captures of hostNetwork pods
+	HostNetworkRefuse HostNetworkMode = "Refuse"
+	// HostNetworkScope restricts captures of hostNetwork pods to the ports
+	// the pod declares, and refuses pods that declare none
+	HostNetworkScope HostNetworkMode = "Scope"
+)
+
+// Limits caps what a single capture may request. Zero values disable the
+// corresponding limit.
+type Limits struct {
+	MaxFileCount  int             `json:"maxFileCount,omitempty"`
+	MaxFileSizeMB int             `json:"maxFileSizeMB,omitempty"`
+	MaxDuration   metav1.Duration `json:"maxDuration,omitempty"`
+	// MaxBufferSizeMB caps the memory buffer of armed captures
+	MaxBufferSizeMB int `json:"maxBufferSizeMB,omitempty"`
+	// MaxKeepRuns caps how many runs of a scheduled capture are kept
+	MaxKeepRuns int `json:"maxKeepRuns,omitempty"`
+	// MaxRetention caps how long files are kept after a capture stops
+	MaxRetention metav1.Duration `json:"maxRetention,omitempty"`
+}
+
+// Policy decides whether a capture may run in a namespace
+type Policy struct {
+	// RequireOptIn only allows captures in namespaces carrying OptInKey set to
+	// "true" as a label or annotation
+	RequireOptIn bool   `json:"requireOptIn"`
+	OptInKey     string `json:"optInKey,omitempty"`
+	// DeniedNamespaces never allow captures, even when opted in
+	DeniedNamespaces []string `json:"deniedNamespaces,omitempty"`
+	// Limits apply to namespaces without an entry in NamespaceLimits
+	Limits          Limits            `json:"limits,omitempty"`
+	NamespaceLimits map[string]Limits `json:"namespaceLimits,omitempty"`
+	// HostNetwork decides how hostNetwork pods are handled
+	HostNetwork HostNetworkMode `json:"hostNetwork,omitempty"`
+}
+
+// Request describes the parts of a capture the policy looks at
+type Request struct {
+	FileCount  int
+	FileSizeMB int
+	// Duration is zero for captures that run until stopped
+	Duration time.Duration
+	// BufferSizeMB is zero for captures that are not armed
+	BufferSizeMB int
+	// KeepRuns is zero for captures that are not scheduled
+	KeepRuns  int
+	Retention time.Duration
+}
+
+// Namespace is the namespace a capture runs in. Labels and Annotations may be
+// nil when the namespace object is not available.
+type Namespace struct {
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// Default returns a policy that requires namespaces to opt in and denies kube-system
+func Default() Policy {
+	return Policy{
+		RequireOptIn:     true,
+		OptInKey:         DefaultOptInKey,
+		DeniedNamespaces: []string{"kube-system"},
+		HostNetwork:      HostNetworkRefuse,
+	}
+}
+
+// Evaluate returns a permanent error describing why req is refused in ns, or
+// nil when the capture is allowed.
+func (p *Policy) Evaluate(ns Namespace, req Request) error {
+	for _, denied := range p.DeniedNamespaces {
+		if ns.Name == denied {
+			return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("captures are not allowed in namespace %s", ns.Name), p.OptInKey)
+		}
+	}
+
+	if p.RequireOptIn && ns.Labels[p.OptInKey] != "true" && ns.Annotations[p.OptInKey] != "true" {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("namespace %s has not opted in to captures", ns.Name), p.OptInKey)
+	}
+
+	limits := p.LimitsFor(ns.Name)
+	if limits.MaxFileCount > 0 && req.FileCount > limits.MaxFileCount {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("fileCount %d exceeds the limit of %d", req.FileCount, limits.MaxFileCount), p.OptInKey)
+	}
+	if limits.MaxFileSizeMB > 0 && req.FileSizeMB > limits.MaxFileSizeMB {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("fileSizeMB %d exceeds the limit of %d", req.FileSizeMB, limits.MaxFileSizeMB), p.OptInKey)
+	}
+	if max := limits.MaxDuration.Duration; max > 0 && (req.Duration == 0 || req.Duration > max) {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("duration must be set and at most %s", max), p.OptInKey)
+	}
+	if limits.MaxBufferSizeMB > 0 && req.BufferSizeMB > limits.MaxBufferSizeMB {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("bufferSizeMB %d exceeds the limit of %d", req.BufferSizeMB, limits.MaxBufferSizeMB), p.OptInKey)
+	}
+	if limits.MaxKeepRuns > 0 && req.KeepRuns > limits.MaxKeepRuns {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("keepRuns %d exceeds the limit of %d", req.KeepRuns, limits.MaxKeepRuns), p.OptInKey)
+	}
+	if max := limits.MaxRetention.Duration; max > 0 && req.Retention > max {
+		return utils.NewPolicyDeniedError(ns.Name, fmt.Sprintf("retention %s exceeds the limit of %s", req.Retention, max), p.OptInKey)
+	}
+	return nil
+}
+
+// LimitsFor returns the limits that apply in namespace
+func (p *Policy) LimitsFor(namespace string) Limits {
+	if limits, ok := p.NamespaceLimits[namespace]; ok {
+		return limits
+	}
+	return p.Limits
+}
+
+// Validate reports the first invalid setting in p
+func (p *Policy) Validate() error {
+	if p.RequireOptIn && p.OptInKey == "" {
+		return fmt.Errorf("policy.optInKey must be set when requireOptIn is true")
+	}
+	switch p.HostNetwork {
+	case "", HostNetworkRefuse, HostNetworkScope:
+	default:
+		return fmt.Errorf("policy.hostNetwork must be %q or %q, got %q", HostNetworkRefuse, HostNetworkScope, p.HostNetwork)
+	}
+	check := func(name string, l Limits) error {
+		if l.MaxFileCount < 0 || l.MaxFileSizeMB < 0 || l.MaxDuration.Duration < 0 ||
+			l.MaxBufferSizeMB < 0 || l.MaxKeepRuns < 0 || l.MaxRetention.Duration < 0 {
+			return fmt.Errorf("%s must not be negative: %+v", name, l)
+		}
+		return nil
+	}
+	if err := check("policy.limits", p.Limits); err != nil {
+		return err
+	}
+	for ns, l := range p.NamespaceLimits {
+		if err := check("policy.namespaceLimits."+ns, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
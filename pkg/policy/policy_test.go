@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEvaluate(t *testing.T) {
+	p := Default()
+	p.Limits = Limits{
+		MaxFileCount:    10,
+		MaxBufferSizeMB: 32,
+		MaxKeepRuns:     5,
+		MaxRetention:    metav1.Duration{Duration: 24 * time.Hour},
+	}
+	p.NamespaceLimits = map[string]Limits{
+		"batch": {MaxFileCount: 50, MaxDuration: metav1.Duration{Duration: time.Hour}},
+	}
+
+	optedIn := map[string]string{DefaultOptInKey: "true"}
+
+	tests := []struct {
+		name    string
+		ns      Namespace
+		req     Request
+		allowed bool
+	}{
+		{"opted in by label", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 5}, true},
+		{"opted in by annotation", Namespace{Name: "shop", Annotations: optedIn}, Request{FileCount: 5}, true},
+		{"not opted in", Namespace{Name: "shop"}, Request{FileCount: 5}, false},
+		{"opt-in value must be true", Namespace{Name: "shop", Labels: map[string]string{DefaultOptInKey: "yes"}}, Request{FileCount: 5}, false},
+		{"denied even when opted in", Namespace{Name: "kube-system", Labels: optedIn}, Request{FileCount: 1}, false},
+		{"over default limit", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 11}, false},
+		{"namespace limit raises file count", Namespace{Name: "batch", Labels: optedIn}, Request{FileCount: 40, Duration: time.Minute}, true},
+		{"namespace limit requires duration", Namespace{Name: "batch", Labels: optedIn}, Request{FileCount: 40}, false},
+		{"armed buffer within limit", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 5, BufferSizeMB: 32}, true},
+		{"armed buffer over limit", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 5, BufferSizeMB: 64}, false},
+		{"kept runs over limit", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 5, KeepRuns: 7}, false},
+		{"retention within limit", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 5, Retention: time.Hour}, true},
+		{"retention over limit", Namespace{Name: "shop", Labels: optedIn}, Request{FileCount: 5, Retention: 48 * time.Hour}, false},
+		{"namespace limit caps duration", Namespace{Name: "batch", Labels: optedIn}, Request{FileCount: 1, Duration: 2 * time.Hour}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Evaluate(tt.ns, tt.req)
+			if tt.allowed && err != nil {
+				t.Errorf("expected capture to be allowed, got: %v", err)
+			}
+			if !tt.allowed {
+				if err == nil {
+					t.Fatal("expected capture to be refused")
+				}
+				if !utils.IsPermanent(err) {
+					t.Errorf("refusals must be permanent, got: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateWithoutOptIn(t *testing.T) {
+	p := Policy{}
+	if err := p.Evaluate(Namespace{Name: "anything"}, Request{FileCount: 1000}); err != nil {
+		t.Errorf("empty policy should allow every capture, got: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Policy{RequireOptIn: true}).Validate(); err == nil {
+		t.Error("requireOptIn without optInKey should be invalid")
+	}
+	if err := (&Policy{NamespaceLimits: map[string]Limits{"a": {MaxFileCount: -1}}}).Validate(); err == nil {
+		t.Error("negative limits should be invalid")
+	}
+	if err := (&Policy{Limits: Limits{MaxRetention: metav1.Duration{Duration: -time.Hour}}}).Validate(); err == nil {
+		t.Error("negative maxRetention should be invalid")
+	}
+	if err := (&Policy{HostNetwork: "Allow"}).Validate(); err == nil {
+		t.Error("unknown hostNetwork mode should be invalid")
+	}
+	p := Default()
+	if err := p.Validate(); err != nil {
+		t.Errorf("default policy should be valid, got: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+// Package rpcap implements the server side of the remote packet capture
+// protocol spoken by libpcap's rpcaps:// sources and Wireshark's remote
+// interfaces, offering the capturable pods of a node as interfaces.
+package rpcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/net/bpf"
+)
+
+// protocolVersion is the only rpcap protocol version the server speaks
+const protocolVersion = 0
+
+// Message types; replies set replyBit on the request type
+const (
+	msgError           = 1
+	msgFindAllIfReq    = 2
+	msgOpenReq         = 3
+	msgStartCapReq     = 4
+	msgUpdateFilterReq = 5
+	msgClose           = 6
+	msgPacket          = 7
+	msgAuthReq         = 8
+	msgStatsReq        = 9
+	msgEndCapReq       = 10
+	msgSetSamplingReq  = 11
+
+	replyBit = 0x80
+)
+
+// Error codes sent in the value field of error messages
+const (
+	errNetwork      = 1
+	errAuth         = 3
+	errFindAllIf    = 4
+	errNoRemoteIf   = 5
+	errOpen         = 6
+	errUpdateFilter = 7
+	errStartCapture = 12
+	errSetSampling  = 15
+	errWrongMsg     = 16
+	errWrongVersion = 17
+	errAuthFailed   = 18
+	errAuthTypeNone = 20
+)
+
+// Authentication types of an auth request
+const (
+	authNull     = 0
+	authPassword = 1
+)
+
+// Flags of a start capture request
+const (
+	startCapFlagDatagram   = 0x2
+	startCapFlagServerOpen = 0x4
+)
+
+const (
+	headerLen = 8
+	// maxPayloadLen bounds the requests accepted from clients; the largest
+	// are filters of a few thousand instructions
+	maxPayloadLen = 1 << 20
+	// filterTypeBPF is the only filter encoding clients send
+	filterTypeBPF = 0
+	// bpfInsnLen is the size of one BPF instruction on the wire
+	bpfInsnLen = 8
+	// packetHeaderLen is the size of the per-packet header on the data connection
+	packetHeaderLen = 20
+	// byteOrderMagic tells clients the server's native byte order
+	byteOrderMagic = 0xa1b2c3d4
+)
+
+// header precedes every message. All integers are in network byte order.
+type header struct {
+	Version uint8
+	Type    uint8
+	Value   uint16
+	Length  uint32
+}
+
+func readHeader(r io.Reader) (header, error) {
+	buf := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return header{}, err
+	}
+	return header{
+		Version: buf[0],
+		Type:    buf[1],
+		Value:   binary.BigEndian.Uint16(buf[2:]),
+		Length:  binary.BigEndian.Uint32(buf[4:]),
+	}, nil
+}
+
+// writeMessage writes a message with the given header type, value and payload
+func writeMessage(w io.Writer, msgType uint8, value uint16, payload []byte) error {
+	buf := make([]byte, headerLen, headerLen+len(payload))
+	buf[0] = protocolVersion
+	buf[1] = msgType
+	binary.BigEndian.PutUint16(buf[2:], value)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(payload)))
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// writeError sends an error message with a human readable description
+func writeError(w io.Writer, code uint16, format string, args ...any) error {
+	return writeMessage(w, msgError, code, []byte(fmt.Sprintf(format, args...)))
+}
+
+// readPayload reads the payload following h, refusing oversized ones
+func readPayload(r io.Reader, h header) ([]byte, error) {
+	if h.Length > maxPayloadLen {
+		return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d", h.Length, maxPayloadLen)
+	}
+	payload := make([]byte, h.Length)
+	_, err := io.ReadFull(r, payload)
+	return payload, err
+}
+
+// authRequest carries the credentials of an auth request
+type authRequest struct {
+	Type     uint16
+	Username string
+	Password string
+}
+
+func parseAuthRequest(p []byte) (authRequest, error) {
+	if len(p) < 8 {
+		return authRequest{}, fmt.Errorf("auth request too short")
+	}
+	req := authRequest{Type: binary.BigEndian.Uint16(p[0:])}
+	userLen, passLen := int(binary.BigEndian.Uint16(p[4:])), int(binary.BigEndian.Uint16(p[6:]))
+	if len(p) < 8+userLen+passLen {
+		return authRequest{}, fmt.Errorf("auth request credentials truncated")
+	}
+	req.Username = string(p[8 : 8+userLen])
+	req.Password = string(p[8+userLen : 8+userLen+passLen])
+	return req, nil
+}
+
+// authReply tells the client which protocol versions the server speaks
+func authReply() []byte {
+	p := make([]byte, 8)
+	p[0], p[1] = protocolVersion, protocolVersion
+	binary.NativeEndian.PutUint32(p[4:], byteOrderMagic)
+	return p
+}
+
+// iface is an interface listed in a findalldevs reply
+type iface struct {
+	Name        string
+	Description string
+}
+
+// Interface flags of a findalldevs reply
+const (
+	ifFlagUp      = 0x2
+	ifFlagRunning = 0x4
+)
+
+func findAllIfReply(ifaces []iface) []byte {
+	var p []byte
+	for _, i := range ifaces {
+		entry := make([]byte, 12)
+		binary.BigEndian.PutUint16(entry[0:], uint16(len(i.Name)))
+		binary.BigEndian.PutUint16(entry[2:], uint16(len(i.Description)))
+		binary.BigEndian.PutUint32(entry[4:], ifFlagUp|ifFlagRunning)
+		// No addresses: the pod IPs are part of the description instead
+		binary.BigEndian.PutUint16(entry[8:], 0)
+		p = append(p, entry...)
+		p = append(p, i.Name...)
+		p = append(p, i.Description...)
+	}
+	return p
+}
+
+func openReply(linkType uint32) []byte {
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint32(p[0:], linkType)
+	// The timezone offset is always zero; timestamps are UTC
+	return p
+}
+
+// startCapRequest is the start capture request with its filter
+type startCapRequest struct {
+	SnapLen uint32
+	Flags   uint16
+	Filter  *bpf.VM
+}
+
+func parseStartCapRequest(p []byte) (startCapRequest, error) {
+	if len(p) < 12 {
+		return startCapRequest{}, fmt.Errorf("start capture request too short")
+	}
+	req := startCapRequest{
+		SnapLen: binary.BigEndian.Uint32(p[0:]),
+		Flags:   binary.BigEndian.Uint16(p[8:]),
+	}
+	filter, err := parseFilter(p[12:])
+	if err != nil {
+		return startCapRequest{}, err
+	}
+	req.Filter = filter
+	return req, nil
+}
+
+// parseFilter decodes the BPF program clients compile from their capture
+// filter. An empty program accepts every packet and yields a nil VM.
+func parseFilter(p []byte) (*bpf.VM, error) {
+	if len(p) < 8 {
+		return nil, fmt.Errorf("filter too short")
+	}
+	if filterType := binary.BigEndian.Uint16(p[0:]); filterType != filterTypeBPF {
+		return nil, fmt.Errorf("unsupported filter type %d", filterType)
+	}
+	count := int(binary.BigEndian.Uint32(p[4:]))
+	if count == 0 {
+		return nil, nil
+	}
+	if len(p) < 8+count*bpfInsnLen {
+		return nil, fmt.Errorf("filter of %d instructions truncated", count)
+	}
+
+	raw := make([]bpf.RawInstruction, count)
+	for i := range raw {
+		insn := p[8+i*bpfInsnLen:]
+		raw[i] = bpf.RawInstruction{
+			Op: binary.BigEndian.Uint16(insn[0:]),
+			Jt: insn[2],
+			Jf: insn[3],
+			K:  binary.BigEndian.Uint32(insn[4:]),
+		}
+	}
+	insns, allDecoded := bpf.Disassemble(raw)
+	if !allDecoded {
+		return nil, fmt.Errorf("filter uses BPF instructions the server cannot run")
+	}
+	return bpf.NewVM(insns)
+}
+
+func startCapReply(bufSize uint32, dataPort uint16) []byte {
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint32(p[0:], bufSize)
+	binary.BigEndian.PutUint16(p[4:], dataPort)
+	return p
+}
+
+// stats are reported in a stats reply. Packets rejected by the client's
+// filter count as received but not sent.
+type stats struct {
+	Received uint32
+	Sent     uint32
+}
+
+func statsReply(s stats) []byte {
+	p := make([]byte, 16)
+	binary.BigEndian.PutUint32(p[0:], s.Received)
+	// Interface and kernel drops are only known to tcpdump, which reports
+	// them on exit, so both are left zero
+	binary.BigEndian.PutUint32(p[4:], 0)
+	binary.BigEndian.PutUint32(p[8:], 0)
+	binary.BigEndian.PutUint32(p[12:], s.Sent)
+	return p
+}
+
+// packetMessage encodes a captured packet for the data connection
+func packetMessage(seconds, micros, origLen, seq uint32, data []byte) []byte {
+	p := make([]byte, headerLen+packetHeaderLen, headerLen+packetHeaderLen+len(data))
+	p[0], p[1] = protocolVersion, msgPacket
+	binary.BigEndian.PutUint32(p[4:], uint32(packetHeaderLen+len(data)))
+	binary.BigEndian.PutUint32(p[8:], seconds)
+	binary.BigEndian.PutUint32(p[12:], micros)
+	binary.BigEndian.PutUint32(p[16:], uint32(len(data)))
+	binary.BigEndian.PutUint32(p[20:], origLen)
+	binary.BigEndian.PutUint32(p[24:], seq)
+	return append(p, data...)
+}
@@ -0,0 +1,422 @@
+package rpcap
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/kubeauth"
+	"github.com/packet-capture-controller/pkg/pcap"
+	"golang.org/x/net/bpf"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// authTimeout bounds how long a new connection may take to authenticate
+	authTimeout = 30 * time.Second
+	// dataAcceptTimeout bounds how long the client may take to open the data
+	// connection after starting a capture
+	dataAcceptTimeout = 30 * time.Second
+	// dataWriteTimeout ends captures whose client stopped reading packets
+	dataWriteTimeout = 30 * time.Second
+	// dataBufferSize is announced to clients as the server's buffer size
+	dataBufferSize = 256 * 1024
+	// maxStreams bounds the tcpdump processes started for remote clients
+	maxStreams = 16
+)
+
+// Stream is a running capture of a pod
+type Stream interface {
+	LinkType() uint32
+	Next() (*pcap.Packet, error)
+	Close() error
+}
+
+// Source provides the pods offered as remote interfaces
+type Source interface {
+	// CapturablePods returns the pods the capture policy allows capturing
+	CapturablePods() []*corev1.Pod
+	// OpenStream applies the capture policy and starts capturing a pod
+	OpenStream(namespace, name string) (Stream, error)
+}
+
+// Server accepts rpcap control connections. Each capturable pod of the node
+// is an interface named <namespace>/<pod>, so Wireshark attaches to
+// rpcaps://<agent>:2002/<namespace>/<pod>. Clients authenticate with a
+// Kubernetes bearer token as password and only see and open pods they may
+// patch. Packet data is sent over a separate TCP connection the client opens
+// to a port announced by the server; UDP and active mode are not supported.
+// Both connections use TLS, so tokens and packets never cross the network in
+// clear text.
+type Server struct {
+	source    Source
+	auth      *kubeauth.Authorizer
+	tlsConfig *tls.Config
+	streams   chan struct{}
+}
+
+// NewServer returns a server offering the pods of source over TLS with
+// tlsConfig, authorizing clients through client
+func NewServer(source Source, client kubernetes.Interface, tlsConfig *tls.Config) *Server {
+	return &Server{
+		source:    source,
+		auth:      kubeauth.NewAuthorizer(client),
+		tlsConfig: tlsConfig,
+		streams:   make(chan struct{}, maxStreams),
+	}
+}
+
+// ListenAndServe serves rpcap clients on addr
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves rpcap clients connecting to l until l is closed
+func (s *Server) Serve(l net.Listener) error {
+	l = tls.NewListener(l, s.tlsConfig)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		conn := &conn{server: s, ctrl: c}
+		go conn.serve()
+	}
+}
+
+// conn is one control connection with at most one open pod
+type conn struct {
+	server *Server
+	ctrl   net.Conn
+	user   *authenticationv1.UserInfo
+
+	// pod and stream are set by an open request
+	pod     string
+	stream  Stream
+	capture *activeCapture
+}
+
+// activeCapture forwards packets of a started capture to the data connection
+type activeCapture struct {
+	stream   Stream
+	data     net.Conn
+	snapLen  uint32
+	filter   atomic.Pointer[filter]
+	received atomic.Uint32
+	sent     atomic.Uint32
+	done     chan struct{}
+}
+
+// filter wraps the client's BPF program; a nil VM accepts every packet
+type filter struct {
+	vm *bpf.VM
+}
+
+func (c *conn) serve() {
+	remote := c.ctrl.RemoteAddr().String()
+	defer func() {
+		c.closeStream()
+		c.ctrl.Close()
+		klog.V(2).Infof("Closed rpcap connection from %s", remote)
+	}()
+	klog.V(2).Infof("Accepted rpcap connection from %s", remote)
+
+	_ = c.ctrl.SetReadDeadline(time.Now().Add(authTimeout))
+	for {
+		h, err := readHeader(c.ctrl)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				klog.V(2).Infof("Reading from rpcap client %s failed: %v", remote, err)
+			}
+			return
+		}
+		payload, err := readPayload(c.ctrl, h)
+		if err != nil {
+			klog.V(2).Infof("Reading from rpcap client %s failed: %v", remote, err)
+			return
+		}
+		if h.Version != protocolVersion {
+			_ = writeError(c.ctrl, errWrongVersion, "unsupported rpcap protocol version %d", h.Version)
+			continue
+		}
+		if c.user == nil && h.Type != msgAuthReq {
+			_ = writeError(c.ctrl, errAuth, "authentication required")
+			return
+		}
+		if h.Type == msgClose {
+			return
+		}
+		if err := c.handle(h, payload); err != nil {
+			klog.V(2).Infof("rpcap connection from %s ended: %v", remote, err)
+			return
+		}
+	}
+}
+
+// handle answers one request. A returned error closes the connection.
+func (c *conn) handle(h header, payload []byte) error {
+	ctx := context.Background()
+	switch h.Type {
+	case msgAuthReq:
+		return c.authenticate(ctx, payload)
+	case msgFindAllIfReq:
+		return c.findAllIf(ctx)
+	case msgOpenReq:
+		return c.open(ctx, string(payload))
+	case msgStartCapReq:
+		return c.startCapture(payload)
+	case msgUpdateFilterReq:
+		if c.capture == nil {
+			return writeError(c.ctrl, errUpdateFilter, "no capture is running")
+		}
+		vm, err := parseFilter(payload)
+		if err != nil {
+			return writeError(c.ctrl, errUpdateFilter, "invalid filter: %v", err)
+		}
+		c.capture.filter.Store(&filter{vm: vm})
+		return writeMessage(c.ctrl, msgUpdateFilterReq|replyBit, 0, nil)
+	case msgStatsReq:
+		var st stats
+		if c.capture != nil {
+			st = stats{Received: c.capture.received.Load(), Sent: c.capture.sent.Load()}
+		}
+		return writeMessage(c.ctrl, msgStatsReq|replyBit, 0, statsReply(st))
+	case msgEndCapReq:
+		c.closeStream()
+		return writeMessage(c.ctrl, msgEndCapReq|replyBit, 0, nil)
+	case msgSetSamplingReq:
+		if len(payload) > 0 && payload[0] != 0 {
+			return writeError(c.ctrl, errSetSampling, "sampling is not supported")
+		}
+		return writeMessage(c.ctrl, msgSetSamplingReq|replyBit, 0, nil)
+	default:
+		return writeError(c.ctrl, errWrongMsg, "unexpected message type %d", h.Type)
+	}
+}
+
+func (c *conn) authenticate(ctx context.Context, payload []byte) error {
+	req, err := parseAuthRequest(payload)
+	if err != nil {
+		_ = writeError(c.ctrl, errAuth, "%v", err)
+		return err
+	}
+	if req.Type != authPassword {
+		_ = writeError(c.ctrl, errAuthTypeNone, "only password authentication with a Kubernetes bearer token is supported")
+		return fmt.Errorf("unsupported authentication type %d", req.Type)
+	}
+	user, err := c.server.auth.Authenticate(ctx, req.Password)
+	if err != nil {
+		_ = writeError(c.ctrl, errAuthFailed, "authentication failed")
+		return err
+	}
+
+	c.user = &user
+	klog.Infof("rpcap client %s authenticated as %s", c.ctrl.RemoteAddr(), user.Username)
+	_ = c.ctrl.SetReadDeadline(time.Time{})
+	return writeMessage(c.ctrl, msgAuthReq|replyBit, 0, authReply())
+}
+
+func (c *conn) findAllIf(ctx context.Context) error {
+	allowedNamespaces := map[string]bool{}
+	var ifaces []iface
+	for _, pod := range c.server.source.CapturablePods() {
+		allowed, checked := allowedNamespaces[pod.Namespace]
+		if !checked {
+			var err error
+			if allowed, err = c.server.auth.MayCapture(ctx, *c.user, pod.Namespace, ""); err != nil {
+				return writeError(c.ctrl, errFindAllIf, "%v", err)
+			}
+			allowedNamespaces[pod.Namespace] = allowed
+		}
+		if !allowed {
+			continue
+		}
+		ifaces = append(ifaces, iface{
+			Name:        fmt.Sprintf("%s/%s", pod.Namespace, pod.Name),
+			Description: fmt.Sprintf("Pod %s/%s (%s) on node %s", pod.Namespace, pod.Name, pod.Status.PodIP, pod.Spec.NodeName),
+		})
+	}
+	if len(ifaces) == 0 {
+		return writeError(c.ctrl, errNoRemoteIf, "no pods on this node that you may capture")
+	}
+	return writeMessage(c.ctrl, msgFindAllIfReq|replyBit, uint16(len(ifaces)), findAllIfReply(ifaces))
+}
+
+func (c *conn) open(ctx context.Context, name string) error {
+	namespace, pod, ok := strings.Cut(name, "/")
+	if !ok || namespace == "" || pod == "" {
+		return writeError(c.ctrl, errOpen, "interface %q is not a pod; use <namespace>/<pod>", name)
+	}
+	allowed, err := c.server.auth.MayCapture(ctx, *c.user, namespace, pod)
+	if err != nil {
+		return writeError(c.ctrl, errOpen, "%v", err)
+	}
+	if !allowed {
+		klog.Infof("rpcap user %s may not capture pod %s", c.user.Username, name)
+		return writeError(c.ctrl, errOpen, "user %s may not capture pod %s", c.user.Username, name)
+	}
+
+	c.closeStream()
+	select {
+	case c.server.streams <- struct{}{}:
+	default:
+		return writeError(c.ctrl, errOpen, "the node agent already runs %d remote captures", maxStreams)
+	}
+	stream, err := c.server.source.OpenStream(namespace, pod)
+	if err != nil {
+		<-c.server.streams
+		return writeError(c.ctrl, errOpen, "%v", err)
+	}
+
+	c.pod, c.stream = name, stream
+	klog.Infof("rpcap user %s opened pod %s", c.user.Username, name)
+	return writeMessage(c.ctrl, msgOpenReq|replyBit, 0, openReply(stream.LinkType()))
+}
+
+func (c *conn) startCapture(payload []byte) error {
+	if c.stream == nil {
+		return writeError(c.ctrl, errStartCapture, "no pod is open")
+	}
+	if c.capture != nil {
+		return writeError(c.ctrl, errStartCapture, "the capture is already running")
+	}
+	req, err := parseStartCapRequest(payload)
+	if err != nil {
+		return writeError(c.ctrl, errStartCapture, "invalid request: %v", err)
+	}
+	if req.Flags&(startCapFlagDatagram|startCapFlagServerOpen) != 0 {
+		return writeError(c.ctrl, errStartCapture, "only passive mode over TCP is supported")
+	}
+
+	host, _, err := net.SplitHostPort(c.ctrl.LocalAddr().String())
+	if err != nil {
+		return writeError(c.ctrl, errNetwork, "%v", err)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return writeError(c.ctrl, errNetwork, "failed to open data port: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	if err := writeMessage(c.ctrl, msgStartCapReq|replyBit, 0, startCapReply(dataBufferSize, uint16(port))); err != nil {
+		return err
+	}
+
+	data, err := c.acceptData(l.(*net.TCPListener))
+	if err != nil {
+		return writeError(c.ctrl, errStartCapture, "%v", err)
+	}
+	c.capture = &activeCapture{stream: c.stream, data: data, snapLen: req.SnapLen, done: make(chan struct{})}
+	c.capture.filter.Store(&filter{vm: req.Filter})
+	go c.capture.forward()
+	return nil
+}
+
+// acceptData waits for the client to open the data connection and completes
+// its TLS handshake. Only connections from the client's own address are
+// accepted, so nobody else can pick up its packets.
+func (c *conn) acceptData(l *net.TCPListener) (net.Conn, error) {
+	clientHost, _, err := net.SplitHostPort(c.ctrl.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	if err := l.SetDeadline(time.Now().Add(dataAcceptTimeout)); err != nil {
+		return nil, err
+	}
+	for {
+		data, err := l.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("client did not open the data connection: %w", err)
+		}
+		host, _, _ := net.SplitHostPort(data.RemoteAddr().String())
+		if host == clientHost {
+			return c.handshake(data)
+		}
+		klog.Warningf("Refusing rpcap data connection from %s for client %s", data.RemoteAddr(), c.ctrl.RemoteAddr())
+		data.Close()
+	}
+}
+
+// handshake completes the TLS handshake of the data connection
+func (c *conn) handshake(data net.Conn) (net.Conn, error) {
+	conn := tls.Server(data, c.server.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), dataAcceptTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake of the data connection failed: %w", err)
+	}
+	return conn, nil
+}
+
+// closeStream stops the capture and tcpdump of the open pod, if any
+func (c *conn) closeStream() {
+	if c.stream == nil {
+		return
+	}
+	c.stream.Close()
+	if c.capture != nil {
+		c.capture.data.Close()
+		<-c.capture.done
+		klog.Infof("rpcap capture of pod %s ended after %d of %d packets", c.pod, c.capture.sent.Load(), c.capture.received.Load())
+	}
+	c.stream, c.capture, c.pod = nil, nil, ""
+	<-c.server.streams
+}
+
+// forward sends every packet accepted by the filter to the data connection
+// until the stream ends or the client stops reading
+func (a *activeCapture) forward() {
+	defer close(a.done)
+	defer a.data.Close()
+
+	var seq uint32
+	for {
+		p, err := a.stream.Next()
+		if err != nil {
+			return
+		}
+		a.received.Add(1)
+
+		data := p.Data
+		if f := a.filter.Load(); f.vm != nil {
+			n, err := f.vm.Run(data)
+			if err != nil || n == 0 {
+				continue
+			}
+			if n < len(data) {
+				data = data[:n]
+			}
+		}
+		if a.snapLen > 0 && uint32(len(data)) > a.snapLen {
+			data = data[:a.snapLen]
+		}
+
+		seq++
+		micros := uint32(p.Timestamp.Nanosecond() / int(time.Microsecond))
+		msg := packetMessage(uint32(p.Timestamp.Unix()), micros, p.OrigLen, seq, data)
+		if err := a.data.SetWriteDeadline(time.Now().Add(dataWriteTimeout)); err != nil {
+			return
+		}
+		if _, err := a.data.Write(msg); err != nil {
+			return
+		}
+		a.sent.Add(1)
+	}
+}
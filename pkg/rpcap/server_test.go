@@ -0,0 +1,343 @@
+package rpcap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/pcap"
+	"golang.org/x/net/bpf"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testToken     = "valid-token"
+	linkTypeEther = 1
+)
+
+// fakeStream returns queued packets, then blocks until closed
+type fakeStream struct {
+	packets chan *pcap.Packet
+	closed  chan struct{}
+}
+
+func (s *fakeStream) LinkType() uint32 { return linkTypeEther }
+
+func (s *fakeStream) Next() (*pcap.Packet, error) {
+	select {
+	case p := <-s.packets:
+		return p, nil
+	case <-s.closed:
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeStream) Close() error {
+	close(s.closed)
+	return nil
+}
+
+type fakeSource struct {
+	pods   []*corev1.Pod
+	stream *fakeStream
+	opened []string
+}
+
+func (s *fakeSource) CapturablePods() []*corev1.Pod { return s.pods }
+
+func (s *fakeSource) OpenStream(namespace, name string) (Stream, error) {
+	s.opened = append(s.opened, namespace+"/"+name)
+	return s.stream, nil
+}
+
+func testPod(namespace, name string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Spec:       corev1.PodSpec{NodeName: "node-1"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.5"},
+	}
+}
+
+// testServer is an rpcap server on a loopback port
+type testServer struct {
+	addr string
+	// clientTLS trusts the server's certificate
+	clientTLS *tls.Config
+}
+
+// newTestServer serves rpcap on a loopback port. The token testToken belongs
+// to user alice, who may patch pods in namespace shop only.
+func newTestServer(t *testing.T, source Source) *testServer {
+	t.Helper()
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == testToken {
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		}
+		return true, review, nil
+	})
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attrs := review.Spec.ResourceAttributes
+		review.Status.Allowed = review.Spec.User == "alice" && attrs.Namespace == "shop" && attrs.Verb == "patch" && attrs.Resource == "pods"
+		return true, review, nil
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	serverTLS, clientTLS := testTLSConfigs(t)
+	go NewServer(source, clientset, serverTLS).Serve(l)
+	return &testServer{addr: l.Addr().String(), clientTLS: clientTLS}
+}
+
+// testTLSConfigs returns the TLS configs of a server with a self-signed
+// certificate for 127.0.0.1 and of a client trusting it
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "packet-capture-controller"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: pool}
+}
+
+// testClient speaks the client side of the protocol
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// dial opens a control connection
+func (s *testServer) dial(t *testing.T) *testClient {
+	t.Helper()
+	return &testClient{t: t, conn: s.dialAddr(t, s.addr)}
+}
+
+// dialData opens the data connection to port
+func (s *testServer) dialData(t *testing.T, port uint16) net.Conn {
+	t.Helper()
+	return s.dialAddr(t, fmt.Sprintf("127.0.0.1:%d", port))
+}
+
+func (s *testServer) dialAddr(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, s.clientTLS)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// request sends a message and returns the reply, failing on error replies
+// unless wantError is set
+func (c *testClient) request(msgType uint8, payload []byte, wantError bool) (header, []byte) {
+	c.t.Helper()
+	if err := writeMessage(c.conn, msgType, 0, payload); err != nil {
+		c.t.Fatalf("Failed to send message %d: %v", msgType, err)
+	}
+	h, err := readHeader(c.conn)
+	if err != nil {
+		c.t.Fatalf("Failed to read reply to message %d: %v", msgType, err)
+	}
+	reply, err := readPayload(c.conn, h)
+	if err != nil {
+		c.t.Fatalf("Failed to read reply payload: %v", err)
+	}
+	if gotError := h.Type == msgError; gotError != wantError {
+		c.t.Fatalf("reply to message %d: type %d (%q), want error=%v", msgType, h.Type, reply, wantError)
+	}
+	if !wantError && h.Type != msgType|replyBit {
+		c.t.Fatalf("reply to message %d has type %d", msgType, h.Type)
+	}
+	return h, reply
+}
+
+func authPayload(token string) []byte {
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint16(p[0:], authPassword)
+	binary.BigEndian.PutUint16(p[4:], uint16(len("alice")))
+	binary.BigEndian.PutUint16(p[6:], uint16(len(token)))
+	return append(append(p, "alice"...), token...)
+}
+
+func filterPayload(t *testing.T, insns []bpf.Instruction) []byte {
+	t.Helper()
+	raw, err := bpf.Assemble(insns)
+	if err != nil {
+		t.Fatalf("Assemble() returned error: %v", err)
+	}
+	p := make([]byte, 8, 8+len(raw)*bpfInsnLen)
+	binary.BigEndian.PutUint32(p[4:], uint32(len(raw)))
+	for _, r := range raw {
+		insn := make([]byte, bpfInsnLen)
+		binary.BigEndian.PutUint16(insn[0:], r.Op)
+		insn[2], insn[3] = r.Jt, r.Jf
+		binary.BigEndian.PutUint32(insn[4:], r.K)
+		p = append(p, insn...)
+	}
+	return p
+}
+
+// firstByteFilter accepts packets whose first byte is b
+func firstByteFilter(b uint32) []bpf.Instruction {
+	return []bpf.Instruction{
+		bpf.LoadAbsolute{Off: 0, Size: 1},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: b, SkipFalse: 1},
+		bpf.RetConstant{Val: 65535},
+		bpf.RetConstant{Val: 0},
+	}
+}
+
+func readPacket(t *testing.T, data net.Conn) (uint32, []byte) {
+	t.Helper()
+	h, err := readHeader(data)
+	if err != nil {
+		t.Fatalf("Failed to read packet header: %v", err)
+	}
+	payload, err := readPayload(data, h)
+	if err != nil || h.Type != msgPacket || len(payload) < packetHeaderLen {
+		t.Fatalf("unexpected packet message %+v: %v", h, err)
+	}
+	return binary.BigEndian.Uint32(payload[12:]), payload[packetHeaderLen:]
+}
+
+func TestRemoteCaptureOfAPod(t *testing.T) {
+	stream := &fakeStream{packets: make(chan *pcap.Packet, 10), closed: make(chan struct{})}
+	source := &fakeSource{
+		pods:   []*corev1.Pod{testPod("kube-system", "dns-0"), testPod("shop", "web-0")},
+		stream: stream,
+	}
+	server := newTestServer(t, source)
+	client := server.dial(t)
+
+	client.request(msgAuthReq, authPayload(testToken), false)
+
+	h, reply := client.request(msgFindAllIfReq, nil, false)
+	if h.Value != 1 || !strings.Contains(string(reply), "shop/web-0") || strings.Contains(string(reply), "dns-0") {
+		t.Errorf("findalldevs listed %d interfaces %q, want only shop/web-0", h.Value, reply)
+	}
+
+	client.request(msgOpenReq, []byte("kube-system/dns-0"), true)
+	_, reply = client.request(msgOpenReq, []byte("shop/web-0"), false)
+	if linkType := binary.BigEndian.Uint32(reply); linkType != linkTypeEther {
+		t.Errorf("link type = %d, want %d", linkType, linkTypeEther)
+	}
+	if len(source.opened) != 1 || source.opened[0] != "shop/web-0" {
+		t.Errorf("opened streams %v, want only shop/web-0", source.opened)
+	}
+
+	start := make([]byte, 12)
+	binary.BigEndian.PutUint32(start[0:], 4)
+	_, reply = client.request(msgStartCapReq, append(start, filterPayload(t, firstByteFilter(1))...), false)
+	port := binary.BigEndian.Uint16(reply[4:])
+	data := server.dialData(t, port)
+
+	now := time.Now()
+	stream.packets <- &pcap.Packet{Timestamp: now, OrigLen: 6, Data: []byte{2, 0, 0, 0, 0, 0}}
+	stream.packets <- &pcap.Packet{Timestamp: now, OrigLen: 6, Data: []byte{1, 2, 3, 4, 5, 6}}
+	origLen, packet := readPacket(t, data)
+	if origLen != 6 || string(packet) != string([]byte{1, 2, 3, 4}) {
+		t.Errorf("packet = %v (len %d), want the filtered packet cut at the snap length", packet, origLen)
+	}
+
+	client.request(msgUpdateFilterReq, filterPayload(t, firstByteFilter(2)), false)
+	stream.packets <- &pcap.Packet{Timestamp: now, OrigLen: 6, Data: []byte{1, 0, 0, 0, 0, 0}}
+	stream.packets <- &pcap.Packet{Timestamp: now, OrigLen: 6, Data: []byte{2, 9, 9, 9, 9, 9}}
+	if _, packet := readPacket(t, data); packet[0] != 2 {
+		t.Errorf("packet %v should have passed the updated filter", packet)
+	}
+
+	_, reply = client.request(msgStatsReq, nil, false)
+	if received, sent := binary.BigEndian.Uint32(reply[0:]), binary.BigEndian.Uint32(reply[12:]); received != 4 || sent != 2 {
+		t.Errorf("stats received=%d sent=%d, want 4 and 2", received, sent)
+	}
+
+	client.request(msgEndCapReq, nil, false)
+	select {
+	case <-stream.closed:
+	default:
+		t.Error("ending the capture should stop the stream")
+	}
+}
+
+func TestRemoteCaptureRequiresAValidToken(t *testing.T) {
+	server := newTestServer(t, &fakeSource{pods: []*corev1.Pod{testPod("shop", "web-0")}})
+
+	client := server.dial(t)
+	client.request(msgFindAllIfReq, nil, true)
+
+	client = server.dial(t)
+	h, _ := client.request(msgAuthReq, authPayload("stolen"), true)
+	if h.Value != errAuthFailed {
+		t.Errorf("error code = %d, want %d", h.Value, errAuthFailed)
+	}
+	if _, err := readHeader(client.conn); err != io.EOF {
+		t.Errorf("connection should be closed after a failed authentication, got %v", err)
+	}
+
+	client = server.dial(t)
+	null := make([]byte, 8)
+	if h, _ := client.request(msgAuthReq, null, true); h.Value != errAuthTypeNone {
+		t.Errorf("NULL authentication: error code = %d, want %d", h.Value, errAuthTypeNone)
+	}
+}
+
+func TestRemoteCaptureRequiresTLS(t *testing.T) {
+	server := newTestServer(t, &fakeSource{pods: []*corev1.Pod{testPod("shop", "web-0")}})
+
+	conn, err := net.Dial("tcp", server.addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := writeMessage(conn, msgAuthReq, 0, authPayload(testToken)); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if h, err := readHeader(conn); err == nil && h.Type == msgAuthReq|replyBit {
+		t.Error("server should not accept rpcap without TLS")
+	}
+}
@@ -0,0 +1,221 @@
+// Package rules describes the trigger rules that start captures on their
+// own when a pod shows a failure signal, and detects those signals.
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Signal is a pod failure a rule reacts to
+type Signal string
+
+const (
+	// SignalReadinessLost is a pod whose Ready condition went from True to False
+	SignalReadinessLost Signal = "ReadinessLost"
+	// SignalContainerRestarted is a container whose restart count increased
+	SignalContainerRestarted Signal = "ContainerRestarted"
+	// SignalOOMKilled is a container that terminated with reason OOMKilled
+	SignalOOMKilled Signal = "OOMKilled"
+	// SignalLivenessProbeFailed is an Unhealthy event of a failed liveness probe
+	SignalLivenessProbeFailed Signal = "LivenessProbeFailed"
+)
+
+const (
+	// DefaultDuration bounds rule captures that do not set a duration
+	DefaultDuration = 2 * time.Minute
+	// MaxDuration is the longest capture a rule may start
+	MaxDuration = time.Hour
+	// DefaultCooldown is the time a rule waits before capturing the same
+	// pod again when it does not set a cooldown
+	DefaultCooldown = 10 * time.Minute
+	// DefaultRetention keeps the files of rule captures, which nobody
+	// asked for explicitly, long enough to be looked at
+	DefaultRetention = 24 * time.Hour
+)
+
+// Capture holds the options of the captures a rule starts. They mean the
+// same as in the capture annotation.
+type Capture struct {
+	Duration   metav1.Duration `json:"duration,omitempty"`
+	FileCount  int             `json:"fileCount,omitempty"`
+	FileSizeMB int             `json:"fileSizeMB,omitempty"`
+	Filter     string          `json:"filter,omitempty"`
+	Snaplen    int             `json:"snaplen,omitempty"`
+	Interface  string          `json:"interface,omitempty"`
+	Container  string          `json:"container,omitempty"`
+	Retention  metav1.Duration `json:"retention,omitempty"`
+}
+
+// Rule starts a time-bounded capture of a pod when it shows one of Signals
+type Rule struct {
+	// Name identifies the rule; its captures are reported as
+	// <namespace>/rule/<name>
+	Name string `json:"name"`
+	// Namespaces limits the rule to these namespaces; empty matches all
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector is a label selector pods must match; empty matches all
+	Selector string   `json:"selector,omitempty"`
+	Signals  []Signal `json:"signals"`
+	Capture  Capture  `json:"capture,omitempty"`
+	// Cooldown is the minimum time between two captures of the same pod
+	Cooldown *metav1.Duration `json:"cooldown,omitempty"`
+	// MaxActive caps the captures of the rule running at once on a node;
+	// zero leaves them unbounded
+	MaxActive int `json:"maxActive,omitempty"`
+}
+
+// Validate reports the first invalid setting of the rule
+func (r *Rule) Validate() error {
+	if errs := validation.IsDNS1123Label(r.Name); len(errs) > 0 {
+		return fmt.Errorf("name %q must be a DNS-1123 label: %s", r.Name, strings.Join(errs, ", "))
+	}
+	if _, err := labels.Parse(r.Selector); err != nil {
+		return fmt.Errorf("rule %s: invalid selector %q: %v", r.Name, r.Selector, err)
+	}
+	if len(r.Signals) == 0 {
+		return fmt.Errorf("rule %s: signals must not be empty", r.Name)
+	}
+	for _, s := range r.Signals {
+		switch s {
+		case SignalReadinessLost, SignalContainerRestarted, SignalOOMKilled, SignalLivenessProbeFailed:
+		default:
+			return fmt.Errorf("rule %s: unknown signal %q", r.Name, s)
+		}
+	}
+	if d := r.Capture.Duration.Duration; d < 0 || d > MaxDuration {
+		return fmt.Errorf("rule %s: capture.duration must be between 0 and %s, got %s", r.Name, MaxDuration, d)
+	}
+	if r.Cooldown != nil && r.Cooldown.Duration < 0 {
+		return fmt.Errorf("rule %s: cooldown must not be negative, got %s", r.Name, r.Cooldown.Duration)
+	}
+	if r.MaxActive < 0 {
+		return fmt.Errorf("rule %s: maxActive must not be negative, got %d", r.Name, r.MaxActive)
+	}
+	return nil
+}
+
+// Validate reports the first invalid rule of rules, including duplicate names
+func Validate(rules []Rule) error {
+	names := make(map[string]bool, len(rules))
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			return fmt.Errorf("triggerRules[%d]: %w", i, err)
+		}
+		if names[rules[i].Name] {
+			return fmt.Errorf("triggerRules[%d]: duplicate rule name %q", i, rules[i].Name)
+		}
+		names[rules[i].Name] = true
+	}
+	return nil
+}
+
+// CaptureDuration returns how long the captures of the rule run
+func (r *Rule) CaptureDuration() time.Duration {
+	if r.Capture.Duration.Duration > 0 {
+		return r.Capture.Duration.Duration
+	}
+	return DefaultDuration
+}
+
+// CooldownDuration returns the minimum time between two captures of a pod
+func (r *Rule) CooldownDuration() time.Duration {
+	if r.Cooldown != nil {
+		return r.Cooldown.Duration
+	}
+	return DefaultCooldown
+}
+
+// Matches reports whether the rule reacts to signal on pod
+func (r *Rule) Matches(pod *corev1.Pod, signal Signal) bool {
+	if !slices.Contains(r.Signals, signal) {
+		return false
+	}
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, pod.Namespace) {
+		return false
+	}
+	selector, err := labels.Parse(r.Selector)
+	return err == nil && selector.Matches(labels.Set(pod.Labels))
+}
+
+// PodSignals returns the failure signals shown by the change of a pod from
+// oldPod to newPod. Pods being deleted show none, as losing readiness and
+// terminating containers is expected then.
+func PodSignals(oldPod, newPod *corev1.Pod) []Signal {
+	if newPod.DeletionTimestamp != nil {
+		return nil
+	}
+	var signals []Signal
+	if podReady(oldPod) && !podReady(newPod) {
+		signals = append(signals, SignalReadinessLost)
+	}
+
+	previous := make(map[string]corev1.ContainerStatus, len(oldPod.Status.ContainerStatuses))
+	for _, status := range oldPod.Status.ContainerStatuses {
+		previous[status.Name] = status
+	}
+	restarted, oomKilled := false, false
+	for _, status := range newPod.Status.ContainerStatuses {
+		old, ok := previous[status.Name]
+		if !ok {
+			continue
+		}
+		if status.RestartCount > old.RestartCount {
+			restarted = true
+			if t := status.LastTerminationState.Terminated; t != nil && t.Reason == "OOMKilled" {
+				oomKilled = true
+			}
+		}
+		// Containers that are not restarted stay terminated
+		if t := status.State.Terminated; t != nil && t.Reason == "OOMKilled" && old.State.Terminated == nil {
+			oomKilled = true
+		}
+	}
+	if restarted {
+		signals = append(signals, SignalContainerRestarted)
+	}
+	if oomKilled {
+		signals = append(signals, SignalOOMKilled)
+	}
+	return signals
+}
+
+// NeedEvents reports whether any of rules matches a signal that only events
+// report, so the node agent has to watch them
+func NeedEvents(rules []Rule) bool {
+	for i := range rules {
+		for _, signal := range rules[i].Signals {
+			if signal == SignalLivenessProbeFailed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EventSignal returns the signal an event about a pod reports, if any
+func EventSignal(event *corev1.Event) (Signal, bool) {
+	if event.InvolvedObject.Kind != "Pod" || event.Reason != "Unhealthy" {
+		return "", false
+	}
+	if strings.HasPrefix(event.Message, "Liveness probe failed") {
+		return SignalLivenessProbeFailed, true
+	}
+	return "", false
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package rules
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func readyPod(ready corev1.ConditionStatus, restarts int32, lastTermination string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "shop", Labels: map[string]string{"app": "web"}},
+		Status: corev1.PodStatus{
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}},
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "app", RestartCount: restarts}},
+		},
+	}
+	if lastTermination != "" {
+		pod.Status.ContainerStatuses[0].LastTerminationState.Terminated = &corev1.ContainerStateTerminated{Reason: lastTermination}
+	}
+	return pod
+}
+
+func TestPodSignals(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new *corev1.Pod
+		want     []Signal
+	}{
+		{name: "no change", old: readyPod(corev1.ConditionTrue, 0, ""), new: readyPod(corev1.ConditionTrue, 0, "")},
+		{name: "readiness lost", old: readyPod(corev1.ConditionTrue, 0, ""), new: readyPod(corev1.ConditionFalse, 0, ""), want: []Signal{SignalReadinessLost}},
+		{name: "becoming ready", old: readyPod(corev1.ConditionFalse, 0, ""), new: readyPod(corev1.ConditionTrue, 0, "")},
+		{name: "restart", old: readyPod(corev1.ConditionTrue, 1, ""), new: readyPod(corev1.ConditionTrue, 2, "Error"), want: []Signal{SignalContainerRestarted}},
+		{
+			name: "restart after OOM kill",
+			old:  readyPod(corev1.ConditionTrue, 0, ""),
+			new:  readyPod(corev1.ConditionFalse, 1, "OOMKilled"),
+			want: []Signal{SignalReadinessLost, SignalContainerRestarted, SignalOOMKilled},
+		},
+		{name: "earlier OOM kill", old: readyPod(corev1.ConditionTrue, 1, "OOMKilled"), new: readyPod(corev1.ConditionTrue, 1, "OOMKilled")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PodSignals(tt.old, tt.new)
+			if len(got) != len(tt.want) {
+				t.Fatalf("PodSignals() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("PodSignals() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	terminating := readyPod(corev1.ConditionFalse, 0, "")
+	terminating.DeletionTimestamp = &metav1.Time{}
+	if got := PodSignals(readyPod(corev1.ConditionTrue, 0, ""), terminating); len(got) != 0 {
+		t.Errorf("terminating pod showed signals %v", got)
+	}
+
+	killed := readyPod(corev1.ConditionFalse, 0, "")
+	killed.Status.ContainerStatuses[0].State.Terminated = &corev1.ContainerStateTerminated{Reason: "OOMKilled"}
+	if got := PodSignals(readyPod(corev1.ConditionFalse, 0, ""), killed); len(got) != 1 || got[0] != SignalOOMKilled {
+		t.Errorf("container OOM killed without restart showed %v, want OOMKilled", got)
+	}
+}
+
+func TestEventSignal(t *testing.T) {
+	event := &corev1.Event{
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Namespace: "shop", Name: "web-0"},
+		Reason:         "Unhealthy",
+		Message:        "Liveness probe failed: HTTP probe failed with statuscode: 500",
+	}
+	if signal, ok := EventSignal(event); !ok || signal != SignalLivenessProbeFailed {
+		t.Errorf("EventSignal() = %q, %v, want LivenessProbeFailed", signal, ok)
+	}
+	event.Message = "Readiness probe failed: connection refused"
+	if signal, ok := EventSignal(event); ok {
+		t.Errorf("readiness probe event reported %q", signal)
+	}
+}
+
+func TestRuleMatchesAndValidate(t *testing.T) {
+	rule := Rule{Name: "web-oom", Namespaces: []string{"shop"}, Selector: "app=web", Signals: []Signal{SignalOOMKilled}}
+	if err := rule.Validate(); err != nil {
+		t.Fatalf("Validate() returned error: %v", err)
+	}
+	pod := readyPod(corev1.ConditionTrue, 0, "")
+	if !rule.Matches(pod, SignalOOMKilled) {
+		t.Errorf("rule should match an OOM kill of shop/web-0")
+	}
+	if rule.Matches(pod, SignalReadinessLost) {
+		t.Errorf("rule should only match its signals")
+	}
+	pod.Labels["app"] = "db"
+	if rule.Matches(pod, SignalOOMKilled) {
+		t.Errorf("rule should only match pods of its selector")
+	}
+	if rule.CaptureDuration() != DefaultDuration || rule.CooldownDuration() != DefaultCooldown {
+		t.Errorf("unset duration and cooldown should use the defaults")
+	}
+
+	invalid := []Rule{
+		{Name: "Web", Signals: []Signal{SignalOOMKilled}},
+		{Name: "web"},
+		{Name: "web", Signals: []Signal{"Crashed"}},
+		{Name: "web", Signals: []Signal{SignalOOMKilled}, Selector: "app in (web"},
+		{Name: "web", Signals: []Signal{SignalOOMKilled}, Capture: Capture{Duration: metav1.Duration{Duration: 2 * MaxDuration}}},
+		{Name: "web", Signals: []Signal{SignalOOMKilled}, MaxActive: -1},
+	}
+	for _, r := range invalid {
+		if err := r.Validate(); err == nil {
+			t.Errorf("Validate() accepted %+v", r)
+		}
+	}
+	if err := Validate([]Rule{rule, rule}); err == nil {
+		t.Errorf("Validate() accepted duplicate rule names")
+	}
+}
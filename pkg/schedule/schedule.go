@@ -0,0 +1,204 @@
+// Package schedule parses cron expressions and computes when they fire next.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSearch bounds the search for the next time a schedule fires
+const maxSearch = 5 * 366 * 24 * time.Hour
+
+// Schedule is a parsed cron expression of five fields: minute, hour, day of
+// month, month and day of week. Times are evaluated in UTC.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record an unrestricted day field: when both day
+	// fields are restricted a day matching either one fires, as in cron
+	domAny, dowAny bool
+}
+
+// field describes the values one field of an expression takes
+type field struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	minuteField = field{name: "minute", min: 0, max: 59}
+	hourField   = field{name: "hour", min: 0, max: 23}
+	domField    = field{name: "day of month", min: 1, max: 31}
+	monthField  = field{name: "month", min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	dowField    = field{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// macros are the predefined schedules
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// daysInMonth is the most days each month can have
+var daysInMonth = [13]int{0, 31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}
+
+// Parse parses a cron expression such as "30 2 * * 1-5", or one of the
+// macros @hourly, @daily, @midnight, @weekly, @monthly, @yearly and
+// @annually. Fields accept *, numbers, ranges a-b, lists a,b and steps */n or
+// a-b/n; months and days of week also accept their English abbreviations.
+func Parse(expr string) (*Schedule, error) {
+	spec := strings.TrimSpace(expr)
+	if macro, ok := macros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have 5 fields, got %d", expr, len(fields))
+	}
+
+	s := &Schedule{}
+	var err error
+	for i, target := range []struct {
+		f    field
+		bits *uint64
+	}{
+		{minuteField, &s.minute},
+		{hourField, &s.hour},
+		{domField, &s.dom},
+		{monthField, &s.month},
+		{dowField, &s.dow},
+	} {
+		if *target.bits, err = target.f.parse(fields[i]); err != nil {
+			return nil, fmt.Errorf("schedule %q: %w", expr, err)
+		}
+	}
+	// Sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	s.domAny, s.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+
+	if s.dowAny && !s.possibleDate() {
+		return nil, fmt.Errorf("schedule %q never fires", expr)
+	}
+	return s, nil
+}
+
+// parse returns the set of values a field expression selects as a bitmask
+func (f field) parse(expr string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(expr, ",") {
+		rangeExpr, stepExpr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepExpr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepExpr, f.name)
+			}
+			step = n
+		}
+
+		var low, high int
+		switch {
+		case rangeExpr == "*":
+			low, high = f.min, f.max
+			if f.name == dowField.name {
+				high = 6
+			}
+		case strings.Contains(rangeExpr, "-"):
+			lowExpr, highExpr, _ := strings.Cut(rangeExpr, "-")
+			var err error
+			if low, err = f.value(lowExpr); err != nil {
+				return 0, err
+			}
+			if high, err = f.value(highExpr); err != nil {
+				return 0, err
+			}
+			if low > high {
+				return 0, fmt.Errorf("invalid range %q in %s field", rangeExpr, f.name)
+			}
+		default:
+			value, err := f.value(rangeExpr)
+			if err != nil {
+				return 0, err
+			}
+			low, high = value, value
+			// A step after a single value runs to the end of the range
+			if hasStep {
+				high = f.max
+			}
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single number or name of the field
+func (f field) value(expr string) (int, error) {
+	for i, name := range f.names {
+		if name != "" && strings.EqualFold(expr, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(expr)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("%s must be between %d and %d, got %q", f.name, f.min, f.max, expr)
+	}
+	return v, nil
+}
+
+// possibleDate reports whether some selected month has a selected day of
+// month, e.g. not for February 30
+func (s *Schedule) possibleDate() bool {
+	for month := 1; month <= 12; month++ {
+		if s.month&(1<<month) == 0 {
+			continue
+		}
+		for day := 1; day <= daysInMonth[month]; day++ {
+			if s.dom&(1<<day) != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next returns the first time after t the schedule fires, in UTC, or the
+// zero time if it does not fire within the next five years
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxSearch)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,74 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	// A Sunday
+	from := time.Date(2026, 10, 18, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 18, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 18, 10, 30, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2026, 10, 19, 2, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 18, 11, 0, 0, 0, time.UTC)},
+		{"0 22 * * mon-fri", time.Date(2026, 10, 19, 22, 0, 0, 0, time.UTC)},
+		{"0 3 * * 6,7", time.Date(2026, 10, 24, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 8-18/4 * * *", time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2026, 10, 18, 10, 25, 0, 0, time.UTC)},
+		// Either day field matches when both are restricted
+		{"0 0 31 * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse() returned error: %v", err)
+			}
+			if got := s.Next(from); !got.Equal(tt.want) {
+				t.Errorf("Next() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNextIsInUTC(t *testing.T) {
+	s, err := Parse("0 2 * * *")
+	if err != nil {
+		t.Fatalf("Parse() returned error: %v", err)
+	}
+	berlin := time.FixedZone("CEST", 2*3600)
+	got := s.Next(time.Date(2026, 10, 18, 3, 0, 0, 0, berlin))
+	if want := time.Date(2026, 10, 18, 2, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next() = %v, want %v", got, want)
+	}
+}
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"0 0 30 feb *",
+		"@often",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) should fail", expr)
+		}
+	}
+}
@@ -1,12 +1,34 @@
 package utils
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorClass tells callers whether retrying an operation can succeed
+type ErrorClass int
+
+const (
+	// Transient errors are expected to resolve on their own, e.g. a container
+	// whose process has not appeared in /proc yet
+	Transient ErrorClass = iota
+	// Permanent errors will fail the same way until the user changes something
+	Permanent
+)
+
+func (c ErrorClass) String() string {
+	if c == Permanent {
+		return "permanent"
+	}
+	return "transient"
+}
 
 // CaptureError represents errors that occur during packet capture operations
 type CaptureError struct {
 	Operation string
 	Reason    string
 	Hint      string
+	Class     ErrorClass
 	Err       error
 }
 
@@ -21,16 +43,33 @@ func (e *CaptureError) Unwrap() error {
 	return e.Err
 }
 
-// NewCaptureError creates a new CaptureError with helpful context
+// NewCaptureError creates a new transient CaptureError with helpful context
 func NewCaptureError(operation, reason, hint string, err error) *CaptureError {
 	return &CaptureError{
 		Operation: operation,
 		Reason:    reason,
 		Hint:      hint,
+		Class:     Transient,
 		Err:       err,
 	}
 }
 
+// NewPermanentCaptureError creates a CaptureError that must not be retried
+func NewPermanentCaptureError(operation, reason, hint string, err error) *CaptureError {
+	e := NewCaptureError(operation, reason, hint, err)
+	e.Class = Permanent
+	return e
+}
+
+// IsPermanent reports whether err, or any error it wraps, is a permanent CaptureError
+func IsPermanent(err error) bool {
+	var captureErr *CaptureError
+	if errors.As(err, &captureErr) {
+		return captureErr.Class == Permanent
+	}
+	return false
+}
+
 // Common error constructors with helpful hints
 
 func NewContainerNotFoundError(podName string, err error) *CaptureError {
@@ -70,10 +109,72 @@ func NewFileCleanupError(filePath string, err error) *CaptureError {
 }
 
 func NewAnnotationParseError(value string, err error) *CaptureError {
-	return NewCaptureError(
+	return NewPermanentCaptureError(
 		"Annotation parsing",
 		fmt.Sprintf("Invalid annotation value: %s", value),
-		"The annotation value must be a positive integer representing max capture files. Example: kubectl annotate pod <name> tcpdump.antrea.io=\"5\"",
+		"The annotation value must be a positive integer representing max capture files or a JSON object of capture options. Example: kubectl annotate pod <name> tcpdump.antrea.io=\"5\" or tcpdump.antrea.io='{\"fileCount\":5,\"filter\":\"port 53\"}'",
+		err,
+	)
+}
+
+func NewHostNetworkRefusedError(podName string) *CaptureError {
+	return NewPermanentCaptureError(
+		"Capture admission",
+		fmt.Sprintf("Pod %s uses hostNetwork", podName),
+		"Capturing a hostNetwork pod would record all traffic on the node. Check the pod spec with: kubectl get pod "+podName+" -o jsonpath='{.spec.hostNetwork}'",
+		errors.New("hostNetwork pods are not captured"),
+	)
+}
+
+func NewPolicyDeniedError(namespace, reason, optInKey string) *CaptureError {
+	return NewPermanentCaptureError(
+		"Capture policy",
+		reason,
+		fmt.Sprintf("Check the capture policy in the controller config. To opt a namespace in, ask an administrator to run: kubectl label namespace %s %s=true", namespace, optInKey),
+		errors.New("capture refused by policy"),
+	)
+}
+
+func NewHostNetworkUnscopedError(podName string) *CaptureError {
+	return NewPermanentCaptureError(
+		"Capture admission",
+		fmt.Sprintf("Pod %s uses hostNetwork and declares no container ports", podName),
+		"Captures of hostNetwork pods are restricted to the pod's ports. Check the declared ports with: kubectl get pod "+podName+" -o jsonpath='{.spec.containers[*].ports}'",
+		errors.New("hostNetwork capture cannot be scoped"),
+	)
+}
+
+// NewArmedBufferBudgetError reports an armed capture whose buffer does not
+// fit into the memory the node agent keeps for armed captures. It is
+// transient while other armed captures hold the memory and permanent when
+// the buffer exceeds the whole budget.
+func NewArmedBufferBudgetError(podName string, requestedMB, inUseMB, budgetMB int) *CaptureError {
+	e := NewCaptureError(
+		"Armed capture",
+		fmt.Sprintf("Buffer of %dMB for pod %s does not fit: %dMB of %dMB are held by other armed captures on the node", requestedMB, podName, inUseMB, budgetMB),
+		"Lower bufferSizeMB, stop other armed captures on the node, or raise maxArmedBufferMB in the controller config together with the DaemonSet memory limit.",
+		errors.New("armed capture buffer budget exhausted"),
+	)
+	if requestedMB > budgetMB {
+		e.Class = Permanent
+	}
+	return e
+}
+
+func NewUnsafePathError(path string, err error) *CaptureError {
+	return NewPermanentCaptureError(
+		"Capture file path",
+		fmt.Sprintf("Refusing to write capture files to %s", path),
+		"Capture files are only written below the capture directory, under <namespace>/<pod>/<session>/. Check the namespace and pod name.",
+		err,
+	)
+}
+
+func NewCaptureDirError(path string, err error) *CaptureError {
+	return NewCaptureError(
+		"Capture directory",
+		fmt.Sprintf("Failed to create capture directory %s", path),
+		"Check that the capture directory is writable and the node has free disk space.",
 		err,
 	)
 }
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"errors"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -156,3 +157,30 @@ func TestErrorWrapping(t *testing.T) {
 		t.Errorf("errors.Is should work with wrapped errors")
 	}
 }
+
+// TestErrorClassification validates that only user-fixable errors are permanent
+func TestErrorClassification(t *testing.T) {
+	testErr := errors.New("underlying error")
+
+	tests := []struct {
+		name          string
+		err           error
+		wantPermanent bool
+	}{
+		{"container not found is transient", NewContainerNotFoundError("pod1", testErr), false},
+		{"process not found is transient", NewProcessNotFoundError("container1", testErr), false},
+		{"tcpdump execution is transient", NewTcpdumpExecutionError("pod2", testErr), false},
+		{"annotation parse is permanent", NewAnnotationParseError("bad-value", testErr), true},
+		{"hostNetwork refusal is permanent", NewHostNetworkRefusedError("pod3"), true},
+		{"wrapped permanent error is permanent", fmt.Errorf("sync: %w", NewAnnotationParseError("x", testErr)), true},
+		{"plain error is not permanent", testErr, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsPermanent(tt.err); got != tt.wantPermanent {
+				t.Errorf("IsPermanent() = %v, want %v", got, tt.wantPermanent)
+			}
+		})
+	}
+}
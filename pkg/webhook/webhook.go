@@ -0,0 +1,176 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/policy"
+	"github.com/packet-capture-controller/pkg/utils"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// maxRequestBytes bounds the AdmissionReview body; pods are far smaller
+const maxRequestBytes = 3 * 1024 * 1024
+
+// Validator is an http.Handler serving a validating admission webhook that
+// rejects pods with malformed or out-of-policy capture annotations.
+type Validator struct {
+	annotationKey   string
+	namespaceLister corelisters.NamespaceLister
+
+	// mu guards the policy and the defaults of unset capture options
+	mu       sync.RWMutex
+	policy   policy.Policy
+	defaults capture.CaptureSpec
+}
+
+// NewValidator returns a Validator enforcing p, the policy of the node
+// agents, on annotations whose unset options take defaults, as they do on
+// the node agents. Namespaces are looked up in namespaceLister to check opt-in.
+func NewValidator(annotationKey string, p policy.Policy, defaults capture.CaptureSpec, namespaceLister corelisters.NamespaceLister) *Validator {
+	return &Validator{annotationKey: annotationKey, namespaceLister: namespaceLister, policy: p, defaults: defaults}
+}
+
+// SetPolicy replaces the policy enforced for subsequent requests
+func (v *Validator) SetPolicy(p policy.Policy) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.policy = p
+}
+
+// SetDefaults replaces the defaults of unset capture options for subsequent requests
+func (v *Validator) SetDefaults(defaults capture.CaptureSpec) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.defaults = defaults
+}
+
+func (v *Validator) settings() (policy.Policy, capture.CaptureSpec) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.policy, v.defaults
+}
+
+func (v *Validator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "AdmissionReview has no request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = v.Validate(review.Request)
+	review.Request = nil
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		klog.Errorf("Failed to write AdmissionReview response: %v", err)
+	}
+}
+
+// Validate admits the request unless it adds or changes a capture annotation
+// that fails to parse or violates the policy.
+func (v *Validator) Validate(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+
+	pod := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, pod); err != nil {
+		return deny(resp, fmt.Sprintf("failed to decode pod: %v", err))
+	}
+
+	value, ok := pod.Annotations[v.annotationKey]
+	if !ok {
+		return resp
+	}
+
+	if req.Operation == admissionv1.Update && len(req.OldObject.Raw) > 0 {
+		oldPod := &corev1.Pod{}
+		if err := json.Unmarshal(req.OldObject.Raw, oldPod); err == nil {
+			if oldValue, oldOk := oldPod.Annotations[v.annotationKey]; oldOk && oldValue == value {
+				return resp
+			}
+		}
+	}
+
+	if err := v.validateAnnotation(req.Namespace, pod, value); err != nil {
+		klog.V(2).Infof("Rejecting capture annotation on pod %s/%s: %v", req.Namespace, req.Name, err)
+		return deny(resp, err.Error())
+	}
+	return resp
+}
+
+// validateAnnotation applies the checks the node agents make before starting
+// the captures requested by value on pod in namespace
+func (v *Validator) validateAnnotation(namespace string, pod *corev1.Pod, value string) error {
+	p, defaults := v.settings()
+	sessions, err := capture.ParseSessionSpecs(value, defaults)
+	if err != nil {
+		return err
+	}
+
+	ns := v.namespace(namespace)
+	for i := range sessions {
+		if err := p.Evaluate(ns, sessions[i].PolicyRequest()); err != nil {
+			return utils.NewAnnotationParseError(value, err)
+		}
+	}
+
+	if pod.Spec.HostNetwork {
+		podName := fmt.Sprintf("%s/%s", namespace, pod.Name)
+		if p.HostNetwork != policy.HostNetworkScope {
+			return utils.NewHostNetworkRefusedError(podName)
+		}
+		if capture.PodPortFilter(pod) == "" {
+			return utils.NewHostNetworkUnscopedError(podName)
+		}
+	}
+	return nil
+}
+
+// namespace returns the policy view of the namespace called name, without
+// labels and annotations when it is not in the cache
+func (v *Validator) namespace(name string) policy.Namespace {
+	ns := policy.Namespace{Name: name}
+	obj, err := v.namespaceLister.Get(name)
+	if err == nil {
+		ns.Labels = obj.Labels
+		ns.Annotations = obj.Annotations
+	} else if !errors.IsNotFound(err) {
+		klog.Errorf("Failed to get namespace %s from cache: %v", name, err)
+	}
+	return ns
+}
+
+func deny(resp *admissionv1.AdmissionResponse, message string) *admissionv1.AdmissionResponse {
+	resp.Allowed = false
+	resp.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: message,
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+	}
+	return resp
+}
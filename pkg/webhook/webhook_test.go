@@ -0,0 +1,365 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packet-capture-controller/pkg/capture"
+	"github.com/packet-capture-controller/pkg/config"
+	"github.com/packet-capture-controller/pkg/policy"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaults returns the defaults of unset capture options of the default config
+func defaults() capture.CaptureSpec {
+	return capture.ConfigDefaults(config.Default())
+}
+
+func namespaceLister(namespaces ...*corev1.Namespace) corelisters.NamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		_ = indexer.Add(ns)
+	}
+	return corelisters.NewNamespaceLister(indexer)
+}
+
+func podWithAnnotation(namespace string, annotations map[string]string) runtime.RawExtension {
+	return rawPod(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: namespace, Annotations: annotations},
+	})
+}
+
+func rawPod(pod *corev1.Pod) runtime.RawExtension {
+	pod.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"}
+	raw, _ := json.Marshal(pod)
+	return runtime.RawExtension{Raw: raw}
+}
+
+func postReview(t *testing.T, server *httptest.Server, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	t.Helper()
+
+	review := &admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("Failed to encode AdmissionReview: %v", err)
+	}
+
+	resp, err := server.Client().Post(server.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to post AdmissionReview: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	result := &admissionv1.AdmissionReview{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if result.Response == nil {
+		t.Fatal("AdmissionReview response is empty")
+	}
+	if result.Response.UID != req.UID {
+		t.Errorf("Response UID = %q, want %q", result.Response.UID, req.UID)
+	}
+	return result.Response
+}
+
+func TestAdmissionValidation(t *testing.T) {
+	server := httptest.NewTLSServer(NewValidator(capture.CaptureAnnotation, policy.Policy{
+		DeniedNamespaces: []string{"kube-system"},
+		Limits: policy.Limits{
+			MaxFileCount:    20,
+			MaxDuration:     metav1.Duration{Duration: time.Hour},
+			MaxBufferSizeMB: 32,
+			MaxKeepRuns:     5,
+			MaxRetention:    metav1.Duration{Duration: 24 * time.Hour},
+		},
+	}, defaults(), namespaceLister()))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		operation   admissionv1.Operation
+		namespace   string
+		oldValue    string
+		newValue    string
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:        "valid json annotation",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    `{"fileCount":5,"duration":"10m"}`,
+			wantAllowed: true,
+		},
+		{
+			name:        "malformed annotation",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    "ten",
+			wantMessage: "Example:",
+		},
+		{
+			name:        "denied namespace",
+			operation:   admissionv1.Create,
+			namespace:   "kube-system",
+			newValue:    `{"fileCount":5,"duration":"10m"}`,
+			wantMessage: "not allowed in namespace kube-system",
+		},
+		{
+			name:        "file count over limit",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    `{"fileCount":50,"duration":"10m"}`,
+			wantMessage: "exceeds the limit of 20",
+		},
+		{
+			name:        "capture list with one session over limit",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    `[{"id":"dns","duration":"1h"},{"id":"burst","fileCount":50,"duration":"1m"}]`,
+			wantMessage: "exceeds the limit of 20",
+		},
+		{
+			name:        "missing duration under max duration policy",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    "5",
+			wantMessage: "duration must be set",
+		},
+		{
+			name:        "armed buffer over limit",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    `{"mode":"armed","bufferSizeMB":64,"duration":"10m"}`,
+			wantMessage: "bufferSizeMB 64 exceeds the limit of 32",
+		},
+		{
+			name:        "default kept runs over limit",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    `{"schedule":"@daily","duration":"10m"}`,
+			wantMessage: "keepRuns 7 exceeds the limit of 5",
+		},
+		{
+			name:        "retention over limit",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			newValue:    `{"duration":"10m","retention":"48h"}`,
+			wantMessage: "retention 48h0m0s exceeds the limit of 24h0m0s",
+		},
+		{
+			name:        "unchanged annotation is admitted",
+			operation:   admissionv1.Update,
+			namespace:   "default",
+			oldValue:    "ten",
+			newValue:    "ten",
+			wantAllowed: true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &admissionv1.AdmissionRequest{
+				UID:       types.UID(strings.Repeat("a", i+1)),
+				Operation: tt.operation,
+				Namespace: tt.namespace,
+				Name:      "test-pod",
+				Object:    podWithAnnotation(tt.namespace, map[string]string{capture.CaptureAnnotation: tt.newValue}),
+			}
+			if tt.oldValue != "" {
+				req.OldObject = podWithAnnotation(tt.namespace, map[string]string{capture.CaptureAnnotation: tt.oldValue})
+			}
+
+			resp := postReview(t, server, req)
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Allowed = %v, want %v (result: %+v)", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			if !tt.wantAllowed && !strings.Contains(resp.Result.Message, tt.wantMessage) {
+				t.Errorf("Message %q should contain %q", resp.Result.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestAgentPolicyIsEnforced(t *testing.T) {
+	optIn := map[string]string{policy.DefaultOptInKey: "true"}
+	validator := NewValidator(capture.CaptureAnnotation, policy.Default(), defaults(), namespaceLister(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: optIn}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+	))
+	server := httptest.NewTLSServer(validator)
+	defer server.Close()
+
+	hostNetworkPod := func(ports ...int32) *corev1.Pod {
+		container := corev1.Container{Name: "app"}
+		for _, port := range ports {
+			container.Ports = append(container.Ports, corev1.ContainerPort{ContainerPort: port})
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-pod", Namespace: "shop", Annotations: map[string]string{capture.CaptureAnnotation: "5"}},
+			Spec:       corev1.PodSpec{HostNetwork: true, Containers: []corev1.Container{container}},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		policy      func(*policy.Policy)
+		namespace   string
+		pod         *corev1.Pod
+		wantAllowed bool
+		wantMessage string
+	}{
+		{
+			name:        "opted-in namespace",
+			namespace:   "shop",
+			wantAllowed: true,
+		},
+		{
+			name:        "namespace without opt-in",
+			namespace:   "default",
+			wantMessage: "has not opted in",
+		},
+		{
+			name:        "unknown namespace",
+			namespace:   "gone",
+			wantMessage: "has not opted in",
+		},
+		{
+			name:        "opt-in not required",
+			policy:      func(p *policy.Policy) { p.RequireOptIn = false },
+			namespace:   "default",
+			wantAllowed: true,
+		},
+		{
+			name:        "refused hostNetwork pod",
+			namespace:   "shop",
+			pod:         hostNetworkPod(8080),
+			wantMessage: "uses hostNetwork",
+		},
+		{
+			name:        "scoped hostNetwork pod",
+			policy:      func(p *policy.Policy) { p.HostNetwork = policy.HostNetworkScope },
+			namespace:   "shop",
+			pod:         hostNetworkPod(8080),
+			wantAllowed: true,
+		},
+		{
+			name:        "hostNetwork pod without ports",
+			policy:      func(p *policy.Policy) { p.HostNetwork = policy.HostNetworkScope },
+			namespace:   "shop",
+			pod:         hostNetworkPod(),
+			wantMessage: "declares no container ports",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := policy.Default()
+			if tt.policy != nil {
+				tt.policy(&p)
+			}
+			validator.SetPolicy(p)
+
+			object := podWithAnnotation(tt.namespace, map[string]string{capture.CaptureAnnotation: "5"})
+			if tt.pod != nil {
+				object = rawPod(tt.pod)
+			}
+			resp := postReview(t, server, &admissionv1.AdmissionRequest{
+				UID:       types.UID(strings.Repeat("b", i+1)),
+				Operation: admissionv1.Create,
+				Namespace: tt.namespace,
+				Name:      "test-pod",
+				Object:    object,
+			})
+			if resp.Allowed != tt.wantAllowed {
+				t.Fatalf("Allowed = %v, want %v (result: %+v)", resp.Allowed, tt.wantAllowed, resp.Result)
+			}
+			if !tt.wantAllowed && !strings.Contains(resp.Result.Message, tt.wantMessage) {
+				t.Errorf("Message %q should contain %q", resp.Result.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestConfiguredDefaultsAreChecked(t *testing.T) {
+	validator := NewValidator(capture.CaptureAnnotation, policy.Policy{
+		Limits: policy.Limits{MaxFileCount: 20, MaxFileSizeMB: 10},
+	}, defaults(), namespaceLister())
+	server := httptest.NewTLSServer(validator)
+	defer server.Close()
+
+	review := func(uid types.UID) *admissionv1.AdmissionResponse {
+		return postReview(t, server, &admissionv1.AdmissionRequest{
+			UID:       uid,
+			Operation: admissionv1.Create,
+			Namespace: "default",
+			Name:      "test-pod",
+			Object:    podWithAnnotation("default", map[string]string{capture.CaptureAnnotation: `{"duration":"10m"}`}),
+		})
+	}
+	if resp := review("uid-1"); !resp.Allowed {
+		t.Fatalf("Annotation within the limits with the default config should be admitted, got %+v", resp.Result)
+	}
+
+	// The annotation sets neither option, only the configured defaults
+	// exceed the limits
+	validator.SetDefaults(capture.CaptureSpec{FileCount: 50, FileSizeMB: 1})
+	resp := review("uid-2")
+	if resp.Allowed || !strings.Contains(resp.Result.Message, "fileCount 50 exceeds the limit of 20") {
+		t.Errorf("Annotation taking fileCount 50 from the defaults should be denied, got %+v", resp.Result)
+	}
+	validator.SetDefaults(capture.CaptureSpec{FileCount: 10, FileSizeMB: 64})
+	resp = review("uid-3")
+	if resp.Allowed || !strings.Contains(resp.Result.Message, "fileSizeMB 64 exceeds the limit of 10") {
+		t.Errorf("Annotation taking fileSizeMB 64 from the defaults should be denied, got %+v", resp.Result)
+	}
+}
+
+func TestPodsWithoutAnnotationAreAdmitted(t *testing.T) {
+	server := httptest.NewTLSServer(NewValidator(capture.CaptureAnnotation, policy.Policy{DeniedNamespaces: []string{"kube-system"}}, defaults(), namespaceLister()))
+	defer server.Close()
+
+	resp := postReview(t, server, &admissionv1.AdmissionRequest{
+		UID:       "uid-1",
+		Operation: admissionv1.Create,
+		Namespace: "kube-system",
+		Object:    podWithAnnotation("kube-system", nil),
+	})
+	if !resp.Allowed {
+		t.Errorf("Pod without capture annotation should be admitted, got: %+v", resp.Result)
+	}
+}
+
+func TestMalformedReviewIsRejected(t *testing.T) {
+	server := httptest.NewTLSServer(NewValidator(capture.CaptureAnnotation, policy.Policy{}, defaults(), namespaceLister()))
+	defer server.Close()
+
+	resp, err := server.Client().Post(server.URL, "application/json", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatalf("Failed to post request: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status code = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -4,6 +4,9 @@ set -e
 
 echo "=== Verifying Packet Capture Functionality ==="
 
+echo "Opting the default namespace in to captures..."
+kubectl label namespace default tcpdump.antrea.io/allow-capture=true --overwrite
+
 echo "Deploying test pod..."
 kubectl apply -f deploy/test-pod.yaml
 
@@ -25,9 +28,9 @@ sleep 10
 
 echo ""
 echo "=== Checking for pcap files ==="
-kubectl exec "$CONTROLLER_POD" -- ls -lh /var/log/antrea-captures/ | tee capture-files.txt
+kubectl exec "$CONTROLLER_POD" -- ls -lhR /var/log/antrea-captures/ | tee capture-files.txt
 
-if kubectl exec "$CONTROLLER_POD" -- ls /var/log/antrea-captures/capture-default-test-pod.pcap* >/dev/null 2>&1; then
+if kubectl exec "$CONTROLLER_POD" -- sh -c 'ls /var/log/antrea-captures/default/test-pod/pod_*/capture.pcap*' >/dev/null 2>&1; then
     echo "✓ Capture files found!"
 else
     echo "✗ No capture files found"
@@ -50,7 +53,7 @@ echo "Saved to pods.txt"
 
 echo ""
 echo "=== Copying pcap file ==="
-PCAP_FILE=$(kubectl exec "$CONTROLLER_POD" -- ls /var/log/antrea-captures/capture-default-test-pod.pcap* | head -1)
+PCAP_FILE=$(kubectl exec "$CONTROLLER_POD" -- sh -c 'ls /var/log/antrea-captures/default/test-pod/pod_*/capture.pcap*' | head -1)
 kubectl cp "$CONTROLLER_POD:$PCAP_FILE" ./capture.pcap
 echo "Copied to ./capture.pcap"
 
@@ -73,7 +76,7 @@ sleep 5
 
 echo ""
 echo "=== Verifying cleanup ==="
-if kubectl exec "$CONTROLLER_POD" -- ls /var/log/antrea-captures/capture-default-test-pod.pcap* >/dev/null 2>&1; then
+if kubectl exec "$CONTROLLER_POD" -- sh -c 'ls /var/log/antrea-captures/default/test-pod/pod_*/capture.pcap*' >/dev/null 2>&1; then
     echo "✗ Capture files still exist (cleanup failed)"
     exit 1
 else